@@ -0,0 +1,11 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build darwin
+
+package dirhash
+
+// Splits a device number into its major and minor numbers, which are the top
+// 8 bits and the low 24 bits.
+func splitDevice(dev uint64) (uint64, uint64) {
+	return (dev >> 24) & 0xff, dev & 0xffffff
+}
@@ -0,0 +1,14 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package dirhash
+
+// Splits a device number into its major and minor numbers, which are encoded
+// as glibc does, with the low 8 bits of the minor number, then 12 bits of the
+// major number, then the rest of the minor and then the rest of the major.
+func splitDevice(dev uint64) (uint64, uint64) {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&0xffffff00
+	return major, minor
+}
@@ -0,0 +1,25 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package dirhash
+
+import (
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestSplitDevice(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	for dev, want := range map[uint64][2]uint64{
+		0x103:              {1, 3},
+		0x10010300:         {259, 65536},
+		0xfffff:            {4095, 255},
+		0x100100038800:     {5000, 1 << 20},
+		0xffffffffffffffff: {0xffffffff, 0xffffffff},
+	} {
+		major, minor := splitDevice(dev)
+		tt.TestEqual(t, [2]uint64{major, minor}, want)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package dirhash computes a single deterministic digest for a directory tree.
+// The digest covers each entry's path, type, permission bits and contents, and
+// can optionally include ownership and extended attributes. Timestamps are
+// never included.
+//
+// The same digest can be computed from a tar archive of the tree with
+// HashTar(), so a tree can be compared to an archive without extracting it.
+package dirhash
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options controls what is included in the digest.
+type Options struct {
+	// Include the numeric UID and GID of each entry.
+	IncludeOwners bool
+
+	// Include extended attributes. When hashing a directory these are read
+	// from the filesystem where supported, when hashing a tar archive they
+	// are read from the SCHILY.xattr PAX records. Those of symlinks are left
+	// out of both.
+	IncludeXattrs bool
+
+	// Hash returns the hash used for both the file contents and the final
+	// digest. If nil, SHA-256 is used.
+	Hash func() hash.Hash
+}
+
+func (o *Options) newHash() hash.Hash {
+	if o != nil && o.Hash != nil {
+		return o.Hash()
+	}
+	return sha256.New()
+}
+
+// Type characters used in the canonical record for each entry.
+const (
+	typeFile    = 'f'
+	typeDir     = 'd'
+	typeSymlink = 'l'
+	typeChar    = 'c'
+	typeBlock   = 'b'
+	typeFifo    = 'p'
+)
+
+// The canonical description of a single entry in the tree.
+type record struct {
+	path    string
+	typ     byte
+	mode    int64
+	uid     int
+	gid     int
+	size    int64
+	content string
+	xattrs  map[string]string
+}
+
+// Writes the canonical form of the record to w. Each record is a single line
+// so that the encoding can't be ambiguous.
+func (r *record) writeTo(w io.Writer, opts *Options) {
+	fmt.Fprintf(w, "%c %04o", r.typ, r.mode)
+	if opts != nil && opts.IncludeOwners {
+		fmt.Fprintf(w, " %d:%d", r.uid, r.gid)
+	}
+	fmt.Fprintf(w, " %d %s %s", r.size, strconv.Quote(r.content), strconv.Quote(r.path))
+	if opts != nil && opts.IncludeXattrs && len(r.xattrs) > 0 {
+		keys := make([]string, 0, len(r.xattrs))
+		for k := range r.xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, " %s=%s", strconv.Quote(k), hex.EncodeToString([]byte(r.xattrs[k])))
+		}
+	}
+	io.WriteString(w, "\n")
+}
+
+// Combines the records into the final digest.
+func digest(records []*record, opts *Options) string {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].path < records[j].path
+	})
+	h := opts.newHash()
+	for _, r := range records {
+		r.writeTo(h, opts)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashDir returns the digest of the tree rooted at dir. The root directory
+// itself is not part of the digest, only its contents. opts may be nil.
+func HashDir(dir string, opts *Options) (string, error) {
+	var records []*record
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		r, err := recordForFile(name, filepath.ToSlash(rel), fi, opts)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			records = append(records, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return digest(records, opts), nil
+}
+
+// Builds the record for a file on disk. Sockets and other unsupported types
+// return a nil record.
+func recordForFile(name, rel string, fi os.FileInfo, opts *Options) (*record, error) {
+	mode := fi.Mode()
+	r := &record{path: rel, mode: permBits(mode)}
+	if opts != nil && opts.IncludeOwners {
+		r.uid, r.gid = ownerForFileInfo(fi)
+	}
+
+	switch {
+	case mode.IsDir():
+		r.typ = typeDir
+	case mode.IsRegular():
+		r.typ = typeFile
+		r.size = fi.Size()
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if r.content, err = hashContent(f, opts); err != nil {
+			return nil, err
+		}
+	case mode&os.ModeSymlink != 0:
+		r.typ = typeSymlink
+		link, err := os.Readlink(name)
+		if err != nil {
+			return nil, err
+		}
+		r.content = link
+	case mode&os.ModeNamedPipe != 0:
+		r.typ = typeFifo
+	case mode&os.ModeDevice != 0:
+		r.typ = typeBlock
+		if mode&os.ModeCharDevice != 0 {
+			r.typ = typeChar
+		}
+		major, minor := deviceForFileInfo(fi)
+		r.content = fmt.Sprintf("%d,%d", major, minor)
+	default:
+		return nil, nil
+	}
+
+	if opts != nil && opts.IncludeXattrs && r.typ != typeSymlink {
+		xattrs, err := readXattrs(name)
+		if err != nil {
+			return nil, err
+		}
+		r.xattrs = xattrs
+	}
+	return r, nil
+}
+
+// HashTar returns the digest of the tree contained in the tar stream r. For an
+// archive of a directory this returns the same digest as HashDir() would for
+// the directory, provided the archive recorded the same permissions, owners
+// and symlink targets. Entries are matched by their cleaned relative names so
+// leading "./" or "/" are ignored. opts may be nil.
+func HashTar(r io.Reader, opts *Options) (string, error) {
+	archive := tar.NewReader(r)
+	records := make(map[string]*record)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		name := cleanName(header.Name)
+		if name == "" {
+			continue
+		}
+		rec := &record{
+			path: name,
+			mode: header.Mode & 07777,
+			uid:  header.Uid,
+			gid:  header.Gid,
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			rec.typ = typeDir
+		case tar.TypeReg, tar.TypeRegA:
+			rec.typ = typeFile
+			rec.size = header.Size
+			if rec.content, err = hashContent(archive, opts); err != nil {
+				return "", err
+			}
+		case tar.TypeLink:
+			// A hard link has the same contents as the entry it links to,
+			// which must have come earlier in the archive.
+			target, ok := records[cleanName(header.Linkname)]
+			if !ok {
+				return "", fmt.Errorf(
+					"hard link %q refers to unknown entry %q", header.Name, header.Linkname)
+			}
+			rec.typ = target.typ
+			rec.size = target.size
+			rec.content = target.content
+		case tar.TypeSymlink:
+			rec.typ = typeSymlink
+			rec.content = header.Linkname
+		case tar.TypeChar, tar.TypeBlock:
+			rec.typ = typeChar
+			if header.Typeflag == tar.TypeBlock {
+				rec.typ = typeBlock
+			}
+			rec.content = fmt.Sprintf("%d,%d", header.Devmajor, header.Devminor)
+		case tar.TypeFifo:
+			rec.typ = typeFifo
+		default:
+			// Metadata only entries like PAX headers are consumed by the tar
+			// reader, anything else isn't part of the tree.
+			continue
+		}
+
+		// Symlinks' attributes, such as security.selinux, can't be read when
+		// hashing a directory, so are left out here too.
+		if opts != nil && opts.IncludeXattrs && rec.typ != typeSymlink {
+			for k, v := range header.PAXRecords {
+				if strings.HasPrefix(k, "SCHILY.xattr.") {
+					if rec.xattrs == nil {
+						rec.xattrs = make(map[string]string)
+					}
+					rec.xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = v
+				}
+			}
+		}
+
+		// Later entries replace earlier ones, as they would on extraction.
+		records[name] = rec
+	}
+
+	list := make([]*record, 0, len(records))
+	for _, rec := range records {
+		list = append(list, rec)
+	}
+	return digest(list, opts), nil
+}
+
+// Returns the hex encoded hash of everything read from r.
+func hashContent(r io.Reader, opts *Options) (string, error) {
+	h := opts.newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Normalizes a tar entry name to a relative path without a trailing slash.
+// The root of the archive returns an empty string.
+func cleanName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// Converts a FileMode into the unix permission bits, including the setuid,
+// setgid and sticky bits.
+func permBits(mode os.FileMode) int64 {
+	bits := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
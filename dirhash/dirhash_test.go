@@ -0,0 +1,160 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package dirhash
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apcera/util/tarhelper"
+	tt "github.com/apcera/util/testtool"
+)
+
+func makeTestTree(t *testing.T) string {
+	dir := tt.TempDir(t)
+	tt.TestExpectSuccess(t, os.MkdirAll(filepath.Join(dir, "a/b"), 0755))
+	tt.TestExpectSuccess(t, os.Mkdir(filepath.Join(dir, "c"), 0700))
+	tt.TestExpectSuccess(t, ioutil.WriteFile(filepath.Join(dir, "a/one"), []byte("one"), 0644))
+	tt.TestExpectSuccess(t, ioutil.WriteFile(filepath.Join(dir, "a/b/two"), []byte("two"), 0755))
+	tt.TestExpectSuccess(t, os.Symlink("b/two", filepath.Join(dir, "a/link")))
+	return dir
+}
+
+func TestHashDirDeterministic(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	dir := makeTestTree(t)
+	h1, err := HashDir(dir, nil)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, len(h1), 64)
+
+	// Timestamps are not part of the digest.
+	old := time.Now().Add(-time.Hour)
+	tt.TestExpectSuccess(t, os.Chtimes(filepath.Join(dir, "a/one"), old, old))
+	h2, err := HashDir(dir, nil)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, h1, h2)
+
+	// A tree with the same contents elsewhere hashes the same.
+	h3, err := HashDir(makeTestTree(t), nil)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, h1, h3)
+
+	// The hash function can be changed.
+	h4, err := HashDir(dir, &Options{Hash: sha1.New})
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, len(h4), 40)
+}
+
+func TestHashDirChanges(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	changes := []func(dir string) error{
+		func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "a/one"), []byte("uno"), 0644)
+		},
+		func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "a/one"), 0600)
+		},
+		func(dir string) error {
+			return os.Rename(filepath.Join(dir, "a/one"), filepath.Join(dir, "a/uno"))
+		},
+		func(dir string) error {
+			os.Remove(filepath.Join(dir, "a/link"))
+			return os.Symlink("one", filepath.Join(dir, "a/link"))
+		},
+		func(dir string) error {
+			return os.Mkdir(filepath.Join(dir, "d"), 0755)
+		},
+	}
+
+	base, err := HashDir(makeTestTree(t), nil)
+	tt.TestExpectSuccess(t, err)
+	for _, change := range changes {
+		dir := makeTestTree(t)
+		tt.TestExpectSuccess(t, change(dir))
+		h, err := HashDir(dir, nil)
+		tt.TestExpectSuccess(t, err)
+		tt.TestNotEqual(t, h, base)
+	}
+}
+
+func TestHashTarMatchesHashDir(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	dir := makeTestTree(t)
+	opts := &Options{IncludeOwners: true}
+	want, err := HashDir(dir, opts)
+	tt.TestExpectSuccess(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tarhelper.NewTar(buf, dir)
+	tw.IncludeOwners = true
+	tt.TestExpectSuccess(t, tw.Archive())
+
+	have, err := HashTar(bytes.NewReader(buf.Bytes()), opts)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, have, want)
+}
+
+func TestHashTarSymlinkXattrs(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	dir := makeTestTree(t)
+	opts := &Options{IncludeXattrs: true}
+	want, err := HashDir(dir, opts)
+	tt.TestExpectSuccess(t, err)
+
+	// GNU tar records the attributes of symlinks, which aren't read from the
+	// directory, so they don't count in the archive either.
+	buf := bytes.NewBuffer(nil)
+	tw := tarhelper.NewTar(buf, dir)
+	tw.HeaderTransform = func(header *tar.Header) (*tar.Header, error) {
+		if header.Typeflag == tar.TypeSymlink {
+			header.PAXRecords = map[string]string{"SCHILY.xattr.security.selinux": "label"}
+		}
+		return header, nil
+	}
+	tt.TestExpectSuccess(t, tw.Archive())
+	tt.TestEqual(t, bytes.Contains(buf.Bytes(), []byte("security.selinux")), true)
+
+	have, err := HashTar(bytes.NewReader(buf.Bytes()), opts)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, have, want)
+}
+
+func TestHashTarHardLink(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	dir := tt.TempDir(t)
+	tt.TestExpectSuccess(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("data"), 0644))
+	tt.TestExpectSuccess(t, os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")))
+	want, err := HashDir(dir, nil)
+	tt.TestExpectSuccess(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	tt.TestExpectSuccess(t, tarhelper.NewTar(buf, dir).Archive())
+	have, err := HashTar(bytes.NewReader(buf.Bytes()), nil)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, have, want)
+
+	// A hard link to an entry that doesn't exist is an error.
+	buf.Reset()
+	w := tar.NewWriter(buf)
+	tt.TestExpectSuccess(t, w.WriteHeader(&tar.Header{
+		Name: "b", Typeflag: tar.TypeLink, Linkname: "missing"}))
+	tt.TestExpectSuccess(t, w.Close())
+	_, err = HashTar(buf, nil)
+	tt.TestExpectError(t, err)
+}
@@ -0,0 +1,24 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !windows
+
+package dirhash
+
+import (
+	"os"
+	"syscall"
+)
+
+func ownerForFileInfo(fi os.FileInfo) (int, int) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return 0, 0
+}
+
+func deviceForFileInfo(fi os.FileInfo) (uint64, uint64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return splitDevice(uint64(st.Rdev))
+	}
+	return 0, 0
+}
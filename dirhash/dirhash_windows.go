@@ -0,0 +1,17 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build windows
+
+package dirhash
+
+import (
+	"os"
+)
+
+func ownerForFileInfo(_ os.FileInfo) (int, int) {
+	return 0, 0
+}
+
+func deviceForFileInfo(_ os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package dirhash
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// Returns the extended attributes of the named file. Filesystems that don't
+// support extended attributes return an empty result.
+func readXattrs(name string) (map[string]string, error) {
+	size, err := syscall.Listxattr(name, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(name, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, key := range bytes.Split(buf[:size], []byte{0}) {
+		if len(key) == 0 {
+			continue
+		}
+		vsize, err := syscall.Getxattr(name, string(key), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(name, string(key), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(key)] = string(value[:vsize])
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,10 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !linux
+
+package dirhash
+
+// Extended attributes are only supported on Linux.
+func readXattrs(name string) (map[string]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package errtrace provides an error type that records the call stack at the
+// point it was created. The type implements the testtool Backtracer interface
+// so failures reported through TestExpectSuccess() show where the error came
+// from rather than just where it was checked.
+package errtrace
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// The maximum number of stack frames that will be captured for an error.
+const maxStackDepth = 64
+
+// Error is an error that carries the stack of the goroutine that created it.
+// It optionally wraps an underlying error which can be retrieved with Unwrap()
+// or Cause().
+type Error struct {
+	// The message provided when the error was created. This may be empty if
+	// the error is simply wrapping another error.
+	msg string
+
+	// The underlying error, if any.
+	err error
+
+	// The program counters captured when the error was created.
+	stack []uintptr
+}
+
+// New returns an error with the given message and the stack of the caller.
+func New(msg string) error {
+	return &Error{msg: msg, stack: callers(0)}
+}
+
+// Errorf formats according to a format specifier and returns the string as an
+// error with the stack of the caller.
+func Errorf(format string, args ...interface{}) error {
+	return &Error{msg: fmt.Sprintf(format, args...), stack: callers(0)}
+}
+
+// Wrap returns an error that annotates err with msg. If err is nil then nil is
+// returned. If err already carries a stack then that stack is preserved since
+// it is closer to the origin of the failure, otherwise the stack of the caller
+// is captured.
+func Wrap(err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	return wrap(err, msg)
+}
+
+// Wrapf is like Wrap but formats the message according to a format specifier.
+func Wrapf(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return wrap(err, fmt.Sprintf(format, args...))
+}
+
+// Wraps err for Wrap and Wrapf, which must call it directly so that the
+// stack captured starts at their caller.
+func wrap(err error, msg string) error {
+	e := &Error{msg: msg, err: err}
+	if inner, ok := err.(*Error); ok {
+		e.stack = inner.stack
+	} else {
+		e.stack = callers(1)
+	}
+	return e
+}
+
+// Error returns the message for the error. Wrapped errors are rendered as
+// "msg: wrapped".
+func (e *Error) Error() string {
+	switch {
+	case e.err == nil:
+		return e.msg
+	case e.msg == "":
+		return e.err.Error()
+	default:
+		return e.msg + ": " + e.err.Error()
+	}
+}
+
+// Unwrap returns the error wrapped by this error, or nil if there is none.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Backtrace returns the captured stack, one frame per line, in the form
+// "function (file:line)". This implements the testtool Backtracer interface.
+func (e *Error) Backtrace() []string {
+	lines := make([]string, 0, len(e.stack))
+	frames := runtime.CallersFrames(e.stack)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" || frame.File != "" {
+			lines = append(lines, fmt.Sprintf(
+				"%s (%s:%d)", frame.Function, frame.File, frame.Line))
+		}
+		if !more {
+			break
+		}
+	}
+	return lines
+}
+
+// String returns the error message followed by the backtrace, which is useful
+// when logging.
+func (e *Error) String() string {
+	lines := append([]string{e.Error()}, e.Backtrace()...)
+	return strings.Join(lines, "\n\t")
+}
+
+// Cause walks the chain of wrapped errors and returns the innermost one. Any
+// error that provides an Unwrap() method is followed.
+func Cause(err error) error {
+	for err != nil {
+		u, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return err
+		}
+		next := u.Unwrap()
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+	return err
+}
+
+// Returns the program counters for the caller of the exported function that
+// called callers(), either directly or through skip internal functions.
+func callers(skip int) []uintptr {
+	pc := make([]uintptr, maxStackDepth)
+	// Skip runtime.Callers, callers(), the errtrace constructor and the skip
+	// internal functions between them.
+	n := runtime.Callers(3+skip, pc)
+	return pc[:n]
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package errtrace
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestNew(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	err := New("simple error")
+	tt.TestEqual(t, err.Error(), "simple error")
+
+	e, ok := err.(*Error)
+	tt.TestTrue(t, ok)
+	tt.TestEqual(t, e.Unwrap(), nil)
+
+	// The first frame should be this test function.
+	bt := e.Backtrace()
+	tt.TestNotEqual(t, len(bt), 0)
+	tt.TestTrue(t, strings.Contains(bt[0], "TestNew"))
+	tt.TestTrue(t, strings.Contains(bt[0], "errtrace_test.go"))
+}
+
+func TestErrorf(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	err := Errorf("failed %d times", 3)
+	tt.TestEqual(t, err.Error(), "failed 3 times")
+}
+
+func TestBacktracer(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	var err error = New("x")
+	_, ok := err.(tt.Backtracer)
+	tt.TestTrue(t, ok)
+}
+
+func TestWrap(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	tt.TestEqual(t, Wrap(nil, "nothing"), nil)
+	tt.TestEqual(t, Wrapf(nil, "nothing %d", 1), nil)
+
+	base := errors.New("base")
+	err := Wrap(base, "context")
+	tt.TestEqual(t, err.Error(), "context: base")
+	tt.TestEqual(t, err.(*Error).Unwrap(), base)
+	tt.TestEqual(t, Cause(err), base)
+	tt.TestTrue(t, errors.Is(err, base))
+
+	// Wrapping with an empty message should pass through the message.
+	tt.TestEqual(t, Wrap(base, "").Error(), "base")
+
+	// Wrapping an errtrace error keeps the original stack.
+	inner := New("inner").(*Error)
+	outer := Wrapf(inner, "outer %s", "wrap").(*Error)
+	tt.TestEqual(t, outer.Error(), "outer wrap: inner")
+	tt.TestEqual(t, outer.Backtrace(), inner.Backtrace())
+	tt.TestEqual(t, Cause(outer), inner)
+
+	// Otherwise the stack starts at the caller of either function.
+	for _, err := range []error{Wrap(base, "context"), Wrapf(base, "context %d", 1)} {
+		bt := err.(*Error).Backtrace()
+		tt.TestNotEqual(t, len(bt), 0)
+		tt.TestTrue(t, strings.Contains(bt[0], "TestWrap"))
+		tt.TestTrue(t, strings.Contains(bt[0], "errtrace_test.go"))
+	}
+}
+
+func TestCause(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	tt.TestEqual(t, Cause(nil), nil)
+	base := errors.New("base")
+	tt.TestEqual(t, Cause(base), base)
+	tt.TestEqual(t, Cause(Wrap(Wrap(base, "a"), "b")), base)
+}
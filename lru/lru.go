@@ -0,0 +1,399 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package lru provides a size bounded in-memory cache, typed by its keys and
+// values. Entries are evicted either least recently used first (LRU) or least
+// frequently used first (LFU). Each entry has a cost, which defaults to 1, and
+// the cache keeps the total cost of its entries at or below a configured
+// maximum. This allows the cache to be bounded by number of entries or by an
+// approximation of memory use.
+package lru
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+)
+
+// Policy selects which entry is evicted when the cache is full.
+type Policy int
+
+const (
+	// Evict the least recently used entry.
+	LRU Policy = iota
+
+	// Evict the least frequently used entry. Ties are broken by evicting the
+	// least recently used of the candidates.
+	LFU
+)
+
+// Stats contains counters describing how the cache has been used.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// HitRate returns the fraction of lookups that were hits, or zero if there
+// have been no lookups.
+func (s Stats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// A single cached value.
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+	cost  int64
+
+	// Used by the LFU policy.
+	freq  uint64
+	tick  uint64
+	index int
+
+	// Used by the LRU policy.
+	elem *list.Element
+}
+
+// Tracks entries in eviction order for a given policy.
+type evictionOrder[K comparable, V any] interface {
+	push(e *entry[K, V])
+	touch(e *entry[K, V])
+	remove(e *entry[K, V])
+	victim() *entry[K, V]
+	each(func(e *entry[K, V]))
+	reset()
+}
+
+// Cache is a concurrency safe cache of values of type V under keys of type K,
+// bounded by the total cost of its entries. The zero value is not usable, use
+// New() or NewWithPolicy() instead.
+type Cache[K comparable, V any] struct {
+	lock    sync.Mutex
+	items   map[K]*entry[K, V]
+	order   evictionOrder[K, V]
+	maxCost int64
+	cost    int64
+	stats   Stats
+
+	// OnEvict, if set, is called when an entry is evicted to make room for
+	// another. It is not called for entries removed with Remove() or Purge().
+	// It is called once the cache lock has been released, so it may use the
+	// cache.
+	OnEvict func(key K, value V)
+}
+
+// New returns an LRU cache that holds entries with a total cost of at most
+// maxCost. When every entry is added with Add() this is the maximum number of
+// entries.
+func New[K comparable, V any](maxCost int64) *Cache[K, V] {
+	return NewWithPolicy[K, V](maxCost, LRU)
+}
+
+// NewWithPolicy returns a cache that evicts entries according to policy.
+func NewWithPolicy[K comparable, V any](maxCost int64, policy Policy) *Cache[K, V] {
+	c := &Cache[K, V]{
+		items:   make(map[K]*entry[K, V]),
+		maxCost: maxCost,
+	}
+	switch policy {
+	case LFU:
+		c.order = new(lfuOrder[K, V])
+	default:
+		c.order = &lruOrder[K, V]{l: list.New()}
+	}
+	return c
+}
+
+// Add stores value under key with a cost of 1. It returns false if the value
+// could not be stored.
+func (c *Cache[K, V]) Add(key K, value V) bool {
+	return c.AddWithCost(key, value, 1)
+}
+
+// AddWithCost stores value under key with the given cost, evicting entries as
+// needed to keep the total cost within the maximum. It returns false if cost
+// is negative, leaving the cache as it was, or if cost alone exceeds the
+// maximum, in which case any existing entry for key is removed.
+func (c *Cache[K, V]) AddWithCost(key K, value V, cost int64) bool {
+	if cost < 0 {
+		return false
+	}
+
+	c.lock.Lock()
+	if e, ok := c.items[key]; ok {
+		c.removeEntry(e)
+	}
+	if cost > c.maxCost {
+		c.lock.Unlock()
+		return false
+	}
+
+	var evicted []*entry[K, V]
+	for c.cost+cost > c.maxCost {
+		v := c.order.victim()
+		if v == nil {
+			break
+		}
+		c.removeEntry(v)
+		c.stats.Evictions++
+		evicted = append(evicted, v)
+	}
+
+	e := &entry[K, V]{key: key, value: value, cost: cost}
+	c.items[key] = e
+	c.order.push(e)
+	c.cost += cost
+	onEvict := c.OnEvict
+	c.lock.Unlock()
+
+	// The callback is run without the lock so that it can use the cache.
+	if onEvict != nil {
+		for _, v := range evicted {
+			onEvict(v.key, v.value)
+		}
+	}
+	return true
+}
+
+// Get returns the value stored under key and records a hit or a miss.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		var zero V
+		return zero, false
+	}
+	c.stats.Hits++
+	c.order.touch(e)
+	return e.value, true
+}
+
+// Peek returns the value stored under key without updating its position in
+// the eviction order or the hit/miss counters.
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		return e.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Contains returns true if key is in the cache. Like Peek() it doesn't affect
+// eviction order or statistics.
+func (c *Cache[K, V]) Contains(key K) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Remove deletes key from the cache, returning true if it was present.
+func (c *Cache[K, V]) Remove(key K) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if ok {
+		c.removeEntry(e)
+	}
+	return ok
+}
+
+// Purge removes every entry. Statistics are not reset.
+func (c *Cache[K, V]) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items = make(map[K]*entry[K, V])
+	c.order.reset()
+	c.cost = 0
+}
+
+// Keys returns the keys in the cache ordered from the next to be evicted to
+// the last.
+func (c *Cache[K, V]) Keys() []K {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := make([]K, 0, len(c.items))
+	c.order.each(func(e *entry[K, V]) {
+		keys = append(keys, e.key)
+	})
+	return keys
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache[K, V]) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Cost returns the total cost of the entries in the cache.
+func (c *Cache[K, V]) Cost() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cost
+}
+
+// MaxCost returns the maximum total cost of the cache.
+func (c *Cache[K, V]) MaxCost() int64 {
+	return c.maxCost
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Cache[K, V]) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// ResetStats zeros the cache's counters.
+func (c *Cache[K, V]) ResetStats() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats = Stats{}
+}
+
+// Removes an entry. Must be called with the lock held.
+func (c *Cache[K, V]) removeEntry(e *entry[K, V]) {
+	delete(c.items, e.key)
+	c.order.remove(e)
+	c.cost -= e.cost
+}
+
+// -----------------------------------------------------------------------
+// LRU ordering.
+// -----------------------------------------------------------------------
+
+// Orders entries by recency using a list with the most recent at the back.
+type lruOrder[K comparable, V any] struct {
+	l *list.List
+}
+
+func (o *lruOrder[K, V]) push(e *entry[K, V]) {
+	e.elem = o.l.PushBack(e)
+}
+
+func (o *lruOrder[K, V]) touch(e *entry[K, V]) {
+	o.l.MoveToBack(e.elem)
+}
+
+func (o *lruOrder[K, V]) remove(e *entry[K, V]) {
+	o.l.Remove(e.elem)
+}
+
+func (o *lruOrder[K, V]) victim() *entry[K, V] {
+	if front := o.l.Front(); front != nil {
+		return front.Value.(*entry[K, V])
+	}
+	return nil
+}
+
+func (o *lruOrder[K, V]) each(f func(e *entry[K, V])) {
+	for elem := o.l.Front(); elem != nil; elem = elem.Next() {
+		f(elem.Value.(*entry[K, V]))
+	}
+}
+
+func (o *lruOrder[K, V]) reset() {
+	o.l.Init()
+}
+
+// -----------------------------------------------------------------------
+// LFU ordering.
+// -----------------------------------------------------------------------
+
+// Orders entries by access frequency using a min-heap. Each access is stamped
+// with a monotonically increasing tick which breaks ties between entries of
+// the same frequency.
+type lfuOrder[K comparable, V any] struct {
+	h    lfuHeap[K, V]
+	tick uint64
+}
+
+func (o *lfuOrder[K, V]) push(e *entry[K, V]) {
+	o.tick++
+	e.freq = 1
+	e.tick = o.tick
+	heap.Push(&o.h, e)
+}
+
+func (o *lfuOrder[K, V]) touch(e *entry[K, V]) {
+	o.tick++
+	e.freq++
+	e.tick = o.tick
+	heap.Fix(&o.h, e.index)
+}
+
+func (o *lfuOrder[K, V]) remove(e *entry[K, V]) {
+	heap.Remove(&o.h, e.index)
+}
+
+func (o *lfuOrder[K, V]) victim() *entry[K, V] {
+	if len(o.h) == 0 {
+		return nil
+	}
+	return o.h[0]
+}
+
+func (o *lfuOrder[K, V]) each(f func(e *entry[K, V])) {
+	// Walk a copy of the heap in eviction order.
+	h := make(lfuHeap[K, V], len(o.h))
+	copy(h, o.h)
+	indexes := make([]int, len(h))
+	for i, e := range h {
+		indexes[i] = e.index
+	}
+	for len(h) > 0 {
+		f(heap.Pop(&h).(*entry[K, V]))
+	}
+	// heap operations update the entries' indexes, so restore them.
+	for i, e := range o.h {
+		e.index = indexes[i]
+	}
+}
+
+func (o *lfuOrder[K, V]) reset() {
+	o.h = nil
+}
+
+// lfuHeap implements heap.Interface.
+type lfuHeap[K comparable, V any] []*entry[K, V]
+
+func (h lfuHeap[K, V]) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap[K, V]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K, V]) Push(x interface{}) {
+	e := x.(*entry[K, V])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap[K, V]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
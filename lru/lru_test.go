@@ -0,0 +1,129 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package lru
+
+import (
+	"testing"
+	"time"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestLRU(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	evicted := []string{}
+	c := New[string, int](3)
+	c.OnEvict = func(k string, v int) {
+		evicted = append(evicted, k)
+	}
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	tt.TestEqual(t, c.Keys(), []string{"a", "b", "c"})
+
+	// Accessing "a" makes "b" the least recently used.
+	v, ok := c.Get("a")
+	tt.TestTrue(t, ok)
+	tt.TestEqual(t, v, 1)
+	c.Add("d", 4)
+	tt.TestEqual(t, c.Keys(), []string{"c", "a", "d"})
+	tt.TestEqual(t, evicted, []string{"b"})
+
+	// Peek doesn't affect ordering.
+	_, ok = c.Peek("c")
+	tt.TestTrue(t, ok)
+	c.Add("e", 5)
+	tt.TestEqual(t, c.Keys(), []string{"a", "d", "e"})
+
+	_, ok = c.Get("c")
+	tt.TestFalse(t, ok)
+	tt.TestEqual(t, c.Stats(), Stats{Hits: 1, Misses: 1, Evictions: 2})
+	tt.TestEqual(t, c.Stats().HitRate(), 0.5)
+}
+
+func TestLFU(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c := NewWithPolicy[string, int](3, LFU)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	c.Get("a")
+	c.Get("a")
+	c.Get("c")
+
+	// "b" has the lowest frequency.
+	tt.TestEqual(t, c.Keys(), []string{"b", "c", "a"})
+	c.Add("d", 4)
+	tt.TestFalse(t, c.Contains("b"))
+
+	// "d" has only been used once so it is evicted next.
+	c.Add("e", 5)
+	tt.TestFalse(t, c.Contains("d"))
+	tt.TestEqual(t, c.Keys(), []string{"e", "c", "a"})
+
+	tt.TestTrue(t, c.Remove("a"))
+	tt.TestEqual(t, c.Keys(), []string{"e", "c"})
+}
+
+func TestCost(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c := New[string, int](10)
+	tt.TestTrue(t, c.AddWithCost("a", 1, 4))
+	tt.TestTrue(t, c.AddWithCost("b", 2, 4))
+	tt.TestEqual(t, c.Cost(), int64(8))
+
+	// Adding a cost of 4 evicts "a".
+	tt.TestTrue(t, c.AddWithCost("c", 3, 4))
+	tt.TestEqual(t, c.Keys(), []string{"b", "c"})
+	tt.TestEqual(t, c.Cost(), int64(8))
+
+	// Replacing an entry adjusts the cost.
+	tt.TestTrue(t, c.AddWithCost("b", 2, 1))
+	tt.TestEqual(t, c.Cost(), int64(5))
+
+	// An entry larger than the cache is rejected and removes the old value.
+	tt.TestFalse(t, c.AddWithCost("c", 3, 11))
+	tt.TestFalse(t, c.Contains("c"))
+	tt.TestEqual(t, c.Cost(), int64(1))
+
+	// Negative costs are rejected without changing anything.
+	tt.TestFalse(t, c.AddWithCost("b", 2, -5))
+	tt.TestTrue(t, c.Contains("b"))
+	tt.TestEqual(t, c.Cost(), int64(1))
+
+	c.Purge()
+	tt.TestEqual(t, c.Len(), 0)
+	tt.TestEqual(t, c.Cost(), int64(0))
+}
+
+func TestOnEvictUsesCache(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	// The callback can use the cache, such as to see what is left in it.
+	c := New[string, int](1)
+	var left []int
+	c.OnEvict = func(k string, v int) {
+		left = append(left, c.Len())
+	}
+	c.Add("a", 1)
+
+	done := make(chan struct{})
+	go func() {
+		c.Add("b", 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		tt.Fatalf(t, "Add() did not return with a callback using the cache.")
+	}
+	tt.TestEqual(t, left, []int{1})
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package multierror provides an error type that aggregates several errors
+// into one. This is useful when an operation should keep going after a
+// failure and report everything that went wrong once it completes.
+package multierror
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error is a collection of errors that is itself an error.
+type Error struct {
+	// Errors contains every error that has been appended, in order.
+	Errors []error
+
+	// FormatFunc can be set to control how the error is rendered by Error().
+	// If this is nil then DefaultFormat is used.
+	FormatFunc func([]error) string
+}
+
+// Append adds errs to err and returns the result. If err is nil a new Error is
+// allocated, if err is already an *Error the new errors are added to it, and
+// otherwise err becomes the first element of a new Error. Any *Error values in
+// errs are flattened into the result and nil errors are dropped, which allows
+// the return value of a function to be appended unconditionally.
+func Append(err error, errs ...error) *Error {
+	var me *Error
+	switch e := err.(type) {
+	case *Error:
+		if e != nil {
+			me = e
+		} else {
+			me = new(Error)
+		}
+	case nil:
+		me = new(Error)
+	default:
+		me = &Error{Errors: []error{e}}
+	}
+
+	for _, e := range errs {
+		switch e := e.(type) {
+		case *Error:
+			if e != nil {
+				me.Errors = append(me.Errors, e.Errors...)
+			}
+		case nil:
+		default:
+			me.Errors = append(me.Errors, e)
+		}
+	}
+	return me
+}
+
+// ErrorOrNil returns nil if no errors have been collected, otherwise it returns
+// e. This should be used when returning an *Error as an error so callers can
+// compare the result against nil.
+func (e *Error) ErrorOrNil() error {
+	if e == nil || len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Len returns the number of collected errors.
+func (e *Error) Len() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.Errors)
+}
+
+// Error renders the collected errors using FormatFunc.
+func (e *Error) Error() string {
+	fn := e.FormatFunc
+	if fn == nil {
+		fn = DefaultFormat
+	}
+	return fn(e.Errors)
+}
+
+// Unwrap returns the collected errors so that errors.Is() and errors.As() will
+// consider each of them.
+func (e *Error) Unwrap() []error {
+	if e == nil || len(e.Errors) == 0 {
+		return nil
+	}
+	errs := make([]error, len(e.Errors))
+	copy(errs, e.Errors)
+	return errs
+}
+
+// DefaultFormat renders a single error as its own message, and multiple errors
+// as a count followed by a bulleted list.
+func DefaultFormat(errs []error) string {
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	}
+
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = fmt.Sprintf("\t* %s", err)
+	}
+	return fmt.Sprintf(
+		"%d errors occurred:\n%s", len(errs), strings.Join(lines, "\n"))
+}
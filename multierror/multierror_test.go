@@ -0,0 +1,88 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package multierror
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestAppend(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	a := errors.New("a")
+	b := errors.New("b")
+	c := errors.New("c")
+
+	// Appending to nil allocates a new error.
+	me := Append(nil, a)
+	tt.TestEqual(t, me.Len(), 1)
+
+	// Nil errors are dropped.
+	me = Append(me, nil, b)
+	tt.TestEqual(t, me.Len(), 2)
+
+	// Nested multierrors are flattened.
+	me = Append(me, Append(nil, c))
+	tt.TestEqual(t, me.Errors, []error{a, b, c})
+
+	// A plain error becomes the first element.
+	me = Append(a, b)
+	tt.TestEqual(t, me.Errors, []error{a, b})
+
+	// A typed nil *Error is treated as empty.
+	var empty *Error
+	tt.TestEqual(t, Append(empty, a).Errors, []error{a})
+}
+
+func TestErrorOrNil(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	var me *Error
+	tt.TestEqual(t, me.ErrorOrNil(), nil)
+	tt.TestTrue(t, Append(nil).ErrorOrNil() == nil)
+	tt.TestTrue(t, Append(nil, nil, nil).ErrorOrNil() == nil)
+	tt.TestTrue(t, Append(nil, errors.New("x")).ErrorOrNil() != nil)
+}
+
+func TestErrorFormat(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	me := Append(nil, errors.New("only"))
+	tt.TestEqual(t, me.Error(), "only")
+
+	me = Append(me, errors.New("second"))
+	tt.TestEqual(t, me.Error(), "2 errors occurred:\n\t* only\n\t* second")
+
+	me.FormatFunc = func(errs []error) string {
+		s := make([]string, len(errs))
+		for i := range errs {
+			s[i] = errs[i].Error()
+		}
+		return strings.Join(s, ", ")
+	}
+	tt.TestEqual(t, me.Error(), "only, second")
+}
+
+func TestUnwrap(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	a := errors.New("a")
+	b := errors.New("b")
+	me := Append(nil, a, b)
+	tt.TestTrue(t, errors.Is(me, a))
+	tt.TestTrue(t, errors.Is(me, b))
+	tt.TestFalse(t, errors.Is(me, errors.New("a")))
+
+	// Modifying the returned slice doesn't change the error.
+	errs := me.Unwrap()
+	errs[0] = nil
+	tt.TestEqual(t, me.Errors[0], a)
+}
@@ -0,0 +1,383 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package pathmatch matches slash separated paths against glob patterns using
+// the rules from gitignore. In addition to the usual "*", "?" and "[...]"
+// wildcards it supports "**" to match any number of directories, negated
+// patterns starting with "!", patterns that only match directories when they
+// end with "/", and patterns anchored to the root when they contain a "/".
+//
+// Paths given to the matchers are always relative to the root the patterns
+// apply to and use "/" as the separator, for example "src/main.go".
+package pathmatch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Pattern is a single compiled gitignore style pattern.
+type Pattern struct {
+	// The pattern as it was given to Compile().
+	raw string
+
+	// Set if the pattern started with "!" and re-includes paths excluded by
+	// earlier patterns in a Set.
+	negate bool
+
+	// Set if the pattern ended with "/" and should only match directories.
+	dirOnly bool
+
+	// The regular expression the glob was translated into.
+	re *regexp.Regexp
+}
+
+// Compile parses a gitignore style pattern. Leading "!" negates the pattern,
+// a trailing "/" restricts it to directories, and a "/" anywhere else anchors
+// it to the root. Patterns without a "/" match at any depth.
+func Compile(pattern string) (*Pattern, error) {
+	p := &Pattern{raw: pattern}
+
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern %q", p.raw)
+	}
+
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr, err := translate(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", p.raw, err)
+	}
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	if p.re, err = regexp.Compile("^" + expr + "$"); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", p.raw, err)
+	}
+	return p, nil
+}
+
+// MustCompile is like Compile but panics if the pattern can't be parsed.
+func MustCompile(pattern string) *Pattern {
+	p, err := Compile(pattern)
+	if err != nil {
+		panic("pathmatch: " + err.Error())
+	}
+	return p
+}
+
+// String returns the pattern as it was originally given.
+func (p *Pattern) String() string {
+	return p.raw
+}
+
+// Negated returns true if the pattern started with "!".
+func (p *Pattern) Negated() bool {
+	return p.negate
+}
+
+// DirOnly returns true if the pattern only matches directories.
+func (p *Pattern) DirOnly() bool {
+	return p.dirOnly
+}
+
+// Match returns true if the pattern matches name. isDir should be true if
+// name refers to a directory. Negation is not taken into account, that is
+// the responsibility of a Set.
+func (p *Pattern) Match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(clean(name))
+}
+
+// MatchGlob reports whether name matches the shell style glob pattern. Unlike
+// path.Match, "**" matches zero or more whole directories, so "logs/**/*.tmp"
+// matches both "logs/a.tmp" and "logs/x/y/a.tmp". The pattern is always
+// anchored to the start of name.
+func MatchGlob(pattern, name string) (bool, error) {
+	g, err := CompileGlob(pattern)
+	if err != nil {
+		return false, err
+	}
+	return g.Match(name), nil
+}
+
+// Glob is a compiled shell style glob pattern with the semantics described
+// for MatchGlob, for when the same pattern is matched against many names.
+type Glob struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// CompileGlob parses a glob pattern for use with MatchGlob semantics.
+func CompileGlob(pattern string) (*Glob, error) {
+	expr, err := translate(strings.TrimPrefix(pattern, "/"))
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return nil, err
+	}
+	return &Glob{pattern: pattern, re: re}, nil
+}
+
+// String returns the pattern the Glob was compiled from.
+func (g *Glob) String() string {
+	return g.pattern
+}
+
+// Match reports whether name matches the glob.
+func (g *Glob) Match(name string) bool {
+	return g.re.MatchString(clean(name))
+}
+
+// Regexp returns the anchored regular expression equivalent to the glob. It
+// matches clean, relative, slash separated names only, without the leading
+// "./" or "/" that Match would tolerate.
+func (g *Glob) Regexp() *regexp.Regexp {
+	return g.re
+}
+
+// Set is an ordered list of patterns evaluated with gitignore semantics: the
+// last pattern that matches a path decides whether it is matched, and once a
+// directory is matched nothing beneath it can be re-included.
+type Set struct {
+	patterns []*Pattern
+}
+
+// NewSet compiles each of the patterns into a new Set.
+func NewSet(patterns ...string) (*Set, error) {
+	s := new(Set)
+	for _, p := range patterns {
+		if err := s.Add(p); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ParseIgnoreFile reads patterns from r in the format of a .gitignore file.
+// Blank lines and lines starting with "#" are skipped, and unescaped trailing
+// spaces are removed.
+func ParseIgnoreFile(r io.Reader) (*Set, error) {
+	s := new(Set)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = trimTrailingSpaces(line)
+		if line == "" {
+			continue
+		}
+		if err := s.Add(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add compiles pattern and appends it to the set.
+func (s *Set) Add(pattern string) error {
+	p, err := Compile(pattern)
+	if err != nil {
+		return err
+	}
+	s.patterns = append(s.patterns, p)
+	return nil
+}
+
+// AddPattern appends an already compiled pattern to the set.
+func (s *Set) AddPattern(p *Pattern) {
+	s.patterns = append(s.patterns, p)
+}
+
+// Patterns returns the patterns in the set, in order.
+func (s *Set) Patterns() []*Pattern {
+	return s.patterns
+}
+
+// Len returns the number of patterns in the set.
+func (s *Set) Len() int {
+	return len(s.patterns)
+}
+
+// Match returns true if name is matched by the set. Each parent directory of
+// name is checked first, since a matched directory matches everything in it.
+func (s *Set) Match(name string, isDir bool) bool {
+	if s == nil || len(s.patterns) == 0 {
+		return false
+	}
+	name = clean(name)
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if s.MatchEntry(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return s.MatchEntry(name, isDir)
+}
+
+// MatchEntry is like Match but doesn't check the parent directories of name.
+// It is intended for use while walking a tree, where the walk stops
+// descending into matched directories.
+func (s *Set) MatchEntry(name string, isDir bool) bool {
+	if s == nil {
+		return false
+	}
+	name = clean(name)
+	matched := false
+	for _, p := range s.patterns {
+		if matched == !p.negate {
+			// This pattern can't change the result.
+			continue
+		}
+		if p.Match(name, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// Normalizes a path for matching.
+func clean(name string) string {
+	name = path.Clean("/" + name)
+	return name[1:]
+}
+
+// Removes trailing spaces from a line unless they are escaped with a
+// backslash.
+func trimTrailingSpaces(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		if end > 1 && line[end-2] == '\\' {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// Translates a glob into a regular expression, without the anchors.
+func translate(glob string) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			atStart := i == 0 || glob[i-1] == '/'
+			if i+1 < len(glob) && glob[i+1] == '*' && atStart {
+				switch {
+				case i+2 == len(glob):
+					// Trailing "**" matches everything beneath.
+					buf.WriteString(".*")
+					i++
+					continue
+				case glob[i+2] == '/':
+					// "**/" matches zero or more directories.
+					buf.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			// Any other run of stars behaves like a single one.
+			for i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+			}
+			buf.WriteString("[^/]*")
+
+		case '?':
+			buf.WriteString("[^/]")
+
+		case '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			buf.WriteString(translateClass(glob[i+1 : end]))
+			i = end
+
+		case '\\':
+			if i+1 == len(glob) {
+				return "", fmt.Errorf("trailing backslash")
+			}
+			i++
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return buf.String(), nil
+}
+
+// Returns the index of the "]" closing the character class that starts at
+// glob[start], or -1 if it isn't terminated.
+func classEnd(glob string, start int) int {
+	i := start + 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		i++
+	}
+	// A "]" immediately after the opening bracket is a literal.
+	if i < len(glob) && glob[i] == ']' {
+		i++
+	}
+	for ; i < len(glob); i++ {
+		switch glob[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// Translates the body of a glob character class into a regular expression
+// character class. Classes never match "/".
+func translateClass(body string) string {
+	var buf strings.Builder
+	buf.WriteString("[")
+	if len(body) > 0 && (body[0] == '!' || body[0] == '^') {
+		buf.WriteString("^/")
+		body = body[1:]
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\' && i+1 < len(body):
+			i++
+			buf.WriteString(regexp.QuoteMeta(body[i : i+1]))
+		case c == '-' && i > 0 && i+1 < len(body):
+			buf.WriteByte('-')
+		case c == '[' || c == ']' || c == '^' || c == '-' || c == '\\':
+			buf.WriteString(`\` + string(c))
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
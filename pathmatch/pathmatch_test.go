@@ -0,0 +1,180 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package pathmatch
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	type testcase struct {
+		Pattern string
+		Path    string
+		IsDir   bool
+		Match   bool
+	}
+
+	testcases := []testcase{
+		// Unanchored patterns match at any depth.
+		{"foo", "foo", false, true},
+		{"foo", "a/b/foo", false, true},
+		{"foo", "a/foo/b", false, false},
+		{"foo", "foobar", false, false},
+		{"*.log", "x.log", false, true},
+		{"*.log", "a/b/x.log", false, true},
+		{"*.log", "a/x.log/b", false, false},
+		{"?.txt", "a.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+		{"[abc].txt", "b.txt", false, true},
+		{"[!abc].txt", "b.txt", false, false},
+		{"[!abc].txt", "d.txt", false, true},
+		{"[a-c]x", "bx", false, true},
+		{"[a-c]x", "dx", false, false},
+		{`\*x`, "*x", false, true},
+		{`\*x`, "ax", false, false},
+		{"[unterminated", "[unterminated", false, true},
+
+		// A slash anchors the pattern to the root.
+		{"/foo", "foo", false, true},
+		{"/foo", "a/foo", false, false},
+		{"a/foo", "a/foo", false, true},
+		{"a/foo", "b/a/foo", false, false},
+		{"a/*", "a/b", false, true},
+		{"a/*", "a/b/c", false, false},
+
+		// Directory only patterns.
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "a/build", true, true},
+
+		// Double star.
+		{"**/foo", "foo", false, true},
+		{"**/foo", "a/b/foo", false, true},
+		{"a/**", "a/b", false, true},
+		{"a/**", "a/b/c", false, true},
+		{"a/**", "a", true, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "a/x/y/c", false, false},
+		{"logs/**/*.tmp", "logs/x.tmp", false, true},
+		{"logs/**/*.tmp", "logs/a/b/x.tmp", false, true},
+		{"logs/**/*.tmp", "other/logs/x.tmp", false, false},
+		{"a**b", "axxb", false, true},
+		{"a**b", "ax/xb", false, false},
+	}
+
+	for _, tc := range testcases {
+		p, err := Compile(tc.Pattern)
+		tt.TestExpectSuccess(t, err)
+		tt.TestEqual(t, p.Match(tc.Path, tc.IsDir), tc.Match,
+			fmt.Sprintf("pattern %q path %q", tc.Pattern, tc.Path))
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	_, err := Compile("")
+	tt.TestExpectError(t, err)
+	_, err = Compile("!")
+	tt.TestExpectError(t, err)
+	_, err = Compile(`foo\`)
+	tt.TestExpectError(t, err)
+	tt.TestExpectPanic(t, func() { MustCompile("") },
+		`pathmatch: empty pattern ""`)
+}
+
+func TestMatchGlob(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	m, err := MatchGlob("logs/**/*.tmp", "logs/a/b/c.tmp")
+	tt.TestExpectSuccess(t, err)
+	tt.TestTrue(t, m)
+
+	// Globs are anchored even without a slash.
+	m, err = MatchGlob("*.tmp", "logs/c.tmp")
+	tt.TestExpectSuccess(t, err)
+	tt.TestFalse(t, m)
+
+	g, err := CompileGlob("usr/**")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, g.String(), "usr/**")
+	tt.TestTrue(t, g.Match("usr/bin/ls"))
+	tt.TestFalse(t, g.Match("etc/passwd"))
+	tt.TestTrue(t, g.Regexp().MatchString("usr/bin/ls"))
+
+	_, err = CompileGlob(`usr\`)
+	tt.TestExpectError(t, err)
+}
+
+func TestSet(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	s, err := NewSet("*.log", "!important.log", "build/", "/tmp")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, s.Len(), 4)
+
+	tt.TestTrue(t, s.Match("a.log", false))
+	tt.TestTrue(t, s.Match("x/a.log", false))
+	tt.TestFalse(t, s.Match("important.log", false))
+	tt.TestFalse(t, s.Match("x/important.log", false))
+	tt.TestTrue(t, s.Match("build", true))
+	tt.TestTrue(t, s.Match("build/out.o", false))
+	tt.TestTrue(t, s.Match("tmp", true))
+	tt.TestTrue(t, s.Match("tmp/x", false))
+	tt.TestFalse(t, s.Match("src/tmp", true))
+	tt.TestFalse(t, s.Match("src/main.go", false))
+
+	// A file can't be re-included if its parent directory is excluded.
+	s, err = NewSet("build/", "!build/keep")
+	tt.TestExpectSuccess(t, err)
+	tt.TestTrue(t, s.Match("build/keep", false))
+	tt.TestFalse(t, s.MatchEntry("build/keep", false))
+
+	// A nil or empty set matches nothing.
+	var empty *Set
+	tt.TestFalse(t, empty.Match("a", false))
+	tt.TestFalse(t, new(Set).Match("a", false))
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	contents := strings.Join([]string{
+		"# comment",
+		"",
+		"*.o",
+		`\#notacomment`,
+		`\!bang`,
+		"trailing   ",
+		`space\ `,
+		"!keep.o",
+	}, "\n")
+	s, err := ParseIgnoreFile(strings.NewReader(contents))
+	tt.TestExpectSuccess(t, err)
+
+	patterns := []string{}
+	for _, p := range s.Patterns() {
+		patterns = append(patterns, p.String())
+	}
+	tt.TestEqual(t, patterns, []string{
+		"*.o", `\#notacomment`, `\!bang`, "trailing", `space\ `, "!keep.o"})
+
+	tt.TestTrue(t, s.Match("main.o", false))
+	tt.TestFalse(t, s.Match("keep.o", false))
+	tt.TestTrue(t, s.Match("#notacomment", false))
+	tt.TestTrue(t, s.Match("!bang", false))
+	tt.TestTrue(t, s.Match("trailing", false))
+	tt.TestTrue(t, s.Match("space ", false))
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package pidfile manages pid files that double as a guard against running
+// more than one instance of a program. The pid file is held with an advisory
+// lock for as long as the program runs, so a pid file left behind by a process
+// that crashed is detected as stale and replaced rather than blocking the next
+// start.
+package pidfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LockedError is returned by Create() when another process holds the pid
+// file.
+type LockedError struct {
+	// The path of the pid file.
+	Path string
+
+	// The pid recorded in the file, or zero if it could not be read.
+	Pid int
+}
+
+func (e *LockedError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("pid file %s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("pid file %s is locked by process %d", e.Path, e.Pid)
+}
+
+// IsLocked returns true if err indicates the pid file is held by another
+// process.
+func IsLocked(err error) bool {
+	_, ok := err.(*LockedError)
+	return ok
+}
+
+// PidFile is a pid file held by the current process.
+type PidFile struct {
+	path string
+	file *os.File
+}
+
+// Create writes the current process id to path and locks it. If another
+// running process holds the file a *LockedError is returned. A file left over
+// from a process that has exited is considered stale and is replaced.
+func Create(path string) (*PidFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err == errWouldBlock {
+			pid, _ := Read(path)
+			return nil, &LockedError{Path: path, Pid: pid}
+		}
+		return nil, err
+	}
+
+	// It's possible the previous owner removed the file between us opening
+	// and locking it, in which case the lock protects nothing. Make sure the
+	// locked file is still the one at path.
+	if same, err := sameFile(f, path); err != nil || !same {
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return Create(path)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &PidFile{path: path, file: f}, nil
+}
+
+// Path returns the location of the pid file.
+func (p *PidFile) Path() string {
+	return p.path
+}
+
+// Release removes the pid file and releases the lock. It should be called
+// when the program exits, typically with defer. Calling it more than once is
+// harmless.
+func (p *PidFile) Release() error {
+	if p.file == nil {
+		return nil
+	}
+	// Remove the file while still holding the lock so another process can't
+	// lock it and then have it deleted out from under it.
+	err := os.Remove(p.path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	p.file = nil
+	return err
+}
+
+// Read returns the pid stored in the file at path.
+func Read(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %v", path, err)
+	}
+	return pid, nil
+}
+
+// IsRunning reports whether the pid file at path is held by a running
+// process, returning that process's pid if it is. A missing or stale file is
+// reported as not running.
+func IsRunning(path string) (int, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	locked, err := isLocked(f)
+	if err != nil || !locked {
+		return 0, false, err
+	}
+	pid, _ := Read(path)
+	return pid, true, nil
+}
+
+// Returns true if the open file f is still the file at path.
+func sameFile(f *os.File, path string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, pi), nil
+}
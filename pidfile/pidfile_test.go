@@ -0,0 +1,80 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package pidfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestCreateAndRelease(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	name := path.Join(tt.TempDir(t), "test.pid")
+	p, err := Create(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, p.Path(), name)
+
+	pid, err := Read(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, pid, os.Getpid())
+
+	pid, running, err := IsRunning(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestTrue(t, running)
+	tt.TestEqual(t, pid, os.Getpid())
+
+	// A second guard on the same file fails while the first is held.
+	_, err = Create(name)
+	tt.TestExpectError(t, err)
+	tt.TestTrue(t, IsLocked(err))
+	tt.TestEqual(t, err.(*LockedError).Pid, os.Getpid())
+
+	tt.TestExpectSuccess(t, p.Release())
+	tt.TestExpectSuccess(t, p.Release())
+	_, err = os.Stat(name)
+	tt.TestTrue(t, os.IsNotExist(err))
+
+	_, running, err = IsRunning(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestFalse(t, running)
+
+	// Once released it can be created again.
+	p, err = Create(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestExpectSuccess(t, p.Release())
+}
+
+func TestStalePidFile(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	// A pid file that isn't locked was left behind by a dead process.
+	name := path.Join(tt.TempDir(t), "stale.pid")
+	tt.TestExpectSuccess(t, ioutil.WriteFile(name, []byte("999999999\n"), 0644))
+
+	_, running, err := IsRunning(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestFalse(t, running)
+
+	p, err := Create(name)
+	tt.TestExpectSuccess(t, err)
+	defer p.Release()
+	pid, err := Read(name)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, pid, os.Getpid())
+}
+
+func TestReadInvalid(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	name := tt.WriteTempFile(t, "not a pid")
+	_, err := Read(name)
+	tt.TestExpectError(t, err)
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !windows
+
+package pidfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returned by lockFile() when another process holds the lock.
+var errWouldBlock = syscall.EWOULDBLOCK
+
+// Takes an exclusive lock on f without blocking.
+func lockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Returns true if another open file description holds a lock on f.
+func isLocked(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	switch err {
+	case nil:
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return false, nil
+	case syscall.EWOULDBLOCK:
+		return true, nil
+	default:
+		return false, err
+	}
+}
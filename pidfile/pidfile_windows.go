@@ -0,0 +1,22 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build windows
+
+package pidfile
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock is held by another process")
+
+var errNotSupported = errors.New("pid file locking is not supported on Windows")
+
+func lockFile(f *os.File) error {
+	return errNotSupported
+}
+
+func isLocked(f *os.File) (bool, error) {
+	return false, errNotSupported
+}
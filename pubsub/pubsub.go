@@ -0,0 +1,292 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package pubsub implements a small in-process publish/subscribe event bus.
+// Publishers send events to a named topic and every subscriber of that topic
+// receives a copy on its own buffered channel. A Bus is typed by the data its
+// events carry, so a bus of progress events can't be given anything else. How
+// a subscriber that falls behind is handled is controlled per subscription
+// with a Policy.
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy controls what happens when an event is published to a subscriber
+// whose buffer is full.
+type Policy int
+
+const (
+	// Block waits until the subscriber has room for the event. This guarantees
+	// delivery but a slow subscriber will slow down every publisher.
+	Block Policy = iota
+
+	// DropNewest discards the event being published.
+	DropNewest
+
+	// DropOldest discards the oldest buffered event to make room for the one
+	// being published.
+	DropOldest
+
+	// Disconnect unsubscribes the subscriber. Its channel is closed, though
+	// any events already buffered can still be read from it.
+	Disconnect
+)
+
+// AllTopics can be passed to Subscribe() to receive events for every topic.
+const AllTopics = ""
+
+// Event is a single message delivered to subscribers, carrying data of type
+// T.
+type Event[T any] struct {
+	// The topic the event was published to.
+	Topic string
+
+	// The payload provided by the publisher.
+	Data T
+}
+
+// Bus routes published events carrying data of type T to subscribers. The
+// zero value is not usable, use NewBus() instead.
+type Bus[T any] struct {
+	lock   sync.RWMutex
+	subs   map[string]map[*Subscription[T]]struct{}
+	closed bool
+}
+
+// NewBus returns an empty Bus for events carrying data of type T.
+func NewBus[T any]() *Bus[T] {
+	return &Bus[T]{
+		subs: make(map[string]map[*Subscription[T]]struct{}),
+	}
+}
+
+// Subscribe registers interest in topic, or in every topic if topic is
+// AllTopics. Events are buffered on a channel of the given size and policy
+// determines what happens when that buffer is full. If ctx is not nil the
+// subscription is removed automatically once ctx is done.
+//
+// Subscribing to a closed Bus returns a subscription whose channel is already
+// closed.
+func (b *Bus[T]) Subscribe(
+	ctx context.Context, topic string, buffer int, policy Policy,
+) *Subscription[T] {
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &Subscription[T]{
+		bus:    b,
+		topic:  topic,
+		policy: policy,
+		ch:     make(chan Event[T], buffer),
+		done:   make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		s.once.Do(func() {
+			close(s.done)
+			close(s.ch)
+		})
+		return s
+	}
+	m, ok := b.subs[topic]
+	if !ok {
+		m = make(map[*Subscription[T]]struct{})
+		b.subs[topic] = m
+	}
+	m[s] = struct{}{}
+	b.lock.Unlock()
+
+	if ctx != nil && ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.Unsubscribe()
+			case <-s.done:
+			}
+		}()
+	}
+
+	return s
+}
+
+// Publish sends data to every subscriber of topic as well as every subscriber
+// of AllTopics. It returns the number of subscribers that accepted the event.
+func (b *Bus[T]) Publish(topic string, data T) int {
+	ev := Event[T]{Topic: topic, Data: data}
+
+	// The subscribers are copied so that the lock isn't held while waiting on
+	// a subscriber with the Block policy, which would stop Close() and
+	// Subscribe() until it reads.
+	b.lock.RLock()
+	if b.closed {
+		b.lock.RUnlock()
+		return 0
+	}
+	var subs []*Subscription[T]
+	for s := range b.subs[topic] {
+		subs = append(subs, s)
+	}
+	if topic != AllTopics {
+		for s := range b.subs[AllTopics] {
+			subs = append(subs, s)
+		}
+	}
+	b.lock.RUnlock()
+
+	delivered := 0
+	for _, s := range subs {
+		if s.send(ev) {
+			delivered++
+		} else if s.policy == Disconnect {
+			s.Unsubscribe()
+		}
+	}
+	return delivered
+}
+
+// Subscribers returns the number of subscribers for topic, not including
+// those subscribed to AllTopics.
+func (b *Bus[T]) Subscribers(topic string) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subs[topic])
+}
+
+// Close unsubscribes every subscriber and causes future calls to Publish() to
+// be ignored.
+func (b *Bus[T]) Close() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	var all []*Subscription[T]
+	for _, m := range b.subs {
+		for s := range m {
+			all = append(all, s)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, s := range all {
+		s.Unsubscribe()
+	}
+}
+
+// Subscription is a single subscriber's view of a Bus.
+type Subscription[T any] struct {
+	bus    *Bus[T]
+	topic  string
+	policy Policy
+	ch     chan Event[T]
+	done   chan struct{}
+	once   sync.Once
+
+	// Held for reading while sending to ch, and for writing to close it.
+	lock sync.RWMutex
+
+	dropped uint64
+}
+
+// C returns the channel that events are delivered on. The channel is closed
+// when the subscription is removed.
+func (s *Subscription[T]) C() <-chan Event[T] {
+	return s.ch
+}
+
+// Topic returns the topic this subscription was created for.
+func (s *Subscription[T]) Topic() string {
+	return s.topic
+}
+
+// Dropped returns the number of events that were not delivered to this
+// subscriber because its buffer was full.
+func (s *Subscription[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Done returns a channel that is closed once the subscription is removed.
+func (s *Subscription[T]) Done() <-chan struct{} {
+	return s.done
+}
+
+// Unsubscribe removes the subscription from the bus and closes its channel.
+// It is safe to call more than once and from multiple goroutines.
+func (s *Subscription[T]) Unsubscribe() {
+	s.once.Do(func() {
+		// Closing done first releases any publisher blocked sending to this
+		// subscriber, which in turn allows the write lock to be acquired.
+		close(s.done)
+
+		s.bus.lock.Lock()
+		if m, ok := s.bus.subs[s.topic]; ok {
+			delete(m, s)
+			if len(m) == 0 {
+				delete(s.bus.subs, s.topic)
+			}
+		}
+		s.bus.lock.Unlock()
+
+		// Publishers only send while holding the read lock, and don't once
+		// done is closed, so it is safe to close the channel.
+		s.lock.Lock()
+		close(s.ch)
+		s.lock.Unlock()
+	})
+}
+
+// Delivers ev according to the subscription's policy. Returns true if the
+// event was queued.
+func (s *Subscription[T]) send(ev Event[T]) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case s.ch <- ev:
+			return true
+		case <-s.done:
+			return false
+		}
+
+	case DropOldest:
+		if cap(s.ch) == 0 {
+			// Nothing is ever buffered so there is nothing to discard.
+			break
+		}
+		for {
+			select {
+			case s.ch <- ev:
+				return true
+			default:
+			}
+			// Make room by discarding the oldest event. Another publisher or
+			// the consumer may have beaten us to it, so just retry.
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	}
+
+	select {
+	case s.ch <- ev:
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	s1 := b.Subscribe(nil, "a", 10, Block)
+	s2 := b.Subscribe(nil, "b", 10, Block)
+	all := b.Subscribe(nil, AllTopics, 10, Block)
+
+	tt.TestEqual(t, b.Publish("a", 1), 2)
+	tt.TestEqual(t, b.Publish("b", 2), 2)
+	tt.TestEqual(t, b.Publish("c", 3), 1)
+
+	tt.TestEqual(t, <-s1.C(), Event[int]{Topic: "a", Data: 1})
+	tt.TestEqual(t, <-s2.C(), Event[int]{Topic: "b", Data: 2})
+	tt.TestEqual(t, (<-all.C()).Data, 1)
+	tt.TestEqual(t, (<-all.C()).Data, 2)
+	tt.TestEqual(t, (<-all.C()).Data, 3)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	s := b.Subscribe(nil, "a", 1, Block)
+	tt.TestEqual(t, b.Subscribers("a"), 1)
+	s.Unsubscribe()
+	s.Unsubscribe()
+	tt.TestEqual(t, b.Subscribers("a"), 0)
+	tt.TestEqual(t, b.Publish("a", 1), 0)
+
+	_, ok := <-s.C()
+	tt.TestFalse(t, ok)
+}
+
+func TestUnsubscribeReleasesBlockedPublisher(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	s := b.Subscribe(nil, "a", 0, Block)
+
+	published := make(chan int)
+	go func() {
+		published <- b.Publish("a", 1)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Unsubscribe()
+
+	select {
+	case n := <-published:
+		tt.TestEqual(t, n, 0)
+	case <-time.After(5 * time.Second):
+		tt.Fatalf(t, "Publish() did not return after unsubscribing.")
+	}
+}
+
+func TestContextUnsubscribe(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := b.Subscribe(ctx, "a", 1, Block)
+	cancel()
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		tt.Fatalf(t, "Subscription was not removed when the context ended.")
+	}
+	tt.TestEqual(t, b.Subscribers("a"), 0)
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	newest := b.Subscribe(nil, "a", 2, DropNewest)
+	oldest := b.Subscribe(nil, "a", 2, DropOldest)
+	disconnect := b.Subscribe(nil, "a", 2, Disconnect)
+
+	for i := 1; i <= 4; i++ {
+		b.Publish("a", i)
+	}
+
+	tt.TestEqual(t, (<-newest.C()).Data, 1)
+	tt.TestEqual(t, (<-newest.C()).Data, 2)
+	tt.TestEqual(t, newest.Dropped(), uint64(2))
+
+	tt.TestEqual(t, (<-oldest.C()).Data, 3)
+	tt.TestEqual(t, (<-oldest.C()).Data, 4)
+	tt.TestEqual(t, oldest.Dropped(), uint64(2))
+
+	// The buffered events are still readable, then the channel is closed.
+	tt.TestEqual(t, (<-disconnect.C()).Data, 1)
+	tt.TestEqual(t, (<-disconnect.C()).Data, 2)
+	_, ok := <-disconnect.C()
+	tt.TestFalse(t, ok)
+}
+
+func TestClose(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	s := b.Subscribe(nil, "a", 1, Block)
+	b.Close()
+	_, ok := <-s.C()
+	tt.TestFalse(t, ok)
+	tt.TestEqual(t, b.Publish("a", 1), 0)
+
+	s = b.Subscribe(nil, "a", 1, Block)
+	_, ok = <-s.C()
+	tt.TestFalse(t, ok)
+}
+
+func TestCloseReleasesBlockedPublisher(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	b := NewBus[int]()
+	b.Subscribe(nil, "a", 0, Block)
+
+	published := make(chan int)
+	go func() {
+		published <- b.Publish("a", 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Subscribing isn't held up by the publisher either.
+	closed := make(chan struct{})
+	go func() {
+		b.Subscribe(nil, "b", 0, Block)
+		b.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		tt.Fatalf(t, "Close() did not return with a blocked publisher.")
+	}
+	select {
+	case n := <-published:
+		tt.TestEqual(t, n, 0)
+	case <-time.After(5 * time.Second):
+		tt.Fatalf(t, "Publish() did not return after closing.")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package strutil contains string helpers for formatting command line output
+// and comparing secrets. All widths are measured in runes rather than bytes so
+// multibyte characters are never split.
+package strutil
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Ellipsis is appended by Truncate() when a string is shortened.
+const Ellipsis = "…"
+
+// Truncate shortens s to at most max runes. If s is shortened, the last rune
+// is replaced with Ellipsis.
+func Truncate(s string, max int) string {
+	return TruncateWith(s, max, Ellipsis)
+}
+
+// TruncateWith shortens s to at most max runes, ending it with the given
+// ellipsis if it had to be shortened. If max is too small to hold the
+// ellipsis then s is simply cut to max runes.
+func TruncateWith(s string, max int, ellipsis string) string {
+	if max <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	keep := max - utf8.RuneCountInString(ellipsis)
+	if keep <= 0 {
+		return prefixRunes(s, max)
+	}
+	return prefixRunes(s, keep) + ellipsis
+}
+
+// Returns the first n runes of s.
+func prefixRunes(s string, n int) string {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// Wrap breaks s into lines of at most width runes, splitting at whitespace.
+// Existing line breaks are preserved and words longer than width are placed on
+// a line of their own rather than being split. A width of zero or less
+// returns s unchanged.
+func Wrap(s string, width int) string {
+	return strings.Join(WrapLines(s, width), "\n")
+}
+
+// WrapLines is like Wrap but returns the individual lines.
+func WrapLines(s string, width int) []string {
+	if width <= 0 {
+		return strings.Split(s, "\n")
+	}
+
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		words := strings.FieldsFunc(paragraph, unicode.IsSpace)
+		if len(words) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+
+		line := words[0]
+		lineWidth := utf8.RuneCountInString(line)
+		for _, word := range words[1:] {
+			wordWidth := utf8.RuneCountInString(word)
+			if lineWidth+1+wordWidth > width {
+				lines = append(lines, line)
+				line, lineWidth = word, wordWidth
+				continue
+			}
+			line += " " + word
+			lineWidth += 1 + wordWidth
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Indent prefixes every non-empty line in s with prefix.
+func Indent(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PadRight pads s with spaces until it is width runes wide.
+func PadRight(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// PadLeft pads s on the left with spaces until it is width runes wide.
+func PadLeft(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return strings.Repeat(" ", width-n) + s
+	}
+	return s
+}
+
+// SecureCompare returns true if a and b are equal. The time taken depends on
+// neither the contents nor the lengths of the strings, which makes it suitable
+// for comparing secrets like tokens and passwords.
+func SecureCompare(a, b string) bool {
+	// Comparing digests rather than the strings themselves keeps the length
+	// of the secret from leaking through an early return.
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
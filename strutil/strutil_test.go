@@ -0,0 +1,85 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package strutil_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/apcera/util/strutil"
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestTruncate(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	tt.TestEqual(t, strutil.Truncate("hello", 10), "hello")
+	tt.TestEqual(t, strutil.Truncate("hello", 5), "hello")
+	tt.TestEqual(t, strutil.Truncate("hello world", 5), "hell…")
+	tt.TestEqual(t, strutil.Truncate("héllo wörld", 8), "héllo w…")
+	tt.TestEqual(t, strutil.Truncate("日本語テキスト", 4), "日本語…")
+	tt.TestEqual(t, strutil.Truncate("hello", 0), "")
+	tt.TestEqual(t, strutil.TruncateWith("hello world", 8, "..."), "hello...")
+	tt.TestEqual(t, strutil.TruncateWith("hello world", 2, "..."), "he")
+}
+
+func TestWrap(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	tt.TestEqual(t, strutil.Wrap("the quick brown fox jumps", 10),
+		"the quick\nbrown fox\njumps")
+	tt.TestEqual(t, strutil.Wrap("a verylongword b", 5), "a\nverylongword\nb")
+	tt.TestEqual(t, strutil.Wrap("one\n\ntwo  three", 20), "one\n\ntwo three")
+	tt.TestEqual(t, strutil.Wrap("ünïcödé wörds hére", 13), "ünïcödé wörds\nhére")
+	tt.TestEqual(t, strutil.Wrap("unchanged  text", 0), "unchanged  text")
+	tt.TestEqual(t, strutil.WrapLines("a b c", 3), []string{"a b", "c"})
+}
+
+func TestIndentAndPad(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	tt.TestEqual(t, strutil.Indent("a\n\nb", "  "), "  a\n\n  b")
+	tt.TestEqual(t, strutil.PadRight("ü", 3), "ü  ")
+	tt.TestEqual(t, strutil.PadLeft("ü", 3), "  ü")
+	tt.TestEqual(t, strutil.PadLeft("long", 2), "long")
+}
+
+func TestTable(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	table := strutil.NewTable("NAME", "SIZE", "MODE")
+	table.SetAlignment(1, strutil.AlignRight)
+	table.AddRow("a", "1", "0644")
+	table.AddRow("longer-name", "12345", "0755")
+	table.AddRow("short")
+	tt.TestEqual(t, table.Len(), 3)
+	tt.TestEqual(t, table.String(), ""+
+		"NAME          SIZE  MODE\n"+
+		"a                1  0644\n"+
+		"longer-name  12345  0755\n"+
+		"short\n")
+
+	table = strutil.NewTable()
+	table.Separator = " | "
+	table.MaxWidth = 4
+	table.AddRow("abcdefg", "x")
+	var buf bytes.Buffer
+	_, err := table.WriteTo(&buf)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, buf.String(), "abc… | x\n")
+}
+
+func TestSecureCompare(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	tt.TestTrue(t, strutil.SecureCompare("secret", "secret"))
+	tt.TestTrue(t, strutil.SecureCompare("", ""))
+	tt.TestFalse(t, strutil.SecureCompare("secret", "Secret"))
+	tt.TestFalse(t, strutil.SecureCompare("secret", "secret2"))
+	tt.TestFalse(t, strutil.SecureCompare("", "x"))
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package strutil
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Alignment controls how a table column is padded.
+type Alignment int
+
+const (
+	AlignLeft Alignment = iota
+	AlignRight
+)
+
+// Table formats rows of text into aligned columns for command line output.
+type Table struct {
+	headers []string
+	rows    [][]string
+	align   []Alignment
+
+	// Separator is placed between columns. It defaults to two spaces.
+	Separator string
+
+	// MaxWidth, if greater than zero, truncates each cell to at most this many
+	// runes.
+	MaxWidth int
+}
+
+// NewTable returns a table with the given column headers. If no headers are
+// given the table is printed without a header line.
+func NewTable(headers ...string) *Table {
+	return &Table{
+		headers:   headers,
+		Separator: "  ",
+	}
+}
+
+// SetAlignment sets the alignment of the given column.
+func (t *Table) SetAlignment(column int, align Alignment) {
+	for len(t.align) <= column {
+		t.align = append(t.align, AlignLeft)
+	}
+	t.align[column] = align
+}
+
+// AddRow appends a row to the table. Rows may have differing numbers of
+// columns.
+func (t *Table) AddRow(columns ...string) {
+	t.rows = append(t.rows, columns)
+}
+
+// Len returns the number of rows in the table, not including the header.
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// WriteTo writes the formatted table to w.
+func (t *Table) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, t.String())
+	return int64(n), err
+}
+
+// String returns the formatted table. The last column is never padded so
+// lines don't have trailing whitespace.
+func (t *Table) String() string {
+	rows := t.rows
+	if len(t.headers) > 0 {
+		rows = append([][]string{t.headers}, rows...)
+	}
+
+	// Truncate cells and find the width of each column.
+	cells := make([][]string, len(rows))
+	widths := []int{}
+	for i, row := range rows {
+		cells[i] = make([]string, len(row))
+		for j, cell := range row {
+			if t.MaxWidth > 0 {
+				cell = Truncate(cell, t.MaxWidth)
+			}
+			cells[i][j] = cell
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, row := range cells {
+		parts := make([]string, len(row))
+		for j, cell := range row {
+			align := AlignLeft
+			if j < len(t.align) {
+				align = t.align[j]
+			}
+			switch {
+			case align == AlignRight:
+				parts[j] = PadLeft(cell, widths[j])
+			case j == len(row)-1:
+				parts[j] = cell
+			default:
+				parts[j] = PadRight(cell, widths[j])
+			}
+		}
+		buf.WriteString(strings.Join(parts, t.Separator))
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+)
+
+// The extended attributes holding the access and default POSIX ACLs.
+var aclXattrs = []string{
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+}
+
+// The prefix for PAX records holding extended attributes, as used by GNU tar
+// and star.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Records the POSIX ACLs of the named file in the header's PAX records.
+func addACLs(header *tar.Header, name string) error {
+	acls, err := readACLs(name)
+	if err != nil {
+		return err
+	}
+	for attr, value := range acls {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[paxXattrPrefix+attr] = value
+	}
+	return nil
+}
+
+// Returns the POSIX ACLs recorded in the header's PAX records.
+func headerACLs(header *tar.Header) map[string]string {
+	var acls map[string]string
+	for _, attr := range aclXattrs {
+		if value, ok := header.PAXRecords[paxXattrPrefix+attr]; ok {
+			if acls == nil {
+				acls = make(map[string]string)
+			}
+			acls[attr] = value
+		}
+	}
+	return acls
+}
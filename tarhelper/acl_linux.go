@@ -0,0 +1,40 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package tarhelper
+
+import (
+	"syscall"
+)
+
+// Returns the POSIX ACLs set on the named file, keyed by extended attribute
+// name. Files without ACLs, and filesystems that don't support them, return
+// an empty result.
+func readACLs(name string) (map[string]string, error) {
+	acls := make(map[string]string)
+	for _, attr := range aclXattrs {
+		size, err := syscall.Getxattr(name, attr, nil)
+		if err == syscall.ENODATA || err == syscall.ENOTSUP || size == 0 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(name, attr, value); err != nil {
+			return nil, err
+		}
+		acls[attr] = string(value[:size])
+	}
+	return acls, nil
+}
+
+// Applies POSIX ACLs read by readACLs to the named file.
+func writeACLs(name string, acls map[string]string) error {
+	for attr, value := range acls {
+		if err := syscall.Setxattr(name, attr, []byte(value), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path"
+	"syscall"
+	"testing"
+
+	. "github.com/apcera/util/testtool"
+)
+
+// Builds the extended attribute value for an access ACL that grants the
+// given user read access on top of the usual owner, group and other entries.
+func makeACL(uid uint32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, 0xffffffff}, // owner
+		{0x02, 4, uid},        // named user
+		{0x04, 4, 0xffffffff}, // group
+		{0x10, 4, 0xffffffff}, // mask
+		{0x20, 4, 0xffffffff}, // other
+	} {
+		binary.Write(&buf, binary.LittleEndian, e)
+	}
+	return buf.Bytes()
+}
+
+func TestTarACLs(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	name := path.Join(dir, "file")
+	TestExpectSuccess(t, ioutil.WriteFile(name, []byte("data"), 0644))
+	acl := makeACL(65534)
+	if err := syscall.Setxattr(name, "system.posix_acl_access", acl, 0); err != nil {
+		t.Skipf("POSIX ACLs aren't supported here: %v", err)
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IncludeACLs = true
+	TestExpectSuccess(t, tw.Archive())
+
+	// the ACL is recorded in the header
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Name == "file" {
+			TestEqual(t, header.PAXRecords["SCHILY.xattr.system.posix_acl_access"], string(acl))
+			break
+		}
+	}
+
+	// and reapplied on extraction when asked
+	for _, preserve := range []bool{true, false} {
+		extractionPath := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+		u.PreserveACLs = preserve
+		TestExpectSuccess(t, u.Extract())
+
+		acls, err := readACLs(path.Join(extractionPath, "file"))
+		TestExpectSuccess(t, err)
+		if preserve {
+			TestEqual(t, acls["system.posix_acl_access"], string(acl))
+		} else {
+			TestEqual(t, len(acls), 0)
+		}
+	}
+}
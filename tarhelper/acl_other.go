@@ -0,0 +1,18 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !linux
+
+package tarhelper
+
+import (
+	"fmt"
+)
+
+// POSIX ACLs are only supported on Linux.
+func readACLs(name string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeACLs(name string, acls map[string]string) error {
+	return fmt.Errorf("POSIX ACLs are not supported on this platform")
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AppleDoublePrefix starts the base name of the AppleDouble entry holding
+// the macOS metadata of the file of the same name without the prefix, as
+// written by bsdtar.
+const AppleDoublePrefix = "._"
+
+// The magic number and version of AppleDouble files.
+const (
+	appleDoubleMagic   = 0x00051607
+	appleDoubleVersion = 0x00020000
+)
+
+// The ids of the AppleDouble entries that are read and written.
+const (
+	appleDoubleResourceFork = 2
+	appleDoubleFinderInfo   = 9
+)
+
+// The size of the Finder info.
+const finderInfoSize = 32
+
+// macMetadata is the metadata of a file on macOS that is kept outside of its
+// content.
+type macMetadata struct {
+	// The Finder info, with the file's type, creator and Finder flags.
+	finderInfo []byte
+
+	// The content of the resource fork.
+	resourceFork []byte
+}
+
+// Reports whether there is no metadata.
+func (m macMetadata) empty() bool {
+	return len(m.finderInfo) == 0 && len(m.resourceFork) == 0
+}
+
+// Returns the metadata as an AppleDouble file.
+func (m macMetadata) appleDouble() []byte {
+	type entry struct {
+		id   uint32
+		data []byte
+	}
+	var entries []entry
+	if len(m.finderInfo) > 0 {
+		entries = append(entries, entry{appleDoubleFinderInfo, m.finderInfo})
+	}
+	if len(m.resourceFork) > 0 {
+		entries = append(entries, entry{appleDoubleResourceFork, m.resourceFork})
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(appleDoubleMagic))
+	binary.Write(&buf, binary.BigEndian, uint32(appleDoubleVersion))
+	buf.WriteString("Mac OS X        ")
+	binary.Write(&buf, binary.BigEndian, uint16(len(entries)))
+	offset := uint32(buf.Len() + 12*len(entries))
+	for _, e := range entries {
+		binary.Write(&buf, binary.BigEndian, []uint32{e.id, offset, uint32(len(e.data))})
+		offset += uint32(len(e.data))
+	}
+	for _, e := range entries {
+		buf.Write(e.data)
+	}
+	return buf.Bytes()
+}
+
+// Parses the metadata held in an AppleDouble file.
+func parseAppleDouble(data []byte) (macMetadata, error) {
+	var m macMetadata
+	if len(data) < 26 || binary.BigEndian.Uint32(data) != appleDoubleMagic ||
+		binary.BigEndian.Uint32(data[4:]) != appleDoubleVersion {
+		return m, errors.New("not an AppleDouble file")
+	}
+	n := int(binary.BigEndian.Uint16(data[24:]))
+	if len(data) < 26+12*n {
+		return m, errors.New("truncated AppleDouble file")
+	}
+	for i := 0; i < n; i++ {
+		e := data[26+12*i:]
+		id := binary.BigEndian.Uint32(e)
+		offset := uint64(binary.BigEndian.Uint32(e[4:]))
+		length := uint64(binary.BigEndian.Uint32(e[8:]))
+		if offset+length > uint64(len(data)) {
+			return m, errors.New("truncated AppleDouble file")
+		}
+		value := data[offset : offset+length]
+		switch id {
+		case appleDoubleFinderInfo:
+			// the Finder info may be followed by extended attributes, which
+			// aren't restored
+			if len(value) >= finderInfoSize {
+				m.finderInfo = value[:finderInfoSize]
+			}
+		case appleDoubleResourceFork:
+			m.resourceFork = value
+		}
+	}
+	return m, nil
+}
+
+// Returns the name of the AppleDouble entry for the named entry.
+func appleDoubleName(name string) string {
+	name = strings.TrimSuffix(name, "/")
+	return path.Join(path.Dir(name), AppleDoublePrefix+path.Base(name))
+}
+
+// Writes an AppleDouble entry ahead of the entry with the given header for
+// the macOS metadata of the named file within the target, if it has any.
+func (t *Tar) writeAppleDouble(header *tar.Header, name string) error {
+	m, err := readMacMetadata(filepath.Join(t.target, name))
+	if err != nil {
+		return entryError(name, fmt.Errorf("failed to read macOS metadata for %q: %v", header.Name, err))
+	}
+	if m.empty() {
+		return nil
+	}
+
+	data := m.appleDouble()
+	ad := &tar.Header{
+		Name:     appleDoubleName(header.Name),
+		Mode:     0644,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		ModTime:  header.ModTime,
+		Typeflag: tar.TypeReg,
+		Size:     int64(len(data)),
+	}
+	if err := t.writeHeader(ad); err != nil {
+		return ignoreDropped(err)
+	}
+	if t.estimate != nil {
+		return nil
+	}
+	_, err = t.archive.Write(data)
+	return err
+}
+
+// AppleDoublePolicy decides what is done with the AppleDouble entries of an
+// archive, which hold the macOS metadata of the file they are named for.
+type AppleDoublePolicy int
+
+const (
+	// AppleDoubleExtract extracts AppleDouble entries as files, like any
+	// other entry.
+	AppleDoubleExtract AppleDoublePolicy = iota
+
+	// AppleDoubleRestore applies the metadata in AppleDouble entries to the
+	// file they are for on macOS, once everything has been extracted, in
+	// place of extracting them. On other platforms they are extracted as
+	// files, so that the metadata isn't lost.
+	AppleDoubleRestore
+
+	// AppleDoubleSkip leaves out AppleDouble entries.
+	AppleDoubleSkip
+)
+
+// pendingMetadata is the macOS metadata to apply to an extracted file.
+type pendingMetadata struct {
+	name     string
+	entry    string
+	metadata macMetadata
+}
+
+// Handles the AppleDouble entry with the given header, which is to be
+// extracted to name, according to the AppleDoublePolicy. Reports whether the
+// entry was dealt with, otherwise it is extracted as a file.
+func (u *Untar) handleAppleDouble(header *tar.Header, name string) (bool, error) {
+	if u.AppleDouble == AppleDoubleExtract || header.Typeflag != tar.TypeReg ||
+		!strings.HasPrefix(path.Base(header.Name), AppleDoublePrefix) {
+		return false, nil
+	}
+	if u.AppleDouble == AppleDoubleSkip {
+		return true, nil
+	}
+	if !macMetadataSupported || !u.onDisk() {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadAll(u.archive)
+	if err != nil {
+		return true, err
+	}
+	m, err := parseAppleDouble(data)
+	if err != nil {
+		u.warn(header.Name, err)
+		return true, nil
+	}
+	target := path.Join(path.Dir(name), strings.TrimPrefix(path.Base(name), AppleDoublePrefix))
+	u.macMetadata = append(u.macMetadata, pendingMetadata{name: target, entry: header.Name, metadata: m})
+	return true, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build darwin
+
+package tarhelper
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// macOS metadata is read and written on macOS.
+const macMetadataSupported = true
+
+// The extended attributes holding the macOS metadata.
+const (
+	xattrFinderInfo   = "com.apple.FinderInfo"
+	xattrResourceFork = "com.apple.ResourceFork"
+)
+
+// The option to getxattr and setxattr to not follow symlinks.
+const xattrNoFollow = 1
+
+// Returns the Finder info and resource fork of the named file, which are
+// empty if it doesn't have them.
+func readMacMetadata(name string) (macMetadata, error) {
+	var m macMetadata
+	var err error
+	if m.finderInfo, err = getxattr(name, xattrFinderInfo); err != nil {
+		return m, err
+	}
+	// a Finder info of zeros is the same as none at all
+	if allZero(m.finderInfo) {
+		m.finderInfo = nil
+	}
+	if m.resourceFork, err = getxattr(name, xattrResourceFork); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// Applies metadata read by readMacMetadata to the named file.
+func writeMacMetadata(name string, m macMetadata) error {
+	if len(m.finderInfo) > 0 {
+		if err := setxattr(name, xattrFinderInfo, m.finderInfo); err != nil {
+			return err
+		}
+	}
+	if len(m.resourceFork) > 0 {
+		if err := setxattr(name, xattrResourceFork, m.resourceFork); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether b holds only zeros.
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the value of the named extended attribute, or nothing if the file
+// doesn't have it.
+func getxattr(name, attr string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), 0, 0, 0, xattrNoFollow)
+	if errno == syscall.ENOATTR || errno == syscall.ENOTSUP || (errno == 0 && size == 0) {
+		return nil, nil
+	} else if errno != 0 {
+		return nil, errno
+	}
+	value := make([]byte, size)
+	size, _, errno = syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(unsafe.Pointer(&value[0])), size, 0, xattrNoFollow)
+	if errno != 0 {
+		return nil, errno
+	}
+	return value[:size], nil
+}
+
+// Sets the named extended attribute.
+func setxattr(name, attr string, value []byte) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, xattrNoFollow)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
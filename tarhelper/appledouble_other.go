@@ -0,0 +1,20 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !darwin
+
+package tarhelper
+
+import (
+	"fmt"
+)
+
+// macOS metadata is only supported on macOS.
+const macMetadataSupported = false
+
+func readMacMetadata(name string) (macMetadata, error) {
+	return macMetadata{}, nil
+}
+
+func writeMacMetadata(name string, m macMetadata) error {
+	return fmt.Errorf("macOS metadata is not supported on this platform")
+}
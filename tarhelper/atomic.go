@@ -0,0 +1,90 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Extracts into a new directory beside the target, which then takes the
+// place of the target once everything has been extracted, for Atomic.
+func (u *Untar) extractAtomic(ctx context.Context) error {
+	if !u.onDisk() {
+		return fmt.Errorf("atomic extraction can't be used with a TargetFS")
+	}
+	target := filepath.Clean(u.target)
+	parent, base := filepath.Dir(target), filepath.Base(target)
+
+	// the new directory starts with the permissions of the target, until the
+	// archive gives it its own
+	mode := os.FileMode(0755)
+	existing, err := os.Lstat(target)
+	if err == nil {
+		if !existing.IsDir() {
+			return fmt.Errorf("%s is not a directory", target)
+		}
+		mode = existing.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(parent, "."+base+".extract-")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// absolute symlinks followed within the target are followed within the
+	// new directory instead
+	absoluteRoot := u.AbsoluteRoot
+	if filepath.Clean(absoluteRoot) == target {
+		u.AbsoluteRoot = tmp
+	}
+	u.target = tmp
+	err = u.extract(ctx)
+	u.target, u.AbsoluteRoot = target, absoluteRoot
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return u.replaceDir(tmp, target, existing != nil)
+}
+
+// Moves the directory tmp into the place of target, first moving aside and
+// then removing the existing target if there is one. The target is put back
+// if tmp can't take its place.
+func (u *Untar) replaceDir(tmp, target string, exists bool) error {
+	if !exists {
+		if err := os.Rename(tmp, target); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		return nil
+	}
+
+	old := tmp + ".old"
+	if err := os.Rename(target, old); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to move %s aside: %v", target, err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		if rerr := os.Rename(old, target); rerr != nil {
+			return fmt.Errorf("failed to replace %s: %v, and to restore it from %s: %v", target, err, old, rerr)
+		}
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to replace %s: %v", target, err)
+	}
+	if err := os.RemoveAll(old); err != nil {
+		u.warn(old, fmt.Errorf("failed to remove the replaced directory: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"io"
+	"sync"
+)
+
+// The size of the buffers used to copy content when no size is set, the same
+// as io.Copy uses.
+const defaultBufferSize = 32 * 1024
+
+// Pools of copy buffers by their size, so that copying the content of many
+// small files doesn't allocate a new buffer for each one.
+var bufferPools sync.Map
+
+// Returns the pool of buffers of the given size.
+func bufferPool(size int) *sync.Pool {
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// Copies from src to dst like io.Copy, using a pooled buffer of the given
+// size, or the default size if it is zero.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	pool := bufferPool(size)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+
+	// hide any ReadFrom and WriteTo methods, which would otherwise be used
+	// in place of the buffer and fall back to allocating one of their own
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Changeset is how the regular files in a directory differ from the
+// manifest of an earlier archive of it. Each list holds the names of files
+// as they are in the manifest, sorted.
+type Changeset struct {
+	// Files in the directory that aren't in the manifest.
+	Added []string
+
+	// Files in both whose content differs.
+	Modified []string
+
+	// Files in the manifest that are no longer in the directory.
+	Deleted []string
+}
+
+// ReadManifest reads a manifest written to an archive with ManifestName, or
+// any other in the format of "sha256sum", with a digest, two spaces and a
+// name on each line. The entries read have no Size.
+func ReadManifest(r io.Reader) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		// sha256sum marks files read in binary mode with a "*"
+		i := strings.Index(text, " ")
+		if i < 0 || i+1 >= len(text) || (text[i+1] != ' ' && text[i+1] != '*') {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", line, text)
+		}
+		digest, name := text[:i], text[i+2:]
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid manifest line %d: %q is not a SHA-256 digest", line, digest)
+		}
+		entries = append(entries, ManifestEntry{Name: name, SHA256: digest})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return entries, nil
+}
+
+// ManifestChanges compares the regular files in dir with the manifest of an
+// earlier archive of it, such as from Tar.Manifest or ReadManifest, by the
+// SHA-256 digest of their content, and returns what has been added,
+// modified and deleted since. An archive of just those changes can be
+// written by setting the manifest as the ManifestBase of a Tar.
+func ManifestChanges(manifest []ManifestEntry, dir string) (*Changeset, error) {
+	t := NewTar(ioutil.Discard, dir)
+	t.ComputeManifest = true
+	t.MetadataOnly = true
+	if err := t.Archive(); err != nil {
+		return nil, err
+	}
+
+	base := manifestDigests(manifest)
+	current := manifestDigests(t.Manifest())
+	c := &Changeset{}
+	for name, digest := range current {
+		if prev, ok := base[name]; !ok {
+			c.Added = append(c.Added, name)
+		} else if prev != digest {
+			c.Modified = append(c.Modified, name)
+		}
+	}
+	for name := range base {
+		if _, ok := current[name]; !ok {
+			c.Deleted = append(c.Deleted, name)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Modified)
+	sort.Strings(c.Deleted)
+	return c, nil
+}
+
+// Returns the digests of the entries of a manifest by their cleaned names.
+func manifestDigests(manifest []ManifestEntry) map[string]string {
+	digests := make(map[string]string, len(manifest))
+	for _, e := range manifest {
+		digests[path.Clean(e.Name)] = e.SHA256
+	}
+	return digests
+}
+
+// Reports whether the named regular file, whose entry is named entryName,
+// has the same content as in the ManifestBase, and so can be left out. The
+// file is recorded as found either way, so it isn't taken to be deleted.
+func (t *Tar) unchangedInManifest(name, entryName string) (bool, error) {
+	if t.ManifestBase == nil {
+		return false, nil
+	}
+	if t.baseDigests == nil {
+		t.baseDigests = manifestDigests(t.ManifestBase)
+		t.baseFound = make(map[string]bool)
+	}
+	entryName = path.Clean(entryName)
+	t.baseFound[entryName] = true
+	digest, ok := t.baseDigests[entryName]
+	if !ok {
+		return false, nil
+	}
+
+	r, err := t.openContent(name)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := copyBuffer(h, r, t.BufferSize); err != nil {
+		return false, err
+	}
+	return strings.EqualFold(hex.EncodeToString(h.Sum(nil)), digest), nil
+}
+
+// Writes whiteout entries for the files in the ManifestBase that weren't
+// found in the target.
+func (t *Tar) writeManifestDeletions() error {
+	if t.ManifestBase == nil || t.Files != nil {
+		return nil
+	}
+	if t.baseDigests == nil {
+		t.baseDigests = manifestDigests(t.ManifestBase)
+	}
+
+	var deleted []string
+	for name := range t.baseDigests {
+		if !t.baseFound[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+
+	// the names in the manifest include the VirtualPath, which the
+	// whiteouts are given again
+	prefix := path.Clean(filepath.ToSlash(t.VirtualPath)) + "/"
+	for _, name := range deleted {
+		if t.VirtualPath != "" {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			name = strings.TrimPrefix(name, prefix)
+		}
+		if err := t.writeWhiteout(path.Dir(name), WhiteoutPrefix+path.Base(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// Checkpoint marks the point in an archive being written where an entry has
+// been written in full, from which writing the archive can be resumed.
+type Checkpoint struct {
+	// The name of the last entry written in full.
+	Entry string
+
+	// The number of bytes of the archive written up to the end of the entry.
+	Offset int64
+}
+
+// offsetWriter counts the bytes written through it, starting from an offset.
+type offsetWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.Write(b)
+	o.offset += int64(n)
+	return n, err
+}
+
+// Reports whether checkpoints are being made or resumed from.
+func (t *Tar) checkpointing() bool {
+	return t.CheckpointFunc != nil || t.ResumeFrom != nil
+}
+
+// Sets up checkpoints for the archive about to be written to output,
+// returning the writer for the archive to write to.
+func (t *Tar) startCheckpoints(output io.Writer) (io.Writer, error) {
+	if !t.checkpointing() {
+		return output, nil
+	}
+	if t.Compression != NONE {
+		return nil, fmt.Errorf("checkpoints need an uncompressed archive, not %v", t.Compression)
+	}
+	if t.EncryptionKey != nil || t.Recipients != nil {
+		return nil, fmt.Errorf("checkpoints can't be used with an encrypted archive")
+	}
+	t.offset = &offsetWriter{w: output}
+	t.lastEntry = ""
+	t.resumeAfter = ""
+	if t.ResumeFrom != nil {
+		t.offset.offset = t.ResumeFrom.Offset
+		t.resumeAfter = t.ResumeFrom.Entry
+	}
+	return t.offset, nil
+}
+
+// Reports whether the entry with the given header was already written before
+// the checkpoint being resumed from, and so should be left out.
+func (t *Tar) resumed(header *tar.Header) bool {
+	if t.resumeAfter == "" || t.estimate != nil {
+		return false
+	}
+	if header.Name == t.resumeAfter {
+		t.resumeAfter = ""
+	}
+	return true
+}
+
+// Passes a checkpoint for the last entry written to the CheckpointFunc, once
+// the entry is complete.
+func (t *Tar) checkpoint() error {
+	if t.CheckpointFunc == nil || t.lastEntry == "" || t.estimate != nil {
+		return nil
+	}
+	if err := t.archive.Flush(); err != nil {
+		return err
+	}
+	t.CheckpointFunc(Checkpoint{Entry: t.lastEntry, Offset: t.offset.offset})
+	t.lastEntry = ""
+	return nil
+}
+
+// Makes the checkpoint for the last entry in the archive, and checks that
+// the checkpoint being resumed from was found.
+func (t *Tar) finishCheckpoints() error {
+	if !t.checkpointing() {
+		return nil
+	}
+	if t.resumeAfter != "" {
+		return fmt.Errorf("the entry %q to resume after was not found", t.resumeAfter)
+	}
+	return t.checkpoint()
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// CommandCompressor is a Compressor that pipes the archive through an
+// external command, such as pigz or "zstd -T0", for more throughput than
+// the built in compressors give. The command reads the archive on its stdin
+// and writes the compressed stream to its stdout. It has to be in the PATH
+// unless Name is a path, and exiting with an error, which includes what it
+// wrote to its stderr, fails the archive. For example, to have pigz write
+// gzip archives:
+//
+//	tarhelper.AddCompressor("gzip", &tarhelper.CommandCompressor{Name: "pigz", Args: []string{"-c"}})
+type CommandCompressor struct {
+	// The name of the command and its arguments.
+	Name string
+	Args []string
+}
+
+func (c *CommandCompressor) NewWriter(dest io.Writer) (io.WriteCloser, error) {
+	return newCommandWriter(dest, c.Name, c.Args...)
+}
+
+// CommandDecompressor is a Decompressor that pipes the archive through an
+// external command, which reads the compressed stream on its stdin and writes
+// the archive to its stdout. Streams are detected by their Magic number, and
+// can't be detected without one. Exiting with an error fails the extraction,
+// while stopping early kills the command. For example, to have pigz read gzip
+// archives:
+//
+//	tarhelper.AddDecompressor("gzip", &tarhelper.CommandDecompressor{
+//		Name: "pigz", Args: []string{"-dc"}, Magic: []byte{0x1f, 0x8b},
+//	})
+type CommandDecompressor struct {
+	// The name of the command and its arguments.
+	Name string
+	Args []string
+
+	// The bytes that streams compressed this way start with.
+	Magic []byte
+}
+
+func (c *CommandDecompressor) Detect(br *bufio.Reader) bool {
+	if len(c.Magic) == 0 {
+		return false
+	}
+	data, err := br.Peek(len(c.Magic))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data, c.Magic)
+}
+
+func (c *CommandDecompressor) NewReader(src io.Reader) (io.Reader, error) {
+	return newCommandReader(src, c.Name, c.Args...)
+}
+
+// commandProcess is an external command that a stream is piped through,
+// capturing its stderr to report if it fails.
+type commandProcess struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+
+	// Set once the command has been waited on, along with the result.
+	waited  bool
+	waitErr error
+}
+
+// Waits for the command to exit, including its stderr in any error.
+func (p *commandProcess) wait() error {
+	if p.waited {
+		return p.waitErr
+	}
+	p.waited = true
+	if err := p.cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(p.stderr.String())
+		if msg == "" {
+			p.waitErr = fmt.Errorf("%s failed: %v", p.cmd.Path, err)
+		} else {
+			p.waitErr = fmt.Errorf("%s failed: %v: %s", p.cmd.Path, err, msg)
+		}
+	}
+	return p.waitErr
+}
+
+// commandWriter pipes everything written to it through an external command,
+// with the command's output going to the destination writer.
+type commandWriter struct {
+	commandProcess
+	stdin io.WriteCloser
+}
+
+// Starts the named command and returns a writer that feeds its stdin.
+func newCommandWriter(dest io.Writer, name string, args ...string) (*commandWriter, error) {
+	w := &commandWriter{}
+	w.cmd = exec.Command(name, args...)
+	w.cmd.Stdout = dest
+	w.cmd.Stderr = &w.stderr
+
+	var err error
+	if w.stdin, err = w.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := w.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", name, err)
+	}
+	return w, nil
+}
+
+func (w *commandWriter) Write(p []byte) (int, error) {
+	n, err := w.stdin.Write(p)
+	if err != nil {
+		// The command most likely exited, so report why.
+		w.stdin.Close()
+		return n, w.wait()
+	}
+	return n, nil
+}
+
+// Close signals the end of the input and waits for the command to exit.
+func (w *commandWriter) Close() error {
+	w.stdin.Close()
+	return w.wait()
+}
+
+// commandReader reads the output of an external command that the source
+// reader is piped through.
+type commandReader struct {
+	commandProcess
+	stdout io.ReadCloser
+}
+
+// Starts the named command and returns a reader of its stdout.
+func newCommandReader(src io.Reader, name string, args ...string) (*commandReader, error) {
+	r := &commandReader{}
+	r.cmd = exec.Command(name, args...)
+	r.cmd.Stdin = src
+	r.cmd.Stderr = &r.stderr
+
+	var err error
+	if r.stdout, err = r.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := r.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", name, err)
+	}
+	return r, nil
+}
+
+// Read reads the command's output, returning its error if it failed once the
+// output ends.
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF {
+		if err := r.wait(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Close stops the command if it is still running, such as when extraction
+// stops before the end of the archive, and waits for it to exit.
+func (r *commandReader) Close() error {
+	if r.waited {
+		return nil
+	}
+	r.cmd.Process.Kill()
+	r.wait()
+	return nil
+}
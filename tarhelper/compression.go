@@ -1,4 +1,4 @@
-// Copyright 2014 Apcera Inc. All rights reserved.
+// Copyright 2014-2015 Apcera Inc. All rights reserved.
 
 package tarhelper
 
@@ -7,26 +7,104 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"fmt"
 	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/apcera/util/tarhelper/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+	"github.com/apcera/util/tarhelper/Godeps/_workspace/src/github.com/klauspost/pgzip"
+	"github.com/apcera/util/tarhelper/Godeps/_workspace/src/github.com/ulikunitz/xz"
 )
 
-var decompressorTypes map[string]Decompressor
+// The registered compressors and decompressors, along with the names of the
+// decompressors in the order they were added, which is the order
+// DetectCompression tries them in.
+var (
+	compressionMu     sync.RWMutex
+	decompressorTypes map[string]Decompressor
+	decompressorOrder []string
+	compressorTypes   map[string]Compressor
+)
 
+// AddDecompressor registers a Decompressor that will be used when extracting
+// with a Compression matching name, and by DetectCompression, which tries
+// them in the order they were added. Adding one for a name that already has
+// one replaces it, so the built in decompressors can be replaced as well.
 func AddDecompressor(name string, comp Decompressor) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	if _, exists := decompressorTypes[name]; !exists {
+		decompressorOrder = append(decompressorOrder, name)
+	}
 	decompressorTypes[name] = comp
 }
 
+// AddCompressor registers a Compressor that will be used when archiving with
+// a Compression matching name, replacing any already registered for it.
+func AddCompressor(name string, comp Compressor) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	compressorTypes[name] = comp
+}
+
+// Returns the Decompressor registered for the compression type.
+func lookupDecompressor(c Compression) (Decompressor, bool) {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	comp, exists := decompressorTypes[string(c)]
+	return comp, exists
+}
+
+// Returns the Compressor registered for the compression type.
+func lookupCompressor(c Compression) (Compressor, bool) {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	comp, exists := compressorTypes[string(c)]
+	return comp, exists
+}
+
 func init() {
 	decompressorTypes = map[string]Decompressor{}
 	AddDecompressor("gzip", &GzipDecompressor{})
 	AddDecompressor("bzip2", &Bzip2Decompressor{})
+	AddDecompressor("xz", &XZDecompressor{})
+	AddDecompressor("zstd", &ZstdDecompressor{})
+
+	compressorTypes = map[string]Compressor{}
+	AddCompressor("gzip", &GzipCompressor{})
+	AddCompressor("bzip2", &Bzip2Compressor{})
+	AddCompressor("xz", &XZCompressor{})
+	AddCompressor("zstd", &ZstdCompressor{})
 }
 
+// Decompressor reads archives compressed in a particular way, for the
+// Compression it is registered for with AddDecompressor. Detect reports
+// whether the stream is compressed this way from the bytes it can peek at
+// the start of it, without consuming them, and can always report false for
+// compression that can't be recognized. NewReader wraps the source in a
+// reader that decompresses it, which is closed once extraction is complete
+// if it is an io.Closer.
 type Decompressor interface {
 	Detect(*bufio.Reader) bool
 	NewReader(io.Reader) (io.Reader, error)
 }
 
+// Compressor is the archiving counterpart to Decompressor. NewWriter wraps the
+// destination in a writer that compresses everything written to it. The
+// returned writer will be closed once the archive has been written and must
+// flush any remaining data to the destination when it is.
+type Compressor interface {
+	NewWriter(io.Writer) (io.WriteCloser, error)
+}
+
+// LevelCompressor can optionally be implemented by a Compressor that supports
+// more than one compression level. It is used when Tar.CompressionLevel is
+// set.
+type LevelCompressor interface {
+	NewWriterLevel(io.Writer, int) (io.WriteCloser, error)
+}
+
 type GzipDecompressor struct{}
 
 func (c *GzipDecompressor) Detect(br *bufio.Reader) bool {
@@ -41,16 +119,120 @@ func (c *GzipDecompressor) NewReader(src io.Reader) (io.Reader, error) {
 	return gzip.NewReader(src)
 }
 
+type GzipCompressor struct{}
+
+func (c *GzipCompressor) NewWriter(dest io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(dest), nil
+}
+
+func (c *GzipCompressor) NewWriterLevel(dest io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(dest, level)
+}
+
+// ParallelGzipCompressor produces a standard gzip stream but compresses blocks
+// of the input concurrently, which is considerably faster on multi-core
+// machines at the cost of some memory and a slightly larger output. It is
+// used in place of GzipCompressor when Tar.ParallelGzip is set.
+type ParallelGzipCompressor struct{}
+
+func (c *ParallelGzipCompressor) NewWriter(dest io.Writer) (io.WriteCloser, error) {
+	return pgzip.NewWriter(dest), nil
+}
+
+func (c *ParallelGzipCompressor) NewWriterLevel(dest io.Writer, level int) (io.WriteCloser, error) {
+	return pgzip.NewWriterLevel(dest, level)
+}
+
 type Bzip2Decompressor struct{}
 
 func (c *Bzip2Decompressor) Detect(br *bufio.Reader) bool {
-	data, err := br.Peek(2)
+	// "BZh" followed by the block size, which is '1' through '9'.
+	data, err := br.Peek(4)
 	if err != nil {
 		return false
 	}
-	return bytes.Equal(data, []byte{0x42, 0x5a})
+	return bytes.Equal(data[:3], []byte("BZh")) && data[3] >= '1' && data[3] <= '9'
 }
 
 func (c *Bzip2Decompressor) NewReader(src io.Reader) (io.Reader, error) {
 	return bzip2.NewReader(src), nil
 }
+
+// Bzip2Compressor compresses using the bzip2 binary since the standard library
+// only implements bzip2 decompression, unlike the other built in codecs which
+// are pure Go. The binary is required to write bzip2 archives, which fails
+// before anything is written when it isn't in the PATH. Reading them doesn't
+// need it.
+type Bzip2Compressor struct{}
+
+func (c *Bzip2Compressor) NewWriter(dest io.Writer) (io.WriteCloser, error) {
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		return nil, fmt.Errorf("bzip2 compression needs the bzip2 command: %v", err)
+	}
+	return newCommandWriter(dest, "bzip2", "-c")
+}
+
+type XZDecompressor struct{}
+
+func (c *XZDecompressor) Detect(br *bufio.Reader) bool {
+	data, err := br.Peek(6)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00})
+}
+
+func (c *XZDecompressor) NewReader(src io.Reader) (io.Reader, error) {
+	return xz.NewReader(src)
+}
+
+type XZCompressor struct{}
+
+func (c *XZCompressor) NewWriter(dest io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(dest)
+}
+
+type ZstdDecompressor struct{}
+
+func (c *ZstdDecompressor) Detect(br *bufio.Reader) bool {
+	data, err := br.Peek(4)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data, []byte{0x28, 0xB5, 0x2F, 0xFD})
+}
+
+func (c *ZstdDecompressor) NewReader(src io.Reader) (io.Reader, error) {
+	d, err := zstd.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{d}, nil
+}
+
+// zstdReader adapts the zstd decoder to io.ReadCloser so that the goroutines
+// it starts are stopped once extraction completes.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r *zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// ZstdCompressor compresses archives with Zstandard. Levels passed to
+// NewWriterLevel use the zstd command line scale of 1 to 22 and are mapped to
+// the closest level supported by the encoder.
+type ZstdCompressor struct{}
+
+func (c *ZstdCompressor) NewWriter(dest io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(dest)
+}
+
+func (c *ZstdCompressor) NewWriterLevel(dest io.Writer, level int) (io.WriteCloser, error) {
+	if level < 1 || level > 22 {
+		return nil, fmt.Errorf("invalid zstd compression level: %d", level)
+	}
+	return zstd.NewWriter(dest, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+}
@@ -0,0 +1,376 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The magic numbers of newc cpio archives, without and with checksums.
+const (
+	cpioMagic      = "070701"
+	cpioMagicCRC   = "070702"
+	cpioTrailer    = "TRAILER!!!"
+	cpioHeaderSize = 110
+)
+
+// The file type bits of the mode of cpio entries.
+const (
+	cpioTypeMask    = 0170000
+	cpioTypeSymlink = 0120000
+	cpioTypeReg     = 0100000
+	cpioTypeBlock   = 060000
+	cpioTypeDir     = 040000
+	cpioTypeChar    = 020000
+	cpioTypeFifo    = 010000
+)
+
+// archiveWriter writes the entries of an archive, as a *tar.Writer does.
+type archiveWriter interface {
+	io.Writer
+	WriteHeader(header *tar.Header) error
+	Flush() error
+	Close() error
+}
+
+// archiveReader reads the entries of an archive, as a *tar.Reader does.
+type archiveReader interface {
+	io.Reader
+	Next() (*tar.Header, error)
+}
+
+// Returns the writer for the archive written to w, which is a CpioWriter for
+// Cpio and a *tar.Writer otherwise.
+func (t *Tar) newArchiveWriter(w io.Writer) archiveWriter {
+	if t.Cpio {
+		return NewCpioWriter(w)
+	}
+	return tar.NewWriter(w)
+}
+
+// Returns the number of bytes of padding needed after n bytes to reach the
+// 4 byte alignment of cpio archives.
+func cpioPad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// CpioWriter writes archives in the newc cpio format, as used for Linux
+// initramfs images, from tar headers, like a *tar.Writer. It is used in place
+// of a *tar.Writer by Tar.Cpio. Hard links can't be written, as newc archives
+// can only record them by holding the content with the last of the links.
+type CpioWriter struct {
+	w         io.Writer
+	ino       uint32
+	remaining int64
+	pad       int64
+	closed    bool
+}
+
+// NewCpioWriter returns a CpioWriter writing to w.
+func NewCpioWriter(w io.Writer) *CpioWriter {
+	return &CpioWriter{w: w}
+}
+
+// WriteHeader writes the entry for header, after finishing the previous one.
+// The content of regular files is then written with Write, while the target
+// of a symlink is written along with the header.
+func (c *CpioWriter) WriteHeader(header *tar.Header) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	var mode int64
+	var size int64
+	var nlink int64 = 1
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		mode, size = cpioTypeReg, header.Size
+	case tar.TypeDir:
+		mode, nlink = cpioTypeDir, 2
+	case tar.TypeSymlink:
+		mode, size = cpioTypeSymlink, int64(len(header.Linkname))
+	case tar.TypeChar:
+		mode = cpioTypeChar
+	case tar.TypeBlock:
+		mode = cpioTypeBlock
+	case tar.TypeFifo:
+		mode = cpioTypeFifo
+	case tar.TypeLink:
+		return fmt.Errorf("%s: cpio archives can't hold hard links", header.Name)
+	default:
+		return fmt.Errorf("%s: cpio archives can't hold entries of type %q", header.Name, header.Typeflag)
+	}
+	mode |= header.Mode & 07777
+
+	if size > 0xffffffff {
+		return fmt.Errorf("%s: %d bytes is too large for a cpio archive", header.Name, size)
+	}
+	if header.Uid < 0 || int64(header.Uid) > 0xffffffff || header.Gid < 0 || int64(header.Gid) > 0xffffffff {
+		return fmt.Errorf("%s: owner %d:%d can't be stored in a cpio archive", header.Name, header.Uid, header.Gid)
+	}
+	// times before the epoch are stored as the epoch
+	mtime := header.ModTime.Unix()
+	if mtime < 0 {
+		mtime = 0
+	} else if mtime > 0xffffffff {
+		return fmt.Errorf("%s: modification time %v can't be stored in a cpio archive", header.Name, header.ModTime)
+	}
+
+	name := cpioName(header.Name)
+	c.ino++
+	if err := c.writeHeader(name, []int64{
+		int64(c.ino), mode, int64(header.Uid), int64(header.Gid), nlink, mtime, size,
+		0, 0, header.Devmajor, header.Devminor,
+	}); err != nil {
+		return err
+	}
+
+	c.remaining, c.pad = size, cpioPad(size)
+	if header.Typeflag == tar.TypeSymlink {
+		if _, err := io.WriteString(c, header.Linkname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the name of a tar entry as it is written to a cpio archive, without
+// the trailing slash of directories.
+func cpioName(name string) string {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// Writes the header of an entry with the given name and fields, which are
+// those of a newc header following the magic number, up to the name size.
+func (c *CpioWriter) writeHeader(name string, fields []int64) error {
+	var buf bytes.Buffer
+	buf.WriteString(cpioMagic)
+	for _, f := range fields {
+		fmt.Fprintf(&buf, "%08x", f)
+	}
+	fmt.Fprintf(&buf, "%08x%08x", len(name)+1, 0)
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	buf.Write(make([]byte, cpioPad(int64(buf.Len()))))
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
+
+// Write writes to the content of the current entry, returning an error if
+// more is written than the size in its header.
+func (c *CpioWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > c.remaining {
+		n, err := c.Write(b[:c.remaining])
+		if err != nil {
+			return n, err
+		}
+		return n, tar.ErrWriteTooLong
+	}
+	n, err := c.w.Write(b)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// Flush finishes the current entry, returning an error if less was written
+// than the size in its header.
+func (c *CpioWriter) Flush() error {
+	if c.remaining > 0 {
+		return fmt.Errorf("missing %d bytes of the cpio entry", c.remaining)
+	}
+	if c.pad > 0 {
+		if _, err := c.w.Write(make([]byte, c.pad)); err != nil {
+			return err
+		}
+		c.pad = 0
+	}
+	return nil
+}
+
+// Close finishes the current entry and writes the trailer that ends the
+// archive. It doesn't close the underlying writer.
+func (c *CpioWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return c.writeHeader(cpioTrailer, []int64{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+}
+
+// CpioReader reads archives in the newc cpio format, with or without
+// checksums, giving a tar header for each entry, like a *tar.Reader. It is
+// used by Untar for archives it detects as cpio. Entries sharing an inode
+// with an earlier regular file and without content of their own are given
+// as hard links to it.
+type CpioReader struct {
+	r         io.Reader
+	remaining int64
+	pad       int64
+	links     map[[3]int64]string
+	done      bool
+}
+
+// NewCpioReader returns a CpioReader reading from r.
+func NewCpioReader(r io.Reader) *CpioReader {
+	return &CpioReader{r: r, links: make(map[[3]int64]string)}
+}
+
+// Next moves on to the next entry, returning io.EOF at the end of the
+// archive.
+func (c *CpioReader) Next() (*tar.Header, error) {
+	if c.done {
+		return nil, io.EOF
+	}
+	if _, err := io.CopyN(ioutil.Discard, c.r, c.remaining+c.pad); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	c.remaining, c.pad = 0, 0
+
+	raw := make([]byte, cpioHeaderSize)
+	if _, err := io.ReadFull(c.r, raw); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	magic := string(raw[:6])
+	if magic != cpioMagic && magic != cpioMagicCRC {
+		return nil, errors.New("not a newc cpio archive")
+	}
+	var fields [13]int64
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[6+i*8:14+i*8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header: %v", err)
+		}
+		fields[i] = int64(v)
+	}
+	ino, mode, uid, gid, nlink, mtime, size := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+	devmajor, devminor, rdevmajor, rdevminor, namesize := fields[7], fields[8], fields[9], fields[10], fields[11]
+
+	rawName := make([]byte, namesize+cpioPad(cpioHeaderSize+namesize))
+	if _, err := io.ReadFull(c.r, rawName); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	name := string(bytes.TrimRight(rawName[:namesize], "\x00"))
+	if name == cpioTrailer {
+		c.done = true
+		return nil, io.EOF
+	}
+	c.remaining, c.pad = size, cpioPad(size)
+
+	header := &tar.Header{
+		Name:     name,
+		Mode:     mode & 07777,
+		Uid:      int(uid),
+		Gid:      int(gid),
+		ModTime:  time.Unix(mtime, 0),
+		Devmajor: rdevmajor,
+		Devminor: rdevminor,
+	}
+	switch mode & cpioTypeMask {
+	case cpioTypeReg:
+		header.Typeflag = tar.TypeReg
+		header.Size = size
+		key := [3]int64{devmajor, devminor, ino}
+		if nlink > 1 {
+			if link, ok := c.links[key]; ok && size == 0 {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = link
+			} else if !ok {
+				c.links[key] = name
+			}
+		}
+	case cpioTypeDir:
+		header.Typeflag = tar.TypeDir
+		if !strings.HasSuffix(name, "/") {
+			header.Name += "/"
+		}
+	case cpioTypeSymlink:
+		target := make([]byte, size)
+		if _, err := io.ReadFull(c, target); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+	case cpioTypeChar:
+		header.Typeflag = tar.TypeChar
+	case cpioTypeBlock:
+		header.Typeflag = tar.TypeBlock
+	case cpioTypeFifo:
+		header.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("%s: unsupported cpio file type %o", name, mode&cpioTypeMask)
+	}
+	return header, nil
+}
+
+// Read reads from the content of the current entry.
+func (c *CpioReader) Read(b []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Returns io.ErrUnexpectedEOF for an archive that ended part way through.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Returns a reader for the archive read from r, which is a CpioReader for
+// newc cpio archives and a *tar.Reader otherwise.
+func newArchiveReader(r io.Reader) (archiveReader, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		// peek without buffering, so that the tar reader can still seek
+		// past the content of entries
+		magic := make([]byte, len(cpioMagic))
+		n, err := io.ReadFull(rs, magic)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		if _, err := rs.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		if isCpioMagic(magic[:n]) {
+			return NewCpioReader(rs), nil
+		}
+		return tar.NewReader(rs), nil
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(cpioMagic))
+	if isCpioMagic(magic) {
+		return NewCpioReader(br), nil
+	}
+	return tar.NewReader(br), nil
+}
+
+// Reports whether b starts with the magic number of a newc cpio archive.
+func isCpioMagic(b []byte) bool {
+	s := string(b)
+	return s == cpioMagic || s == cpioMagicCRC
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+)
+
+// dedupKey groups the files that could be linked to each other by
+// DeduplicateContent, which need the same size, permissions and owner.
+type dedupKey struct {
+	size     int64
+	mode     int64
+	uid, gid int
+}
+
+// dedupFile is a file that has been written to the archive, which later
+// files with the same content are linked to.
+type dedupFile struct {
+	// The name of the file's entry.
+	name string
+
+	// The SHA-256 digest of the content that was written.
+	digest []byte
+}
+
+// Returns the key for the file with the given header.
+func newDedupKey(header *tar.Header) dedupKey {
+	return dedupKey{size: header.Size, mode: header.Mode, uid: header.Uid, gid: header.Gid}
+}
+
+// Returns the name of an entry already written with the same content as the
+// named file, and the same key, or "" if there isn't one. The file is only
+// read when there are entries that it could be the same as.
+func (t *Tar) findDuplicate(key dedupKey, name string) (string, error) {
+	candidates := t.duplicates[key]
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	r, err := t.openContent(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := copyBuffer(h, r, t.BufferSize); err != nil {
+		return "", err
+	}
+
+	digest := h.Sum(nil)
+	for _, c := range candidates {
+		if bytes.Equal(c.digest, digest) {
+			return c.name, nil
+		}
+	}
+	return "", nil
+}
+
+// Records a file written to the archive as the entry name, with the digest
+// of its content, for later files to be linked to.
+func (t *Tar) addDuplicate(key dedupKey, name string, digest []byte) {
+	if t.duplicates == nil {
+		t.duplicates = make(map[dedupKey][]dedupFile)
+	}
+	t.duplicates[key] = append(t.duplicates[key], dedupFile{name: name, digest: digest})
+}
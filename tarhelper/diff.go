@@ -0,0 +1,174 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"sort"
+)
+
+// ChangeKind is the way an entry differs between two archives.
+type ChangeKind int
+
+const (
+	// EntryAdded is an entry only in the second archive.
+	EntryAdded ChangeKind = iota
+
+	// EntryRemoved is an entry only in the first archive.
+	EntryRemoved
+
+	// EntryModified is an entry in both archives that differs.
+	EntryModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case EntryAdded:
+		return "added"
+	case EntryRemoved:
+		return "removed"
+	case EntryModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// Change is an entry that differs between two archives.
+type Change struct {
+	// The name of the entry, cleaned so that "./a/" is "a".
+	Name string
+
+	Kind ChangeKind
+
+	// For modified entries, the attributes that differ, of "type", "size",
+	// "mode", "owner", "link target" and "content".
+	Differences []string
+}
+
+// Diff compares the archives read from a and b, which may be compressed with
+// any of the supported compression types, and returns the entries that were
+// added, removed or modified going from a to b, sorted by name. Entries are
+// compared by type, size, mode, owner, link target and the SHA-256 digest of
+// their content. Modification times are not compared, since they differ
+// between otherwise identical builds.
+func Diff(a, b io.Reader) ([]Change, error) {
+	before, err := summarizeArchive(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := summarizeArchive(b)
+	if err != nil {
+		return nil, err
+	}
+	return diffSummaries(before, after), nil
+}
+
+// DiffDir compares the archive read from r with the directory dir, as if dir
+// were archived with its owners recorded, and returns the entries that were
+// added, removed or modified going from the archive to the directory, as
+// with Diff.
+func DiffDir(r io.Reader, dir string) ([]Change, error) {
+	before, err := summarizeArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := NewTar(pw, dir)
+		tw.IncludeOwners = true
+		pw.CloseWithError(tw.Archive())
+	}()
+	after, err := summarizeArchive(pr)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	return diffSummaries(before, after), nil
+}
+
+// entrySummary is what is compared of an entry.
+type entrySummary struct {
+	header *tar.Header
+	digest string
+}
+
+// Reads the archive from r and summarizes each entry by its cleaned name.
+func summarizeArchive(r io.Reader) (map[string]entrySummary, error) {
+	archive, err := DetectArchiveCompression(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]entrySummary)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := entrySummary{header: header}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			h := sha256.New()
+			if _, err := io.Copy(h, archive); err != nil {
+				return nil, err
+			}
+			s.digest = hex.EncodeToString(h.Sum(nil))
+		}
+		entries[path.Clean(header.Name)] = s
+	}
+}
+
+// Compares two sets of summarized entries.
+func diffSummaries(before, after map[string]entrySummary) []Change {
+	var changes []Change
+	for name, a := range before {
+		b, ok := after[name]
+		if !ok {
+			changes = append(changes, Change{Name: name, Kind: EntryRemoved})
+			continue
+		}
+		if diffs := compareEntries(a, b); diffs != nil {
+			changes = append(changes, Change{Name: name, Kind: EntryModified, Differences: diffs})
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			changes = append(changes, Change{Name: name, Kind: EntryAdded})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// Returns the attributes that differ between two entries.
+func compareEntries(a, b entrySummary) []string {
+	var diffs []string
+	if a.header.Typeflag != b.header.Typeflag {
+		diffs = append(diffs, "type")
+	}
+	if a.header.Size != b.header.Size {
+		diffs = append(diffs, "size")
+	}
+	if a.header.Mode&07777 != b.header.Mode&07777 {
+		diffs = append(diffs, "mode")
+	}
+	if a.header.Uid != b.header.Uid || a.header.Gid != b.header.Gid {
+		diffs = append(diffs, "owner")
+	}
+	if a.header.Linkname != b.header.Linkname {
+		diffs = append(diffs, "link target")
+	}
+	if a.digest != b.digest {
+		diffs = append(diffs, "content")
+	}
+	return diffs
+}
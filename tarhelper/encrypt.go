@@ -0,0 +1,216 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted streams start with this magic number, followed by the random
+// prefix of the nonces used for each chunk.
+var encryptMagic = []byte("TARHAES1")
+
+const (
+	// The size of the plaintext of each chunk, other than the last which may
+	// be smaller.
+	encryptChunkSize = 64 * 1024
+
+	// The size of the random nonce prefix. Each nonce is the prefix, the
+	// chunk's number as a big endian uint32 and a byte that is 1 for the last
+	// chunk and 0 otherwise, so chunks can't be reordered or dropped, and the
+	// stream can't be truncated.
+	encryptPrefixSize = 7
+)
+
+// errDecrypt is returned for encrypted streams that can't be decrypted,
+// whether from the wrong key or tampering.
+var errDecrypt = errors.New("failed to decrypt the archive, the key is wrong or it has been modified")
+
+// Returns the AES-GCM AEAD for a 32 byte key.
+func newEncryptAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption keys need to be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce for the chunk numbered n.
+func chunkNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 0, encryptPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, n)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptWriter encrypts what is written to it in chunks with AES-GCM.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+	closed bool
+}
+
+// NewEncryptWriter returns a writer that encrypts what is written to it with
+// AES-256-GCM using the 32 byte key, writing the result to w, as is done for
+// Tar.EncryptionKey. The data is encrypted in chunks so that it can be
+// streamed. The writer has to be closed to write the last chunk, which
+// doesn't close w.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newEncryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte(nil), encryptMagic...), prefix...)); err != nil {
+		return nil, err
+	}
+	return newEncryptWriter(w, aead, prefix), nil
+}
+
+// Returns a writer encrypting chunks with the AEAD and nonce prefix, once
+// the header of the stream has been written.
+func newEncryptWriter(w io.Writer, aead cipher.AEAD, prefix []byte) *encryptWriter {
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptChunkSize),
+	}
+}
+
+func (e *encryptWriter) Write(b []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to a closed encrypted stream")
+	}
+	var written int
+	for len(b) > 0 {
+		// a full chunk is only written once more follows it, as the last
+		// chunk is sealed differently
+		if len(e.buf) == encryptChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptChunkSize], b)
+		e.buf = e.buf[:len(e.buf)+n]
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close writes the last chunk.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// Encrypts and writes the buffered chunk.
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.n, last), e.buf, nil)
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts a stream written by an encryptWriter.
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	chunk  []byte
+	plain  []byte
+	done   bool
+}
+
+// NewDecryptReader returns a reader that decrypts what was written by a
+// writer from NewEncryptWriter, such as an archive written with
+// Tar.EncryptionKey, reading it from r. Reading fails if the key is wrong or
+// the stream has been modified or truncated.
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newEncryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptMagic)+encryptPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read the encryption header: %v", err)
+	}
+	if bytes.Equal(header[:len(encryptMagic)], recipientsMagic) {
+		return nil, errors.New("the archive is encrypted to recipients, and needs an identity to decrypt it")
+	}
+	if !bytes.Equal(header[:len(encryptMagic)], encryptMagic) {
+		return nil, errors.New("the archive is not encrypted")
+	}
+	return newDecryptReader(r, aead, header[len(encryptMagic):]), nil
+}
+
+// Returns a reader decrypting the chunks read from r with the AEAD and nonce
+// prefix, once the header of the stream has been read.
+func newDecryptReader(r io.Reader, aead cipher.AEAD, prefix []byte) *decryptReader {
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: prefix,
+		chunk:  make([]byte, encryptChunkSize+aead.Overhead()),
+	}
+}
+
+func (d *decryptReader) Read(b []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// Reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		d.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.r.Peek(1); err == io.EOF {
+		d.done = true
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.prefix, d.n, d.done), d.chunk[:n], nil)
+	if err != nil {
+		return errDecrypt
+	}
+	d.n++
+	d.plain = plain
+	return nil
+}
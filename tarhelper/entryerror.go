@@ -0,0 +1,55 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/apcera/util/multierror"
+)
+
+// EntryError is the error for an entry that couldn't be read to be archived,
+// such as a file that couldn't be opened or a directory that couldn't be
+// listed. With ContinueOnError these entries are skipped, and the error
+// returned by Archive holds an EntryError for each of them.
+type EntryError struct {
+	// The path of the entry relative to the target directory.
+	Path string
+
+	// The error reading the entry.
+	Err error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the error reading the entry.
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// Marks an error reading the named entry, before anything was written for
+// it, so that the entry can be skipped.
+func entryError(name string, err error) error {
+	return &EntryError{Path: name, Err: err}
+}
+
+// Records the entry that failed with err when ContinueOnError is set, so the
+// archive can carry on without it. Returns the error if it should stop the
+// archive.
+func (t *Tar) skipFailed(err error) error {
+	var ee *EntryError
+	if !t.ContinueOnError || !errors.As(err, &ee) {
+		return err
+	}
+	t.logger().Warnf("tarhelper: skipping %q, %v", ee.Path, ee.Err)
+	t.failed = multierror.Append(t.failed, ee)
+	t.trackFailed(ee.Path)
+	if t.estimate == nil {
+		t.stats.Failed++
+	}
+	t.skipped(ee.Path, SkipFailed, "")
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// URLOptions configures how ExtractURL downloads and extracts an archive.
+type URLOptions struct {
+	// Client is the HTTP client making the requests. The default is
+	// http.DefaultClient.
+	Client *http.Client
+
+	// Header holds extra headers to send with each request, such as
+	// Authorization.
+	Header http.Header
+
+	// Retries is the number of times a failed request or download is tried
+	// again before giving up. Downloads are resumed from where they stopped
+	// with a Range request, or started again and read up to the same point
+	// if the server doesn't support ranges.
+	Retries int
+
+	// RetryDelay is how long to wait before the first retry, doubling for
+	// each one after. The default is one second.
+	RetryDelay time.Duration
+
+	// Untar, if set, is called to configure the Untar before extraction,
+	// such as to set its Compression or limits.
+	Untar func(u *Untar)
+}
+
+// ExtractURL downloads the archive at the HTTP or HTTPS url and extracts it
+// to destDir as it is read, in place of piping curl into tar. The
+// compression is detected and the extraction is Hardened unless opts.Untar
+// changes them. Downloads that fail part way through are resumed, up to
+// opts.Retries times, and one that changes on the server while it is being
+// resumed is an error rather than a mix of both. opts may be nil.
+func ExtractURL(ctx context.Context, url, destDir string, opts *URLOptions) error {
+	if opts == nil {
+		opts = &URLOptions{}
+	}
+	body := &urlReader{ctx: ctx, url: url, opts: opts}
+	defer body.Close()
+
+	u := NewUntar(body, destDir)
+	u.Compression = DETECT
+	u.Hardened = true
+	if opts.Untar != nil {
+		opts.Untar(u)
+	}
+	return u.ExtractContext(ctx)
+}
+
+// urlReader reads the body of a URL, retrying failed requests and resuming
+// from where it stopped when reading fails.
+type urlReader struct {
+	ctx  context.Context
+	url  string
+	opts *URLOptions
+
+	body    io.ReadCloser
+	offset  int64
+	retries int
+	err     error
+
+	// The length of the body, or -1 if it isn't known, along with its ETag
+	// and modification time, to check that a resumed download is of the
+	// same body.
+	length       int64
+	etag         string
+	lastModified string
+}
+
+func (r *urlReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for {
+		if r.body == nil {
+			if err := r.open(); err != nil {
+				if !r.retry(err) {
+					r.err = err
+					return 0, err
+				}
+				continue
+			}
+		}
+
+		n, err := r.body.Read(b)
+		r.offset += int64(n)
+		if err == io.EOF && r.length >= 0 && r.offset < r.length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		r.body.Close()
+		r.body = nil
+		if n > 0 {
+			// retried on the next read, once this data is used
+			return n, nil
+		}
+		if !r.retry(err) {
+			r.err = fmt.Errorf("failed to download %s: %v", r.url, err)
+			return 0, r.err
+		}
+	}
+}
+
+// Close closes the body of the response being read.
+func (r *urlReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// Waits to retry after err, reporting false if there are no retries left,
+// the error can't be retried or the context was cancelled.
+func (r *urlReader) retry(err error) bool {
+	if _, ok := err.(*permanentError); ok || r.retries >= r.opts.Retries || r.ctx.Err() != nil {
+		return false
+	}
+	delay := r.opts.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	delay <<= uint(r.retries)
+	r.retries++
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// permanentError is a download failure that isn't worth retrying, such as
+// a 404 response.
+type permanentError struct {
+	url    string
+	reason string
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("failed to download %s: %s", e.url, e.reason)
+}
+
+// Makes the request for the rest of the body, from the offset read so far.
+func (r *urlReader) open() error {
+	req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range r.opts.Header {
+		req.Header[k] = v
+	}
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		// only the range of the same body is wanted, and weak ETags can't be
+		// used to check that
+		if r.etag != "" && !strings.HasPrefix(r.etag, "W/") {
+			req.Header.Set("If-Range", r.etag)
+		} else if r.lastModified != "" {
+			req.Header.Set("If-Range", r.lastModified)
+		}
+	}
+
+	client := r.opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && r.offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != r.offset {
+			resp.Body.Close()
+			return fmt.Errorf("failed to resume %s: unexpected range %q", r.url, resp.Header.Get("Content-Range"))
+		}
+
+	case resp.StatusCode == http.StatusOK:
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if r.offset > 0 {
+			// the server sent everything again, which is only of use if it
+			// is still the same
+			if etag != r.etag || lastModified != r.lastModified || resp.ContentLength != r.length {
+				resp.Body.Close()
+				return &permanentError{url: r.url, reason: "changed while being downloaded"}
+			}
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, r.offset); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		} else {
+			r.length, r.etag, r.lastModified = resp.ContentLength, etag, lastModified
+		}
+
+	default:
+		resp.Body.Close()
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return fmt.Errorf("failed to download %s: %s", r.url, resp.Status)
+		}
+		return &permanentError{url: r.url, reason: resp.Status}
+	}
+	r.body = resp.Body
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"strings"
+)
+
+// The PAX record holding file flags, as used by star and libarchive.
+const paxFileFlags = "SCHILY.fflags"
+
+// The file flags that are recorded, as set with chattr on Linux, or chflags
+// on macOS.
+const (
+	// flagImmutable is chattr's i, for files that can't be modified.
+	flagImmutable uint32 = 0x10
+
+	// flagAppend is chattr's a, for files that can only be appended to.
+	flagAppend uint32 = 0x20
+
+	// flagNoDump is chattr's d, for files that dump skips.
+	flagNoDump uint32 = 0x40
+
+	// flagHidden is for files hidden by the Finder, which is only on macOS.
+	flagHidden uint32 = 0x8000
+)
+
+// The names file flags are recorded with, in the order they are written,
+// which are those used by libarchive so that bsdtar understands them.
+var fileFlagNames = []struct {
+	name string
+	flag uint32
+}{
+	{"sappnd", flagAppend},
+	{"schg", flagImmutable},
+	{"nodump", flagNoDump},
+	{"hidden", flagHidden},
+}
+
+// The alternate names accepted for flags, which are the user versions of the
+// system flags on BSD.
+var fileFlagAliases = map[string]uint32{
+	"uappnd": flagAppend,
+	"uchg":   flagImmutable,
+}
+
+// The mask of all of the file flags that are recorded.
+const fileFlagsMask = flagImmutable | flagAppend | flagNoDump | flagHidden
+
+// Records the file flags of the named file in the header's PAX records.
+func addFileFlags(header *tar.Header, name string) error {
+	flags, err := readFileFlags(name)
+	if err != nil {
+		return err
+	}
+	if flags&fileFlagsMask == 0 {
+		return nil
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxFileFlags] = formatFileFlags(flags)
+	return nil
+}
+
+// Returns the file flags recorded in the header's PAX records, and whether
+// any were recorded.
+func headerFileFlags(header *tar.Header) (uint32, bool) {
+	value, ok := header.PAXRecords[paxFileFlags]
+	if !ok {
+		return 0, false
+	}
+	return parseFileFlags(value), true
+}
+
+// Returns the names of the flags set in flags, separated by commas.
+func formatFileFlags(flags uint32) string {
+	var names []string
+	for _, f := range fileFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Returns the flags named in a list separated by commas, ignoring any that
+// aren't known.
+func parseFileFlags(value string) uint32 {
+	var flags uint32
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		for _, f := range fileFlagNames {
+			if f.name == name {
+				flags |= f.flag
+			}
+		}
+		flags |= fileFlagAliases[name]
+	}
+	return flags
+}
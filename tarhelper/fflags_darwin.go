@@ -0,0 +1,77 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build darwin
+
+package tarhelper
+
+import (
+	"os"
+	"syscall"
+)
+
+// The BSD file flags that are recorded.
+const (
+	ufNoDump    = 0x1
+	ufImmutable = 0x2
+	ufAppend    = 0x4
+	ufHidden    = 0x8000
+	sfImmutable = 0x20000
+	sfAppend    = 0x40000
+)
+
+// Returns the file flags of the named file or directory, as shown by ls -lO.
+// The system and user immutable and append only flags are recorded alike.
+func readFileFlags(name string) (uint32, error) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, nil
+	}
+	var flags uint32
+	if st.Flags&ufNoDump != 0 {
+		flags |= flagNoDump
+	}
+	if st.Flags&(ufImmutable|sfImmutable) != 0 {
+		flags |= flagImmutable
+	}
+	if st.Flags&(ufAppend|sfAppend) != 0 {
+		flags |= flagAppend
+	}
+	if st.Flags&ufHidden != 0 {
+		flags |= flagHidden
+	}
+	return flags, nil
+}
+
+// Sets the file flags recorded by readFileFlags on the named file or
+// directory, as the user flags, leaving any other flags it has as they are.
+func writeFileFlags(name string, flags uint32) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	value := st.Flags &^ (ufNoDump | ufImmutable | ufAppend | ufHidden)
+	if flags&flagNoDump != 0 {
+		value |= ufNoDump
+	}
+	if flags&flagImmutable != 0 {
+		value |= ufImmutable
+	}
+	if flags&flagAppend != 0 {
+		value |= ufAppend
+	}
+	if flags&flagHidden != 0 {
+		value |= ufHidden
+	}
+	if value == st.Flags {
+		return nil
+	}
+	return syscall.Chflags(name, int(value))
+}
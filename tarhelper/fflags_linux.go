@@ -0,0 +1,69 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package tarhelper
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The ioctls to get and set file flags, which take a pointer to an int
+// despite being numbered for a long.
+const (
+	fsIocGetFlags = 2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+	fsIocSetFlags = 1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2
+)
+
+// The recorded flags that Linux has, which use the same bits.
+const linuxFileFlags = flagImmutable | flagAppend | flagNoDump
+
+// Returns the file flags of the named file or directory, as shown by lsattr.
+// Filesystems that don't support flags return no flags.
+func readFileFlags(name string) (uint32, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	flags, err := getFileFlags(f)
+	if err == syscall.ENOTTY || err == syscall.ENOTSUP || err == syscall.EINVAL {
+		return 0, nil
+	}
+	return flags & linuxFileFlags, err
+}
+
+// Sets the file flags recorded by readFileFlags on the named file or
+// directory, leaving any other flags it has as they are.
+func writeFileFlags(name string, flags uint32) error {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	current, err := getFileFlags(f)
+	if err != nil {
+		return err
+	}
+	value := int32(current&^linuxFileFlags | flags&linuxFileFlags)
+	if uint32(value) == current {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&value)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Returns the flags of the open file.
+func getFileFlags(f *os.File) (uint32, error) {
+	var value int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&value)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint32(value), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	. "github.com/apcera/util/testtool"
+)
+
+func TestTarFileFlags(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	name := path.Join(dir, "file")
+	TestExpectSuccess(t, ioutil.WriteFile(name, []byte("data"), 0644))
+	if err := writeFileFlags(name, flagNoDump); err != nil {
+		t.Skipf("file flags aren't supported here: %v", err)
+	}
+	if flags, err := readFileFlags(name); err != nil || flags&flagNoDump == 0 {
+		t.Skipf("file flags aren't supported here: %v", err)
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IncludeFileFlags = true
+	TestExpectSuccess(t, tw.Archive())
+
+	// the flags are recorded in the header
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Name == "file" {
+			TestEqual(t, header.PAXRecords["SCHILY.fflags"], "nodump")
+			break
+		}
+	}
+
+	// and reapplied on extraction when asked
+	for _, preserve := range []bool{true, false} {
+		extractionPath := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+		u.PreserveFileFlags = preserve
+		TestExpectSuccess(t, u.Extract())
+
+		flags, err := readFileFlags(path.Join(extractionPath, "file"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, flags&flagNoDump != 0, preserve)
+	}
+
+	TestEqual(t, parseFileFlags("schg, uappnd,unknown"), flagImmutable|flagAppend)
+	TestEqual(t, formatFileFlags(flagImmutable|flagAppend|flagNoDump), "sappnd,schg,nodump")
+}
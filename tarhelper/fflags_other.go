@@ -0,0 +1,18 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !linux,!darwin
+
+package tarhelper
+
+import (
+	"fmt"
+)
+
+// File flags are only supported on Linux and macOS.
+func readFileFlags(name string) (uint32, error) {
+	return 0, nil
+}
+
+func writeFileFlags(name string, flags uint32) error {
+	return fmt.Errorf("file flags are not supported on this platform")
+}
@@ -0,0 +1,258 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+)
+
+// Index records where the content of each entry is within an archive, so
+// that single entries can be read from an io.ReaderAt without reading the
+// whole archive. It can be encoded as JSON to be stored alongside the
+// archive.
+type Index struct {
+	// The compression used by the archive.
+	Compression Compression
+
+	// The entries of the archive, in order.
+	Entries []IndexEntry
+
+	// The points that decompression can be started from, in order. Every
+	// compressed archive has one at the start, gzip archives made of several
+	// gzip members also have one at the start of each member.
+	Restarts []RestartPoint
+}
+
+// IndexEntry locates the content of an entry within an archive.
+type IndexEntry struct {
+	// The name and type of the entry, along with the target of links.
+	Name     string
+	Typeflag byte
+	Linkname string
+
+	// The offset of the content within the uncompressed archive, and its
+	// size.
+	Offset int64
+	Size   int64
+
+	// Set for sparse entries, whose content isn't stored contiguously and
+	// so can't be read through the index.
+	Sparse bool
+}
+
+// RestartPoint is a position that decompression can be started from.
+type RestartPoint struct {
+	// The offset within the compressed archive.
+	CompressedOffset int64
+
+	// The corresponding offset within the uncompressed archive.
+	Offset int64
+}
+
+// BuildIndex reads the archive from r, which may be compressed with any of
+// the supported compression types, and returns an index of its entries.
+func BuildIndex(r io.Reader) (*Index, error) {
+	comp, br := DetectCompression(r)
+	index := &Index{Compression: comp}
+
+	// Count the uncompressed bytes read to find where each entry's content
+	// starts, along with the compressed bytes read for gzip members.
+	var source io.Reader
+	switch comp {
+	case NONE:
+		source = br
+	case GZIP:
+		members, err := newGzipMemberReader(br.(*bufio.Reader), index)
+		if err != nil {
+			return nil, err
+		}
+		source = members
+	default:
+		dc, _ := lookupDecompressor(comp)
+		arch, err := dc.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		if cl, ok := arch.(io.ReadCloser); ok {
+			defer cl.Close()
+		}
+		index.Restarts = []RestartPoint{{}}
+		source = arch
+	}
+	counter := &countingReader{r: source}
+	archive := tar.NewReader(counter)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sparse := header.Typeflag == tar.TypeGNUSparse
+		for k := range header.PAXRecords {
+			if strings.HasPrefix(k, "GNU.sparse.") {
+				sparse = true
+			}
+		}
+		index.Entries = append(index.Entries, IndexEntry{
+			Name:     header.Name,
+			Typeflag: header.Typeflag,
+			Linkname: header.Linkname,
+			Offset:   counter.n,
+			Size:     header.Size,
+			Sparse:   sparse,
+		})
+	}
+}
+
+// Lookup returns the entry with the given name, which is compared after
+// cleaning so that "./a/" finds "a".
+func (idx *Index) Lookup(name string) (IndexEntry, bool) {
+	name = path.Clean(name)
+	for i := len(idx.Entries) - 1; i >= 0; i-- {
+		if path.Clean(idx.Entries[i].Name) == name {
+			return idx.Entries[i], true
+		}
+	}
+	return IndexEntry{}, false
+}
+
+// Open returns a reader for the content of the named regular file, or the
+// file a hard link refers to, reading only what is needed from the archive
+// in ra.
+func (idx *Index) Open(ra io.ReaderAt, name string) (io.Reader, error) {
+	entry, ok := idx.Lookup(name)
+	if ok && entry.Typeflag == tar.TypeLink {
+		entry, ok = idx.Lookup(entry.Linkname)
+	}
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("%s is not in the archive", name)
+	case entry.Typeflag != tar.TypeReg && entry.Typeflag != tar.TypeRegA:
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	case entry.Sparse:
+		return nil, fmt.Errorf("%s is a sparse file, which can't be read through an index", name)
+	}
+
+	if idx.Compression == NONE {
+		return io.NewSectionReader(ra, entry.Offset, entry.Size), nil
+	}
+
+	// Decompress from the last restart point before the content, skipping
+	// up to it.
+	var restart RestartPoint
+	for _, rp := range idx.Restarts {
+		if rp.Offset > entry.Offset {
+			break
+		}
+		restart = rp
+	}
+	compressed := io.NewSectionReader(ra, restart.CompressedOffset, math.MaxInt64-restart.CompressedOffset)
+	var r io.Reader
+	var err error
+	if idx.Compression == GZIP {
+		r, err = gzip.NewReader(compressed)
+	} else {
+		comp, exists := lookupDecompressor(idx.Compression)
+		if !exists {
+			return nil, fmt.Errorf("unrecognized decompression type %q", idx.Compression)
+		}
+		r, err = comp.NewReader(compressed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, entry.Offset-restart.Offset); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, entry.Size), nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipMemberReader decompresses a gzip stream one member at a time, adding
+// a restart point to the index at the start of each member.
+type gzipMemberReader struct {
+	src    *byteCountingReader
+	z      *gzip.Reader
+	index  *Index
+	offset int64
+}
+
+func newGzipMemberReader(r *bufio.Reader, index *Index) (*gzipMemberReader, error) {
+	src := &byteCountingReader{r: r}
+	z, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	z.Multistream(false)
+	index.Restarts = []RestartPoint{{}}
+	return &gzipMemberReader{src: src, z: z, index: index}, nil
+}
+
+func (g *gzipMemberReader) Read(b []byte) (int, error) {
+	for {
+		n, err := g.z.Read(b)
+		g.offset += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+
+		// move on to the next member, if there is one
+		start := g.src.n
+		if err := g.z.Reset(g.src); err == io.EOF {
+			return n, io.EOF
+		} else if err != nil {
+			return n, err
+		}
+		g.z.Multistream(false)
+		g.index.Restarts = append(g.index.Restarts, RestartPoint{
+			CompressedOffset: start,
+			Offset:           g.offset,
+		})
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// byteCountingReader counts the bytes read from a buffered reader. It is an
+// io.ByteReader so that gzip doesn't read ahead of what it uses.
+type byteCountingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *byteCountingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *byteCountingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WhiteoutPrefix starts the base name of an entry that records the deletion
+// of the file of the same name without the prefix, as in OCI image layers.
+const WhiteoutPrefix = ".wh."
+
+// OpaqueWhiteout is the base name of an entry that records that everything
+// that was in the directory holding it has been deleted, as in OCI image
+// layers, so that none of it shows through from the layers below.
+const OpaqueWhiteout = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+
+// Reports whether the named entry, with the FileInfo f, is the same in the
+// LayerBase as it is in the target, and so can be left out of the layer.
+func (t *Tar) unchangedInBase(name string, f os.FileInfo) bool {
+	if t.LayerBase == "" || t.fsys != nil || f == nil {
+		return false
+	}
+	baseName := filepath.Join(t.LayerBase, name)
+	base, err := os.Lstat(baseName)
+	if err != nil {
+		return false
+	}
+	return sameEntry(baseName, base, filepath.Join(t.target, name), f)
+}
+
+// Reports whether the files a and b, with the FileInfos fa and fb, are the
+// same as far as an archive goes, by their type, permissions and owner, and
+// then their link target, device numbers or size and modification time.
+// The content of files isn't compared, and neither are the times of
+// directories, which change along with what is in them.
+func sameEntry(a string, fa os.FileInfo, b string, fb os.FileInfo) bool {
+	if fa.Mode() != fb.Mode() || uidForFileInfo(fa) != uidForFileInfo(fb) ||
+		gidForFileInfo(fa) != gidForFileInfo(fb) {
+		return false
+	}
+
+	mode := fa.Mode()
+	switch {
+	case mode.IsDir():
+		return true
+	case mode&os.ModeSymlink != 0:
+		la, erra := os.Readlink(a)
+		lb, errb := os.Readlink(b)
+		return erra == nil && errb == nil && la == lb
+	case mode&(os.ModeDevice|os.ModeCharDevice) != 0:
+		majA, minA := osDeviceNumbersForFileInfo(fa)
+		majB, minB := osDeviceNumbersForFileInfo(fb)
+		return majA == majB && minA == minB
+	}
+	return fa.Size() == fb.Size() && fa.ModTime().Equal(fb.ModTime())
+}
+
+// Writes whiteout entries for everything in the LayerBase that is no longer
+// in the target. The contents of a deleted directory are covered by the
+// directory's whiteout, and a directory that is still there with everything
+// in it deleted is given an opaque whiteout instead of one for each entry.
+func (t *Tar) writeLayerDeletions() error {
+	if t.LayerBase == "" || t.Files != nil {
+		return nil
+	}
+	return t.writeLayerDirDeletions(".")
+}
+
+// Writes the whiteouts for the named directory, which is in both the
+// LayerBase and the target, and those within it.
+func (t *Tar) writeLayerDirDeletions(dir string) error {
+	if err := contextErr(t.ctx); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(t.LayerBase, dir))
+	if err != nil {
+		return err
+	}
+
+	var deleted, dirs []string
+	var compared int
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if t.shouldBeExcluded(name) {
+			continue
+		}
+		compared++
+		f, err := os.Lstat(filepath.Join(t.target, name))
+		if os.IsNotExist(err) {
+			deleted = append(deleted, e.Name())
+		} else if err != nil {
+			return err
+		} else if e.IsDir() && f.IsDir() {
+			dirs = append(dirs, name)
+		}
+	}
+
+	if len(deleted) > 0 && len(deleted) == compared {
+		if err := t.writeWhiteout(dir, OpaqueWhiteout); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range deleted {
+			if err := t.writeWhiteout(dir, WhiteoutPrefix+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range dirs {
+		if err := t.writeLayerDirDeletions(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the named entry if it is a whiteout, deleting what it names from
+// destDir, the resolved directory holding it, and otherwise records that it
+// is being extracted. Reports whether the entry was a whiteout.
+func (u *Untar) applyWhiteout(name, destDir string) (bool, error) {
+	name = path.Clean(name)
+	base := path.Base(name)
+	if !strings.HasPrefix(base, WhiteoutPrefix) {
+		if u.extracted == nil {
+			u.extracted = make(map[string]bool)
+		}
+		for n := name; n != "." && n != "/"; n = path.Dir(n) {
+			u.extracted[n] = true
+		}
+		return false, nil
+	}
+
+	if base == OpaqueWhiteout {
+		return true, u.applyOpaqueWhiteout(path.Dir(name), destDir)
+	}
+
+	deleted := strings.TrimPrefix(base, WhiteoutPrefix)
+	if deleted == "" || deleted == "." || deleted == ".." {
+		return true, fmt.Errorf("invalid whiteout %s", name)
+	}
+	if err := u.filesystem().RemoveAll(path.Join(destDir, deleted)); err != nil {
+		return true, fmt.Errorf("failed to apply whiteout %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// Deletes everything in destDir, the resolved location of the directory dir
+// in the archive, other than the entries that have been extracted into it.
+func (u *Untar) applyOpaqueWhiteout(dir, destDir string) error {
+	names, err := readDirNames(u.filesystem(), destDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to apply opaque whiteout in %s: %v", dir, err)
+	}
+	for _, n := range names {
+		if u.extracted[path.Join(dir, n)] {
+			continue
+		}
+		if err := u.filesystem().RemoveAll(path.Join(destDir, n)); err != nil {
+			return fmt.Errorf("failed to apply opaque whiteout in %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Returns the names of the entries in the named directory of fsys, which
+// needs to have a ReadDir method like MemFS or open directories as files that
+// can be listed like the OS.
+func readDirNames(fsys TargetFS, name string) ([]string, error) {
+	if rd, ok := fsys.(interface {
+		ReadDir(name string) ([]os.FileInfo, error)
+	}); ok {
+		infos, err := rd.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, len(infos))
+		for i, fi := range infos {
+			names[i] = fi.Name()
+		}
+		return names, nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lister, ok := f.(interface {
+		Readdirnames(n int) ([]string, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("the target filesystem can't list directories")
+	}
+	return lister.Readdirnames(-1)
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// EntryInfo describes an entry within an archive.
+type EntryInfo struct {
+	// The name of the entry within the archive.
+	Name string
+
+	// The tar type flag of the entry, such as tar.TypeReg or tar.TypeDir.
+	Typeflag byte
+
+	// The size of the entry's content.
+	Size int64
+
+	// The entry's type and permissions.
+	Mode os.FileMode
+
+	// The recorded owner, by id and by name if the names were recorded.
+	Uid   int
+	Gid   int
+	Uname string
+	Gname string
+
+	// The target of a symlink or hard link.
+	Linkname string
+
+	// The modification time of the entry.
+	ModTime time.Time
+}
+
+// List returns a description of each entry in the archive read from r, which
+// may be compressed with any of the supported compression types, without
+// extracting anything.
+func List(r io.Reader) ([]EntryInfo, error) {
+	archive, err := DetectArchiveCompression(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []EntryInfo
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, EntryInfo{
+			Name:     header.Name,
+			Typeflag: header.Typeflag,
+			Size:     header.Size,
+			Mode:     header.FileInfo().Mode(),
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			Uname:    header.Uname,
+			Gname:    header.Gname,
+			Linkname: header.Linkname,
+			ModTime:  header.ModTime,
+		})
+	}
+}
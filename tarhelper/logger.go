@@ -0,0 +1,24 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+// LeveledLogger receives the messages logged while archiving, such as the entries
+// that were left out and why. A *logray.Logger satisfies it.
+type LeveledLogger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// nopLogger discards everything logged to it.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+
+// Returns the Logger, or one that discards everything if none is set.
+func (t *Tar) logger() LeveledLogger {
+	if t.Logger == nil {
+		return nopLogger{}
+	}
+	return t.Logger
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"fmt"
+	"os"
+)
+
+// fileID identifies a file by its device and inode numbers.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// visitedDir is a directory that is being archived, which the directories
+// within it are checked against so that links or mounts that loop back to it
+// aren't followed forever.
+type visitedDir struct {
+	// The name of the directory within the target.
+	name string
+
+	// The absolute path of the directory with any symlinks resolved, or the
+	// name within an fs.FS.
+	path string
+
+	// The device and inode of the directory, when they are known.
+	id    fileID
+	hasID bool
+}
+
+// Returns the visitedDir for the named directory, found at path p.
+func newVisitedDir(name, p string, f os.FileInfo) visitedDir {
+	id, hasID := fileIDForFileInfo(f)
+	return visitedDir{name: name, path: p, id: id, hasID: hasID}
+}
+
+// Returns the directory on the stack that d is the same directory as, if it
+// is already being archived. Directories are compared by device and inode,
+// which catches bind mounts as well as symlinks, or by path when those
+// aren't known.
+func findLoop(dirStack []visitedDir, d visitedDir) (visitedDir, bool) {
+	for _, elem := range dirStack {
+		if d.hasID && elem.hasID {
+			if d.id == elem.id {
+				return elem, true
+			}
+		} else if d.path == elem.path {
+			return elem, true
+		}
+	}
+	return visitedDir{}, false
+}
+
+// Handles the named entry looping back to the directory elem. It is skipped
+// unless FailOnLoops is set.
+func (t *Tar) loopFound(name string, elem visitedDir) error {
+	if t.FailOnLoops {
+		return entryError(name, fmt.Errorf("loops back to %q, which contains it", elem.name))
+	}
+	t.logger().Warnf("tarhelper: skipping %q, a link back to %q", name, elem.path)
+	t.skipped(name, SkipLoop, "")
+	return nil
+}
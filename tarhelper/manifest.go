@@ -0,0 +1,170 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ManifestEntry is the digest of a regular file written to an archive.
+type ManifestEntry struct {
+	// The name of the entry within the archive.
+	Name string
+
+	// The size of the file's content.
+	Size int64
+
+	// The hex encoded SHA-256 digest of the file's content.
+	SHA256 string
+
+	// The media type of the file's content, such as "image/png", with
+	// Tar.DetectContentType. It is empty otherwise, and for entries read
+	// with ReadManifest.
+	ContentType string
+}
+
+// Manifest returns the digests of the regular files written by the last call
+// to Archive when ComputeManifest was set, in the order they were written.
+// Hard links are listed with the digest of the file they link to.
+func (t *Tar) Manifest() []ManifestEntry {
+	return t.manifest
+}
+
+// Returns a reader that adds everything read through it to a new digest, and
+// the digest, when a manifest is being computed. Otherwise r is returned.
+func (t *Tar) digestReader(r io.Reader) (io.Reader, hash.Hash) {
+	if !t.ComputeManifest {
+		return r, nil
+	}
+	var h hash.Hash = sha256.New()
+	if t.DetectContentType {
+		h = &sniffHash{Hash: h}
+	}
+	return io.TeeReader(r, h), h
+}
+
+// The most content http.DetectContentType considers.
+const sniffLen = 512
+
+// sniffHash keeps the start of what is written to a digest, to detect the
+// content type from.
+type sniffHash struct {
+	hash.Hash
+	head []byte
+}
+
+func (s *sniffHash) Write(b []byte) (int, error) {
+	if n := sniffLen - len(s.head); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		s.head = append(s.head, b[:n]...)
+	}
+	return s.Hash.Write(b)
+}
+
+// Adds the entry written with the given header to the manifest, with the
+// digest of its content. Entries that aren't regular files or hard links are
+// ignored.
+func (t *Tar) addToManifest(header *tar.Header, h hash.Hash) {
+	if !t.ComputeManifest || t.estimate != nil {
+		return
+	}
+	if t.manifestIndex == nil {
+		t.manifestIndex = make(map[string]int)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		if h == nil {
+			h = sha256.New()
+		}
+		entry := ManifestEntry{
+			Name:   header.Name,
+			Size:   header.Size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		}
+		if t.DetectContentType {
+			var head []byte
+			if s, ok := h.(*sniffHash); ok {
+				head = s.head
+			}
+			entry.ContentType = http.DetectContentType(head)
+		}
+		t.manifestIndex[header.Name] = len(t.manifest)
+		t.manifest = append(t.manifest, entry)
+	case tar.TypeLink:
+		if i, ok := t.manifestIndex[header.Linkname]; ok {
+			entry := t.manifest[i]
+			entry.Name = header.Name
+			t.manifest = append(t.manifest, entry)
+		}
+	}
+}
+
+// Writes the manifest to the archive as an entry named ManifestName, in the
+// format read by "sha256sum -c".
+func (t *Tar) writeManifest() error {
+	data := formatManifest(t.manifest)
+	header := &tar.Header{
+		Name:     path.Join(".", filepath.ToSlash(t.VirtualPath), t.ManifestName),
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := t.writeHeader(header); err != nil {
+		return ignoreDropped(err)
+	}
+	if _, err := t.copyContent(t.archive, header.Name, bytes.NewReader(data), header.Size); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// Formats manifest entries one per line as the digest, two spaces and the
+// name.
+func formatManifest(entries []ManifestEntry) []byte {
+	var b bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s  %s\n", e.SHA256, e.Name)
+	}
+	return b.Bytes()
+}
+
+// holeReader adds the zeros of a hole in a sparse file to a digest when it is
+// read, without returning any data itself.
+type holeReader struct {
+	h hash.Hash
+	n int64
+}
+
+func (r *holeReader) Read(b []byte) (int, error) {
+	if r.n > 0 {
+		if _, err := io.CopyN(r.h, zeroReader{}, r.n); err != nil {
+			return 0, err
+		}
+		r.n = 0
+	}
+	return 0, io.EOF
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,420 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The most symlinks followed while resolving a name, as with Linux.
+const maxSymlinks = 40
+
+// MemFS is a TargetFS that keeps everything in memory, so that archives can
+// be extracted and examined without touching disk. Ownership and times are
+// recorded but not enforced, and hard links share their content. It is safe
+// for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+// memNode is a file, directory, symlink or device within a MemFS. Hard links
+// are names sharing the same node.
+type memNode struct {
+	mode    os.FileMode
+	data    []byte
+	link    string
+	modTime time.Time
+	uid     int
+	gid     int
+	dev     int
+}
+
+// NewMemFS returns an empty MemFS holding only the root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		nodes: map[string]*memNode{
+			"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
+
+// ReadFile returns the contents of the named regular file.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, node, err := m.resolve(name, true)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if !node.mode.IsRegular() {
+		return nil, pathError("open", n, syscall.EINVAL)
+	}
+	return append([]byte(nil), node.data...), nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, node, err := m.resolve(name, true)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	if !node.mode.IsDir() {
+		return nil, pathError("readdir", dir, syscall.ENOTDIR)
+	}
+	var infos []os.FileInfo
+	for n, child := range m.nodes {
+		if n != "/" && path.Dir(n) == dir {
+			infos = append(infos, &memFileInfo{name: path.Base(n), node: child})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	return m.stat("lstat", name, false)
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	return m.stat("stat", name, true)
+}
+
+func (m *MemFS) stat(op, name string, follow bool) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, node, err := m.resolve(name, follow)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return &memFileInfo{name: path.Base(n), node: node}, nil
+}
+
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (TargetFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, node, err := m.resolve(name, true)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, os.ErrExist)
+	case err == nil && !node.mode.IsRegular():
+		return nil, pathError("open", name, syscall.EISDIR)
+	case err == nil:
+		if flag&os.O_TRUNC != 0 {
+			node.data = nil
+		}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0 && n != "":
+		node = &memNode{mode: perm & memModeBits, modTime: time.Now()}
+		m.nodes[n] = node
+	default:
+		return nil, pathError("open", name, err)
+	}
+	f := &memFile{fs: m, node: node}
+	if flag&os.O_APPEND != 0 {
+		f.offset = int64(len(node.data))
+	}
+	return f, nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := "/"
+	for _, c := range strings.Split(memName(name), "/") {
+		if c == "" {
+			continue
+		}
+		n, node, err := m.resolve(path.Join(dir, c), true)
+		switch {
+		case err == nil && !node.mode.IsDir():
+			return pathError("mkdir", name, syscall.ENOTDIR)
+		case os.IsNotExist(err) && n != "":
+			m.nodes[n] = &memNode{mode: os.ModeDir | perm&memModeBits, modTime: time.Now()}
+		case err != nil:
+			return pathError("mkdir", name, err)
+		}
+		dir = n
+	}
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := memName(name)
+	if n == "/" {
+		return pathError("removeall", name, syscall.EINVAL)
+	}
+	for other := range m.nodes {
+		if other == n || strings.HasPrefix(other, n+"/") {
+			delete(m.nodes, other)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.create("symlink", newname)
+	if err != nil {
+		return err
+	}
+	m.nodes[n] = &memNode{mode: os.ModeSymlink | 0777, link: oldname, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, node, err := m.resolve(oldname, false)
+	if err != nil {
+		return pathError("link", oldname, err)
+	}
+	if node.mode.IsDir() {
+		return pathError("link", oldname, syscall.EPERM)
+	}
+	n, err := m.create("link", newname)
+	if err != nil {
+		return err
+	}
+	m.nodes[n] = node
+	return nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, node, err := m.resolve(name, false)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", pathError("readlink", name, syscall.EINVAL)
+	}
+	return node.link, nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	return m.update("chmod", name, true, func(node *memNode) {
+		node.mode = node.mode&os.ModeType | mode&memModeBits
+	})
+}
+
+func (m *MemFS) Chown(name string, uid, gid int) error {
+	return m.update("chown", name, true, func(node *memNode) {
+		node.uid, node.gid = uid, gid
+	})
+}
+
+func (m *MemFS) Lchown(name string, uid, gid int) error {
+	return m.update("lchown", name, false, func(node *memNode) {
+		node.uid, node.gid = uid, gid
+	})
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	return m.update("chtimes", name, true, func(node *memNode) {
+		node.modTime = mtime
+	})
+}
+
+func (m *MemFS) Mknod(name string, mode uint32, dev int) error {
+	var typ os.FileMode
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		typ = os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		typ = os.ModeDevice
+	case syscall.S_IFIFO:
+		typ = os.ModeNamedPipe
+	default:
+		return pathError("mknod", name, syscall.EINVAL)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.create("mknod", name)
+	if err != nil {
+		return err
+	}
+	m.nodes[n] = &memNode{mode: typ | os.FileMode(mode&0777), dev: dev, modTime: time.Now()}
+	return nil
+}
+
+// The permission bits kept by a MemFS.
+const memModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Cleans a name into the form used as the key for its node.
+func memName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Resolves name to the cleaned name of the node it refers to and the node,
+// following symlinks in every directory of the name and, when follow is set,
+// in the last element. The mutex must be held. When only the last element
+// doesn't exist, the error is os.ErrNotExist and the cleaned name where it
+// would be created is still returned.
+func (m *MemFS) resolve(name string, follow bool) (string, *memNode, error) {
+	hops := 0
+	return m.resolveFrom("/", memName(name), follow, &hops)
+}
+
+func (m *MemFS) resolveFrom(dir, name string, follow bool, hops *int) (string, *memNode, error) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if name == "/" {
+		return "/", m.nodes["/"], nil
+	}
+	for i, c := range parts {
+		last := i == len(parts)-1
+		n := path.Join(dir, c)
+		node := m.nodes[n]
+		if node == nil {
+			if last {
+				return n, nil, os.ErrNotExist
+			}
+			return "", nil, os.ErrNotExist
+		}
+		if node.mode&os.ModeSymlink != 0 && (follow || !last) {
+			if *hops++; *hops > maxSymlinks {
+				return "", nil, syscall.ELOOP
+			}
+			target := node.link
+			if !path.IsAbs(target) {
+				target = path.Join(dir, target)
+			}
+			var err error
+			n, node, err = m.resolveFrom("/", path.Clean(target), true, hops)
+			if err != nil {
+				if last {
+					return n, nil, err
+				}
+				return "", nil, err
+			}
+		}
+		if last {
+			return n, node, nil
+		}
+		if !node.mode.IsDir() {
+			return "", nil, syscall.ENOTDIR
+		}
+		dir = n
+	}
+	return dir, m.nodes[dir], nil
+}
+
+// Returns the cleaned name to create a new node at, which must not already
+// exist. The mutex must be held.
+func (m *MemFS) create(op, name string) (string, error) {
+	n, _, err := m.resolve(name, false)
+	switch {
+	case err == nil:
+		return "", pathError(op, name, os.ErrExist)
+	case !os.IsNotExist(err) || n == "":
+		return "", pathError(op, name, err)
+	}
+	return n, nil
+}
+
+// Applies fn to the named node.
+func (m *MemFS) update(op, name string, follow bool, fn func(*memNode)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, node, err := m.resolve(name, follow)
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	fn(node)
+	return nil
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// memFileInfo describes a node of a MemFS.
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return int64(len(fi.node.data)) }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.node.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.node.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is a regular file of a MemFS opened for writing.
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	offset int64
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	end := f.offset + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.offset:], b)
+	f.offset = end
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return f.offset, syscall.EINVAL
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	data := make([]byte, size)
+	copy(data, f.node.data)
+	f.node.data = data
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// nameCache caches lookups between user and group ids and names, since the
+// same few owners tend to be repeated throughout an archive. Failed lookups
+// are cached as well.
+type nameCache struct {
+	userNames  map[int]string
+	groupNames map[int]string
+	userIDs    map[string]int
+	groupIDs   map[string]int
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{
+		userNames:  make(map[int]string),
+		groupNames: make(map[int]string),
+		userIDs:    make(map[string]int),
+		groupIDs:   make(map[string]int),
+	}
+}
+
+// Returns the name of the user with the given id, or "" if there isn't one.
+func (c *nameCache) userName(uid int) string {
+	name, ok := c.userNames[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		c.userNames[uid] = name
+	}
+	return name
+}
+
+// Returns the name of the group with the given id, or "" if there isn't one.
+func (c *nameCache) groupName(gid int) string {
+	name, ok := c.groupNames[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			name = g.Name
+		}
+		c.groupNames[gid] = name
+	}
+	return name
+}
+
+// Returns the id of the named user, or -1 if there isn't one.
+func (c *nameCache) userID(name string) int {
+	id, ok := c.userIDs[name]
+	if !ok {
+		id = -1
+		if u, err := user.Lookup(name); err == nil {
+			if n, err := strconv.Atoi(u.Uid); err == nil {
+				id = n
+			}
+		}
+		c.userIDs[name] = id
+	}
+	return id
+}
+
+// Returns the id of the named group, or -1 if there isn't one.
+func (c *nameCache) groupID(name string) int {
+	id, ok := c.groupIDs[name]
+	if !ok {
+		id = -1
+		if g, err := user.LookupGroup(name); err == nil {
+			if n, err := strconv.Atoi(g.Gid); err == nil {
+				id = n
+			}
+		}
+		c.groupIDs[name] = id
+	}
+	return id
+}
+
+// Returns the user and group ids to use on this host for an owner recorded in
+// an archive. Ids that don't exist here are replaced by the ids of the users
+// or groups with the recorded names, if there are any.
+func (c *nameCache) resolve(uid, gid int, uname, gname string) (int, int) {
+	if uname != "" && c.userName(uid) == "" {
+		if id := c.userID(uname); id >= 0 {
+			uid = id
+		}
+	}
+	if gname != "" && c.groupName(gid) == "" {
+		if id := c.groupID(gname); id >= 0 {
+			gid = id
+		}
+	}
+	return uid, gid
+}
+
+// Sets the owner of the named extracted file, or of the symlink itself when
+// link is set. Owners that only root could set are left alone when running
+// without privileges, and other failures are only returned for
+// StrictOwners.
+func (u *Untar) chown(name string, uid, gid int, link bool) error {
+	if u.onDisk() && os.Geteuid() != 0 && uid != os.Geteuid() {
+		return nil
+	}
+	var err error
+	if link {
+		err = u.filesystem().Lchown(name, uid, gid)
+	} else {
+		err = u.filesystem().Chown(name, uid, gid)
+	}
+	if err != nil && u.StrictOwners {
+		return fmt.Errorf("failed to set the owner of %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The largest file that is read into memory to be written by the pool with
+// Untar.Parallelism. Larger files are written as they are read.
+const parallelFileSize = 1024 * 1024
+
+// extractPool writes extracted files on several goroutines, for
+// Untar.Parallelism.
+type extractPool struct {
+	jobs     chan func() error
+	workers  sync.WaitGroup
+	inflight sync.WaitGroup
+
+	// The names of the files submitted since the pool was last waited for,
+	// only used by the goroutine reading the archive.
+	names map[string]bool
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// Returns a pool writing files on n goroutines.
+func newExtractPool(n int) *extractPool {
+	p := &extractPool{
+		jobs:  make(chan func() error, n),
+		names: make(map[string]bool),
+	}
+	for i := 0; i < n; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *extractPool) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		// once a file has failed the rest are left unwritten
+		if p.failed() == nil {
+			if err := job(); err != nil {
+				p.mu.Lock()
+				if p.err == nil {
+					p.err = err
+				}
+				p.mu.Unlock()
+			}
+		}
+		p.inflight.Done()
+	}
+}
+
+// Returns the error of the first file that failed, if any have.
+func (p *extractPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Queues the job writing the named file, waiting for a goroutine to be free
+// if they are all busy.
+func (p *extractPool) submit(name string, job func() error) {
+	p.names[name] = true
+	p.inflight.Add(1)
+	p.jobs <- job
+}
+
+// Waits for every file submitted so far to be written, returning the error
+// of the first that failed.
+func (p *extractPool) wait() error {
+	p.inflight.Wait()
+	p.names = make(map[string]bool)
+	return p.failed()
+}
+
+// Waits for the files submitted so far and stops the goroutines.
+func (p *extractPool) close() error {
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+		p.workers.Wait()
+	}
+	return p.failed()
+}
+
+// Waits for the files being written by the pool before extracting the entry
+// with the given header to name, unless it is a file or directory that
+// can't depend on them. Hard links may link to them, other entries may be in
+// their place and whiteouts may delete them.
+func (u *Untar) waitForFiles(header *tar.Header, name string) error {
+	if u.pool == nil {
+		return nil
+	}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+		whiteout := u.ApplyWhiteouts && strings.HasPrefix(path.Base(header.Name), WhiteoutPrefix)
+		if !whiteout && !u.pool.names[name] {
+			return nil
+		}
+	}
+	return u.pool.wait()
+}
+
+// Reads the content of the regular file with the given header from the
+// archive, and has the pool write it to name.
+func (u *Untar) submitFile(header *tar.Header, name string) error {
+	var buf bytes.Buffer
+	var src io.Reader = u.archive
+	if u.ctx != nil {
+		src = &contextReader{ctx: u.ctx, r: src}
+	}
+	if _, err := copyBuffer(&buf, src, u.BufferSize); err != nil {
+		return err
+	}
+	u.pool.submit(name, func() error {
+		return u.extractFile(header, name, &buf)
+	})
+	return nil
+}
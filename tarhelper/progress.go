@@ -0,0 +1,203 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The interval between calls to Tar.BytesWrittenFunc when no ProgressInterval
+// is set.
+const defaultProgressInterval = time.Second
+
+// Writes the header for an entry to the archive, preceded by the headers for
+// any pending parent directories, and reports the start of the entry to the
+// ProgressFunc. When estimating, the entry is counted instead. The header is
+// updated with any changes made by the HeaderTransform, and errEntryDropped
+// is returned if it dropped the entry, or if the entry was written before the
+// checkpoint being resumed from.
+func (t *Tar) writeHeader(header *tar.Header) error {
+	if keep, err := t.transformHeader(header); err != nil {
+		return err
+	} else if !keep {
+		return errEntryDropped
+	}
+	if err := t.flushPendingDirs(); err != nil {
+		return err
+	}
+	if t.resumed(header) {
+		return errEntryDropped
+	}
+	if err := t.checkpoint(); err != nil {
+		return err
+	}
+
+	t.prepareHeader(header)
+	if err := t.checkSize(header); err != nil {
+		return err
+	}
+	if t.estimate != nil {
+		t.estimate.Entries++
+		t.estimate.Bytes += header.Size
+		return nil
+	}
+	if err := t.archive.WriteHeader(header); err != nil {
+		if t.Format != tar.FormatUnknown && !t.Cpio {
+			// nothing has been written for the entry, so it can be skipped
+			return entryError(header.Name, fmt.Errorf("can't be represented in the %v format: %v", t.Format, err))
+		}
+		return err
+	}
+	t.lastEntry = header.Name
+	t.countEntry(header)
+	t.reportThroughput(false)
+	if t.ProgressFunc != nil {
+		t.ProgressFunc(header.Name, 0, header.Size)
+	}
+	return nil
+}
+
+// Returned by writeHeader for entries dropped by the HeaderTransform, whose
+// content shouldn't be written.
+var errEntryDropped = errors.New("entry dropped by the header transform")
+
+// Returns err, unless it is errEntryDropped, for entries that have nothing
+// more to write than their header.
+func ignoreDropped(err error) error {
+	if err == errEntryDropped {
+		return nil
+	}
+	return err
+}
+
+// Passes the header to the HeaderTransform, if there is one, updating the
+// header in place with the result. Reports false if the entry was dropped.
+func (t *Tar) transformHeader(header *tar.Header) (bool, error) {
+	if t.HeaderTransform == nil {
+		return true, nil
+	}
+	name := header.Name
+	h, err := t.HeaderTransform(header)
+	if err != nil {
+		return false, fmt.Errorf("failed to transform header for %q: %v", name, err)
+	}
+	if h == nil {
+		t.countExcluded(name, SkipTransformed, "HeaderTransform")
+		return false, nil
+	}
+	if h != header {
+		*header = *h
+	}
+	return true, nil
+}
+
+// Applies the settings that affect every header written.
+func (t *Tar) prepareHeader(header *tar.Header) {
+	if t.Format != tar.FormatUnknown {
+		header.Format = t.Format
+	}
+	if len(t.PAXRecords) > 0 && !t.Cpio {
+		records := make(map[string]string, len(t.PAXRecords)+len(header.PAXRecords))
+		for k, v := range t.PAXRecords {
+			records[k] = v
+		}
+		for k, v := range header.PAXRecords {
+			records[k] = v
+		}
+		header.PAXRecords = records
+	}
+	if !t.PreserveSetuid {
+		header.Mode &^= c_ISUID | c_ISGID | c_ISVTX
+	}
+	if !t.IncludeTimestamps || !t.IncludeAccessTimes {
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	}
+	if t.IncludeTimestamps && header.Format == tar.FormatUnknown &&
+		(header.ModTime.Nanosecond() != 0 || !header.AccessTime.IsZero()) {
+		header.Format = tar.FormatPAX
+	}
+}
+
+// Writes the headers for any pending parent directories.
+func (t *Tar) flushPendingDirs() error {
+	pending := t.pendingDirs
+	t.pendingDirs = nil
+	for _, h := range pending {
+		if err := ignoreDropped(t.writeHeader(h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the content of the named entry to w, which is normally the archive,
+// reporting progress to the ProgressFunc as it goes and stopping if the
+// context is cancelled.
+func (t *Tar) copyContent(w io.Writer, name string, r io.Reader, size int64) (int64, error) {
+	if t.ctx != nil {
+		r = &contextReader{ctx: t.ctx, r: r}
+	}
+	if t.ProgressFunc != nil {
+		r = &progressReader{r: r, name: name, total: size, fn: t.ProgressFunc}
+	}
+	if t.meter != nil {
+		r = &throughputReader{r: r, t: t}
+	}
+	n, err := copyBuffer(w, r, t.BufferSize)
+	t.stats.BytesRead += n
+	return n, err
+}
+
+// progressReader reports the number of bytes read through it.
+type progressReader struct {
+	r     io.Reader
+	name  string
+	read  int64
+	total int64
+	fn    func(entry string, written, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.fn(p.name, p.read, p.total)
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written through it, periodically reporting
+// the running total.
+type countingWriter struct {
+	w        io.Writer
+	written  int64
+	interval time.Duration
+	last     time.Time
+	fn       func(written int64)
+}
+
+func newCountingWriter(w io.Writer, interval time.Duration, fn func(int64)) *countingWriter {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	return &countingWriter{w: w, interval: interval, last: time.Now(), fn: fn}
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.written += int64(n)
+	if now := time.Now(); now.Sub(c.last) >= c.interval {
+		c.last = now
+		c.fn(c.written)
+	}
+	return n, err
+}
+
+// Reports the final total.
+func (c *countingWriter) finish() {
+	c.fn(c.written)
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateLimitedWriter limits the rate bytes are written through it with a token
+// bucket, which fills at the rate and holds up to a second's worth of bytes.
+type rateLimitedWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func newRateLimitedWriter(ctx context.Context, w io.Writer, rate int64) *rateLimitedWriter {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &rateLimitedWriter{ctx: ctx, w: w, rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (r *rateLimitedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// write no more than the bucket can hold at once
+		chunk := b
+		if int64(len(chunk)) > r.rate {
+			chunk = chunk[:r.rate]
+		}
+		if err := r.wait(int64(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := r.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Waits until there are n tokens in the bucket and takes them, or until the
+// context is done.
+func (r *rateLimitedWriter) wait(n int64) error {
+	r.refill(time.Now())
+	if r.tokens < n {
+		delay := time.Duration(float64(n-r.tokens) / float64(r.rate) * float64(time.Second))
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return r.ctx.Err()
+		case now := <-timer.C:
+			r.refill(now)
+		}
+	}
+	r.tokens -= n
+	return nil
+}
+
+// Adds the tokens accumulated since the last refill.
+func (r *rateLimitedWriter) refill(now time.Time) {
+	elapsed := now.Sub(r.last)
+	r.last = now
+	r.tokens += int64(elapsed.Seconds() * float64(r.rate))
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+}
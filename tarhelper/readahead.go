@@ -0,0 +1,154 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The largest file read ahead, larger files are read as they are archived.
+const maxReadAheadSize = 1024 * 1024
+
+// readAhead reads the content of the small files in a directory into memory
+// ahead of them being archived, in the order they will be archived. A file
+// holds one of a limited number of slots from when it is started until the
+// archive moves past it, so that no more than that many files are in flight
+// or held in memory at once.
+type readAhead struct {
+	t     *Tar
+	files []*prefetchedFile
+	slots chan struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// prefetchedFile is the content of a file read ahead.
+type prefetchedFile struct {
+	name string
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Starts reading ahead the files that will be archived from the listing of
+// dir, if ReadAhead is set. Returns nil if there is nothing to read ahead.
+func (t *Tar) startReadAhead(dir string, files []os.FileInfo) *readAhead {
+	if t.ReadAhead <= 0 || t.estimate != nil || !t.readsContent() {
+		return nil
+	}
+
+	ra := &readAhead{
+		t:     t,
+		slots: make(chan struct{}, t.ReadAhead),
+		stop:  make(chan struct{}),
+	}
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		if !f.Mode().IsRegular() || f.Size() == 0 || f.Size() > maxReadAheadSize ||
+			!t.mayArchive(name, f) {
+			continue
+		}
+		p := &prefetchedFile{name: name, done: make(chan struct{})}
+		ra.files = append(ra.files, p)
+		if t.prefetched == nil {
+			t.prefetched = make(map[string]*prefetchedFile)
+		}
+		t.prefetched[name] = p
+	}
+	if len(ra.files) == 0 {
+		return nil
+	}
+
+	// feed the files to the workers in order as slots become free
+	jobs := make(chan *prefetchedFile)
+	go func() {
+		defer close(jobs)
+		for _, p := range ra.files {
+			select {
+			case ra.slots <- struct{}{}:
+			case <-ra.stop:
+				return
+			}
+			select {
+			case jobs <- p:
+			case <-ra.stop:
+				return
+			}
+		}
+	}()
+	for i := 0; i < t.ReadAhead; i++ {
+		ra.wg.Add(1)
+		go func() {
+			defer ra.wg.Done()
+			for p := range jobs {
+				p.data, p.err = t.readFile(p.name)
+				close(p.done)
+			}
+		}()
+	}
+	return ra
+}
+
+// Frees the slot held by the named file once the archive has moved past it,
+// whether or not its content was used.
+func (ra *readAhead) release(name string) {
+	if ra == nil {
+		return
+	}
+	p, ok := ra.t.prefetched[name]
+	if !ok {
+		return
+	}
+	delete(ra.t.prefetched, name)
+	<-p.done
+	<-ra.slots
+}
+
+// Stops reading ahead, waiting for any reads in progress to finish.
+func (ra *readAhead) close() {
+	if ra == nil {
+		return
+	}
+	close(ra.stop)
+	ra.wg.Wait()
+	for _, p := range ra.files {
+		delete(ra.t.prefetched, p.name)
+	}
+}
+
+// Reads the whole of the named file within the target.
+func (t *Tar) readFile(name string) ([]byte, error) {
+	f, err := t.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// Opens the content of the named file within the target, using what was
+// read ahead if there is any.
+func (t *Tar) openContent(name string) (io.ReadCloser, error) {
+	if p, ok := t.prefetched[name]; ok {
+		<-p.done
+		if p.err != nil {
+			return nil, p.err
+		}
+		return ioutil.NopCloser(bytes.NewReader(p.data)), nil
+	}
+	return t.open(name)
+}
+
+// Reports whether the named entry could be archived, as far as the
+// exclusions, ignore file and included paths go.
+func (t *Tar) mayArchive(name string, f os.FileInfo) bool {
+	if t.shouldBeExcluded(name) || !t.shouldBeIncluded(name) {
+		return false
+	}
+	return t.ignore == nil || !t.ignore.Match(filepath.ToSlash(filepath.Clean(name)), f.IsDir())
+}
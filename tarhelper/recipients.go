@@ -0,0 +1,209 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streams encrypted to recipients start with this magic number, followed by
+// the number of recipients as a big endian uint16, a stanza for each of
+// them and then the random prefix of the nonces, after which the chunks are
+// as in streams encrypted with a key. Each stanza is an ephemeral X25519
+// public key and the key the chunks are encrypted with, encrypted with
+// AES-256-GCM using a key derived with HKDF-SHA256 from the shared secret of
+// the ephemeral key and the recipient's key, as age does.
+var recipientsMagic = []byte("TARHX255")
+
+const (
+	// The size of X25519 public keys.
+	x25519KeySize = 32
+
+	// The size of the content key once wrapped for a recipient.
+	wrappedKeySize = 32 + 16
+
+	// The size of the stanza for each recipient.
+	stanzaSize = x25519KeySize + wrappedKeySize
+
+	// The most recipients a stream can be encrypted to.
+	maxRecipients = 1<<16 - 1
+)
+
+// The HKDF info for the keys that wrap the content key.
+const wrapInfo = "tarhelper X25519 key wrap"
+
+// Returns the AEAD wrapping the content key for the recipient with the
+// public key recipient, given the shared secret of it and the ephemeral
+// public key of the stanza.
+func newWrapAEAD(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeral...), recipient...)
+	return newEncryptAEAD(hkdfSHA256(shared, salt, wrapInfo))
+}
+
+// Derives a 32 byte key from the secret with HKDF-SHA256, as in RFC 5869,
+// whose expansion is a single HMAC for a key the size of the digest.
+func hkdfSHA256(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// The nonce used to wrap content keys, which is always zero as every key
+// wrapping one is only ever used once.
+var wrapNonce = make([]byte, 12)
+
+// NewRecipientsEncryptWriter returns a writer that encrypts what is written
+// to it for each of the X25519 public keys of the recipients, writing the
+// result to w, as is done for Tar.Recipients. The data is encrypted with a
+// random key, as with NewEncryptWriter, and that key is wrapped for each
+// recipient so that any of them can decrypt it with NewIdentityDecryptReader
+// and their private key, without sharing a secret. The writer has to be
+// closed to write the last chunk, which doesn't close w.
+func NewRecipientsEncryptWriter(w io.Writer, recipients []*ecdh.PublicKey) (io.WriteCloser, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if err := writeRecipientsHeader(w, key, prefix, recipients); err != nil {
+		return nil, err
+	}
+	aead, err := newEncryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptWriter(w, aead, prefix), nil
+}
+
+// Writes the header of a stream encrypted with the key and nonce prefix for
+// the recipients.
+func writeRecipientsHeader(w io.Writer, key, prefix []byte, recipients []*ecdh.PublicKey) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients to encrypt the archive for")
+	}
+	if len(recipients) > maxRecipients {
+		return fmt.Errorf("an archive can't be encrypted for more than %d recipients", maxRecipients)
+	}
+
+	var header bytes.Buffer
+	header.Write(recipientsMagic)
+	binary.Write(&header, binary.BigEndian, uint16(len(recipients)))
+	for i, recipient := range recipients {
+		if recipient == nil || recipient.Curve() != ecdh.X25519() {
+			return fmt.Errorf("recipient %d is not an X25519 public key", i)
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return fmt.Errorf("recipient %d: %v", i, err)
+		}
+		public := ephemeral.PublicKey().Bytes()
+		aead, err := newWrapAEAD(shared, public, recipient.Bytes())
+		if err != nil {
+			return err
+		}
+		header.Write(public)
+		header.Write(aead.Seal(nil, wrapNonce, key, nil))
+	}
+	header.Write(prefix)
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// NewIdentityDecryptReader returns a reader that decrypts what was written by
+// a writer from NewRecipientsEncryptWriter, such as an archive written with
+// Tar.Recipients, reading it from r. The identity is the X25519 private key
+// of one of the recipients. Reading fails if the stream has been modified or
+// truncated.
+func NewIdentityDecryptReader(r io.Reader, identity *ecdh.PrivateKey) (io.Reader, error) {
+	key, prefix, err := readRecipientsHeader(r, identity)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newEncryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(r, aead, prefix), nil
+}
+
+// Reads the header of a stream encrypted to recipients, returning the key
+// it is encrypted with, as unwrapped with the identity, and the nonce
+// prefix.
+func readRecipientsHeader(r io.Reader, identity *ecdh.PrivateKey) ([]byte, []byte, error) {
+	if identity == nil || identity.Curve() != ecdh.X25519() {
+		return nil, nil, errors.New("the identity is not an X25519 private key")
+	}
+	start := make([]byte, len(recipientsMagic)+2)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the encryption header: %v", err)
+	}
+	if bytes.Equal(start[:len(encryptMagic)], encryptMagic) {
+		return nil, nil, errors.New("the archive is encrypted with a key, not to recipients")
+	}
+	if !bytes.Equal(start[:len(recipientsMagic)], recipientsMagic) {
+		return nil, nil, errors.New("the archive is not encrypted")
+	}
+	count := int(binary.BigEndian.Uint16(start[len(recipientsMagic):]))
+	rest := make([]byte, count*stanzaSize+encryptPrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the encryption header: %v", err)
+	}
+
+	public := identity.PublicKey().Bytes()
+	for i := 0; i < count; i++ {
+		stanza := rest[i*stanzaSize : (i+1)*stanzaSize]
+		ephemeral, err := ecdh.X25519().NewPublicKey(stanza[:x25519KeySize])
+		if err != nil {
+			continue
+		}
+		shared, err := identity.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+		aead, err := newWrapAEAD(shared, stanza[:x25519KeySize], public)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, err := aead.Open(nil, wrapNonce, stanza[x25519KeySize:], nil); err == nil {
+			return key, rest[count*stanzaSize:], nil
+		}
+	}
+	return nil, nil, errors.New("the archive is not encrypted to this identity")
+}
+
+// Rewrap copies an archive encrypted to recipients from r to w, changing the
+// recipients it is encrypted to without decrypting it, such as to rotate
+// keys or give access to another system. The identity is the private key of
+// one of its current recipients. Recipients that are left out can't decrypt
+// the copy with their identity, but the key the content is encrypted with is
+// unchanged, so anyone who kept it still can.
+func Rewrap(w io.Writer, r io.Reader, identity *ecdh.PrivateKey, recipients []*ecdh.PublicKey) error {
+	key, prefix, err := readRecipientsHeader(r, identity)
+	if err != nil {
+		return err
+	}
+	if err := writeRecipientsHeader(w, key, prefix, recipients); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,402 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package tarhelper
+
+import (
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Flags for the *at syscalls and open, which aren't all exported by the
+// syscall package.
+const (
+	atRemoveDir       = 0x200
+	atSymlinkNofollow = 0x100
+	oPath             = 0x200000
+)
+
+// The flags used to open each directory on the way to an entry.
+const dirFlags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+
+// RootFS is a TargetFS for a directory on disk that is opened once, with
+// everything within it reached relative to that directory through openat(2),
+// mkdirat(2), linkat(2), symlinkat(2) and related calls. Symlinks are never
+// followed on the way to an entry, and Chown, Chmod and Chtimes don't follow
+// a symlink at the entry itself, so a symlink swapped in while extracting a
+// hostile archive can't lead anywhere outside of the directory. Stat follows
+// symlinks within the directory, treating absolute targets as relative to
+// it. Extract into it with NewUntarFS, and Close it once done.
+type RootFS struct {
+	fd int
+}
+
+// OpenRootFS opens the directory dir as a RootFS.
+func OpenRootFS(dir string) (*RootFS, error) {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, pathError("open", dir, err)
+	}
+	return &RootFS{fd: fd}, nil
+}
+
+// Close closes the directory.
+func (r *RootFS) Close() error {
+	return syscall.Close(r.fd)
+}
+
+func (r *RootFS) Lstat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := r.at(name, func(dirfd int, base string) error {
+		fd, err := syscall.Openat(dirfd, base, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), base)
+		defer f.Close()
+		fi, err = f.Stat()
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		return err
+	})
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+	return fi, nil
+}
+
+func (r *RootFS) Stat(name string) (os.FileInfo, error) {
+	n := path.Clean("/" + name)
+	for i := 0; i < maxSymlinks; i++ {
+		fi, err := r.Lstat(n)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return fi, err
+		}
+		link, err := r.Readlink(n)
+		if err != nil {
+			return nil, err
+		}
+		if path.IsAbs(link) {
+			n = path.Clean(link)
+		} else {
+			n = path.Join(path.Dir(n), link)
+		}
+	}
+	return nil, pathError("stat", name, syscall.ELOOP)
+}
+
+func (r *RootFS) Open(name string) (io.ReadCloser, error) {
+	f, err := r.openFile(name, syscall.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *RootFS) OpenFile(name string, flag int, perm os.FileMode) (TargetFile, error) {
+	f, err := r.openFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *RootFS) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	var f *os.File
+	err := r.at(name, func(dirfd int, base string) error {
+		fd, err := syscall.Openat(dirfd, base, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, sysMode(perm))
+		if err != nil {
+			return err
+		}
+		f = os.NewFile(uintptr(fd), name)
+		return nil
+	})
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+
+func (r *RootFS) MkdirAll(name string, perm os.FileMode) error {
+	fd := r.fd
+	defer func() { r.closeDir(fd) }()
+	for _, c := range rootParts(name) {
+		if err := syscall.Mkdirat(fd, c, sysMode(perm)); err != nil && err != syscall.EEXIST {
+			return pathError("mkdir", name, err)
+		}
+		next, err := syscall.Openat(fd, c, dirFlags, 0)
+		if err != nil {
+			return pathError("mkdir", name, err)
+		}
+		r.closeDir(fd)
+		fd = next
+	}
+	return nil
+}
+
+func (r *RootFS) RemoveAll(name string) error {
+	err := r.at(name, removeAllAt)
+	if err != nil && err != syscall.ENOENT {
+		return pathError("removeall", name, err)
+	}
+	return nil
+}
+
+func (r *RootFS) Symlink(oldname, newname string) error {
+	err := r.at(newname, func(dirfd int, base string) error {
+		return symlinkat(oldname, dirfd, base)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (r *RootFS) Link(oldname, newname string) error {
+	err := r.at(oldname, func(olddirfd int, oldbase string) error {
+		return r.at(newname, func(newdirfd int, newbase string) error {
+			return linkat(olddirfd, oldbase, newdirfd, newbase)
+		})
+	})
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (r *RootFS) Readlink(name string) (string, error) {
+	var link string
+	err := r.at(name, func(dirfd int, base string) error {
+		var err error
+		link, err = readlinkat(dirfd, base)
+		return err
+	})
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	return link, nil
+}
+
+// Chmod changes the mode of the named entry, which is refused for a symlink
+// since Linux can't change the mode of a symlink itself. The mode is changed
+// through /proc/self/fd, so that the entry is only looked up once.
+func (r *RootFS) Chmod(name string, mode os.FileMode) error {
+	err := r.at(name, func(dirfd int, base string) error {
+		fd, err := syscall.Openat(dirfd, base, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			return err
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			return syscall.ELOOP
+		}
+		return syscall.Chmod("/proc/self/fd/"+strconv.Itoa(fd), sysMode(mode))
+	})
+	if err != nil {
+		return pathError("chmod", name, err)
+	}
+	return nil
+}
+
+func (r *RootFS) Chown(name string, uid, gid int) error {
+	return r.Lchown(name, uid, gid)
+}
+
+func (r *RootFS) Lchown(name string, uid, gid int) error {
+	err := r.at(name, func(dirfd int, base string) error {
+		return syscall.Fchownat(dirfd, base, uid, gid, atSymlinkNofollow)
+	})
+	if err != nil {
+		return pathError("lchown", name, err)
+	}
+	return nil
+}
+
+func (r *RootFS) Chtimes(name string, atime, mtime time.Time) error {
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	err := r.at(name, func(dirfd int, base string) error {
+		return utimensat(dirfd, base, &ts, atSymlinkNofollow)
+	})
+	if err != nil {
+		return pathError("chtimes", name, err)
+	}
+	return nil
+}
+
+func (r *RootFS) Mknod(name string, mode uint32, dev int) error {
+	osUmask(0000)
+	err := r.at(name, func(dirfd int, base string) error {
+		return syscall.Mknodat(dirfd, base, mode, dev)
+	})
+	if err != nil {
+		return pathError("mknod", name, err)
+	}
+	return nil
+}
+
+// Opens each directory on the way to the named entry without following
+// symlinks, and calls fn with the last of them and the entry's name within
+// it. The root itself is "." within the root.
+func (r *RootFS) at(name string, fn func(dirfd int, base string) error) error {
+	parts := rootParts(name)
+	if len(parts) == 0 {
+		return fn(r.fd, ".")
+	}
+	fd := r.fd
+	for _, c := range parts[:len(parts)-1] {
+		next, err := syscall.Openat(fd, c, dirFlags, 0)
+		r.closeDir(fd)
+		if err != nil {
+			return err
+		}
+		fd = next
+	}
+	defer r.closeDir(fd)
+	return fn(fd, parts[len(parts)-1])
+}
+
+// Closes a directory opened on the way to an entry, leaving the root open.
+func (r *RootFS) closeDir(fd int) {
+	if fd != r.fd {
+		syscall.Close(fd)
+	}
+}
+
+// Splits a name into the elements of its path within the root.
+func rootParts(name string) []string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// Converts a FileMode into the mode bits used by the syscalls.
+func sysMode(perm os.FileMode) uint32 {
+	mode := uint32(perm.Perm())
+	if perm&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if perm&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if perm&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// Removes the named entry within the directory dirfd, along with everything
+// within it if it is a directory, without following symlinks.
+func removeAllAt(dirfd int, name string) error {
+	err := unlinkat(dirfd, name, 0)
+	if err != syscall.EISDIR {
+		return err
+	}
+
+	fd, err := syscall.Openat(dirfd, name, dirFlags, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	for i := 0; err == nil && i < len(names); i++ {
+		err = removeAllAt(fd, names[i])
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	return unlinkat(dirfd, name, atRemoveDir)
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func symlinkat(target string, dirfd int, name string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dirfd), uintptr(unsafe.Pointer(p)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkat(olddirfd int, oldname string, newdirfd int, newname string) error {
+	o, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(olddirfd), uintptr(unsafe.Pointer(o)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(n)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	for size := 128; ; size *= 2 {
+		b := make([]byte, size)
+		n, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&b[0])), uintptr(size), 0, 0)
+		if errno != 0 {
+			return "", errno
+		}
+		if int(n) < size {
+			return string(b[:n]), nil
+		}
+	}
+}
+
+func utimensat(dirfd int, name string, ts *[2]syscall.Timespec, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(ts)), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
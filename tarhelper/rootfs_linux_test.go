@@ -0,0 +1,64 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/apcera/util/testtool"
+)
+
+func TestRootFS(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/f"), []byte("data"), 0755))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "a/b/c/f"), path.Join(dir, "a/b/link")))
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, dir).Archive())
+
+	// extraction matches the original directory
+	target := TempDir(t)
+	fsys, err := OpenRootFS(target)
+	TestExpectSuccess(t, err)
+	defer fsys.Close()
+	u := NewUntarFS(bytes.NewReader(w.Bytes()), fsys)
+	u.PreserveTimestamps = true
+	u.Sparse = true
+	TestExpectSuccess(t, u.Extract())
+	report, err := VerifyWithOptions(bytes.NewReader(w.Bytes()), target, VerifyOptions{SkipOwners: true})
+	TestExpectSuccess(t, err)
+	TestEqual(t, report.Mismatches, []Mismatch(nil))
+
+	// symlinks leading outside are never followed on the way to an entry
+	outside := TempDir(t)
+	TestExpectSuccess(t, os.Symlink(outside, path.Join(target, "out")))
+	_, err = fsys.OpenFile("/out/x", os.O_WRONLY|os.O_CREATE, 0644)
+	TestExpectError(t, err)
+	TestExpectError(t, fsys.MkdirAll("/out/y", 0755))
+	TestExpectError(t, fsys.Symlink("z", "/out/z"))
+	TestExpectError(t, fsys.Chmod("/out", 0700))
+	fi, err := os.Stat(outside)
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode().Perm(), os.FileMode(0755))
+	TestExpectSuccess(t, fsys.RemoveAll("/out"))
+	infos, err := ioutil.ReadDir(outside)
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(infos), 0)
+
+	// absolute links are followed within the root
+	TestExpectSuccess(t, os.Symlink("/a/b/c/f", path.Join(target, "abs")))
+	fi, err = fsys.Stat("/abs")
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Size(), int64(4))
+
+	// directories are removed along with their contents
+	TestExpectSuccess(t, fsys.RemoveAll("/a"))
+	_, err = os.Lstat(path.Join(target, "a"))
+	TestEqual(t, os.IsNotExist(err), true)
+}
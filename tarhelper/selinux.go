@@ -0,0 +1,187 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// The extended attribute holding the SELinux security context of a file.
+const selinuxXattr = "security.selinux"
+
+// The most paths looked up by each run of matchpathcon.
+const matchpathconBatch = 256
+
+// SELinuxPolicy decides what is done with the SELinux security contexts of
+// extracted entries.
+type SELinuxPolicy int
+
+const (
+	// SELinuxIgnore leaves extracted entries with the contexts they are
+	// given by default where they are extracted.
+	SELinuxIgnore SELinuxPolicy = iota
+
+	// SELinuxRestore gives extracted entries the contexts recorded in the
+	// archive, as by Tar.IncludeSELinux.
+	SELinuxRestore
+
+	// SELinuxRelabel gives extracted entries the contexts that the loaded
+	// policy gives their paths within the archive, taken from the root "/",
+	// as looked up with matchpathcon, for extracting root filesystem images.
+	SELinuxRelabel
+)
+
+// selinuxLabel is an extracted entry to give a security context, along
+// with the entry's name in the archive.
+type selinuxLabel struct {
+	name     string
+	entry    string
+	typeflag byte
+	label    string
+}
+
+// Records the security context of the named file in the header's PAX
+// records.
+func addSELinuxLabel(header *tar.Header, name string) error {
+	label, err := readSELinuxLabel(name)
+	if err != nil || label == "" {
+		return err
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxXattrPrefix+selinuxXattr] = label
+	return nil
+}
+
+// Returns the security context recorded in the header's PAX records.
+func headerSELinuxLabel(header *tar.Header) (string, bool) {
+	label, ok := header.PAXRecords[paxXattrPrefix+selinuxXattr]
+	return label, ok && label != ""
+}
+
+// Records the entry with the given header, extracted to name, to be given
+// its security context once extraction is complete, according to the
+// SELinux policy.
+func (u *Untar) recordSELinuxLabel(header *tar.Header, name string) {
+	l := selinuxLabel{name: name, entry: header.Name, typeflag: header.Typeflag}
+	if u.SELinux == SELinuxRestore {
+		var ok bool
+		if l.label, ok = headerSELinuxLabel(header); !ok {
+			return
+		}
+	}
+	u.mu.Lock()
+	u.selinuxLabels = append(u.selinuxLabels, l)
+	u.mu.Unlock()
+}
+
+// Gives the extracted entries their security contexts, looking them up
+// first for SELinuxRelabel. Failures are reported to the WarningFunc, as
+// contexts can only be set with privileges where SELinux is enabled.
+func (u *Untar) applySELinuxLabels() {
+	if u.SELinux == SELinuxRelabel {
+		u.lookupSELinuxLabels()
+	}
+	for _, l := range u.selinuxLabels {
+		if l.label == "" {
+			continue
+		}
+		if err := writeSELinuxLabel(l.name, l.label); err != nil {
+			u.warn(l.entry, fmt.Errorf("failed to set the SELinux context: %v", err))
+		}
+	}
+}
+
+// Looks up the contexts the policy gives the extracted entries, with as few
+// runs of matchpathcon as there can be, as each run loads the policy's file
+// contexts.
+func (u *Untar) lookupSELinuxLabels() {
+	byType := make(map[string][]int)
+	var types []string
+	for i, l := range u.selinuxLabels {
+		t := matchpathconType(l.typeflag)
+		if byType[t] == nil {
+			types = append(types, t)
+		}
+		byType[t] = append(byType[t], i)
+	}
+
+	for _, t := range types {
+		indexes := byType[t]
+		for len(indexes) > 0 {
+			batch := indexes
+			if len(batch) > matchpathconBatch {
+				batch = batch[:matchpathconBatch]
+			}
+			indexes = indexes[len(batch):]
+
+			paths := make([]string, len(batch))
+			for i, index := range batch {
+				paths[i] = path.Join("/", u.selinuxLabels[index].entry)
+			}
+			labels, err := matchpathcon(t, paths)
+			for i, index := range batch {
+				if err != nil {
+					u.warn(u.selinuxLabels[index].entry, err)
+				} else {
+					u.selinuxLabels[index].label = labels[i]
+				}
+			}
+		}
+	}
+}
+
+// Returns the contexts the policy gives each of the paths for files of the
+// given matchpathcon type, which are empty for paths it has none for.
+func matchpathcon(fileType string, paths []string) ([]string, error) {
+	cmd := exec.Command("matchpathcon", append([]string{"-n", "-m", fileType}, paths...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, fmt.Errorf("failed to look up the SELinux context: %v", err)
+		}
+		return nil, fmt.Errorf("failed to look up the SELinux context: %v: %s", err, msg)
+	}
+
+	var labels []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		label := strings.TrimSpace(s.Text())
+		if label == "<<none>>" {
+			label = ""
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) != len(paths) {
+		return nil, fmt.Errorf("matchpathcon gave %d contexts for %d paths", len(labels), len(paths))
+	}
+	return labels, nil
+}
+
+// Returns the matchpathcon file type for entries of the given type.
+func matchpathconType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "lnk_file"
+	case tar.TypeChar:
+		return "chr_file"
+	case tar.TypeBlock:
+		return "blk_file"
+	case tar.TypeFifo:
+		return "pipe"
+	default:
+		return "file"
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package tarhelper
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Returns the SELinux security context of the named file, without following
+// symlinks, or "" if it doesn't have one.
+func readSELinuxLabel(name string) (string, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	a, err := syscall.BytePtrFromString(selinuxXattr)
+	if err != nil {
+		return "", err
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), 0, 0, 0, 0)
+	if errno == syscall.ENODATA || errno == syscall.ENOTSUP || (errno == 0 && size == 0) {
+		return "", nil
+	} else if errno != 0 {
+		return "", errno
+	}
+	value := make([]byte, size)
+	size, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(unsafe.Pointer(&value[0])), size, 0, 0)
+	if errno != 0 {
+		return "", errno
+	}
+	return string(value[:size]), nil
+}
+
+// Sets the SELinux security context of the named file, without following
+// symlinks.
+func writeSELinuxLabel(name, label string) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(selinuxXattr)
+	if err != nil {
+		return err
+	}
+	value := []byte(label)
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
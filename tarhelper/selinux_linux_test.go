@@ -0,0 +1,126 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/apcera/util/testtool"
+)
+
+func TestTarSELinux(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	label := "system_u:object_r:etc_t:s0"
+	dir := TempDir(t)
+	name := path.Join(dir, "file")
+	TestExpectSuccess(t, ioutil.WriteFile(name, []byte("data"), 0644))
+	if err := writeSELinuxLabel(name, label); err != nil {
+		t.Skipf("SELinux contexts can't be set here: %v", err)
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IncludeSELinux = true
+	TestExpectSuccess(t, tw.Archive())
+
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Name == "file" {
+			recorded, ok := headerSELinuxLabel(header)
+			TestEqual(t, ok, true)
+			TestEqual(t, recorded, label)
+			break
+		}
+	}
+
+	extractionPath := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+	u.SELinux = SELinuxRestore
+	TestExpectSuccess(t, u.Extract())
+	restored, err := readSELinuxLabel(path.Join(extractionPath, "file"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, restored, label)
+}
+
+func TestUntarSELinux(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644,
+		PAXRecords: map[string]string{"SCHILY.xattr.security.selinux": "system_u:object_r:passwd_file_t:s0"},
+	}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "passwd"}))
+	TestExpectSuccess(t, tw.Close())
+
+	// contexts that can't be set are warned about, once everything has been
+	// extracted
+	extract := func(policy SELinuxPolicy) (string, map[string]string) {
+		dir := TempDir(t)
+		warnings := make(map[string]string)
+		u := NewUntar(bytes.NewReader(w.Bytes()), dir)
+		u.SELinux = policy
+		u.WarningFunc = func(name string, err error) {
+			warnings[name] = err.Error()
+		}
+		TestExpectSuccess(t, u.Extract())
+		return dir, warnings
+	}
+
+	// only the recorded contexts are restored
+	dir, warnings := extract(SELinuxRestore)
+	if len(warnings) == 0 {
+		label, err := readSELinuxLabel(path.Join(dir, "etc/passwd"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, label, "system_u:object_r:passwd_file_t:s0")
+	} else {
+		TestEqual(t, len(warnings), 1)
+		TestNotEqual(t, warnings["etc/passwd"], "")
+	}
+
+	// or every entry is relabelled with the contexts looked up for its path
+	// and type, here from a stand in for matchpathcon
+	bin := TempDir(t)
+	script := "#!/bin/sh\n" +
+		"[ \"$1 $2\" = \"-n -m\" ] || exit 1\n" +
+		"type=$3; shift 3\n" +
+		"for p in \"$@\"; do echo \"system_u:object_r:${type}_t:s0\"; done\n"
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(bin, "matchpathcon"), []byte(script), 0755))
+	oldPath := os.Getenv("PATH")
+	AddTestFinalizer(func() { os.Setenv("PATH", oldPath) })
+	TestExpectSuccess(t, os.Setenv("PATH", bin+":"+oldPath))
+
+	dir, warnings = extract(SELinuxRelabel)
+	if len(warnings) == 0 {
+		for name, label := range map[string]string{
+			"etc":        "system_u:object_r:dir_t:s0",
+			"etc/passwd": "system_u:object_r:file_t:s0",
+			"etc/link":   "system_u:object_r:lnk_file_t:s0",
+		} {
+			set, err := readSELinuxLabel(path.Join(dir, name))
+			TestExpectSuccess(t, err)
+			TestEqual(t, set, label)
+		}
+	} else {
+		TestEqual(t, len(warnings), 3)
+		TestNotEqual(t, warnings["etc/link"], "")
+	}
+
+	// and failing to look them up is warned about too
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(bin, "matchpathcon"), []byte("#!/bin/sh\necho no policy >&2\nexit 1\n"), 0755))
+	_, warnings = extract(SELinuxRelabel)
+	TestEqual(t, len(warnings), 3)
+	TestEqual(t, warnings["etc/passwd"], "failed to look up the SELinux context: exit status 1: no policy")
+}
@@ -0,0 +1,18 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !linux
+
+package tarhelper
+
+import (
+	"fmt"
+)
+
+// SELinux contexts are only supported on Linux.
+func readSELinuxLabel(name string) (string, error) {
+	return "", nil
+}
+
+func writeSELinuxLabel(name, label string) error {
+	return fmt.Errorf("SELinux is not supported on this platform")
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// Option configures the Tar that ServeTar writes, such as setting its
+// Compression or ExcludedPaths.
+type Option func(t *Tar)
+
+// ServeTar replies to the request with an archive of dir, as written by a
+// Tar configured by opts, for endpoints that download a directory. The
+// Content-Type follows the Compression, and the Content-Disposition names
+// the download after the directory. No Content-Length is set as the archive
+// is streamed while it is written, and HTTP/1.1 responses are always sent
+// with chunked transfer encoding, even for archives small enough for the
+// server to have buffered. Writing stops if the request's context is
+// cancelled, such as when the client goes away. HEAD requests are only given
+// the headers.
+//
+// An error before the first 32KB of the archive was sent is replied to with
+// a 500 status. After that the status can't be changed, so the error is only
+// returned, and the handler can panic with http.ErrAbortHandler to have the
+// client see the download fail rather than end early.
+func ServeTar(w http.ResponseWriter, r *http.Request, dir string, opts ...Option) error {
+	t := NewTar(nil, dir)
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", t.contentType())
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": t.fileName(dir),
+	}))
+	header.Del("Content-Length")
+	if r.ProtoMajor == 1 && r.ProtoAtLeast(1, 1) {
+		header.Set("Transfer-Encoding", "chunked")
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	// The start of the archive is held back, so that errors in setting up
+	// the archive, which may still have written the start of a compressed
+	// stream, can be given an error status.
+	rw := &responseWriter{w: w}
+	buf := bufio.NewWriterSize(rw, serveBufferSize)
+	t.dest = buf
+	err := t.ArchiveContext(r.Context())
+	if err == nil {
+		return buf.Flush()
+	}
+	if !rw.written {
+		header.Del("Content-Disposition")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+	return err
+}
+
+// The amount of the start of an archive that ServeTar holds back.
+const serveBufferSize = 32 * 1024
+
+// responseWriter records whether any of the archive was sent in the reply.
+type responseWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (r *responseWriter) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		r.written = true
+	}
+	return r.w.Write(b)
+}
+
+// Returns the media type of the archive being written.
+func (t *Tar) contentType() string {
+	if t.EncryptionKey != nil || t.Recipients != nil {
+		return "application/octet-stream"
+	}
+	switch t.Compression {
+	case NONE:
+		if t.Cpio {
+			return "application/x-cpio"
+		}
+		return "application/x-tar"
+	case GZIP:
+		return "application/gzip"
+	case BZIP2:
+		return "application/x-bzip2"
+	case XZ:
+		return "application/x-xz"
+	case ZSTD:
+		return "application/zstd"
+	}
+	return "application/octet-stream"
+}
+
+// Returns the file name for an archive of dir, with the extensions for the
+// archive format and Compression.
+func (t *Tar) fileName(dir string) string {
+	name := filepath.Base(dir)
+	if name == "." || name == string(filepath.Separator) {
+		name = "archive"
+	}
+	if t.Cpio {
+		name += ".cpio"
+	} else {
+		name += ".tar"
+	}
+	switch t.Compression {
+	case NONE:
+	case GZIP:
+		name += ".gz"
+	case BZIP2:
+		name += ".bz2"
+	case ZSTD:
+		name += ".zst"
+	default:
+		name += "." + string(t.Compression)
+	}
+	return name
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Signatures are Ed25519ph signatures, of the SHA-512 digest of the archive,
+// so that they can be made and checked as the archive is streamed.
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// Signature returns the detached signature of the last archive written when
+// SigningKey was set, which VerifySignature checks.
+func (t *Tar) Signature() []byte {
+	return t.signature
+}
+
+// Returns the hash that the archive is signed from, for SigningKey.
+func (t *Tar) newSigningHash() (hash.Hash, error) {
+	if len(t.SigningKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("signing keys need to be %d bytes, not %d",
+			ed25519.PrivateKeySize, len(t.SigningKey))
+	}
+	return sha512.New(), nil
+}
+
+// Signs the digest of the archive that was written.
+func (t *Tar) sign(h hash.Hash) error {
+	sig, err := t.SigningKey.Sign(nil, h.Sum(nil), signatureOptions)
+	if err != nil {
+		return fmt.Errorf("failed to sign the archive: %v", err)
+	}
+	t.signature = sig
+	return nil
+}
+
+// VerifySignature reads the archive from r, exactly as it was written, and
+// checks that signature is its detached signature from Tar.Signature, made
+// with the private key of key. It returns an error if it isn't.
+func VerifySignature(r io.Reader, signature []byte, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("public keys need to be %d bytes, not %d", ed25519.PublicKeySize, len(key))
+	}
+	h := sha512.New()
+	if _, err := copyBuffer(h, r, 0); err != nil {
+		return err
+	}
+	if err := ed25519.VerifyWithOptions(key, h.Sum(nil), signature, signatureOptions); err != nil {
+		return errors.New("the archive's signature is not valid")
+	}
+	return nil
+}
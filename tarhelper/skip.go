@@ -0,0 +1,142 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/apcera/util/pathmatch"
+)
+
+// SkipReason is the reason an entry was left out of an archive, as given to
+// Tar.OnSkip.
+type SkipReason int
+
+const (
+	// SkipExcluded is an entry matching the ExcludedPaths or ExcludeRegexps.
+	SkipExcluded SkipReason = iota
+
+	// SkipIgnored is an entry matching the IgnoreFile.
+	SkipIgnored
+
+	// SkipNotIncluded is an entry that isn't one of the IncludedPaths.
+	SkipNotIncluded
+
+	// SkipOtherFileSystem is an entry on, or a symlink being followed to,
+	// another filesystem with OneFileSystem.
+	SkipOtherFileSystem
+
+	// SkipSocket is a socket left out by the SocketPolicy.
+	SkipSocket
+
+	// SkipTransformed is an entry dropped by the HeaderTransform.
+	SkipTransformed
+
+	// SkipUnchanged is an entry left out of an incremental archive or layer
+	// as it hadn't changed.
+	SkipUnchanged
+
+	// SkipLoop is a symlink being followed back to a directory that
+	// contains it.
+	SkipLoop
+
+	// SkipFailed is an entry that couldn't be read, with ContinueOnError.
+	SkipFailed
+
+	// SkipTooLarge is a file larger than the MaxFileSize.
+	SkipTooLarge
+
+	// SkipModTime is an entry modified before the MinMtime or after the
+	// MaxMtime.
+	SkipModTime
+)
+
+func (r SkipReason) String() string {
+	switch r {
+	case SkipExcluded:
+		return "it matches the excluded paths"
+	case SkipIgnored:
+		return "it matches the ignore file"
+	case SkipNotIncluded:
+		return "it isn't one of the included paths"
+	case SkipOtherFileSystem:
+		return "it is on a different filesystem"
+	case SkipSocket:
+		return "it is a socket"
+	case SkipTransformed:
+		return "it was dropped by the header transform"
+	case SkipUnchanged:
+		return "it hasn't changed"
+	case SkipLoop:
+		return "it links back to a directory containing it"
+	case SkipFailed:
+		return "it couldn't be read"
+	case SkipTooLarge:
+		return "it is larger than the maximum file size"
+	case SkipModTime:
+		return "it was modified outside the times included"
+	}
+	return "unknown"
+}
+
+// Exclusion is an entry that was left out of an archive, as recorded with
+// Tar.RecordExclusions.
+type Exclusion struct {
+	// The path of the entry relative to the target directory.
+	Path string
+
+	// Why the entry was left out.
+	Reason SkipReason
+
+	// The rule that matched the entry, where there is one, which is the
+	// expression from the ExcludedPaths or ExcludeRegexps, the pattern from
+	// the IgnoreFile, or the name of the option otherwise, such as
+	// "ExcludeVCS" or "MaxFileSize".
+	Rule string
+}
+
+func (e Exclusion) String() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("%s: %v", e.Path, e.Reason)
+	}
+	return fmt.Sprintf("%s: %v (%s)", e.Path, e.Reason, e.Rule)
+}
+
+// Exclusions returns the entries left out of the last archive written with
+// RecordExclusions, or of the one being written, in the order they were
+// found.
+func (t *Tar) Exclusions() []Exclusion {
+	return t.exclusions
+}
+
+// Reports an entry that was left out of the archive, and the rule that
+// matched it if there is one, to the OnSkip function and RecordExclusions.
+func (t *Tar) skipped(name string, reason SkipReason, rule string) {
+	if t.estimate != nil {
+		return
+	}
+	if t.RecordExclusions {
+		t.exclusions = append(t.exclusions, Exclusion{Path: name, Reason: reason, Rule: rule})
+	}
+	if t.OnSkip != nil {
+		t.OnSkip(name, reason)
+	}
+}
+
+// Returns the last pattern of the ignore file that matches the named entry,
+// which is the one that decides it is ignored, or "" if it is ignored as a
+// parent directory matched.
+func ignoreRule(ignore *pathmatch.Set, name string, isDir bool) string {
+	name = filepath.ToSlash(filepath.Clean(name))
+	var rule string
+	for _, p := range ignore.Patterns() {
+		if p.Match(name, isDir) {
+			rule = ""
+			if !p.Negated() {
+				rule = p.String()
+			}
+		}
+	}
+	return rule
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The version of the snapshot format written by Snapshot.WriteTo.
+const snapshotVersion = 1
+
+// Snapshot records the state of the entries found when writing an archive,
+// so that a later archive of the same directory can hold only what has
+// changed since, with IncrementalFrom.
+type Snapshot struct {
+	// The entries by their slash separated paths relative to the target
+	// directory, without a leading "./".
+	Entries map[string]SnapshotEntry
+}
+
+// SnapshotEntry is the state of an entry when a Snapshot was taken.
+type SnapshotEntry struct {
+	// The tar type of the entry.
+	Typeflag byte
+
+	// The size of regular files.
+	Size int64
+
+	// The modification and change times of the entry.
+	ModTime    time.Time
+	ChangeTime time.Time
+}
+
+// The form of a snapshot written by WriteTo.
+type snapshotFile struct {
+	Version int                      `json:"version"`
+	Entries map[string]SnapshotEntry `json:"entries"`
+}
+
+// ReadSnapshot reads a Snapshot written by Snapshot.WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var f snapshotFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	if f.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", f.Version)
+	}
+	if f.Entries == nil {
+		f.Entries = make(map[string]SnapshotEntry)
+	}
+	return &Snapshot{Entries: f.Entries}, nil
+}
+
+// WriteTo writes the snapshot to w, to be read back by ReadSnapshot.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.Marshal(snapshotFile{Version: snapshotVersion, Entries: s.Entries})
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// Reports whether the entry is the same as it was when the snapshot was
+// taken.
+func (s *Snapshot) unchanged(name string, e SnapshotEntry) bool {
+	prev, ok := s.Entries[name]
+	return ok && prev.Typeflag == e.Typeflag && prev.Size == e.Size &&
+		prev.ModTime.Equal(e.ModTime) && prev.ChangeTime.Equal(e.ChangeTime)
+}
+
+// Snapshot returns the Snapshot of the entries found while writing the last
+// archive when RecordSnapshot was set, to use as IncrementalFrom for the
+// next one.
+func (t *Tar) Snapshot() *Snapshot {
+	return t.snapshot
+}
+
+// Returns the snapshot to record the entries found in, when one is wanted.
+func (t *Tar) newSeen() *Snapshot {
+	if !t.RecordSnapshot && t.IncrementalFrom == nil {
+		return nil
+	}
+	return &Snapshot{Entries: make(map[string]SnapshotEntry)}
+}
+
+// Returns the name an entry is recorded under in a snapshot.
+func snapshotName(name string) string {
+	return filepath.ToSlash(filepath.Clean(name))
+}
+
+// Records the named entry, with the header made from its FileInfo, in the
+// snapshot being taken, and reports whether it should be archived. Entries
+// other than directories are left out of incremental archives when they
+// haven't changed.
+func (t *Tar) trackEntry(name string, header *tar.Header) bool {
+	if t.seen == nil {
+		return true
+	}
+	name = snapshotName(name)
+	e := SnapshotEntry{
+		Typeflag:   header.Typeflag,
+		ModTime:    header.ModTime,
+		ChangeTime: header.ChangeTime,
+	}
+	if header.Typeflag == tar.TypeReg {
+		e.Size = header.Size
+	}
+	t.seen.Entries[name] = e
+
+	if t.IncrementalFrom == nil || header.Typeflag == tar.TypeDir ||
+		!t.IncrementalFrom.unchanged(name, e) {
+		return true
+	}
+	t.countUnchanged(name)
+	return false
+}
+
+// Records an entry that couldn't be archived, so that neither it nor
+// anything within it is taken to be deleted, and it is archived again next
+// time. It is recorded without a type.
+func (t *Tar) trackFailed(name string) {
+	if t.seen != nil {
+		t.seen.Entries[snapshotName(name)] = SnapshotEntry{}
+	}
+}
+
+// Writes whiteout entries for everything in the IncrementalFrom snapshot
+// that wasn't found this time. The contents of a deleted directory are
+// covered by the directory's whiteout, and nothing is taken to be deleted
+// from a directory that couldn't be read.
+func (t *Tar) writeDeletions() error {
+	if t.IncrementalFrom == nil || t.Files != nil {
+		return nil
+	}
+
+	var deleted []string
+	for name := range t.IncrementalFrom.Entries {
+		if _, ok := t.seen.Entries[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+
+	for _, name := range deleted {
+		dir := path.Dir(name)
+		if !t.listedDir(dir) {
+			continue
+		}
+		if err := t.writeWhiteout(dir, WhiteoutPrefix+path.Base(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes an empty whiteout entry with the given name within the directory,
+// which is a slash separated path relative to the target.
+func (t *Tar) writeWhiteout(dir, name string) error {
+	header := &tar.Header{
+		Name:     path.Join(".", filepath.ToSlash(t.VirtualPath), dir, name),
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	return ignoreDropped(t.writeHeader(header))
+}
+
+// Reports whether the named directory, and every directory it is within,
+// was found and read this time.
+func (t *Tar) listedDir(dir string) bool {
+	for {
+		e, ok := t.seen.Entries[dir]
+		if !ok || e.Typeflag == 0 {
+			return false
+		}
+		if dir == "." {
+			return true
+		}
+		dir = path.Dir(dir)
+	}
+}
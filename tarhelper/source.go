@@ -0,0 +1,95 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// NewTarFS returns a Tar ready to write the contents of the filesystem fsys
+// to w, rather than a directory on disk. Symlinks are archived as links when
+// fsys has the ReadLink and Lstat methods of fs.ReadLinkFS, while
+// DereferenceLinks, Sparse and IncludeACLs need a directory on disk and are
+// ignored. Owners and hard links are only detected when fsys gives the same
+// os.FileInfo details as the OS, as the filesystems returned by os.DirFS do.
+func NewTarFS(w io.Writer, fsys fs.FS) *Tar {
+	t := NewTar(w, "")
+	t.fsys = fsys
+	return t
+}
+
+// The methods of fs.ReadLinkFS, declared here so that filesystems can provide
+// them before Go 1.25.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// The name of a path relative to the target within the fs.FS.
+func fsName(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// Returns the FileInfo for the target directory itself.
+func (t *Tar) statTarget() (os.FileInfo, error) {
+	if t.fsys != nil {
+		return fs.Stat(t.fsys, ".")
+	}
+	return os.Stat(t.target)
+}
+
+// Returns the FileInfo for the named path within the target, without
+// following a symlink.
+func (t *Tar) lstat(name string) (os.FileInfo, error) {
+	if t.fsys != nil {
+		if lfs, ok := t.fsys.(readLinkFS); ok {
+			return lfs.Lstat(fsName(name))
+		}
+		return fs.Stat(t.fsys, fsName(name))
+	}
+	return os.Lstat(filepath.Join(t.target, name))
+}
+
+// Opens the named file within the target.
+func (t *Tar) open(name string) (io.ReadCloser, error) {
+	if t.fsys != nil {
+		return t.fsys.Open(fsName(name))
+	}
+	return os.Open(filepath.Join(t.target, name))
+}
+
+// Returns the entries of the named directory within the target, sorted by
+// name.
+func (t *Tar) readDir(name string) ([]os.FileInfo, error) {
+	if t.fsys == nil {
+		return ioutil.ReadDir(filepath.Join(t.target, name))
+	}
+	entries, err := fs.ReadDir(t.fsys, fsName(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Returns the target of the named symlink within an fs.FS.
+func (t *Tar) readFSLink(name string) (string, error) {
+	lfs, ok := t.fsys.(readLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: fsName(name), Err: fs.ErrInvalid}
+	}
+	return lfs.ReadLink(fsName(name))
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sparseRegion is a range of a file that holds data, as opposed to a hole.
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+// The size of a tar block.
+const blockSize = 512
+
+// Determines if the Tar can write sparse entries, which are only supported
+// in the PAX format.
+func (t *Tar) sparseFormat() bool {
+	return !t.Cpio && (t.Format == tar.FormatUnknown || t.Format == tar.FormatPAX)
+}
+
+// Writes the named file within the target as a PAX sparse entry, in the GNU
+// 1.0 sparse format, if it contains any holes. The archive/tar writer can't
+// produce sparse entries, so the headers are written directly to the output.
+// Reports whether the file was written, files without holes are left for the
+// caller.
+func (t *Tar) writeSparseFile(header *tar.Header, name string) (bool, error) {
+	f, err := os.Open(filepath.Join(t.target, name))
+	if err != nil {
+		return false, entryError(name, err)
+	}
+	defer f.Close()
+
+	regions, err := findDataRegions(f, header.Size)
+	if err != nil {
+		return false, entryError(name, err)
+	}
+	var dataSize int64
+	for _, r := range regions {
+		dataSize += r.length
+	}
+	if regions == nil || dataSize == header.Size {
+		return false, nil
+	}
+
+	// A trailing hole is recorded with an empty region at the end.
+	if last := regions[len(regions)-1]; last.offset+last.length < header.Size {
+		regions = append(regions, sparseRegion{offset: header.Size})
+	}
+
+	// The content starts with the map of data regions, padded to a block.
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	for _, r := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", r.offset, r.length)
+	}
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+	size := int64(sparseMap.Len()) + dataSize
+
+	if keep, err := t.transformHeader(header); err != nil {
+		return false, err
+	} else if !keep {
+		return false, errEntryDropped
+	}
+	entryHeader := *header
+	t.prepareHeader(&entryHeader)
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+	}
+	if t.IncludeTimestamps {
+		records["mtime"] = formatPAXTime(entryHeader.ModTime)
+		if !entryHeader.AccessTime.IsZero() {
+			records["atime"] = formatPAXTime(entryHeader.AccessTime)
+		}
+		if !entryHeader.ChangeTime.IsZero() {
+			records["ctime"] = formatPAXTime(entryHeader.ChangeTime)
+		}
+	}
+	for k, v := range entryHeader.PAXRecords {
+		records[k] = v
+	}
+	if size > maxUstarSize {
+		// too large for the size field of the ustar header written below
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+	dir, file := path.Split(header.Name)
+	sparseName := path.Join(dir, "GNUSparseFile.0", file)
+
+	// Write the extended header and then the header for the entry itself,
+	// after padding out the previous entry.
+	if err := t.flushPendingDirs(); err != nil {
+		return false, err
+	}
+	if t.resumed(header) {
+		return false, errEntryDropped
+	}
+	if err := t.checkpoint(); err != nil {
+		return false, err
+	}
+	if err := t.archive.Flush(); err != nil {
+		return false, err
+	}
+	paxData := formatPAXRecords(records)
+	paxHeader := &tar.Header{
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Mode:     0644,
+		Size:     int64(len(paxData)),
+		ModTime:  header.ModTime,
+		Typeflag: tar.TypeXHeader,
+	}
+	blocks := formatUstarHeader(paxHeader)
+	blocks = append(blocks, paxData...)
+	blocks = append(blocks, make([]byte, blockPadding(int64(len(paxData))))...)
+	entryHeader.Name = sparseName
+	entryHeader.Size = size
+	blocks = append(blocks, formatUstarHeader(&entryHeader)...)
+	blocks = append(blocks, sparseMap.Bytes()...)
+	if _, err := t.output.Write(blocks); err != nil {
+		return false, err
+	}
+	t.lastEntry = header.Name
+	t.countEntry(header)
+	if t.ProgressFunc != nil {
+		t.ProgressFunc(header.Name, 0, dataSize)
+	}
+
+	// Then the data regions, one after the other. The digest for the manifest
+	// is of the whole file, so it is given the zeros of the holes in between.
+	var readers []io.Reader
+	var digest hash.Hash
+	var offset int64
+	for _, r := range regions {
+		var section io.Reader = io.NewSectionReader(f, r.offset, r.length)
+		if t.ComputeManifest {
+			if digest == nil {
+				section, digest = t.digestReader(section)
+			} else {
+				section = io.TeeReader(section, digest)
+			}
+			readers = append(readers, &holeReader{h: digest, n: r.offset - offset})
+		}
+		readers = append(readers, section)
+		offset = r.offset + r.length
+	}
+	n, err := t.copyContent(t.output, header.Name, io.MultiReader(readers...), dataSize)
+	if err != nil {
+		return false, err
+	} else if n != dataSize {
+		return false, fmt.Errorf("%s changed size while being archived", name)
+	}
+	t.addToManifest(header, digest)
+	if _, err := t.output.Write(make([]byte, blockPadding(dataSize))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the number of bytes needed to pad n out to a whole block.
+func blockPadding(n int64) int64 {
+	return -n & (blockSize - 1)
+}
+
+// Formats a time for a PAX record, as decimal seconds since the epoch with
+// as many fractional digits as needed.
+func formatPAXTime(ts time.Time) string {
+	secs, nsecs := ts.Unix(), ts.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	sign := ""
+	if secs < 0 {
+		sign = "-"
+		secs, nsecs = -(secs + 1), 1e9-nsecs
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
+
+// Encodes PAX records in the "length key=value\n" format, where the length
+// includes itself.
+func formatPAXRecords(records map[string]string) []byte {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		record := " " + k + "=" + records[k] + "\n"
+		size := len(record)
+		for size < len(strconv.Itoa(size))+len(record) {
+			size++
+		}
+		buf.WriteString(strconv.Itoa(size))
+		buf.WriteString(record)
+	}
+	return buf.Bytes()
+}
+
+// Encodes a ustar header block for the header. Values that don't fit in their
+// fields are truncated, which is fine for the sparse entries written here as
+// the PAX records hold anything that matters.
+func formatUstarHeader(h *tar.Header) []byte {
+	b := make([]byte, blockSize)
+	copy(b[0:100], h.Name)
+	formatOctal(b[100:108], h.Mode&07777)
+	formatOctal(b[108:116], int64(h.Uid))
+	formatOctal(b[116:124], int64(h.Gid))
+	formatOctal(b[124:136], h.Size)
+	formatOctal(b[136:148], h.ModTime.Unix())
+	b[156] = h.Typeflag
+	copy(b[157:257], h.Linkname)
+	copy(b[257:263], "ustar\x00")
+	copy(b[263:265], "00")
+	copy(b[265:297], h.Uname)
+	copy(b[297:329], h.Gname)
+
+	// The checksum is calculated with its own field filled with spaces.
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+// Writes v as a NUL terminated octal number filling the field, or zero if it
+// doesn't fit.
+func formatOctal(b []byte, v int64) {
+	s := strconv.FormatInt(v, 8)
+	if v < 0 || len(s) >= len(b) {
+		s = "0"
+	}
+	for i := 0; i < len(b)-1-len(s); i++ {
+		b[i] = '0'
+	}
+	copy(b[len(b)-1-len(s):], s)
+	b[len(b)-1] = 0
+}
+
+// The granularity at which runs of zeros are turned into holes on
+// extraction, matching the usual filesystem block size.
+const holeSize = 4096
+
+// sparseWriter writes to a file, seeking over runs of zeros that cover whole
+// blocks of the file rather than writing them, so that the filesystem can
+// leave holes in their place.
+type sparseWriter struct {
+	f      TargetFile
+	offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// work a block at a time, aligned to the block boundaries of the file
+		n := int(holeSize - w.offset%holeSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		chunk := p[:n]
+
+		if n == holeSize && isZero(chunk) {
+			if _, err := w.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.f.Write(chunk); err != nil {
+			return written, err
+		}
+
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Sets the size of the file, since seeking over a trailing hole doesn't
+// extend it.
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.offset)
+}
+
+// Reports whether b contains only zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build linux
+
+package tarhelper
+
+import (
+	"os"
+	"syscall"
+)
+
+// lseek whence values for finding data and holes.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Returns the regions of the file that contain data, using SEEK_DATA and
+// SEEK_HOLE. Returns nil if the filesystem can't report holes.
+func findDataRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	var regions []sparseRegion
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, seekData)
+		if err != nil {
+			if isErrno(err, syscall.ENXIO) {
+				// nothing but a hole to the end of the file
+				break
+			}
+			if isErrno(err, syscall.EINVAL) || isErrno(err, syscall.EOPNOTSUPP) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		regions = append(regions, sparseRegion{offset: start, length: end - start})
+		offset = end
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	// a file that is entirely a hole still needs a region to record
+	if len(regions) == 0 {
+		regions = append(regions, sparseRegion{offset: size})
+	}
+	return regions, nil
+}
+
+// Reports whether err is, or wraps, the given errno.
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == errno
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"time"
+)
+
+// Stats summarizes the archive written by the last call to Archive.
+type Stats struct {
+	// The number of each type of entry written.
+	Files     int64
+	Dirs      int64
+	Symlinks  int64
+	HardLinks int64
+	Devices   int64
+	Fifos     int64
+
+	// The number of entries left out by the exclusion, ignore file and
+	// included path rules, along with skipped sockets and anything on
+	// another filesystem with OneFileSystem.
+	Excluded int64
+
+	// The number of entries left out of an incremental archive or layer as
+	// they hadn't changed.
+	Unchanged int64
+
+	// The number of entries skipped for errors, with ContinueOnError.
+	Failed int64
+
+	// The number of bytes of content read from files and added entries.
+	BytesRead int64
+
+	// How long the archive took to write.
+	Duration time.Duration
+}
+
+// Stats returns the statistics of the last archive written, or of the one
+// being written.
+func (t *Tar) Stats() Stats {
+	return t.stats
+}
+
+// Counts an entry written with the given header.
+func (t *Tar) countEntry(header *tar.Header) {
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		t.stats.Files++
+	case tar.TypeDir:
+		t.stats.Dirs++
+	case tar.TypeSymlink:
+		t.stats.Symlinks++
+	case tar.TypeLink:
+		t.stats.HardLinks++
+	case tar.TypeChar, tar.TypeBlock:
+		t.stats.Devices++
+	case tar.TypeFifo:
+		t.stats.Fifos++
+	}
+}
+
+// Counts an entry that was left out of the archive, logging the reason and
+// reporting it along with the rule that matched it, if there is one.
+func (t *Tar) countExcluded(name string, reason SkipReason, rule string) {
+	t.logger().Debugf("tarhelper: excluding %q, %v", name, reason)
+	if t.estimate == nil {
+		t.stats.Excluded++
+	}
+	t.skipped(name, reason, rule)
+}
+
+// Counts an entry that was left out as it hadn't changed.
+func (t *Tar) countUnchanged(name string) {
+	if t.estimate == nil {
+		t.stats.Unchanged++
+	}
+	t.skipped(name, SkipUnchanged, "")
+}
@@ -4,15 +4,28 @@ package tarhelper
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
+
+	"github.com/apcera/util/multierror"
+	"github.com/apcera/util/pathmatch"
+	"github.com/apcera/util/tarhelper/Godeps/_workspace/src/github.com/klauspost/pgzip"
 )
 
 // User options enumeration type. This encodes the control options provided
@@ -27,22 +40,142 @@ type DirStack []string
 type Tar struct {
 	target string
 
+	// The filesystem to archive in place of the target directory, for
+	// NewTarFS.
+	fsys fs.FS
+
 	// The destination writer
 	dest io.Writer
 
 	// The archive/tar reader that we will use to extract each
 	// element from the tar file. This will be set when Extract()
 	// is called.
-	archive *tar.Writer
+	archive archiveWriter
+
+	// The writer that the archive writes to, after any compression, for
+	// entries that have to be written directly.
+	output io.Writer
 
 	// The Compression being used in this tar.
 	Compression Compression
 
+	// CompressionLevel selects the compression level for compressors that
+	// support more than one. The meaning of the value depends on the
+	// compressor, for GZIP it is 1 (fastest) to 9 (smallest), or -2 for
+	// Huffman only compression, and for ZSTD it is the usual 1 (fastest) to 22
+	// (smallest) scale. Zero uses the compressor's default level.
+	CompressionLevel int
+
+	// GzipHeader is written as the gzip header when the Compression is GZIP.
+	// It can be used to record the original name, modification time or a
+	// comment. The zero value leaves the modification time zeroed, so the
+	// same input always produces the same compressed stream.
+	GzipHeader gzip.Header
+
+	// EncryptionKey, if set, is a 32 byte key that the archive is encrypted
+	// with using AES-256-GCM, after any compression. It is encrypted in
+	// chunks so that it can be streamed, and can be decrypted with
+	// NewDecryptReader or Untar.DecryptionKey.
+	EncryptionKey []byte
+
+	// Recipients, if set, are the X25519 public keys of those the archive
+	// is encrypted to, in place of an EncryptionKey. The archive is
+	// encrypted with a random key, which is wrapped for each of them, so
+	// that any of them can decrypt it with their private key with
+	// NewIdentityDecryptReader or Untar.DecryptionIdentity. Rewrap changes
+	// the recipients of an archive that has been written.
+	Recipients []*ecdh.PublicKey
+
+	// ParallelGzip can be set to compress GZIP archives using multiple
+	// goroutines. The output is still a single valid gzip stream.
+	ParallelGzip bool
+
+	// Format selects the tar format to write. FormatPAX stores names of any
+	// length and files of any size, along with sub-second modification times,
+	// using PAX extended headers. FormatGNU does the same for names and link
+	// targets with GNU LongName and LongLink entries, for tools that only
+	// understand GNU tar archives. FormatUSTAR restricts the archive to plain
+	// ustar headers, for old tar implementations such as busybox's. Entries
+	// that the chosen format can't represent, such as long names or files
+	// of 8GiB or more with FormatUSTAR, give an EntryError naming the entry
+	// before any of its content is read, so they are skipped with
+	// ContinueOnError. Options that are recorded in PAX records, such as
+	// IncludeACLs, are an error with FormatUSTAR and FormatGNU. The default
+	// picks the most compatible format able to represent each entry.
+	Format tar.Format
+
+	// PAXRecords are extra PAX records to add to the header of every entry,
+	// such as "comment" or vendor specific records like "APCERA.build",
+	// which requires the PAX format. Records already set for an entry, such
+	// as those of IncludeACLs or a HeaderTransform, take precedence. The
+	// records archive/tar derives from the header itself, such as "path" and
+	// "size", can't be set.
+	PAXRecords map[string]string
+
+	// Cpio can be set to write a cpio archive in the newc format, as used
+	// for Linux initramfs images, in place of a tar archive. The Format,
+	// Sparse and the options recorded in PAX records don't apply, hard links
+	// are written as copies of the file since newc archives can't record
+	// them as they are found, and files over 4GB are an error.
+	Cpio bool
+
 	// Set to true if archiving should attempt to preserve
 	// permissions as it was on the filesystem. If this is false then
 	// files will be archived with basic file/directory permissions.
 	IncludePermissions bool
 
+	// IncludeACLs can be set to record the POSIX ACLs of files and
+	// directories in PAX records, which requires the PAX format. They are
+	// only read on Linux.
+	IncludeACLs bool
+
+	// IncludeSELinux can be set to record the SELinux security contexts of
+	// entries in PAX records, as GNU tar and star do, which requires the PAX
+	// format. They are only read on Linux.
+	IncludeSELinux bool
+
+	// IncludeFileFlags can be set to record the immutable, append only and
+	// no dump flags of files and directories, as set with chattr, in PAX
+	// records, which requires the PAX format. They are only read on Linux
+	// and macOS, where the Finder's hidden flag is recorded too.
+	IncludeFileFlags bool
+
+	// IncludeAppleDouble can be set to record the Finder info and resource
+	// forks of files and directories on macOS, as bsdtar does, in AppleDouble
+	// entries written ahead of each entry that has them, named for it with
+	// the AppleDoublePrefix.
+	IncludeAppleDouble bool
+
+	// Sparse can be set to store files containing holes as sparse entries,
+	// with only the regions holding data in the archive, rather than writing
+	// out the holes in full. Holes are only detected on Linux, and sparse
+	// entries are only written in the PAX format, in the GNU 1.0 sparse
+	// format understood by GNU tar and archive/tar.
+	Sparse bool
+
+	// MetadataOnly can be set to write the entries for regular files with no
+	// content, as empty files, so that the archive is a small snapshot of
+	// the tree's names, types, permissions, owners and times. Files aren't
+	// read unless ComputeManifest is set, in which case the manifest still
+	// holds the size and digest of each file. Entries added with AddEntry are
+	// written in full.
+	MetadataOnly bool
+
+	// PreserveSetuid keeps the setuid, setgid and sticky bits in the
+	// permissions written when IncludePermissions is set. When false they are
+	// stripped from every entry. NewTar sets this to true.
+	PreserveSetuid bool
+
+	// IncludeTimestamps can be set to record modification times with
+	// nanosecond precision in PAX records, selecting the PAX format for
+	// entries that need it when no Format is set. Otherwise modification
+	// times are rounded to the second, unless the PAX format is selected.
+	IncludeTimestamps bool
+
+	// IncludeAccessTimes can be set along with IncludeTimestamps to also
+	// record the access and change times of each entry.
+	IncludeAccessTimes bool
+
 	// Set to true to perserve ownership of files and directories. If set to
 	// false, the Uid and Gid will be set as 500, which is the first Uid/Gid
 	// reserved for normal users.
@@ -53,6 +186,44 @@ type Tar struct {
 	// included in the tar.
 	ExcludedPaths []*regexp.Regexp
 
+	// ExcludeRegexps excludes any entry whose path relative to the target
+	// directory, using forward slashes and without a leading "./", matches
+	// one of these expressions. Unlike ExcludedPaths they are not anchored
+	// or tried against the base name, so they can express rules about the
+	// whole path, such as `(^|/)logs/(.*/)?[^/]*\.log$` for any .log file
+	// under any logs directory.
+	ExcludeRegexps []*regexp.Regexp
+
+	// ExcludeVCS can be set to leave out the directories and metadata files
+	// of version control systems, those of Git, Mercurial, Subversion, Bazaar
+	// and CVS, such as .git and .gitignore, wherever they are, like the
+	// --exclude-vcs option to GNU tar.
+	ExcludeVCS bool
+
+	// IgnoreFile, if set, names a file in the root of the target directory
+	// containing patterns for paths to leave out of the archive, using the
+	// same rules as a .gitignore file, including negated and directory only
+	// patterns. DefaultIgnoreFile is the conventional name. It is not an
+	// error for the file not to exist.
+	IgnoreFile string
+
+	// IncludedPaths, if not empty, limits the archive to the paths matching
+	// one of these glob patterns, along with everything beneath a matching
+	// directory and the parent directories needed to hold them. Patterns are
+	// relative to the target directory and "**" matches any number of
+	// directories. ExcludedPaths are applied as well.
+	IncludedPaths []string
+
+	// MaxFileSize, if set, leaves out regular files larger than this many
+	// bytes, such as core dumps.
+	MaxFileSize int64
+
+	// MinMtime and MaxMtime, if set, leave out anything other than
+	// directories last modified before MinMtime or after MaxMtime, such as
+	// stale cache files. Directories are kept to hold what is within them.
+	MinMtime time.Time
+	MaxMtime time.Time
+
 	// If set, this will be a virtual path that is prepended to the
 	// file location.  This allows the target to be under a temp directory
 	// but have it packaged as though it was under another directory, such as
@@ -82,9 +253,350 @@ type Tar struct {
 	// choose a GID or the GID is not allowed.
 	GroupMappingFunc func(int) (int, error)
 
+	// DereferenceLinks can be set to follow symlinks and archive what they
+	// point to, storing linked files as regular files and the contents of
+	// linked directories as directories, like the -h option to GNU tar.
+	// Links back to a directory that is already being archived are skipped so
+	// that loops don't recurse forever.
+	DereferenceLinks bool
+
+	// ResolveTarget can be set to resolve any symlinks in the path of the
+	// target before it is walked, such as /tmp being a link to /private/tmp
+	// on macOS, so that the archive holds what the target points to. A
+	// target that is a symlink to a file is then archived as that file
+	// rather than as the link, and absolute symlinks to within the target
+	// are made relative. The filesystem given to NewTarFS has no links to
+	// resolve.
+	ResolveTarget bool
+
+	// OneFileSystem can be set to leave out anything on a different
+	// filesystem to the target directory, such as /proc, /sys or bind mounted
+	// volumes when archiving a root directory, like the --one-file-system
+	// option to GNU tar. Mount points are left out along with their contents.
+	OneFileSystem bool
+
+	// FailOnLoops makes a symlink or mount that loops back to a directory
+	// that is already being archived an error, as an *EntryError, rather
+	// than being skipped and logged. Directories are matched by device and
+	// inode where the platform has them.
+	FailOnLoops bool
+
+	// DeduplicateContent can be set to write files with the same content as
+	// one already in the archive as hard links to it, as well as those that
+	// are hard links on disk. Only files with the same size, permissions and
+	// owner are compared, and a file is only read to compare it when there is
+	// such a file. The copies share the modification time of the first one
+	// once extracted. Content isn't deduplicated in cpio archives.
+	DeduplicateContent bool
+
+	// ComputeManifest can be set to compute the SHA-256 digest of each
+	// regular file as it is written, which are returned by Manifest once the
+	// archive is complete.
+	ComputeManifest bool
+
+	// ManifestName, if set along with ComputeManifest, is the name of an
+	// entry appended to the archive holding the manifest, in the format read
+	// by "sha256sum -c".
+	ManifestName string
+
+	// DetectContentType, if set along with ComputeManifest, records the
+	// media type of each regular file in its ManifestEntry, as detected by
+	// http.DetectContentType from the first 512 bytes of its content. The
+	// types aren't written to the ManifestName entry, which keeps to the
+	// format of "sha256sum".
+	DetectContentType bool
+
+	// DigestHash can be set to compute a digest of the archive as it is
+	// written to the destination, after compression, which is returned by
+	// Digest once the archive is complete. The hash function's package needs
+	// to be linked into the binary, crypto.SHA256 always is.
+	DigestHash crypto.Hash
+
+	// SigningKey, if set, is the Ed25519 private key used to make a detached
+	// signature of the archive as it is written to the destination, after
+	// any compression and encryption, which is returned by Signature once
+	// the archive is complete. It is an Ed25519ph signature of the archive's
+	// SHA-512 digest, so that nothing has to be read twice.
+	SigningKey ed25519.PrivateKey
+
+	// SocketPolicy controls what is done with sockets, which can't be
+	// archived as they are. They are skipped by default.
+	SocketPolicy SocketPolicy
+
+	// OwnershipOverride, if set, is the owner given to every entry when
+	// IncludeOwners is false, in place of the default of 500.
+	OwnershipOverride *Ownership
+
+	// IncludeNames can be set to record the user and group names for the
+	// UID and GID of each entry, as looked up on this host, so that the owners
+	// can be resolved by name on extraction. Otherwise the archive only holds
+	// numeric ids.
+	IncludeNames bool
+
+	// IDMappingFunc, if set, is called for every entry with the UID and GID
+	// of the file on the filesystem and returns the UID and GID to record in
+	// the archive, or an error if the file can't be mapped. It is used
+	// regardless of IncludeOwners, replacing the OwnerMappingFunc and
+	// GroupMappingFunc and the default of 500, so ownership can be rewritten
+	// wholesale, such as when remapping a user namespace.
+	IDMappingFunc func(uid, gid int) (int, int, error)
+
 	// User provided control options. UserOption enum has the
 	// definitions and explanations for the various flags.
 	UserOptions UserOption
+
+	// ProgressFunc, if set, is called as each entry is written with the name
+	// of the entry, the number of bytes of its content written so far and its
+	// total size. It is called once when the entry is started and then as its
+	// content is copied into the archive.
+	ProgressFunc func(entry string, written, total int64)
+
+	// BytesWrittenFunc, if set, is called periodically with the number of
+	// bytes written to the destination so far, after compression, and once
+	// more when the archive is complete.
+	BytesWrittenFunc func(written int64)
+
+	// ThroughputFunc, if set, is called periodically with the Throughput of
+	// the archive being written, including the rate it is being written at,
+	// and once more when the archive is complete, for driving progress
+	// reports.
+	ThroughputFunc func(Throughput)
+
+	// Expected, if set, is the Estimate made for the archive beforehand,
+	// from which the ThroughputFunc is told how much of the archive has been
+	// written and how long the rest will take.
+	Expected *Estimate
+
+	// ProgressInterval is the minimum time between calls to BytesWrittenFunc
+	// and ThroughputFunc. One second is used if it is not set.
+	ProgressInterval time.Duration
+
+	// Logger, if set, is where the entries that are left out of the archive
+	// are logged, along with anything else of note. Nothing is logged if it
+	// is not set.
+	Logger LeveledLogger
+
+	// HeaderTransform, if set, is called with the header of each entry
+	// before it is written, and returns the header to write in its place,
+	// which may be the same header changed in place, or nil to leave the
+	// entry out. It can rename entries or change their owners, modes and
+	// times, but not the size of regular files. Leaving out a directory
+	// leaves out only the directory's own entry, while hard links to a file
+	// that was left out are written as the file in its place.
+	HeaderTransform func(header *tar.Header) (*tar.Header, error)
+
+	// CheckpointFunc, if set, is called with a Checkpoint as each entry is
+	// written in full, which can be saved so that writing the archive can be
+	// resumed with ResumeFrom if it is interrupted, rather than started over.
+	// The archive has to be uncompressed and unencrypted.
+	CheckpointFunc func(Checkpoint)
+
+	// ResumeFrom, if set, continues writing an archive that was interrupted
+	// after the Checkpoint was made, leaving out the entries up to and
+	// including the checkpoint's entry. The destination has to continue from
+	// the checkpoint's Offset, such as by truncating the partial archive to
+	// that size and appending to it, and the target and options have to be
+	// the same as when the checkpoint was made. The Manifest, Digest and
+	// Stats only cover what is written after the checkpoint.
+	ResumeFrom *Checkpoint
+
+	// RateLimit, if set, limits the rate the archive is written to the
+	// destination to this many bytes a second, after compression, so that
+	// streaming an archive doesn't saturate the disk or network. Up to a
+	// second's worth of bytes can be written at once after a pause.
+	RateLimit int64
+
+	// BufferSize is the size of the buffers used to copy the content of
+	// files into the archive, which are pooled and reused across files and
+	// archives rather than allocated for each file. The default is 32KB.
+	BufferSize int
+
+	// ReadAhead, if set, is the number of files within a directory that are
+	// opened and read ahead of being written to the archive, by as many
+	// goroutines, so that reading trees of many small files isn't held up by
+	// the latency of each one. Entries are still written in the same order.
+	// Only files of up to 1MB are read ahead, and they are held in memory
+	// until they are written.
+	ReadAhead int
+
+	// ContinueOnError can be set to skip entries that can't be read, such as
+	// files that can't be opened and directories that can't be listed,
+	// rather than stopping at the first one. The rest of the archive is still
+	// written, and Archive then returns a *multierror.Error holding an
+	// *EntryError for each entry that was skipped. Errors writing the archive,
+	// or reading a file after its content has been started, still stop it.
+	ContinueOnError bool
+
+	// RecordExclusions can be set to record each entry that is left out of
+	// the archive, along with the reason why and the rule that matched it,
+	// to be returned by Exclusions, so that it can be seen why something
+	// expected in the archive is missing.
+	RecordExclusions bool
+
+	// OnSkip, if set, is called with the name of each entry that is left
+	// out of the archive and the reason why, such as matching the
+	// ExcludedPaths, being a socket or, with ContinueOnError, failing to be
+	// read, so that what didn't make it into the archive can be recorded.
+	// The contents of directories beyond the MaxDepth aren't reported.
+	OnSkip func(path string, reason SkipReason)
+
+	// IncrementalFrom, if set, is the Snapshot recorded with an earlier
+	// archive of the same directory, and makes this an incremental archive
+	// holding only what has changed since. Entries other than directories are
+	// left out when their type, size, modification time and change time are
+	// the same as in the snapshot, while directories are always written.
+	// Anything in the snapshot that is no longer found is recorded with an
+	// empty whiteout entry, named for it with WhiteoutPrefix, as in OCI image
+	// layers.
+	IncrementalFrom *Snapshot
+
+	// LayerBase, if set, is a directory that the target is a changed copy of,
+	// and makes the archive a layer holding only the changes from it, as for
+	// an OCI image layer. Entries are left out when their type, permissions
+	// and owner are the same in the LayerBase, along with their link target,
+	// device numbers or size and modification time, and directories are only
+	// written if they have changed or something within them has. Anything in
+	// the LayerBase that is no longer in the target is recorded with a
+	// whiteout entry, named for it with WhiteoutPrefix, or an OpaqueWhiteout
+	// for a directory whose contents have all been deleted. It can't be used
+	// along with IncrementalFrom.
+	LayerBase string
+
+	// ManifestBase, if set, is the manifest of an earlier archive of the
+	// same directory, from Manifest or ReadManifest, and makes this archive
+	// hold only the regular files that have been added or modified since,
+	// as found by ManifestChanges, along with everything other than regular
+	// files. Files are compared by the SHA-256 digest of their content, so
+	// those in the manifest are read twice when they have changed. Files in
+	// the manifest that are no longer found are recorded with an empty
+	// whiteout entry, named for them with WhiteoutPrefix.
+	ManifestBase []ManifestEntry
+
+	// RecordSnapshot can be set to record a Snapshot of every entry found
+	// while writing the archive, which is returned by Snapshot once it is
+	// complete, to be used as the IncrementalFrom of the next archive.
+	RecordSnapshot bool
+
+	// MaxDepth, if set, limits the archive to the entries at most this many
+	// levels below the target directory, so that 1 archives only the entries
+	// directly within it. Directories at the limit are archived without their
+	// contents, which aren't read at all.
+	MaxDepth int
+
+	// Files, if set, is the list of paths relative to the target directory
+	// that will be archived, in order, in place of walking the target
+	// directory. Directories in the list are archived without their contents,
+	// so those have to be listed as well. ExcludedPaths still apply.
+	Files []string
+
+	// The context for the archive in progress, checked between entries.
+	ctx context.Context
+
+	// The patterns read from the IgnoreFile for the archive in progress.
+	ignore *pathmatch.Set
+
+	// Cached user and group names, for IncludeNames.
+	names *nameCache
+
+	// The compiled IncludedPaths for the archive in progress.
+	includes []*pathmatch.Glob
+
+	// The device of the target directory, for OneFileSystem.
+	rootDevice *uint64
+
+	// The files written to the archive in progress, for DeduplicateContent.
+	duplicates map[dedupKey][]dedupFile
+
+	// The entries found by the archive in progress, for RecordSnapshot and
+	// IncrementalFrom, and the snapshot of the last archive written.
+	seen     *Snapshot
+	snapshot *Snapshot
+
+	// Headers for directories that are not included themselves but that
+	// may contain included entries. They are written before the first such
+	// entry.
+	pendingDirs []*tar.Header
+
+	// Entries added with AddEntry that will be written after the contents
+	// of the target directory.
+	entries []virtualEntry
+
+	// The files being read ahead of being archived, for ReadAhead.
+	prefetched map[string]*prefetchedFile
+
+	// The manifest of the archive being written, for ComputeManifest, along
+	// with the position of each name within it.
+	manifest      []ManifestEntry
+	manifestIndex map[string]int
+
+	// The digests of the files in the ManifestBase by their cleaned names,
+	// and the names of those found by the archive in progress.
+	baseDigests map[string]string
+	baseFound   map[string]bool
+
+	// The digest of the last archive written, for DigestHash.
+	digest []byte
+
+	// The signature of the last archive written, for SigningKey.
+	signature []byte
+
+	// The entries left out of the last archive written, for
+	// RecordExclusions.
+	exclusions []Exclusion
+
+	// The estimate being made, in place of writing the archive.
+	estimate *Estimate
+
+	// The throughput of the archive being written, for ThroughputFunc.
+	meter *throughputMeter
+
+	// The statistics of the archive being written.
+	stats Stats
+
+	// The entries skipped for ContinueOnError.
+	failed *multierror.Error
+
+	// The position in the archive in progress, the name of the last entry
+	// written to it and the entry being resumed after, for checkpoints.
+	offset      *offsetWriter
+	lastEntry   string
+	resumeAfter string
+}
+
+// Ownership is the UID and GID of an owner.
+type Ownership struct {
+	Uid int
+	Gid int
+}
+
+// SocketPolicy is the handling of sockets found when archiving.
+type SocketPolicy int
+
+const (
+	// SocketSkip leaves sockets out of the archive, as GNU tar does.
+	SocketSkip SocketPolicy = iota
+
+	// SocketError fails archiving when a socket is found.
+	SocketError
+
+	// SocketArchiveAsEmptyFile records sockets as empty regular files, so
+	// that their existence isn't lost.
+	SocketArchiveAsEmptyFile
+)
+
+// emptyFileInfo presents a file as an empty regular file.
+type emptyFileInfo struct {
+	os.FileInfo
+}
+
+func (fi emptyFileInfo) Mode() os.FileMode { return fi.FileInfo.Mode() &^ os.ModeType }
+func (fi emptyFileInfo) Size() int64       { return 0 }
+
+// virtualEntry is an entry that does not exist on disk and is written to the
+// archive from a header and reader supplied by the caller.
+type virtualEntry struct {
+	header *tar.Header
+	reader io.Reader
 }
 
 // UserOption definitions.
@@ -96,6 +608,7 @@ const (
 const (
 	c_ISUID  = 04000 // Set uid
 	c_ISGID  = 02000 // Set gid
+	c_ISVTX  = 01000 // Sticky
 	c_ISDIR  = 040000
 	c_ISFIFO = 010000
 	c_ISREG  = 0100000
@@ -105,55 +618,587 @@ const (
 	c_ISSOCK = 0140000
 )
 
+// DefaultIgnoreFile is the conventional name for a Tar.IgnoreFile.
+const DefaultIgnoreFile = ".tarignore"
+
+// The names of version control directories and metadata files, for
+// ExcludeVCS.
+var vcsNames = map[string]bool{
+	".git":           true,
+	".gitattributes": true,
+	".gitignore":     true,
+	".gitmodules":    true,
+	".hg":            true,
+	".hgignore":      true,
+	".hgsub":         true,
+	".hgsubstate":    true,
+	".hgtags":        true,
+	".svn":           true,
+	".bzr":           true,
+	".bzrignore":     true,
+	".bzrtags":       true,
+	"CVS":            true,
+	".cvsignore":     true,
+}
+
 // NewTar returns a Tar ready to write the contents of targetDir to w.
+// targetDir can also be a single file, or a symlink to one, which is then
+// archived as the only entry, named after its base name within any
+// VirtualPath.
 func NewTar(w io.Writer, targetDir string) *Tar {
 	return &Tar{
 		target:             targetDir,
 		dest:               w,
 		hardLinks:          make(map[uint64]string),
 		IncludePermissions: true,
+		PreserveSetuid:     true,
 		IncludeOwners:      false,
 		OwnerMappingFunc:   defaultMappingFunc,
 		GroupMappingFunc:   defaultMappingFunc,
 	}
 }
 
+// Archive writes the archive to the destination writer.
 func (t *Tar) Archive() error {
+	return t.ArchiveContext(context.Background())
+}
+
+// ArchiveContext writes the archive to the destination writer, stopping with
+// the context's error if it is cancelled before the archive is complete.
+func (t *Tar) ArchiveContext(ctx context.Context) error {
+	t.ctx = ctx
+	t.manifest = nil
+	t.digest = nil
+	t.signature = nil
+	t.stats = Stats{}
+	t.failed = nil
+	t.snapshot = nil
+	t.exclusions = nil
+	t.seen = t.newSeen()
+	t.startThroughput()
+	start := time.Now()
 	defer func() {
+		t.stats.Duration = time.Since(start)
+		t.ctx = nil
+		t.meter = nil
+		t.failed = nil
+		t.seen = nil
+		t.offset = nil
+		t.duplicates = nil
+		t.manifestIndex = nil
+		t.baseDigests = nil
+		t.baseFound = nil
+		t.output = nil
+		t.ignore = nil
+		t.includes = nil
+		t.rootDevice = nil
+		t.pendingDirs = nil
 		if t.archive != nil {
 			t.archive.Close()
 			t.archive = nil
 		}
 	}()
 
+	if err := t.prepareRules(); err != nil {
+		return err
+	}
+	if t.LayerBase != "" && t.IncrementalFrom != nil {
+		return fmt.Errorf("an archive can't be both a layer and incremental")
+	}
+	if err := t.checkFormat(); err != nil {
+		return err
+	}
+
+	// Throttle the bytes going to the destination if a rate limit is set.
+	output := t.dest
+	if t.RateLimit > 0 {
+		output = newRateLimitedWriter(ctx, output, t.RateLimit)
+	}
+
+	// Hash the bytes going to the destination if a digest is wanted.
+	var digest hash.Hash
+	if t.DigestHash != 0 {
+		if !t.DigestHash.Available() {
+			return fmt.Errorf("digest hash function %d is not available", t.DigestHash)
+		}
+		digest = t.DigestHash.New()
+		output = io.MultiWriter(output, digest)
+	}
+
+	// And for a signature, if one is wanted.
+	var signing hash.Hash
+	if t.SigningKey != nil {
+		var err error
+		if signing, err = t.newSigningHash(); err != nil {
+			return err
+		}
+		output = io.MultiWriter(output, signing)
+	}
+
+	// Count the bytes going to the destination if progress is wanted.
+	var counter *countingWriter
+	if t.BytesWrittenFunc != nil {
+		counter = newCountingWriter(output, t.ProgressInterval, t.BytesWrittenFunc)
+		output = counter
+	}
+
+	// Track the position in the archive if checkpoints are wanted.
+	output, err := t.startCheckpoints(output)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt what is written after compression if a key or recipients are
+	// given.
+	var encrypted io.WriteCloser
+	if t.EncryptionKey != nil && t.Recipients != nil {
+		return fmt.Errorf("an archive can't be encrypted with both a key and recipients")
+	}
+	if t.EncryptionKey != nil {
+		if encrypted, err = NewEncryptWriter(output, t.EncryptionKey); err != nil {
+			return err
+		}
+		output = encrypted
+	} else if t.Recipients != nil {
+		if encrypted, err = NewRecipientsEncryptWriter(output, t.Recipients); err != nil {
+			return err
+		}
+		output = encrypted
+	}
+
 	// Create a TarWriter that wraps the proper io.Writer object
 	// the implements the expected compression for this file.
+	var compressed io.WriteCloser
 	switch t.Compression {
 	case NONE:
-		t.archive = tar.NewWriter(t.dest)
-	case GZIP:
-		dest := gzip.NewWriter(t.dest)
-		defer dest.Close()
-		t.archive = tar.NewWriter(dest)
-	case BZIP2:
-		return fmt.Errorf("bzip2 compression is not supported")
+		t.output = output
+		t.archive = t.newArchiveWriter(output)
 	case DETECT:
 		return fmt.Errorf("not a valid compression type: %v", DETECT)
 	default:
-		return fmt.Errorf("unknown compression type: %v", t.Compression)
+		// Look up the compression handler
+		comp, exists := lookupCompressor(t.Compression)
+		if !exists {
+			return fmt.Errorf("unknown compression type: %v", t.Compression)
+		}
+		if t.Compression == GZIP && t.ParallelGzip {
+			comp = &ParallelGzipCompressor{}
+		}
+
+		// Create the writer, at the requested level if there is one
+		var dest io.WriteCloser
+		var err error
+		if t.CompressionLevel != 0 {
+			lc, ok := comp.(LevelCompressor)
+			if !ok {
+				return fmt.Errorf(
+					"compression type %v does not support compression levels",
+					t.Compression)
+			}
+			dest, err = lc.NewWriterLevel(output, t.CompressionLevel)
+		} else {
+			dest, err = comp.NewWriter(output)
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if compressed != nil {
+				compressed.Close()
+			}
+		}()
+		t.setGzipHeader(dest)
+		compressed = dest
+		t.output = dest
+		t.archive = t.newArchiveWriter(dest)
+	}
+
+	// write the target's contents, anything deleted since the snapshot
+	// being archived from and then any entries that were added by the caller
+	if err := t.processTarget(); err != nil {
+		return err
+	}
+	if err := t.writeDeletions(); err != nil {
+		return err
+	}
+	if err := t.writeLayerDeletions(); err != nil {
+		return err
+	}
+	if err := t.writeManifestDeletions(); err != nil {
+		return err
+	}
+	if err := t.writeEntries(); err != nil {
+		return err
+	}
+
+	// and finally the manifest, when it is wanted in the archive
+	if t.ComputeManifest && t.ManifestName != "" {
+		if err := t.writeManifest(); err != nil {
+			return err
+		}
+	}
+
+	if err := t.finishCheckpoints(); err != nil {
+		return err
+	}
+
+	// The tar writer needs to be closed before the compressor so that the end
+	// of archive marker is included in the compressed stream.
+	err = t.archive.Close()
+	t.archive = nil
+	if err != nil {
+		return err
+	}
+	if compressed != nil {
+		err = compressed.Close()
+		compressed = nil
+		if err != nil {
+			return err
+		}
+	}
+	if encrypted != nil {
+		if err := encrypted.Close(); err != nil {
+			return err
+		}
+	}
+	if counter != nil {
+		counter.finish()
+	}
+	t.reportThroughput(true)
+	if digest != nil {
+		t.digest = digest.Sum(nil)
+	}
+	if signing != nil {
+		if err := t.sign(signing); err != nil {
+			return err
+		}
+	}
+	if t.RecordSnapshot {
+		t.snapshot = t.seen
+	}
+
+	return t.failed.ErrorOrNil()
+}
+
+// Estimate is the projected size of an archive.
+type Estimate struct {
+	// The number of entries, including directories and links.
+	Entries int64
+
+	// The total size of the content of the entries, before compression.
+	Bytes int64
+}
+
+// Estimate walks the target directory, applying all of the rules that decide
+// what is archived, and returns the number of entries and bytes of content
+// that Archive would write, without reading any file contents or writing
+// anything to the destination. Entries added with AddEntry are included, the
+// manifest entry is not.
+func (t *Tar) Estimate() (Estimate, error) {
+	var e Estimate
+	hardLinks := t.hardLinks
+	t.estimate = &e
+	t.hardLinks = make(map[uint64]string)
+	t.failed = nil
+	t.seen = t.newSeen()
+	defer func() {
+		t.estimate = nil
+		t.failed = nil
+		t.seen = nil
+		t.baseDigests = nil
+		t.baseFound = nil
+		t.hardLinks = hardLinks
+		t.ignore = nil
+		t.includes = nil
+		t.rootDevice = nil
+		t.pendingDirs = nil
+	}()
+
+	if err := t.prepareRules(); err != nil {
+		return e, err
+	}
+	if err := t.processTarget(); err != nil {
+		return e, err
+	}
+	if err := t.writeDeletions(); err != nil {
+		return e, err
+	}
+	if err := t.writeLayerDeletions(); err != nil {
+		return e, err
+	}
+	if err := t.writeManifestDeletions(); err != nil {
+		return e, err
+	}
+	if err := t.writeEntries(); err != nil {
+		return e, err
+	}
+	return e, t.failed.ErrorOrNil()
+}
+
+// Checks that the Format is one that can be written, and that it can hold
+// the options that are recorded in PAX records.
+func (t *Tar) checkFormat() error {
+	if t.Cpio {
+		return nil
+	}
+	if err := t.checkPAXRecords(); err != nil {
+		return err
+	}
+	switch t.Format {
+	case tar.FormatUnknown, tar.FormatPAX:
+		return nil
+	case tar.FormatUSTAR, tar.FormatGNU:
+	default:
+		return fmt.Errorf("unsupported tar format %v", t.Format)
+	}
+	if t.IncludeACLs {
+		return fmt.Errorf("ACLs can't be recorded in the %v format, they need PAX", t.Format)
+	}
+	if t.IncludeFileFlags {
+		return fmt.Errorf("file flags can't be recorded in the %v format, they need PAX", t.Format)
+	}
+	if t.IncludeSELinux {
+		return fmt.Errorf("SELinux contexts can't be recorded in the %v format, they need PAX", t.Format)
+	}
+	if len(t.PAXRecords) > 0 {
+		return fmt.Errorf("PAX records can't be recorded in the %v format", t.Format)
+	}
+	return nil
+}
+
+// The PAX records that archive/tar writes from the fields of a header, which
+// can't be given in the PAXRecords.
+var headerPAXRecords = map[string]bool{
+	"path": true, "linkpath": true, "size": true, "uid": true, "gid": true,
+	"uname": true, "gname": true, "mtime": true, "atime": true, "ctime": true,
+}
+
+// Checks that the PAXRecords don't set any of the records derived from the
+// header of each entry.
+func (t *Tar) checkPAXRecords() error {
+	for k := range t.PAXRecords {
+		if headerPAXRecords[k] {
+			return fmt.Errorf("the PAX record %q can't be set, it is written from the header of each entry", k)
+		}
+	}
+	return nil
+}
+
+// The largest file a ustar header can hold, in its 11 octal digit size
+// field. Larger files need a PAX size record or the GNU base-256 encoding.
+const maxUstarSize = 1<<33 - 1
+
+// The largest file a newc cpio header can hold.
+const maxCpioSize = 0xffffffff
+
+// Checks that the size of the entry with the given header can be recorded in
+// the format being written, giving an EntryError naming the entry if it is
+// too large.
+func (t *Tar) checkSize(header *tar.Header) error {
+	var format string
+	var limit int64
+	switch {
+	case t.Cpio:
+		format, limit = "cpio", maxCpioSize
+	case t.Format == tar.FormatUSTAR:
+		format, limit = t.Format.String(), maxUstarSize
+	default:
+		return nil
+	}
+	if header.Size > limit {
+		return entryError(header.Name, fmt.Errorf("file too large for the %s format, %d bytes is over its limit of %d", format, header.Size, limit))
+	}
+	return nil
+}
+
+// Sets up the ignore file and included paths for the archive to be written.
+func (t *Tar) prepareRules() error {
+	if t.IgnoreFile != "" {
+		if err := t.readIgnoreFile(); err != nil {
+			return err
+		}
+	}
+
+	if t.OneFileSystem {
+		f, err := t.statTarget()
+		if err != nil {
+			return err
+		}
+		if id, ok := fileIDForFileInfo(f); ok {
+			t.rootDevice = &id.dev
+		}
+	}
+
+	var err error
+	t.includes, err = compileIncludes(t.IncludedPaths)
+	return err
+}
+
+// Compiles the globs of included paths, ignoring any trailing slash.
+func compileIncludes(patterns []string) ([]*pathmatch.Glob, error) {
+	var includes []*pathmatch.Glob
+	for _, pattern := range patterns {
+		g, err := pathmatch.CompileGlob(strings.TrimSuffix(pattern, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid included path %q: %v", pattern, err)
+		}
+		includes = append(includes, g)
+	}
+	return includes, nil
+}
+
+// Processes the listed Files, or otherwise the whole target directory.
+func (t *Tar) processTarget() error {
+	if t.ResolveTarget && t.fsys == nil {
+		resolved, err := filepath.EvalSymlinks(t.target)
+		if err != nil {
+			return fmt.Errorf("failed to resolve target %q: %v", t.target, err)
+		}
+		target := t.target
+		t.target = resolved
+		defer func() { t.target = target }()
+	}
+
+	if t.Files != nil {
+		// archive only the listed files
+		return t.processFiles()
+	}
+
+	// a target that isn't a directory is archived on its own
+	if single, f, err := t.singleTarget(); err != nil {
+		return err
+	} else if f != nil {
+		target := t.target
+		t.target = filepath.Dir(target)
+		defer func() { t.target = target }()
+		return t.skipFailed(t.processEntry(single, f, nil))
 	}
 
 	// ensure we write the current directory
-	f, err := os.Stat(t.target)
+	f, err := t.statTarget()
 	if err != nil {
 		return err
 	}
 
 	// walk the directory tree
-	if err := t.processEntry(".", f, []string{}); err != nil {
-		return err
+	return t.skipFailed(t.processEntry(".", f, nil))
+}
+
+// Returns the base name and FileInfo of the target when it is a single file
+// or a symlink to one, rather than a directory, otherwise a nil FileInfo.
+func (t *Tar) singleTarget() (string, os.FileInfo, error) {
+	if t.fsys != nil {
+		return "", nil, nil
 	}
+	f, err := os.Lstat(t.target)
+	if err != nil {
+		return "", nil, err
+	}
+	if f.Mode()&os.ModeSymlink != 0 {
+		// symlinks to directories are archived as the directory
+		if fi, err := os.Stat(t.target); err == nil && fi.IsDir() {
+			return "", nil, nil
+		}
+	} else if f.IsDir() {
+		return "", nil, nil
+	}
+	return filepath.Base(t.target), f, nil
+}
 
+// Digest returns the digest of the last archive written when DigestHash was
+// set, using its hash function.
+func (t *Tar) Digest() []byte {
+	return t.digest
+}
+
+// Copies the GzipHeader fields into the gzip writer, leaving the writer's
+// default OS if none was given.
+func (t *Tar) setGzipHeader(w io.Writer) {
+	h := t.GzipHeader
+	switch gw := w.(type) {
+	case *gzip.Writer:
+		if h.OS == 0 {
+			h.OS = gw.OS
+		}
+		gw.Header = h
+	case *pgzip.Writer:
+		if h.OS == 0 {
+			h.OS = gw.OS
+		}
+		gw.Header = pgzip.Header{
+			Comment: h.Comment,
+			Extra:   h.Extra,
+			ModTime: h.ModTime,
+			Name:    h.Name,
+			OS:      h.OS,
+		}
+	}
+}
+
+// AddEntry queues an entry that does not exist on disk, such as a generated
+// manifest, to be written to the archive after the contents of the target
+// directory. The header name is relative to the root of the archive and has
+// VirtualPath applied like any other entry. For regular files the content is
+// read from r when Archive is called. If header.Size is zero, r is read into
+// memory up front to determine the size.
+func (t *Tar) AddEntry(header *tar.Header, r io.Reader) error {
+	if header == nil {
+		return fmt.Errorf("no header given for the entry")
+	}
+	h := *header
+
+	isFile := h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA
+	if !isFile && r != nil {
+		return fmt.Errorf("entry %q is not a regular file and can't have content", h.Name)
+	}
+	if isFile && r == nil {
+		r = strings.NewReader("")
+	}
+	if isFile && h.Size == 0 {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read content for entry %q: %v", h.Name, err)
+		}
+		h.Size = int64(len(data))
+		r = bytes.NewReader(data)
+	}
+
+	t.entries = append(t.entries, virtualEntry{header: &h, reader: r})
+	return nil
+}
+
+// Writes the entries queued by AddEntry to the archive.
+func (t *Tar) writeEntries() error {
+	for _, e := range t.entries {
+		if err := contextErr(t.ctx); err != nil {
+			return err
+		}
+		header := *e.header
+		dir := strings.HasSuffix(header.Name, "/")
+		header.Name = path.Join(".", filepath.ToSlash(t.VirtualPath), header.Name)
+		if dir {
+			header.Name += "/"
+		}
+
+		if err := t.writeHeader(&header); err == errEntryDropped {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if e.reader == nil || t.estimate != nil {
+			t.addToManifest(&header, nil)
+			continue
+		}
+		src, digest := t.digestReader(e.reader)
+		n, err := t.copyContent(t.archive, header.Name, src, header.Size)
+		if err != nil {
+			return fmt.Errorf("failed to write entry %q: %v", header.Name, err)
+		}
+		if n != header.Size {
+			return fmt.Errorf("entry %q is %d bytes, expected %d", header.Name, n, header.Size)
+		}
+		t.addToManifest(&header, digest)
+	}
 	return nil
 }
 
@@ -170,35 +1215,149 @@ func (t *Tar) ExcludePath(pathRE string) {
 	}
 }
 
-func (t *Tar) processDirectory(dir string, dirStack []string) error {
+// Archives each of the paths in Files, without descending into directories.
+func (t *Tar) processFiles() error {
+	for _, name := range t.Files {
+		clean := filepath.Clean(name)
+		if filepath.IsAbs(clean) || clean == ".." ||
+			strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("path %q is not within the target directory", name)
+		}
+
+		f, err := t.lstat(clean)
+		if err != nil {
+			err = entryError(clean, err)
+		} else {
+			err = t.processEntry(clean, f, nil)
+		}
+		if err := t.skipFailed(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExcludeGlob appends a shell style glob, relative to the toplevel path to be
+// archived, to the ExcludedPaths. Unlike with filepath.Match, "**" matches any
+// number of directories, so "logs/**/*.tmp" excludes .tmp files anywhere under
+// the top level logs directory. Like ExcludePath, a pattern without a slash
+// also matches against the base name of every entry.
+func (t *Tar) ExcludeGlob(pattern string) error {
+	g, err := pathmatch.CompileGlob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+	}
+	t.ExcludedPaths = append(t.ExcludedPaths, g.Regexp())
+	return nil
+}
+
+func (t *Tar) processDirectory(dir string, dirStack []visitedDir) error {
+	// leave out the contents of directories at the maximum depth, whose
+	// entries would be one level beyond it
+	if t.MaxDepth > 0 && len(dirStack) > t.MaxDepth {
+		return nil
+	}
+
 	// get directory entries
-	files, err := ioutil.ReadDir(filepath.Join(t.target, dir))
+	files, err := t.readDir(dir)
 	if err != nil {
-		return err
+		return entryError(dir, err)
 	}
 
+	ra := t.startReadAhead(dir, files)
+	defer ra.close()
+
 	for _, f := range files {
 		fullName := filepath.Join(dir, f.Name())
-		if err := t.processEntry(fullName, f, dirStack); err != nil {
+		if err := t.skipFailed(t.processEntry(fullName, f, dirStack)); err != nil {
 			return err
 		}
+		ra.release(fullName)
 	}
 
 	return nil
 }
 
-func (t *Tar) processEntry(fullName string, f os.FileInfo, dirStack []string) error {
+func (t *Tar) processEntry(fullName string, f os.FileInfo, dirStack []visitedDir) error {
 	var err error
 
+	// Stop if the archive has been cancelled.
+	if err := contextErr(t.ctx); err != nil {
+		return err
+	}
+
 	// Exclude any files or paths specified by the user.
-	if t.shouldBeExcluded(fullName) {
+	if rule, excluded := t.excludedBy(fullName); excluded {
+		t.countExcluded(fullName, SkipExcluded, rule)
+		return nil
+	}
+
+	// Anything else needs to have been stat'd by the caller, as only excluded
+	// paths are checked without a FileInfo.
+	if f == nil {
+		return entryError(fullName, fmt.Errorf("entry was not stat'd, so there is no file info to archive it with"))
+	}
+
+	// Skip anything matched by the ignore file.
+	if t.ignore != nil && fullName != "." &&
+		t.ignore.Match(filepath.ToSlash(filepath.Clean(fullName)), f.IsDir()) {
+		t.countExcluded(fullName, SkipIgnored, ignoreRule(t.ignore, fullName, f.IsDir()))
+		return nil
+	}
+
+	// When only some paths are included, anything else is skipped unless it
+	// is a directory that could contain included paths.
+	included := t.shouldBeIncluded(fullName)
+	if !included && !(f.IsDir() && t.mayIncludeBelow(fullName)) &&
+		!(f.Mode()&os.ModeSymlink != 0 && t.dereferenceLinks()) {
+		t.countExcluded(fullName, SkipNotIncluded, "IncludedPaths")
+		return nil
+	}
+
+	// Skip anything on another filesystem, including mount points.
+	if t.onOtherFileSystem(f) {
+		t.countExcluded(fullName, SkipOtherFileSystem, "OneFileSystem")
+		return nil
+	}
+
+	// sockets are skipped, refused or recorded as empty files
+	if f.Mode()&os.ModeSocket == os.ModeSocket {
+		switch t.SocketPolicy {
+		case SocketError:
+			return fmt.Errorf("%q is a socket, which can't be archived", fullName)
+		case SocketArchiveAsEmptyFile:
+			f = emptyFileInfo{f}
+		default:
+			t.countExcluded(fullName, SkipSocket, "SocketPolicy")
+			return nil
+		}
+	}
+
+	// Skip files that are too large, or modified outside the wanted times.
+	if reason, rule, skip := t.outsideLimits(f); skip {
+		t.countExcluded(fullName, reason, rule)
 		return nil
 	}
 
 	// set base header parameters
 	header, err := tar.FileInfoHeader(f, "")
 	if err != nil {
-		return err
+		return entryError(fullName, err)
+	}
+
+	// leave out anything that hasn't changed since the snapshot being
+	// archived from
+	if !t.trackEntry(fullName, header) {
+		return nil
+	}
+
+	// and anything that is the same in the base of a layer, other than
+	// directories, which are held on to in case anything within them has
+	// changed
+	unchanged := t.unchangedInBase(fullName, f)
+	if unchanged && !f.IsDir() {
+		t.countUnchanged(fullName)
+		return nil
 	}
 
 	// Correct Windows paths so untar works in stager's container.
@@ -209,19 +1368,79 @@ func (t *Tar) processEntry(fullName string, f os.FileInfo, dirStack []string) er
 		header.Name = path.Join(".", filepath.ToSlash(t.VirtualPath), header.Name)
 	}
 
+	// leave out files with the same content as in the manifest being
+	// archived from
+	if f.Mode().IsRegular() {
+		unchanged, err := t.unchangedInManifest(fullName, header.Name)
+		if err != nil {
+			return entryError(fullName, err)
+		}
+		if unchanged {
+			t.countUnchanged(fullName)
+			return nil
+		}
+	}
+
 	// copy uid/gid if Permissions enabled
-	if t.IncludeOwners {
+	if t.IDMappingFunc != nil {
+		uid, gid := uidForFileInfo(f), gidForFileInfo(f)
+		if header.Uid, header.Gid, err = t.IDMappingFunc(uid, gid); err != nil {
+			return entryError(fullName, fmt.Errorf("failed to map owner for %q: %v", header.Name, err))
+		}
+	} else if t.IncludeOwners {
 		if header.Uid, err = t.OwnerMappingFunc(uidForFileInfo(f)); err != nil {
-			return fmt.Errorf("failed to map UID for %q: %v", header.Name, err)
+			return entryError(fullName, fmt.Errorf("failed to map UID for %q: %v", header.Name, err))
 		}
 		if header.Gid, err = t.GroupMappingFunc(gidForFileInfo(f)); err != nil {
-			return fmt.Errorf("failed to map GID for %q: %v", header.Name, err)
+			return entryError(fullName, fmt.Errorf("failed to map GID for %q: %v", header.Name, err))
 		}
+	} else if t.OwnershipOverride != nil {
+		header.Uid = t.OwnershipOverride.Uid
+		header.Gid = t.OwnershipOverride.Gid
 	} else {
 		header.Uid = 500
 		header.Gid = 500
 	}
 
+	// record the names for the ids, rather than those of the file's actual
+	// owner that archive/tar fills in
+	header.Uname, header.Gname = "", ""
+	if t.IncludeNames {
+		if t.names == nil {
+			t.names = newNameCache()
+		}
+		header.Uname = t.names.userName(header.Uid)
+		header.Gname = t.names.groupName(header.Gid)
+	}
+
+	// record ACLs for the types that can have them
+	if t.IncludeACLs && t.fsys == nil && (f.IsDir() || f.Mode().IsRegular()) {
+		if err := addACLs(header, filepath.Join(t.target, fullName)); err != nil {
+			return entryError(fullName, fmt.Errorf("failed to read ACLs for %q: %v", header.Name, err))
+		}
+	}
+
+	// and SELinux contexts, which any type can have
+	if t.IncludeSELinux && t.fsys == nil {
+		if err := addSELinuxLabel(header, filepath.Join(t.target, fullName)); err != nil {
+			return entryError(fullName, fmt.Errorf("failed to read the SELinux context for %q: %v", header.Name, err))
+		}
+	}
+
+	// and file flags
+	if t.IncludeFileFlags && t.fsys == nil && (f.IsDir() || f.Mode().IsRegular()) {
+		if err := addFileFlags(header, filepath.Join(t.target, fullName)); err != nil {
+			return entryError(fullName, fmt.Errorf("failed to read file flags for %q: %v", header.Name, err))
+		}
+	}
+
+	// the macOS metadata goes in an entry of its own ahead of this one
+	if t.IncludeAppleDouble && t.fsys == nil && fullName != "." && (f.IsDir() || f.Mode().IsRegular()) {
+		if err := t.writeAppleDouble(header, fullName); err != nil {
+			return err
+		}
+	}
+
 	mode := f.Mode()
 	switch {
 	// directory handling
@@ -234,20 +1453,43 @@ func (t *Tar) processEntry(fullName string, f os.FileInfo, dirStack []string) er
 		// update directory specific values, tarballs often append with a slash
 		header.Name = header.Name + "/"
 
-		// write the header
-		err = t.archive.WriteHeader(header)
-		if err != nil {
-			return err
+		// Resolve the directory the same way as link targets, so that links
+		// back to it can be detected, and skip it if it is a mount of a
+		// directory that is already being archived
+		p := fullName
+		if t.fsys == nil {
+			p, err = filepath.Abs(filepath.Join(t.target, fullName))
+			if err != nil {
+				return fmt.Errorf("error getting absolute path for path %q, err='%v'\n", fullName, err)
+			}
+			if resolved, err := filepath.EvalSymlinks(p); err == nil {
+				p = resolved
+			}
+		}
+		visited := newVisitedDir(fullName, p, f)
+		if elem, ok := findLoop(dirStack, visited); ok {
+			return t.loopFound(fullName, elem)
 		}
 
-		// Push the directory to stack
-		p, err := filepath.Abs(fullName)
-		if err != nil {
-			return fmt.Errorf("error getting absolute path for path %q, err='%v'\n", fullName, err)
+		// write the header, or hold on to it until something within the
+		// directory is included or has changed
+		if included && !unchanged {
+			err = t.writeHeader(header)
+			if err != nil && err != errEntryDropped {
+				return err
+			}
+		} else {
+			pending := len(t.pendingDirs)
+			t.pendingDirs = append(t.pendingDirs, header)
+			defer t.dropPendingDirs(pending)
 		}
 
-		// process the directory's entries next
-		if err = t.processDirectory(fullName, append(dirStack, p)); err != nil {
+		// process the directory's entries next, unless only the listed files
+		// are being archived
+		if t.Files != nil {
+			return nil
+		}
+		if err = t.processDirectory(fullName, append(dirStack, visited)); err != nil {
 			return err
 		}
 
@@ -258,54 +1500,88 @@ func (t *Tar) processEntry(fullName string, f os.FileInfo, dirStack []string) er
 			header.Mode = 0755
 		}
 
+		// links within an fs.FS are archived as they are
+		if t.fsys != nil {
+			if !included {
+				return nil
+			}
+			if header.Linkname, err = t.readFSLink(fullName); err != nil {
+				return entryError(fullName, err)
+			}
+			return ignoreDropped(t.writeHeader(header))
+		}
+
 		// read and process the link
 		link, err := cleanLinkName(t.target, fullName)
 		if err != nil {
-			return err
+			return entryError(fullName, err)
 		}
 
-		if t.UserOptions&c_DEREF != 0 {
+		if t.dereferenceLinks() {
 			// Evaluate the path for the link. This will give us the
 			// complete absolute path with all symlinks resolved.
 			slink, err := filepath.EvalSymlinks(link)
 			if err != nil {
-				return fmt.Errorf("error evaluating symlink %q, err='%v'", link, err)
-			}
-
-			for _, elem := range dirStack {
-				if slink == elem {
-					// We don't want to abort if we detect a cycle.
-					// Let it continue  without this path element.
-					return nil
-				}
+				return entryError(fullName, fmt.Errorf("error evaluating symlink %q, err='%v'", link, err))
 			}
 
-			// Ok we are not in a circular path. Proceed.
 			f, err := os.Stat(slink)
 			if err != nil {
-				return fmt.Errorf("error getting file stat for %q, err='%v'", slink, err)
+				return entryError(fullName, fmt.Errorf("error getting file stat for %q, err='%v'", slink, err))
+			}
+
+			if t.onOtherFileSystem(f) {
+				t.countExcluded(fullName, SkipOtherFileSystem, "OneFileSystem")
+				return nil
 			}
 
 			if f.IsDir() {
+				// Don't follow links back to a directory that is already
+				// being archived, which would recurse forever.
+				visited := newVisitedDir(fullName, slink, f)
+				if elem, ok := findLoop(dirStack, visited); ok {
+					return t.loopFound(fullName, elem)
+				}
+
+				if !included && !t.mayIncludeBelow(fullName) {
+					t.countExcluded(fullName, SkipNotIncluded, "IncludedPaths")
+					return nil
+				}
+
 				// Write the header so that the symlinked directory contents appears
 				// under current dir.
 				header, err := tar.FileInfoHeader(f, "")
 				if err != nil {
 					return err
 				}
-				header.Name = "./" + fullName + "/"
-
-				// write the header
-				err = t.archive.WriteHeader(header)
-				if err != nil {
-					return err
+				// named as other directories are, under the VirtualPath,
+				// so that it holds the entries written from within it
+				header.Name = path.Join(".", filepath.ToSlash(t.VirtualPath), filepath.ToSlash(fullName)) + "/"
+
+				// write the header, or hold on to it until something within
+				// the directory is included
+				if included {
+					err = t.writeHeader(header)
+					if err != nil && err != errEntryDropped {
+						return err
+					}
+				} else {
+					pending := len(t.pendingDirs)
+					t.pendingDirs = append(t.pendingDirs, header)
+					defer t.dropPendingDirs(pending)
 				}
 
-				return t.processDirectory(fullName, append(dirStack, slink))
+				if t.Files != nil {
+					return nil
+				}
+				return t.processDirectory(fullName, append(dirStack, visited))
 			} else {
 				return t.processEntry(fullName, f, dirStack)
 			}
 
+		} else if !included {
+			t.countExcluded(fullName, SkipNotIncluded, "IncludedPaths")
+			return nil
 		} else {
 			dir := filepath.Dir(fullName)
 			// If the link path contains the target path, then convert the link to be
@@ -322,84 +1598,164 @@ func (t *Tar) processEntry(fullName string, f os.FileInfo, dirStack []string) er
 
 			header.Linkname = link
 			// write the header
-			err = t.archive.WriteHeader(header)
+			err = t.writeHeader(header)
 			if err != nil {
-				return err
+				return ignoreDropped(err)
 			}
 
 		}
 
 	// regular file handling
 	case mode&os.ModeType == 0:
-		// if Permissions is not enabled, force mode back to 0644
+		// if Permissions is not enabled, force mode back to 0644, otherwise
+		// ensure files from Windows have +x bit written.
 		if !t.IncludePermissions {
 			header.Mode = 0644
+		} else {
+			header.Mode = tarMode(chmodTarEntry(mode))
 		}
 
-		// Necessary to ensure files from Windows have +x bit written.
-		header.Mode = int64(chmodTarEntry(mode))
-
 		// check to see if this is a hard link
-		if linkCountForFileInfo(f) > 1 {
-			inode := inodeForFileInfo(f)
+		var firstLink bool
+		var inode uint64
+		if linkCountForFileInfo(f) > 1 && !t.Cpio {
+			inode = inodeForFileInfo(f)
 			if dst, ok := t.hardLinks[inode]; ok {
 				// update the header if it is
 				header.Typeflag = tar.TypeLink
 				header.Linkname = dst
 				header.Size = 0
 			} else {
-				// push it on the list, and continue to write it as a file
-				// this is our first time seeing it
-				t.hardLinks[inode] = header.Name
+				// this is our first time seeing it, so it is written as a
+				// file and put on the list once it has its final name
+				firstLink = true
+			}
+		}
+
+		// link to a file with the same content that was already written
+		var dedup dedupKey
+		if t.DeduplicateContent && header.Typeflag == tar.TypeReg && header.Size > 0 &&
+			t.estimate == nil && !t.MetadataOnly && !t.Cpio {
+			dedup = newDedupKey(header)
+			dst, err := t.findDuplicate(dedup, fullName)
+			if err != nil {
+				return entryError(fullName, err)
+			}
+			if dst != "" {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = dst
+				header.Size = 0
 			}
 		}
 
+		// leave out the content when only the metadata is wanted, keeping
+		// the size of the file for the manifest
+		size := header.Size
+		if t.MetadataOnly && header.Typeflag == tar.TypeReg {
+			header.Size = 0
+		}
+
+		// store files with holes as sparse entries when asked to
+		if t.Sparse && t.estimate == nil && t.fsys == nil && header.Typeflag == tar.TypeReg && header.Size > 0 && t.sparseFormat() {
+			written, err := t.writeSparseFile(header, fullName)
+			if err != nil {
+				return ignoreDropped(err)
+			}
+			if written {
+				if firstLink {
+					t.hardLinks[inode] = header.Name
+				}
+				return nil
+			}
+		}
+
+		// open the file before writing the header, so that a file that
+		// can't be read is left out whole
+		var data io.ReadCloser
+		if header.Typeflag == tar.TypeReg && size > 0 && t.estimate == nil && t.readsContent() {
+			data, err = t.openContent(fullName)
+			if err != nil {
+				return entryError(fullName, err)
+			}
+			defer data.Close()
+		}
+
 		// write the header
-		err = t.archive.WriteHeader(header)
+		err = t.writeHeader(header)
 		if err != nil {
-			return err
+			return ignoreDropped(err)
+		}
+		if firstLink {
+			t.hardLinks[inode] = header.Name
 		}
 
-		// only write the file if tye type is still a regular file
-		if header.Typeflag == tar.TypeReg {
-			// open the file and copy
-			data, err := os.Open(filepath.Join(t.target, fullName))
-			if err != nil {
+		// only write the file if tye type is still a regular file, with
+		// content to write
+		var digest hash.Hash
+		if data != nil && header.Typeflag == tar.TypeReg && t.MetadataOnly {
+			// the file is only read for the manifest
+			var src io.Reader
+			src, digest = t.digestReader(data)
+			if _, err = io.Copy(ioutil.Discard, src); err != nil {
 				return err
 			}
-			_, err = io.Copy(t.archive, data)
+			header.Size = size
+		} else if data != nil && header.Typeflag == tar.TypeReg {
+			var src io.Reader
+			src, digest = t.digestReader(data)
+			var content hash.Hash
+			if t.DeduplicateContent {
+				content = sha256.New()
+				src = io.TeeReader(src, content)
+			}
+			_, err = t.copyContent(t.archive, header.Name, src, header.Size)
 			if err != nil {
-				data.Close()
 				return err
 			}
 
 			// important to flush before the file is closed
 			err = t.archive.Flush()
 			if err != nil {
-				data.Close()
 				return err
 			}
-			// we want to ensure the file is closed in the loop
-			data.Close()
+			if content != nil {
+				t.addDuplicate(dedup, header.Name, content.Sum(nil))
+			}
 		}
+		t.addToManifest(header, digest)
 
 	// device support
 	case mode&os.ModeDevice == os.ModeDevice ||
 		mode&os.ModeCharDevice == os.ModeCharDevice:
 		//
 		// stat to get devmode
-		fi, err := os.Stat(filepath.Join(t.target, fullName))
+		fi := f
+		if t.fsys == nil {
+			fi, err = os.Stat(filepath.Join(t.target, fullName))
+			if err != nil {
+				return entryError(fullName, err)
+			}
+		}
 		header.Devmajor, header.Devminor = osDeviceNumbersForFileInfo(fi)
 
 		// write the header
-		err = t.archive.WriteHeader(header)
+		err = t.writeHeader(header)
 		if err != nil {
-			return err
+			return ignoreDropped(err)
+		}
+
+	// named pipes are recreated on extraction, without any content
+	case mode&os.ModeNamedPipe == os.ModeNamedPipe:
+		if !t.IncludePermissions {
+			header.Mode = 0644
+		}
+
+		// write the header
+		err = t.writeHeader(header)
+		if err != nil {
+			return ignoreDropped(err)
 		}
 
-	// socket handling
-	case mode&os.ModeSocket == os.ModeSocket:
-		// skip... gnutar does, so we will
 	default:
 	}
 
@@ -430,13 +1786,163 @@ func cleanLinkName(targetDir, name string) (string, error) {
 	return link, nil
 }
 
+// Reads the patterns from the IgnoreFile, if it exists.
+func (t *Tar) readIgnoreFile() error {
+	f, err := t.open(t.IgnoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t.ignore, err = pathmatch.ParseIgnoreFile(f)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", t.IgnoreFile, err)
+	}
+	return nil
+}
+
+// Determines if the supplied name, or one of its parent directories, matches
+// the IncludedPaths. Everything is included when there are none.
+func (t *Tar) shouldBeIncluded(name string) bool {
+	return matchIncludes(t.includes, name)
+}
+
+// Determines if the supplied path, or one of the directories it is within,
+// matches one of the included path globs. Everything matches when there are
+// none.
+func matchIncludes(includes []*pathmatch.Glob, name string) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	name = filepath.ToSlash(filepath.Clean(name))
+	for name != "." && name != "/" {
+		for _, g := range includes {
+			if g.Match(name) {
+				return true
+			}
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
+
+// Determines if the supplied directory could contain a path matching one of
+// the IncludedPaths, by matching its path elements against the leading
+// elements of each pattern.
+func (t *Tar) mayIncludeBelow(dir string) bool {
+	if len(t.includes) == 0 {
+		return true
+	}
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	if dir == "." {
+		return true
+	}
+	elems := strings.Split(dir, "/")
+	for _, g := range t.includes {
+		patterns := strings.Split(strings.TrimPrefix(g.String(), "/"), "/")
+		if globPrefixMatch(patterns, elems) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the path elements could be the start of a path matching
+// the glob pattern elements.
+func globPrefixMatch(patterns, elems []string) bool {
+	for i, elem := range elems {
+		if i >= len(patterns) {
+			return false
+		}
+		if strings.Contains(patterns[i], "**") {
+			return true
+		}
+		// Be conservative about anything path.Match doesn't understand.
+		if ok, err := path.Match(patterns[i], elem); err == nil && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Forgets the pending directory headers from index n on, once the directories
+// have been processed without including anything within them.
+func (t *Tar) dropPendingDirs(n int) {
+	if len(t.pendingDirs) > n {
+		t.pendingDirs = t.pendingDirs[:n]
+	}
+}
+
+// Determines if the content of files is read, which it isn't when only the
+// metadata is archived unless it is needed for the manifest.
+func (t *Tar) readsContent() bool {
+	return !t.MetadataOnly || t.ComputeManifest
+}
+
+// Determines if symlinks should be followed, either because DereferenceLinks
+// is set or the equivalent user option.
+func (t *Tar) dereferenceLinks() bool {
+	return t.DereferenceLinks || t.UserOptions&c_DEREF != 0
+}
+
+// Determines if the file is on a different filesystem to the target
+// directory, when OneFileSystem is set.
+func (t *Tar) onOtherFileSystem(f os.FileInfo) bool {
+	if t.rootDevice == nil || f == nil {
+		return false
+	}
+	id, ok := fileIDForFileInfo(f)
+	return ok && id.dev != *t.rootDevice
+}
+
+// Reports whether the entry with the given FileInfo is left out by the
+// MaxFileSize, MinMtime or MaxMtime, and why, along with which of them it
+// was.
+func (t *Tar) outsideLimits(f os.FileInfo) (SkipReason, string, bool) {
+	if f == nil || f.IsDir() {
+		return 0, "", false
+	}
+	if t.MaxFileSize > 0 && f.Mode().IsRegular() && f.Size() > t.MaxFileSize {
+		return SkipTooLarge, "MaxFileSize", true
+	}
+	mtime := f.ModTime()
+	if !t.MinMtime.IsZero() && mtime.Before(t.MinMtime) {
+		return SkipModTime, "MinMtime", true
+	}
+	if !t.MaxMtime.IsZero() && mtime.After(t.MaxMtime) {
+		return SkipModTime, "MaxMtime", true
+	}
+	return 0, "", false
+}
+
 // Determines if supplied name is contained in the slice of files to exclude.
 func (t *Tar) shouldBeExcluded(name string) bool {
+	_, excluded := t.excludedBy(name)
+	return excluded
+}
+
+// Reports whether the named entry is excluded, along with the rule that
+// excludes it, which is the expression for the ExcludedPaths and
+// ExcludeRegexps.
+func (t *Tar) excludedBy(name string) (string, bool) {
 	name = filepath.Clean(name)
+	if t.ExcludeVCS && vcsNames[filepath.Base(name)] {
+		return "ExcludeVCS", true
+	}
 	for _, re := range t.ExcludedPaths {
 		if re.MatchString(name) || re.MatchString(filepath.Base(name)) {
-			return true
+			return re.String(), true
 		}
 	}
-	return false
+	if len(t.ExcludeRegexps) > 0 && name != "." {
+		rel := strings.TrimPrefix(filepath.ToSlash(name), "/")
+		for _, re := range t.ExcludeRegexps {
+			if re.MatchString(rel) {
+				return re.String(), true
+			}
+		}
+	}
+	return "", false
 }
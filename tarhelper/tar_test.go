@@ -4,14 +4,37 @@ package tarhelper
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"os/user"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/apcera/logray"
+	"github.com/apcera/util/multierror"
 	. "github.com/apcera/util/testtool"
 )
 
@@ -43,6 +66,20 @@ func makeTestDir(t *testing.T) string {
 	return dir
 }
 
+// Returns the names of the entries in an uncompressed archive, in order.
+func archiveNames(t *testing.T, data []byte) []string {
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		TestExpectSuccess(t, err)
+		names = append(names, header.Name)
+	}
+}
+
 func TestTarSimple(t *testing.T) {
 	StartTest(t)
 	defer FinishTest(t)
@@ -181,10 +218,12 @@ func TestPathExclusion(t *testing.T) {
 	tw.ExcludePath("/one.*")
 	tw.ExcludePath("/two/two/.*")
 	tw.ExcludePath("/three/three/three.*")
-	TestExpectSuccess(t, tw.processEntry("/one/something", nil, []string{}))
-	TestExpectSuccess(t, tw.processEntry("/two/two/something", nil, []string{}))
-	TestExpectSuccess(t, tw.processEntry("/three/three/three-something", nil, []string{}))
-	TestExpectError(t, tw.processEntry("/two/two-something", nil, []string{}))
+	TestExpectSuccess(t, tw.processEntry("/one/something", nil, nil))
+	TestExpectSuccess(t, tw.processEntry("/two/two/something", nil, nil))
+	TestExpectSuccess(t, tw.processEntry("/three/three/three-something", nil, nil))
+	err := tw.processEntry("/two/two-something", nil, nil)
+	TestExpectError(t, err)
+	TestTrue(t, strings.Contains(err.Error(), "not stat'd"))
 }
 
 func TestTarIDMapping(t *testing.T) {
@@ -210,6 +249,8 @@ func TestTarIDMapping(t *testing.T) {
 	tw.OwnerMappingFunc = uidMappingFunc
 	tw.GroupMappingFunc = gidMappingFunc
 	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, uidFuncCalled, true)
+	TestEqual(t, gidFuncCalled, true)
 
 	// untar it and verify all of the uid/gids are 0
 	archive := tar.NewReader(w)
@@ -506,3 +547,2828 @@ func TestSymlinkOptDereferenceCircularToRoot(t *testing.T) {
 	_, err = os.Stat(path.Join(extractionPath, "./a/b/i/ll"))
 	TestEqual(t, true, os.IsNotExist(err))
 }
+
+func TestTarCompression(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	for _, c := range []Compression{GZIP, BZIP2, XZ, ZSTD} {
+		if c == BZIP2 {
+			if _, err := exec.LookPath("bzip2"); err != nil {
+				continue
+			}
+		}
+
+		// archive with the compression
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, makeTestDir(t))
+		tw.Compression = c
+		TestExpectSuccess(t, tw.Archive())
+
+		// extract it using both the explicit type and detection
+		for _, uc := range []Compression{c, DETECT} {
+			extractionPath := TempDir(t)
+			u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+			u.Compression = uc
+			TestExpectSuccess(t, u.Extract())
+
+			f, err := os.Stat(path.Join(extractionPath, "a/b/c/d/e"))
+			TestExpectSuccess(t, err)
+			TestEqual(t, f.Mode().IsRegular(), true)
+		}
+	}
+
+	// unknown compression types are an error
+	tw := NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Compression = Compression("unknown")
+	TestExpectError(t, tw.Archive())
+	tw.Compression = DETECT
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarZstd(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	for _, level := range []int{0, 1, 19} {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.Compression = ZSTD
+		tw.CompressionLevel = level
+		TestExpectSuccess(t, tw.Archive())
+		TestEqual(t, w.Bytes()[:4], []byte{0x28, 0xB5, 0x2F, 0xFD})
+
+		extractionPath := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+		u.Compression = ZSTD
+		TestExpectSuccess(t, u.Extract())
+
+		f, err := os.Stat(path.Join(extractionPath, "a/b/c/d/e"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, f.Mode().IsRegular(), true)
+	}
+
+	// out of range levels are rejected
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.Compression = ZSTD
+	tw.CompressionLevel = 23
+	TestExpectError(t, tw.Archive())
+
+	// as are levels for compressors that don't support them
+	tw.Compression = BZIP2
+	tw.CompressionLevel = 1
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarBzip2Command(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// without the command, bzip2 archives fail before anything is written
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	TestExpectSuccess(t, os.Setenv("PATH", TempDir(t)))
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Compression = BZIP2
+	err := tw.Archive()
+	TestExpectError(t, err)
+	TestEqual(t, strings.Contains(err.Error(), "needs the bzip2 command"), true)
+	TestEqual(t, w.Len(), 0)
+}
+
+func TestTarGzipOptions(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	archive := func(level int, header gzip.Header) []byte {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.Compression = GZIP
+		tw.CompressionLevel = level
+		tw.GzipHeader = header
+		TestExpectSuccess(t, tw.Archive())
+		return w.Bytes()
+	}
+
+	// the default header has no modification time, so output is repeatable
+	TestEqual(t, archive(0, gzip.Header{}), archive(0, gzip.Header{}))
+
+	// the header fields are written
+	mtime := time.Unix(1400000000, 0)
+	data := archive(gzip.BestSpeed, gzip.Header{
+		Name:    "test.tar",
+		Comment: "a comment",
+		ModTime: mtime,
+	})
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	TestExpectSuccess(t, err)
+	TestEqual(t, gr.Name, "test.tar")
+	TestEqual(t, gr.Comment, "a comment")
+	TestEqual(t, gr.ModTime.Equal(mtime), true)
+
+	// and the archive still extracts
+	extractionPath := TempDir(t)
+	u := NewUntar(bytes.NewReader(data), extractionPath)
+	u.Compression = DETECT
+	TestExpectSuccess(t, u.Extract())
+	_, err = os.Stat(path.Join(extractionPath, "a/b/c/d/e"))
+	TestExpectSuccess(t, err)
+
+	// invalid levels are rejected
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.Compression = GZIP
+	tw.CompressionLevel = 10
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarParallelGzip(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// include a file spanning several compression blocks
+	dir := makeTestDir(t)
+	big := make([]byte, 3<<20)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "big"), big, 0644))
+
+	for _, level := range []int{0, gzip.BestSpeed} {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.Compression = GZIP
+		tw.CompressionLevel = level
+		tw.ParallelGzip = true
+		tw.GzipHeader.Name = "test.tar"
+		TestExpectSuccess(t, tw.Archive())
+
+		// the standard library can read the stream
+		gr, err := gzip.NewReader(bytes.NewReader(w.Bytes()))
+		TestExpectSuccess(t, err)
+		TestEqual(t, gr.Name, "test.tar")
+		TestEqual(t, gr.OS, byte(255))
+		gr.Multistream(false)
+		_, err = io.Copy(ioutil.Discard, gr)
+		TestExpectSuccess(t, err)
+
+		extractionPath := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+		u.Compression = GZIP
+		TestExpectSuccess(t, u.Extract())
+		data, err := ioutil.ReadFile(path.Join(extractionPath, "big"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, bytes.Equal(data, big), true)
+	}
+}
+
+func TestTarAddEntry(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.VirtualPath = "virt"
+	TestExpectSuccess(t, tw.AddEntry(&tar.Header{
+		Name:     "meta/",
+		Mode:     0755,
+		Typeflag: tar.TypeDir,
+	}, nil))
+	TestExpectSuccess(t, tw.AddEntry(&tar.Header{
+		Name:     "meta/manifest.json",
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+	}, strings.NewReader(`{"a": 1}`)))
+	TestExpectSuccess(t, tw.AddEntry(&tar.Header{
+		Name:     "meta/sized",
+		Mode:     0644,
+		Size:     5,
+		Typeflag: tar.TypeReg,
+	}, strings.NewReader("hello")))
+
+	// invalid entries are rejected
+	TestExpectError(t, tw.AddEntry(nil, nil))
+	TestExpectError(t, tw.AddEntry(&tar.Header{
+		Name:     "link",
+		Typeflag: tar.TypeSymlink,
+	}, strings.NewReader("data")))
+
+	TestExpectSuccess(t, tw.Archive())
+
+	extractionPath := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+	TestExpectSuccess(t, u.Extract())
+
+	// both the walked and added entries are there
+	_, err := os.Stat(path.Join(extractionPath, "virt/a/b/c/d/e"))
+	TestExpectSuccess(t, err)
+	data, err := ioutil.ReadFile(path.Join(extractionPath, "virt/meta/manifest.json"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), `{"a": 1}`)
+	data, err = ioutil.ReadFile(path.Join(extractionPath, "virt/meta/sized"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "hello")
+
+	// content that doesn't match the size is an error
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	TestExpectSuccess(t, tw.AddEntry(&tar.Header{
+		Name:     "short",
+		Size:     10,
+		Typeflag: tar.TypeReg,
+	}, strings.NewReader("hello")))
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarFiles(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Files = []string{"a/b/g", "a/b/c", "./a/b/c/d/e", "a/b/h"}
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"a/b/g", "a/b/c/", "a/b/c/d/e", "a/b/h",
+	})
+
+	// exclusions still apply
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, makeTestDir(t))
+	tw.Files = []string{"a/b/g", "a/b/c/f"}
+	tw.ExcludePath("f")
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"a/b/g"})
+
+	// paths outside the target and missing files are errors
+	for _, name := range []string{"../a", "/etc/passwd", "a/missing"} {
+		tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+		tw.Files = []string{name}
+		TestExpectError(t, tw.Archive())
+	}
+}
+
+func TestTarProgress(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/big"), make([]byte, 100000), 0644))
+
+	type progress struct{ written, total int64 }
+	entries := map[string][]progress{}
+	var written []int64
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Compression = GZIP
+	tw.ProgressFunc = func(entry string, n, total int64) {
+		entries[entry] = append(entries[entry], progress{n, total})
+	}
+	tw.BytesWrittenFunc = func(n int64) {
+		written = append(written, n)
+	}
+	TestExpectSuccess(t, tw.Archive())
+
+	// every entry is reported, with the content reported as it's copied
+	TestEqual(t, len(entries), len(archiveNames(t, gunzipBytes(t, w.Bytes()))))
+	TestEqual(t, entries["a/b/g"], []progress{{0, 0}})
+	big := entries["a/big"]
+	TestEqual(t, big[0], progress{0, 100000})
+	TestEqual(t, big[len(big)-1], progress{100000, 100000})
+
+	// the final byte count is the compressed size
+	TestNotEqual(t, len(written), 0)
+	TestEqual(t, written[len(written)-1], int64(w.Len()))
+}
+
+// Decompresses a gzip stream.
+func gunzipBytes(t *testing.T, data []byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	TestExpectSuccess(t, err)
+	out, err := ioutil.ReadAll(gr)
+	TestExpectSuccess(t, err)
+	return out
+}
+
+func TestTarArchiveContext(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+
+	// an already cancelled context stops the archive before it begins
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	TestEqual(t, tw.ArchiveContext(ctx), context.Canceled)
+
+	// cancelling part way through stops the copy of the current file
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "big"), make([]byte, 1<<20), 0644))
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.ProgressFunc = func(entry string, written, total int64) {
+		if entry == "big" && written > 0 {
+			cancel()
+		}
+	}
+	TestEqual(t, tw.ArchiveContext(ctx), context.Canceled)
+
+	// the Tar can still be used afterwards
+	TestExpectSuccess(t, tw.Archive())
+}
+
+func TestTarIncludedPaths(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	archive := func(patterns ...string) []string {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, makeTestDir(t))
+		tw.IncludedPaths = patterns
+		TestExpectSuccess(t, tw.Archive())
+		return archiveNames(t, w.Bytes())
+	}
+
+	// a directory brings its contents and its parents
+	TestEqual(t, archive("a/b/c/"), []string{
+		"./", "a/", "a/b/", "a/b/c/", "a/b/c/d/", "a/b/c/d/e", "a/b/c/f", "a/b/c/l",
+	})
+
+	// globs match at any depth with "**", and directories that end up with
+	// nothing included are left out
+	TestEqual(t, archive("**/k", "a/b/[gh]"), []string{
+		"./", "a/", "a/b/", "a/b/g", "a/b/h", "a/b/i/", "a/b/i/j/", "a/b/i/j/k",
+	})
+
+	// nothing matching leaves an empty archive
+	TestEqual(t, archive("missing"), []string(nil))
+
+	// invalid patterns are an error
+	tw := NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.IncludedPaths = []string{`a\`}
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarExcludeRegexps(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	for _, name := range []string{"logs/x.log", "a/logs/y.log", "a/logs/deep/z.log", "a/logs/keep.txt", "other.log"} {
+		TestExpectSuccess(t, os.MkdirAll(path.Join(dir, path.Dir(name)), 0755))
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), nil, 0644))
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.ExcludeRegexps = []*regexp.Regexp{regexp.MustCompile(`(^|/)logs/(.*/)?[^/]*\.log$`)}
+	TestExpectSuccess(t, tw.Archive())
+
+	names := map[string]bool{}
+	for _, name := range archiveNames(t, w.Bytes()) {
+		names[name] = true
+	}
+	TestEqual(t, names["logs/x.log"], false)
+	TestEqual(t, names["a/logs/y.log"], false)
+	TestEqual(t, names["a/logs/deep/z.log"], false)
+	TestEqual(t, names["a/logs/keep.txt"], true)
+	TestEqual(t, names["other.log"], true)
+	TestEqual(t, names["a/b/c/d/e"], true)
+}
+
+func TestTarIgnoreFile(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/keep.tmp"), nil, 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/other.tmp"), nil, 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, DefaultIgnoreFile), []byte(
+		"# comments are ignored\n"+
+			"*.tmp\n"+
+			"!keep.tmp\n"+
+			"/a/b/c/\n"+
+			"j/\n"), 0644))
+
+	archive := func(ignoreFile string) map[string]bool {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.IgnoreFile = ignoreFile
+		TestExpectSuccess(t, tw.Archive())
+		names := map[string]bool{}
+		for _, name := range archiveNames(t, w.Bytes()) {
+			names[name] = true
+		}
+		return names
+	}
+
+	names := archive(DefaultIgnoreFile)
+	TestEqual(t, names["a/b/keep.tmp"], true)
+	TestEqual(t, names["a/b/other.tmp"], false)
+	TestEqual(t, names["a/b/c/"], false)
+	TestEqual(t, names["a/b/c/d/e"], false)
+	TestEqual(t, names["a/b/i/"], true)
+	TestEqual(t, names["a/b/i/j/"], false)
+	TestEqual(t, names["a/b/i/j/k"], false)
+	TestEqual(t, names["a/b/g"], true)
+
+	// without an ignore file, or if it doesn't exist, everything is included
+	TestEqual(t, archive("")["a/b/other.tmp"], true)
+	TestEqual(t, archive("missing")["a/b/other.tmp"], true)
+}
+
+func TestTarExcludeGlob(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	for _, name := range []string{"logs/a.tmp", "logs/x/y/b.tmp", "logs/keep.txt", "other/c.tmp", "d.bak", "other/e.bak"} {
+		TestExpectSuccess(t, os.MkdirAll(path.Join(dir, path.Dir(name)), 0755))
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), nil, 0644))
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	TestExpectSuccess(t, tw.ExcludeGlob("logs/**/*.tmp"))
+	TestExpectSuccess(t, tw.ExcludeGlob("*.bak"))
+	TestExpectError(t, tw.ExcludeGlob(`bad\`))
+	TestExpectSuccess(t, tw.Archive())
+
+	names := map[string]bool{}
+	for _, name := range archiveNames(t, w.Bytes()) {
+		names[name] = true
+	}
+	TestEqual(t, names["logs/a.tmp"], false)
+	TestEqual(t, names["logs/x/y/b.tmp"], false)
+	TestEqual(t, names["logs/x/y/"], true)
+	TestEqual(t, names["logs/keep.txt"], true)
+	TestEqual(t, names["other/c.tmp"], true)
+	TestEqual(t, names["d.bak"], false)
+	TestEqual(t, names["other/e.bak"], false)
+}
+
+func TestTarDereferenceLinks(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// not run from within the directory, and with a link back to the root
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.MkdirAll(path.Join(dir, "a/b"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/file"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink("../file", path.Join(dir, "a/b/link")))
+	TestExpectSuccess(t, os.Symlink("../..", path.Join(dir, "a/b/root")))
+	TestExpectSuccess(t, os.Symlink("../b", path.Join(dir, "a/b/self")))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.DereferenceLinks = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"./", "a/", "a/b/", "a/b/link", "a/file",
+	})
+
+	// the link is stored as a copy of the file
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Name == "a/b/link" {
+			TestEqual(t, header.Typeflag, byte(tar.TypeReg))
+			data, err := ioutil.ReadAll(tr)
+			TestExpectSuccess(t, err)
+			TestEqual(t, string(data), "data")
+			break
+		}
+	}
+
+	// linked directories are put under the VirtualPath with their contents
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "linked"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "linked/file"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink("../linked", path.Join(dir, "a/dir")))
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.DereferenceLinks = true
+	tw.VirtualPath = "v"
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"v/", "v/a/", "v/a/b/", "v/a/b/link", "v/a/dir/", "v/a/dir/file",
+		"v/a/file", "v/linked/", "v/linked/file",
+	})
+
+	// linked directories that aren't included are counted as excluded
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "other"), 0755))
+	TestExpectSuccess(t, os.Symlink("../other", path.Join(dir, "a/other")))
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.DereferenceLinks = true
+	tw.IncludedPaths = []string{"a/file"}
+	tw.RecordExclusions = true
+	TestExpectSuccess(t, tw.Archive())
+	excluded := make(map[string]bool)
+	for _, e := range tw.Exclusions() {
+		excluded[e.Path] = true
+	}
+	TestEqual(t, excluded["a/other"], true)
+	TestEqual(t, tw.Stats().Excluded, int64(len(tw.Exclusions())))
+}
+
+func TestTarFormat(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	long := strings.Repeat("d", 90) + "/" + strings.Repeat("f", 110)
+	TestExpectSuccess(t, os.MkdirAll(path.Join(dir, path.Dir(long)), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, long), []byte("data"), 0644))
+
+	// PAX keeps the full name
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Format = tar.FormatPAX
+	TestExpectSuccess(t, tw.Archive())
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Typeflag == tar.TypeReg {
+			TestEqual(t, header.Name, long)
+			TestEqual(t, header.Format, tar.FormatPAX)
+			break
+		}
+	}
+
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), extractionPath).Extract())
+	data, err := ioutil.ReadFile(path.Join(extractionPath, long))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+
+	// USTAR can't represent it, and the error names the entry
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.Format = tar.FormatUSTAR
+	err = tw.Archive()
+	TestExpectError(t, err)
+	var ee *EntryError
+	TestEqual(t, errors.As(err, &ee), true)
+	TestEqual(t, ee.Path, long)
+
+	// which is skipped with ContinueOnError, leaving the rest
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.Format = tar.FormatUSTAR
+	tw.ContinueOnError = true
+	TestExpectError(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", path.Dir(long) + "/"})
+
+	// options needing PAX records can't be used with USTAR or GNU
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Format = tar.FormatGNU
+	tw.IncludeACLs = true
+	TestExpectError(t, tw.Archive())
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Format = tar.FormatPAX | tar.FormatGNU
+	TestExpectError(t, tw.Archive())
+
+	// but can represent short names
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Format = tar.FormatUSTAR
+	TestExpectSuccess(t, tw.Archive())
+}
+
+func TestTarGNULongNames(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	long := strings.Repeat("d", 90) + "/" + strings.Repeat("f", 90)
+	target := strings.Repeat("t", 120)
+	TestExpectSuccess(t, os.MkdirAll(path.Join(dir, path.Dir(long)), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, long), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink(target, path.Join(dir, "link")))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Format = tar.FormatGNU
+	TestExpectSuccess(t, tw.Archive())
+
+	// the long name and link target are carried by GNU 'L' and 'K' entries,
+	// which are read back transparently
+	var flags []byte
+	for off := 0; off+512 <= w.Len(); off += 512 {
+		flags = append(flags, w.Bytes()[off+156])
+	}
+	TestEqual(t, bytes.IndexByte(flags, 'L') >= 0, true)
+	TestEqual(t, bytes.IndexByte(flags, 'K') >= 0, true)
+
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), extractionPath).Extract())
+	data, err := ioutil.ReadFile(path.Join(extractionPath, long))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+	link, err := os.Readlink(path.Join(extractionPath, "link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, link, target)
+
+	// archives written by GNU tar itself extract too
+	if _, err := exec.LookPath("tar"); err != nil {
+		return
+	}
+	gnuTar := path.Join(TempDir(t), "gnu.tar")
+	cmd := exec.Command("tar", "--format=gnu", "-cf", gnuTar, "-C", dir, ".")
+	out, err := cmd.CombinedOutput()
+	TestExpectSuccess(t, err, string(out))
+	f, err := os.Open(gnuTar)
+	TestExpectSuccess(t, err)
+	defer f.Close()
+	extractionPath = TempDir(t)
+	TestExpectSuccess(t, NewUntar(f, extractionPath).Extract())
+	data, err = ioutil.ReadFile(path.Join(extractionPath, long))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+	link, err = os.Readlink(path.Join(extractionPath, "link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, link, target)
+}
+
+func TestTarSparse(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	const size = 10 << 20
+	f, err := os.Create(path.Join(dir, "sparse"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, f.Truncate(size))
+	_, err = f.WriteAt([]byte("middle"), 5<<20)
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, f.Close())
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "dense"), []byte("dense"), 0644))
+
+	f, err = os.Open(path.Join(dir, "sparse"))
+	TestExpectSuccess(t, err)
+	regions, err := findDataRegions(f, size)
+	f.Close()
+	TestExpectSuccess(t, err)
+	if len(regions) == 0 || regions[0].length == size {
+		t.Skip("holes can't be detected here")
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Sparse = true
+	TestExpectSuccess(t, tw.Archive())
+
+	// only the data is stored
+	TestEqual(t, w.Len() < 1<<20, true)
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "dense", "sparse"})
+
+	check := func(extractionPath string) {
+		data, err := ioutil.ReadFile(path.Join(extractionPath, "sparse"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, len(data), size)
+		TestEqual(t, string(data[5<<20:5<<20+6]), "middle")
+		TestEqual(t, bytes.Count(data, []byte{0}), size-6)
+		data, err = ioutil.ReadFile(path.Join(extractionPath, "dense"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, string(data), "dense")
+	}
+
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), extractionPath).Extract())
+	check(extractionPath)
+
+	// extracting with holes uses far less space than the file's size
+	extractionPath = TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+	u.Sparse = true
+	TestExpectSuccess(t, u.Extract())
+	check(extractionPath)
+	fi, err := os.Stat(path.Join(extractionPath, "sparse"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Sys().(*syscall.Stat_t).Blocks*512 < 1<<20, true)
+
+	// GNU tar understands it too
+	if _, err := exec.LookPath("tar"); err != nil {
+		return
+	}
+	extractionPath = TempDir(t)
+	cmd := exec.Command("tar", "-xf", "-", "-C", extractionPath)
+	cmd.Stdin = bytes.NewReader(w.Bytes())
+	out, err := cmd.CombinedOutput()
+	TestExpectSuccess(t, err, string(out))
+	check(extractionPath)
+}
+
+func TestTarIDMappingFunc(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// the function is used even without IncludeOwners, and sees the real ids
+	dir := makeTestDir(t)
+	fi, err := os.Lstat(path.Join(dir, "a"))
+	TestExpectSuccess(t, err)
+	calls := 0
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IDMappingFunc = func(uid, gid int) (int, int, error) {
+		calls++
+		TestEqual(t, uid, uidForFileInfo(fi))
+		TestEqual(t, gid, gidForFileInfo(fi))
+		return uid + 100000, gid + 200000, nil
+	}
+	TestExpectSuccess(t, tw.Archive())
+	TestNotEqual(t, calls, 0)
+
+	tr := tar.NewReader(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		TestEqual(t, header.Uid, uidForFileInfo(fi)+100000)
+		TestEqual(t, header.Gid, gidForFileInfo(fi)+200000)
+	}
+
+	// errors stop the archive
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.IDMappingFunc = func(uid, gid int) (int, int, error) {
+		return 0, 0, fmt.Errorf("not allowed")
+	}
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarIncludeNames(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	usr, err := user.Current()
+	TestExpectSuccess(t, err)
+	group, err := user.LookupGroupId(usr.Gid)
+	TestExpectSuccess(t, err)
+
+	for _, include := range []bool{true, false} {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, makeTestDir(t))
+		tw.IncludeOwners = true
+		tw.IncludeNames = include
+		TestExpectSuccess(t, tw.Archive())
+
+		tr := tar.NewReader(w)
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if include {
+			TestEqual(t, header.Uname, usr.Username)
+			TestEqual(t, header.Gname, group.Name)
+		} else {
+			TestEqual(t, header.Uname, "")
+			TestEqual(t, header.Gname, "")
+		}
+	}
+}
+
+func TestTarOwnershipOverride(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	owners := func(tw *Tar, w *bytes.Buffer) (uid, gid int) {
+		TestExpectSuccess(t, tw.Archive())
+		header, err := tar.NewReader(w).Next()
+		TestExpectSuccess(t, err)
+		return header.Uid, header.Gid
+	}
+
+	// the default is 500
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	uid, gid := owners(tw, w)
+	TestEqual(t, uid, 500)
+	TestEqual(t, gid, 500)
+
+	// unless overridden
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, makeTestDir(t))
+	tw.OwnershipOverride = &Ownership{Uid: 0, Gid: 65534}
+	uid, gid = owners(tw, w)
+	TestEqual(t, uid, 0)
+	TestEqual(t, gid, 65534)
+}
+
+func TestTarPreserveSetuid(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	name := path.Join(dir, "suid")
+	TestExpectSuccess(t, ioutil.WriteFile(name, []byte("data"), 0755))
+	TestExpectSuccess(t, os.Chmod(name, 0755|os.ModeSetuid|os.ModeSetgid))
+
+	archive := func(preserve bool) []byte {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.PreserveSetuid = preserve
+		TestExpectSuccess(t, tw.Archive())
+		tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+		for {
+			header, err := tr.Next()
+			TestExpectSuccess(t, err)
+			if header.Name == "suid" {
+				if preserve {
+					TestEqual(t, header.Mode, int64(06755))
+				} else {
+					TestEqual(t, header.Mode, int64(0755))
+				}
+				return w.Bytes()
+			}
+		}
+	}
+	archive(false)
+	data := archive(true)
+
+	// the bits are restored on extraction unless disabled
+	for _, preserve := range []bool{true, false} {
+		extractionPath := TempDir(t)
+		u := NewUntar(bytes.NewReader(data), extractionPath)
+		u.PreserveSetuid = preserve
+		TestExpectSuccess(t, u.Extract())
+		fi, err := os.Stat(path.Join(extractionPath, "suid"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, fi.Mode()&os.ModeSetuid != 0, preserve)
+		TestEqual(t, fi.Mode()&os.ModeSetgid != 0, preserve)
+	}
+}
+
+func TestTarTimestamps(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	atime := time.Unix(1400000000, 123456789)
+	mtime := time.Unix(1500000000, 987654321)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "d"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "d", "f"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Chtimes(path.Join(dir, "d", "f"), atime, mtime))
+	TestExpectSuccess(t, os.Chtimes(path.Join(dir, "d"), atime, mtime))
+
+	archive := func(timestamps, accessTimes bool) map[string]*tar.Header {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.IncludeTimestamps = timestamps
+		tw.IncludeAccessTimes = accessTimes
+		TestExpectSuccess(t, tw.Archive())
+		headers := make(map[string]*tar.Header)
+		tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			TestExpectSuccess(t, err)
+			headers[header.Name] = header
+		}
+		return headers
+	}
+
+	// by default the times are rounded to the second
+	headers := archive(false, false)
+	TestEqual(t, headers["d/f"].ModTime, time.Unix(1500000001, 0))
+	TestEqual(t, headers["d/f"].AccessTime.IsZero(), true)
+
+	headers = archive(true, false)
+	TestEqual(t, headers["d/f"].ModTime, mtime)
+	TestEqual(t, headers["d/"].ModTime, mtime)
+	TestEqual(t, headers["d/f"].AccessTime.IsZero(), true)
+
+	headers = archive(true, true)
+	TestEqual(t, headers["d/f"].ModTime, mtime)
+	TestEqual(t, headers["d/f"].AccessTime, atime)
+	TestEqual(t, headers["d/f"].ChangeTime.IsZero(), false)
+
+	// extraction restores them, including for the directory after its
+	// contents were written
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IncludeTimestamps = true
+	tw.IncludeAccessTimes = true
+	TestExpectSuccess(t, tw.Archive())
+	extractionPath := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+	u.PreserveTimestamps = true
+	TestExpectSuccess(t, u.Extract())
+	for _, name := range []string{"d", "d/f"} {
+		fi, err := os.Stat(path.Join(extractionPath, name))
+		TestExpectSuccess(t, err)
+		TestEqual(t, fi.ModTime().Equal(mtime), true)
+	}
+}
+
+func TestTarFifo(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, syscall.Mkfifo(path.Join(dir, "pipe"), 0600))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IncludePermissions = true
+	TestExpectSuccess(t, tw.Archive())
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Name == "pipe" {
+			TestEqual(t, header.Typeflag, byte(tar.TypeFifo))
+			TestEqual(t, header.Mode, int64(0600))
+			break
+		}
+	}
+
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), extractionPath).Extract())
+	fi, err := os.Lstat(path.Join(extractionPath, "pipe"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode()&os.ModeNamedPipe != 0, true)
+	TestEqual(t, fi.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestTarSocketPolicy(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	l, err := net.Listen("unix", path.Join(dir, "sock"))
+	TestExpectSuccess(t, err)
+	defer l.Close()
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "file"), []byte("data"), 0644))
+
+	archive := func(policy SocketPolicy) ([]byte, error) {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.SocketPolicy = policy
+		err := tw.Archive()
+		return w.Bytes(), err
+	}
+
+	// skipped by default
+	data, err := archive(SocketSkip)
+	TestExpectSuccess(t, err)
+	TestEqual(t, archiveNames(t, data), []string{"./", "file"})
+
+	_, err = archive(SocketError)
+	TestExpectError(t, err)
+
+	data, err = archive(SocketArchiveAsEmptyFile)
+	TestExpectSuccess(t, err)
+	TestEqual(t, archiveNames(t, data), []string{"./", "file", "sock"})
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(data), extractionPath).Extract())
+	fi, err := os.Lstat(path.Join(extractionPath, "sock"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode().IsRegular(), true)
+	TestEqual(t, fi.Size(), int64(0))
+}
+
+func TestTarManifest(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "file"), []byte("data"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "empty"), nil, 0644))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "file"), path.Join(dir, "link")))
+
+	// a file with holes gets the digest of all of its content
+	sparse := make([]byte, 3<<20)
+	copy(sparse[1<<20:], "data")
+	f, err := os.Create(path.Join(dir, "sparse"))
+	TestExpectSuccess(t, err)
+	_, err = f.WriteAt([]byte("data"), 1<<20)
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, f.Truncate(int64(len(sparse))))
+	TestExpectSuccess(t, f.Close())
+
+	digest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.ComputeManifest = true
+	tw.ManifestName = "SHA256SUMS"
+	tw.Sparse = true
+	TestExpectSuccess(t, tw.AddEntry(&tar.Header{Name: "added", Mode: 0644, Size: 5}, strings.NewReader("added")))
+	TestExpectSuccess(t, tw.Archive())
+
+	manifest := make(map[string]ManifestEntry)
+	for _, e := range tw.Manifest() {
+		manifest[e.Name] = e
+	}
+	TestEqual(t, len(manifest), 5)
+	TestEqual(t, manifest["file"], ManifestEntry{Name: "file", Size: 4, SHA256: digest([]byte("data"))})
+	TestEqual(t, manifest["link"].SHA256, digest([]byte("data")))
+	TestEqual(t, manifest["empty"].SHA256, digest(nil))
+	TestEqual(t, manifest["sparse"].SHA256, digest(sparse))
+	TestEqual(t, manifest["added"].SHA256, digest([]byte("added")))
+
+	// the manifest is the last entry
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	var last *tar.Header
+	var content []byte
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		last = header
+		content, err = ioutil.ReadAll(tr)
+		TestExpectSuccess(t, err)
+	}
+	TestEqual(t, last.Name, "SHA256SUMS")
+	TestEqual(t, string(content), string(formatManifest(tw.Manifest())))
+	TestEqual(t, strings.Contains(string(content), digest([]byte("data"))+"  file\n"), true)
+}
+
+func TestTarManifestContentType(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1000)...)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "image"), png, 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "page"), []byte("<html><body>hi</body></html>"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "empty"), nil, 0644))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "image"), path.Join(dir, "link")))
+
+	for _, metadataOnly := range []bool{false, true} {
+		tw := NewTar(bytes.NewBufferString(""), dir)
+		tw.ComputeManifest = true
+		tw.ManifestName = "SHA256SUMS"
+		tw.DetectContentType = true
+		tw.MetadataOnly = metadataOnly
+		TestExpectSuccess(t, tw.AddEntry(&tar.Header{Name: "added", Mode: 0644, Size: 5}, strings.NewReader("added")))
+		TestExpectSuccess(t, tw.Archive())
+
+		types := make(map[string]string)
+		for _, e := range tw.Manifest() {
+			types[e.Name] = e.ContentType
+		}
+		TestEqual(t, types, map[string]string{
+			"image": "image/png",
+			"link":  "image/png",
+			"page":  "text/html; charset=utf-8",
+			"empty": "text/plain; charset=utf-8",
+			"added": "text/plain; charset=utf-8",
+		})
+	}
+
+	// the types are only detected when asked for
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.ComputeManifest = true
+	TestExpectSuccess(t, tw.Archive())
+	for _, e := range tw.Manifest() {
+		TestEqual(t, e.ContentType, "")
+	}
+}
+
+func TestTarDigest(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Compression = GZIP
+	tw.DigestHash = crypto.SHA256
+	TestExpectSuccess(t, tw.Archive())
+	sum := sha256.Sum256(w.Bytes())
+	TestEqual(t, tw.Digest(), sum[:])
+
+	// the hash function needs to be available
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.DigestHash = crypto.MD4
+	TestExpectError(t, tw.Archive())
+	TestEqual(t, len(tw.Digest()), 0)
+}
+
+func TestTarRateLimit(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, dir).Archive())
+	TestEqual(t, w.Len(), 9216)
+
+	// a second's worth passes at once, the rest waits for the bucket
+	limited := bytes.NewBufferString("")
+	tw := NewTar(limited, dir)
+	tw.RateLimit = 6144
+	start := time.Now()
+	TestExpectSuccess(t, tw.Archive())
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		Fatalf(t, "Archive took %v, expected at least 400ms", elapsed)
+	}
+	TestEqual(t, limited.Bytes(), w.Bytes())
+
+	// waiting stops when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.RateLimit = 1024
+	TestExpectError(t, tw.ArchiveContext(ctx))
+}
+
+func TestTarEstimate(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/d/e"), []byte("some data"), 0644))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "a/b/c/d/e"), path.Join(dir, "a/b/link")))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.ExcludePath("a/b/g")
+	TestExpectSuccess(t, tw.AddEntry(&tar.Header{Name: "added", Mode: 0644, Size: 5}, strings.NewReader("added")))
+	estimate, err := tw.Estimate()
+	TestExpectSuccess(t, err)
+	TestEqual(t, w.Len(), 0)
+	TestExpectSuccess(t, tw.Archive())
+
+	// the estimate matches what was archived
+	var expected Estimate
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		TestNotEqual(t, header.Name, "a/b/g")
+		expected.Entries++
+		expected.Bytes += header.Size
+	}
+	TestEqual(t, estimate, expected)
+	TestNotEqual(t, estimate.Bytes, int64(0))
+}
+
+func TestTarStats(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/d/e"), []byte("some data"), 0644))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "a/b/c/d/e"), path.Join(dir, "a/b/link")))
+	TestExpectSuccess(t, syscall.Mkfifo(path.Join(dir, "pipe"), 0644))
+
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.ExcludePath("a/b/g")
+	TestExpectSuccess(t, tw.Archive())
+	stats := tw.Stats()
+	TestEqual(t, stats.Files, int64(3))
+	TestEqual(t, stats.Dirs, int64(7))
+	TestEqual(t, stats.Symlinks, int64(5))
+	TestEqual(t, stats.HardLinks, int64(1))
+	TestEqual(t, stats.Fifos, int64(1))
+	TestEqual(t, stats.Devices, int64(0))
+	TestEqual(t, stats.Excluded, int64(1))
+	TestEqual(t, stats.BytesRead, int64(len("some data")))
+	TestNotEqual(t, stats.Duration, time.Duration(0))
+}
+
+func TestTarOnSkip(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	l, err := net.Listen("unix", path.Join(dir, "sock"))
+	TestExpectSuccess(t, err)
+	defer l.Close()
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "file"), []byte("data"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "excluded"), []byte("data"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "secret"), []byte("data"), 0644))
+
+	skipped := make(map[string]SkipReason)
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.ExcludePath("excluded")
+	tw.HeaderTransform = func(h *tar.Header) (*tar.Header, error) {
+		if h.Name == "secret" {
+			return nil, nil
+		}
+		return h, nil
+	}
+	tw.OnSkip = func(path string, reason SkipReason) {
+		skipped[path] = reason
+	}
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, skipped, map[string]SkipReason{
+		"excluded": SkipExcluded,
+		"secret":   SkipTransformed,
+		"sock":     SkipSocket,
+	})
+	TestEqual(t, SkipSocket.String(), "it is a socket")
+
+	// nothing is reported when estimating
+	skipped = make(map[string]SkipReason)
+	_, err = tw.Estimate()
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(skipped), 0)
+}
+
+func TestTarSizeAndAgeLimits(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "cache"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "core"), make([]byte, 1000), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "small"), []byte("data"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "cache/stale"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Chtimes(path.Join(dir, "cache/stale"), old, old))
+	TestExpectSuccess(t, os.Chtimes(path.Join(dir, "cache"), old, old))
+
+	skipped := make(map[string]SkipReason)
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.MaxFileSize = 100
+	tw.MinMtime = now.Add(-24 * time.Hour)
+	tw.OnSkip = func(path string, reason SkipReason) {
+		skipped[path] = reason
+	}
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "cache/", "small"})
+	TestEqual(t, skipped, map[string]SkipReason{
+		"core":        SkipTooLarge,
+		"cache/stale": SkipModTime,
+	})
+	TestEqual(t, tw.Stats().Excluded, int64(2))
+
+	// and anything newer than the MaxMtime
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.MaxMtime = now.Add(-24 * time.Hour)
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "cache/", "cache/stale"})
+}
+
+func TestTarRecordExclusions(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, ".git"), 0755))
+	for _, name := range []string{"keep", "debug.log", "important.log", "secret"} {
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), []byte("data"), 0644))
+	}
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "big"), make([]byte, 100), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, ".ignore"), []byte("*.log\n!important.log\n"), 0644))
+
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.ExcludeVCS = true
+	tw.IgnoreFile = ".ignore"
+	tw.ExcludedPaths = []*regexp.Regexp{regexp.MustCompile("^secret$")}
+	tw.MaxFileSize = 50
+	tw.RecordExclusions = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, tw.Exclusions(), []Exclusion{
+		{Path: ".git", Reason: SkipExcluded, Rule: "ExcludeVCS"},
+		{Path: "big", Reason: SkipTooLarge, Rule: "MaxFileSize"},
+		{Path: "debug.log", Reason: SkipIgnored, Rule: "*.log"},
+		{Path: "secret", Reason: SkipExcluded, Rule: "^secret$"},
+	})
+	TestEqual(t, tw.Exclusions()[2].String(), "debug.log: it matches the ignore file (*.log)")
+
+	// nothing is recorded otherwise
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.ExcludeVCS = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, len(tw.Exclusions()), 0)
+}
+
+func TestTarHeaderTransform(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "src"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "src/file"), []byte("data"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "src/secret"), []byte("secret"), 0600))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "src/file"), path.Join(dir, "src/link")))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "src/secret"), path.Join(dir, "src/secret2")))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.HeaderTransform = func(h *tar.Header) (*tar.Header, error) {
+		if path.Base(h.Name) == "secret" {
+			return nil, nil
+		}
+		renamed := *h
+		renamed.Name = strings.Replace(h.Name, "src", "dst", 1)
+		renamed.Linkname = strings.Replace(h.Linkname, "src", "dst", 1)
+		renamed.Uid, renamed.Gid = 1234, 5678
+		return &renamed, nil
+	}
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, tw.Stats().Excluded, int64(1))
+
+	entries, err := List(bytes.NewReader(w.Bytes()))
+	TestExpectSuccess(t, err)
+	types := make(map[string]byte)
+	for _, e := range entries {
+		TestEqual(t, e.Uid, 1234)
+		TestEqual(t, e.Gid, 5678)
+		types[e.Name] = e.Typeflag
+		if e.Typeflag == tar.TypeLink {
+			TestEqual(t, e.Linkname, "dst/file")
+		}
+	}
+	TestEqual(t, types, map[string]byte{
+		"./":          tar.TypeDir,
+		"dst/":        tar.TypeDir,
+		"dst/file":    tar.TypeReg,
+		"dst/link":    tar.TypeLink,
+		"dst/secret2": tar.TypeReg,
+	})
+
+	// errors stop the archive
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.HeaderTransform = func(h *tar.Header) (*tar.Header, error) {
+		return nil, fmt.Errorf("refused")
+	}
+	TestExpectError(t, tw.Archive())
+}
+
+// recordingLogger records the messages logged to it.
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.messages = append(l.messages, "debug: "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.messages = append(l.messages, "warn: "+fmt.Sprintf(format, args...))
+}
+
+func TestTarLogger(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	var _ LeveledLogger = (*logray.Logger)(nil)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/file"), []byte("data"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/tmp"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink("..", path.Join(dir, "sub/up")))
+	root, err := filepath.EvalSymlinks(dir)
+	TestExpectSuccess(t, err)
+
+	logger := &recordingLogger{}
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.Logger = logger
+	tw.DereferenceLinks = true
+	tw.ExcludePath("tmp")
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, logger.messages, []string{
+		`debug: tarhelper: excluding "sub/tmp", it matches the excluded paths`,
+		`warn: tarhelper: skipping "sub/up", a link back to "` + root + `"`,
+	})
+
+	// nothing is logged by default
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.ExcludePath("tmp")
+	TestExpectSuccess(t, tw.Archive())
+}
+
+func TestTarSignature(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	TestExpectSuccess(t, err)
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Compression = GZIP
+	tw.SigningKey = priv
+	TestExpectSuccess(t, tw.Archive())
+	sig := tw.Signature()
+	TestEqual(t, len(sig), ed25519.SignatureSize)
+	TestExpectSuccess(t, VerifySignature(bytes.NewReader(w.Bytes()), sig, pub))
+
+	// any change to the archive is caught, as is the wrong key
+	data := append([]byte(nil), w.Bytes()...)
+	data[len(data)/2] ^= 1
+	TestExpectError(t, VerifySignature(bytes.NewReader(data), sig, pub))
+	other, _, err := ed25519.GenerateKey(nil)
+	TestExpectSuccess(t, err)
+	TestExpectError(t, VerifySignature(bytes.NewReader(w.Bytes()), sig, other))
+
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.SigningKey = priv[:10]
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarEncryption(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "large"), large, 0644))
+	key := bytes.Repeat([]byte{7}, 32)
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.EncryptionKey = key
+	TestExpectSuccess(t, tw.Archive())
+	encrypted := w.Bytes()
+	TestEqual(t, bytes.Contains(encrypted, large[:1000]), false)
+
+	out := TempDir(t)
+	u := NewUntar(bytes.NewReader(encrypted), out)
+	u.DecryptionKey = key
+	TestExpectSuccess(t, u.Extract())
+	data, err := ioutil.ReadFile(path.Join(out, "large"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, bytes.Equal(data, large), true)
+
+	// compressed archives are encrypted after compression
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.Compression = GZIP
+	tw.EncryptionKey = key
+	TestExpectSuccess(t, tw.Archive())
+	r, err := NewDecryptReader(bytes.NewReader(w.Bytes()), key)
+	TestExpectSuccess(t, err)
+	_, err = DetectArchiveCompression(r)
+	TestExpectSuccess(t, err)
+
+	// the wrong key, changes and truncation are all caught
+	decrypt := func(data, key []byte) error {
+		r, err := NewDecryptReader(bytes.NewReader(data), key)
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+	TestExpectSuccess(t, decrypt(encrypted, key))
+	TestExpectError(t, decrypt(encrypted, bytes.Repeat([]byte{8}, 32)))
+	tampered := append([]byte(nil), encrypted...)
+	tampered[100] ^= 1
+	TestExpectError(t, decrypt(tampered, key))
+	TestExpectError(t, decrypt(encrypted[:len(encrypted)-1], key))
+	TestExpectError(t, decrypt(encrypted[:encryptChunkSize+100], key))
+	TestExpectError(t, decrypt(encrypted, key[:16]))
+}
+
+func TestTarEncryptionRecipients(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// the keys wrapping the content key are derived as in the first test
+	// case of RFC 5869
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	TestEqual(t, hex.EncodeToString(hkdfSHA256(bytes.Repeat([]byte{0x0b}, 22), salt, string(info))),
+		"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf")
+
+	dir := makeTestDir(t)
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "large"), large, 0644))
+	newIdentity := func() *ecdh.PrivateKey {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		TestExpectSuccess(t, err)
+		return key
+	}
+	ops, backup, other := newIdentity(), newIdentity(), newIdentity()
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Recipients = []*ecdh.PublicKey{ops.PublicKey(), backup.PublicKey()}
+	TestExpectSuccess(t, tw.Archive())
+	encrypted := w.Bytes()
+	TestEqual(t, bytes.Contains(encrypted, large[:1000]), false)
+
+	// each recipient can extract it
+	for _, identity := range []*ecdh.PrivateKey{ops, backup} {
+		out := TempDir(t)
+		u := NewUntar(bytes.NewReader(encrypted), out)
+		u.DecryptionIdentity = identity
+		TestExpectSuccess(t, u.Extract())
+		data, err := ioutil.ReadFile(path.Join(out, "large"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, bytes.Equal(data, large), true)
+	}
+
+	decrypt := func(data []byte, identity *ecdh.PrivateKey) error {
+		r, err := NewIdentityDecryptReader(bytes.NewReader(data), identity)
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+
+	// but nobody else can, and changes are caught
+	TestExpectError(t, decrypt(encrypted, other))
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-100] ^= 1
+	TestExpectError(t, decrypt(tampered, ops))
+	_, err := NewDecryptReader(bytes.NewReader(encrypted), bytes.Repeat([]byte{7}, 32))
+	TestExpectError(t, err)
+
+	// rewrapping replaces the recipients without changing the content
+	w = bytes.NewBufferString("")
+	TestExpectSuccess(t, Rewrap(w, bytes.NewReader(encrypted), ops, []*ecdh.PublicKey{ops.PublicKey(), other.PublicKey()}))
+	rewrapped := w.Bytes()
+	TestExpectSuccess(t, decrypt(rewrapped, other))
+	TestExpectSuccess(t, decrypt(rewrapped, ops))
+	TestExpectError(t, decrypt(rewrapped, backup))
+	TestEqual(t, bytes.Equal(rewrapped[len(rewrapped)-1000:], encrypted[len(encrypted)-1000:]), true)
+
+	// and a key and recipients can't both be used
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.EncryptionKey = bytes.Repeat([]byte{7}, 32)
+	tw.Recipients = []*ecdh.PublicKey{ops.PublicKey()}
+	TestExpectError(t, tw.Archive())
+}
+
+// failingWriter accepts up to n bytes and then fails.
+type failingWriter struct {
+	n int
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > f.n {
+		return 0, fmt.Errorf("destination full")
+	}
+	f.n -= len(b)
+	return len(b), nil
+}
+
+func TestTarTee(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	a, b := bytes.NewBufferString(""), bytes.NewBufferString("")
+	tee := NewTeeWriter(a, &failingWriter{n: 1024}, b)
+	TestExpectSuccess(t, NewTar(tee, dir).Archive())
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(a.Bytes()), TempDir(t)).Extract())
+	TestEqual(t, bytes.Equal(a.Bytes(), b.Bytes()), true)
+
+	// only the failing destination has an error
+	errs := tee.Errors()
+	TestEqual(t, len(errs), 3)
+	TestEqual(t, errs[0] == nil, true)
+	TestExpectError(t, errs[1])
+	TestEqual(t, errs[2] == nil, true)
+	err := tee.Close()
+	merr, ok := err.(*multierror.Error)
+	TestEqual(t, ok, true)
+	TestEqual(t, merr.Len(), 1)
+	TestEqual(t, merr.Errors[0].(*DestinationError).Index, 1)
+
+	// the archive fails once every destination has
+	tee = NewTeeWriter(&failingWriter{n: 512}, &failingWriter{n: 2048})
+	TestExpectError(t, NewTar(tee, dir).Archive())
+	TestEqual(t, tee.Err().(*multierror.Error).Len(), 2)
+}
+
+func TestTarVolumes(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Compression = GZIP
+	TestExpectSuccess(t, tw.Archive())
+
+	var volumes []*bytes.Buffer
+	vw := NewVolumeWriter(300, func(n int) (io.Writer, error) {
+		TestEqual(t, n, len(volumes)+1)
+		volumes = append(volumes, bytes.NewBufferString(""))
+		return volumes[n-1], nil
+	})
+	tw = NewTar(vw, dir)
+	tw.Compression = GZIP
+	TestExpectSuccess(t, tw.Archive())
+	TestExpectSuccess(t, vw.Close())
+	TestEqual(t, vw.Volumes(), len(volumes))
+	TestEqual(t, len(volumes) > 1, true)
+	for _, v := range volumes[:len(volumes)-1] {
+		TestEqual(t, v.Len(), 300)
+	}
+
+	// the volumes are read back as the whole archive
+	vr := NewVolumeReader(func(n int) (io.Reader, error) {
+		if n > len(volumes) {
+			return nil, io.EOF
+		}
+		return volumes[n-1], nil
+	})
+	data, err := ioutil.ReadAll(vr)
+	TestExpectSuccess(t, err)
+	TestEqual(t, bytes.Equal(data, w.Bytes()), true)
+	TestExpectSuccess(t, vr.Close())
+
+	vw = NewVolumeWriter(100, func(n int) (io.Writer, error) {
+		return nil, fmt.Errorf("no more media")
+	})
+	TestExpectError(t, NewTar(vw, dir).Archive())
+}
+
+func TestTarCheckpoints(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	var checkpoints []Checkpoint
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.CheckpointFunc = func(c Checkpoint) {
+		checkpoints = append(checkpoints, c)
+	}
+	TestExpectSuccess(t, tw.Archive())
+	full := w.Bytes()
+	names := archiveNames(t, full)
+	TestEqual(t, len(checkpoints), len(names))
+	TestEqual(t, checkpoints[len(checkpoints)-1].Entry, names[len(names)-1])
+
+	// resuming from any of the checkpoints completes the same archive
+	for _, c := range checkpoints {
+		c := c
+		w := bytes.NewBuffer(append([]byte(nil), full[:c.Offset]...))
+		tw := NewTar(w, dir)
+		tw.ResumeFrom = &c
+		TestExpectSuccess(t, tw.Archive())
+		TestEqual(t, bytes.Equal(w.Bytes(), full), true, c.Entry)
+	}
+
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.ResumeFrom = &Checkpoint{Entry: "missing", Offset: 512}
+	TestExpectError(t, tw.Archive())
+
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.Compression = GZIP
+	tw.CheckpointFunc = func(Checkpoint) {}
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarIncremental(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub2"), 0755))
+	for _, name := range []string{"a", "b", "sub/c", "sub2/d"} {
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644))
+	}
+
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.RecordSnapshot = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, len(tw.Snapshot().Entries), 7)
+
+	// the snapshot is saved and read back between runs
+	var saved bytes.Buffer
+	_, err := tw.Snapshot().WriteTo(&saved)
+	TestExpectSuccess(t, err)
+	snapshot, err := ReadSnapshot(&saved)
+	TestExpectSuccess(t, err)
+	TestEqual(t, snapshot.Entries, tw.Snapshot().Entries)
+
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a"), []byte("changed"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "e"), []byte("e"), 0644))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "b")))
+	TestExpectSuccess(t, os.RemoveAll(path.Join(dir, "sub2")))
+
+	w := bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.IncrementalFrom = snapshot
+	tw.RecordSnapshot = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"./", "a", "e", "sub/", ".wh.b", ".wh.sub2",
+	})
+	TestEqual(t, tw.Stats().Unchanged, int64(1))
+	TestEqual(t, len(tw.Snapshot().Entries), 5)
+
+	_, err = ReadSnapshot(strings.NewReader(`{"version": 2}`))
+	TestExpectError(t, err)
+}
+
+func TestTarLayer(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// the base and target start out the same
+	base, dir := TempDir(t), TempDir(t)
+	mtime := time.Unix(1400000000, 0)
+	for _, root := range []string{base, dir} {
+		for _, name := range []string{"sub", "gone", "keep"} {
+			TestExpectSuccess(t, os.Mkdir(path.Join(root, name), 0755))
+		}
+		for _, name := range []string{"a", "b", "sub/c", "sub/d", "gone/e", "keep/f"} {
+			TestExpectSuccess(t, ioutil.WriteFile(path.Join(root, name), []byte(name), 0644))
+			TestExpectSuccess(t, os.Chtimes(path.Join(root, name), mtime, mtime))
+		}
+		TestExpectSuccess(t, os.Symlink("a", path.Join(root, "link")))
+	}
+
+	// and then the target is changed
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a"), []byte("changed"), 0644))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "new"), []byte("new"), 0644))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "b")))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "sub/c")))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "sub/d")))
+	TestExpectSuccess(t, os.RemoveAll(path.Join(dir, "gone")))
+	TestExpectSuccess(t, os.Chmod(path.Join(dir, "keep/f"), 0600))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.LayerBase = base
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"./", "a", "keep/", "keep/f", "new", ".wh.b", ".wh.gone", "sub/.wh..wh..opq",
+	})
+	TestEqual(t, tw.Stats().Unchanged, int64(1))
+
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.LayerBase = base
+	tw.IncrementalFrom = &Snapshot{}
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarDeduplicateContent(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	files := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{"a", "same", 0644},
+		{"b", "diff", 0644},
+		{"c", "same", 0600},
+		{"sub/d", "same", 0644},
+	}
+	for _, f := range files {
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, f.name), []byte(f.content), f.mode))
+		TestExpectSuccess(t, os.Chmod(path.Join(dir, f.name), f.mode))
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.DeduplicateContent = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, tw.Stats().Files, int64(3))
+	TestEqual(t, tw.Stats().HardLinks, int64(1))
+
+	links := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		if header.Typeflag == tar.TypeLink {
+			links[header.Name] = header.Linkname
+		}
+	}
+	TestEqual(t, links, map[string]string{"sub/d": "a"})
+
+	// the link is extracted with the content of the file
+	out := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), out).Extract())
+	data, err := ioutil.ReadFile(path.Join(out, "sub/d"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "same")
+}
+
+func TestTarMetadataOnly(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	content := []byte("some data that is left out")
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/file"), content, 0600))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	TestExpectSuccess(t, tw.Archive())
+	want := archiveNames(t, w.Bytes())
+
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.MetadataOnly = true
+	tw.ComputeManifest = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), want)
+
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		TestEqual(t, header.Size, int64(0), header.Name)
+		if header.Name == "a/b/file" {
+			TestEqual(t, header.Mode, int64(0600))
+		}
+	}
+
+	// the manifest still has the files' sizes and digests
+	sum := sha256.Sum256(content)
+	var found bool
+	for _, e := range tw.Manifest() {
+		if e.Name == "a/b/file" {
+			found = true
+			TestEqual(t, e.Size, int64(len(content)))
+			TestEqual(t, e.SHA256, hex.EncodeToString(sum[:]))
+		}
+	}
+	TestEqual(t, found, true)
+}
+
+func TestTarExcludeVCS(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	for _, name := range []string{".git/objects", "sub/.svn", "sub/CVS", "sub/src"} {
+		TestExpectSuccess(t, os.MkdirAll(path.Join(dir, name), 0755))
+	}
+	for _, name := range []string{".git/HEAD", ".gitignore", "sub/.hgtags", "sub/src/main.go", "sub/.github"} {
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), []byte("data"), 0644))
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.ExcludeVCS = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"./", "sub/", "sub/.github", "sub/src/", "sub/src/main.go",
+	})
+	TestEqual(t, tw.Stats().Excluded, int64(5))
+}
+
+func TestTarMaxDepth(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.MaxDepth = 2
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "a/", "a/b/"})
+
+	// linked directories count towards the depth as well
+	TestExpectSuccess(t, os.Symlink("a/b", path.Join(dir, "link")))
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.MaxDepth = 1
+	tw.DereferenceLinks = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "a/", "link/"})
+}
+
+func TestTarOneFileSystem(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "file"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink("/proc", path.Join(dir, "proc")))
+	root, err := os.Stat(dir)
+	TestExpectSuccess(t, err)
+	proc, err := os.Stat("/proc")
+	if err != nil || root.Sys().(*syscall.Stat_t).Dev == proc.Sys().(*syscall.Stat_t).Dev {
+		t.Skip("/proc is not a separate filesystem")
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.DereferenceLinks = true
+	tw.OneFileSystem = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "file"})
+	TestEqual(t, tw.Stats().Excluded, int64(1))
+
+	// the link itself is on the same filesystem
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.OneFileSystem = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "file", "proc"})
+}
+
+func TestTarFailOnLoops(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.MkdirAll(path.Join(dir, "a/b"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/file"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink("../..", path.Join(dir, "a/b/up")))
+
+	// loops are skipped by default
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.DereferenceLinks = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "a/", "a/b/", "a/b/file"})
+
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.DereferenceLinks = true
+	tw.FailOnLoops = true
+	err := tw.Archive()
+	TestExpectError(t, err)
+	ee, ok := err.(*EntryError)
+	TestEqual(t, ok, true)
+	TestEqual(t, ee.Path, "a/b/up")
+	TestEqual(t, ee.Error(), `a/b/up: loops back to ".", which contains it`)
+
+	// directories are the same by device and inode, whatever their paths,
+	// so that bind mounts are caught as well
+	fi, err := os.Stat(path.Join(dir, "a"))
+	TestExpectSuccess(t, err)
+	stack := []visitedDir{newVisitedDir("a", "/one", fi)}
+	elem, ok := findLoop(stack, newVisitedDir("a/b/c", "/two", fi))
+	TestEqual(t, ok, true)
+	TestEqual(t, elem.name, "a")
+	other, err := os.Stat(path.Join(dir, "a/b"))
+	TestExpectSuccess(t, err)
+	_, ok = findLoop(stack, newVisitedDir("a/b", "/one", other))
+	TestEqual(t, ok, false)
+}
+
+func TestTarContinueOnError(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/a"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink("missing", path.Join(dir, "sub/b")))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/c"), []byte("data"), 0644))
+	wantNames := []string{"./", "sub/", "sub/a", "sub/c"}
+	wantPaths := []string{"sub/b"}
+	if os.Getuid() != 0 {
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/d"), []byte("data"), 0))
+		wantPaths = append(wantPaths, "sub/d")
+	}
+
+	// the broken link stops the archive by default
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	tw.DereferenceLinks = true
+	TestExpectError(t, tw.Archive())
+
+	w := bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.DereferenceLinks = true
+	tw.ContinueOnError = true
+	err := tw.Archive()
+	TestExpectError(t, err)
+	TestEqual(t, archiveNames(t, w.Bytes()), wantNames)
+	TestEqual(t, tw.Stats().Failed, int64(len(wantPaths)))
+
+	merr, ok := err.(*multierror.Error)
+	TestEqual(t, ok, true)
+	var paths []string
+	for _, e := range merr.Errors {
+		ee, ok := e.(*EntryError)
+		TestEqual(t, ok, true)
+		paths = append(paths, ee.Path)
+	}
+	TestEqual(t, paths, wantPaths)
+
+	// nothing is returned when everything could be read
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "sub/b")))
+	TestExpectSuccess(t, os.RemoveAll(path.Join(dir, "sub/d")))
+	tw = NewTar(bytes.NewBufferString(""), dir)
+	tw.ContinueOnError = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, tw.Stats().Failed, int64(0))
+}
+
+func TestList(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	for _, compression := range []Compression{NONE, GZIP, BZIP2, XZ, ZSTD} {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, makeTestDir(t))
+		tw.Compression = compression
+		TestExpectSuccess(t, tw.Archive())
+
+		entries, err := List(bytes.NewReader(w.Bytes()))
+		TestExpectSuccess(t, err)
+		entry := make(map[string]EntryInfo)
+		for _, e := range entries {
+			entry[e.Name] = e
+		}
+		TestEqual(t, len(entries), 16)
+		TestEqual(t, entry["a/b/c/d/e"].Typeflag, byte(tar.TypeReg))
+		TestEqual(t, entry["a/b/c/d/e"].Mode, os.FileMode(0755))
+		TestEqual(t, entry["a/b/c/d/e"].Uid, 500)
+		TestEqual(t, entry["a/b/c/"].Mode.IsDir(), true)
+		TestEqual(t, entry["a/b/h"].Typeflag, byte(tar.TypeSymlink))
+		TestEqual(t, entry["a/b/h"].Linkname, "g")
+	}
+
+	_, err := List(strings.NewReader("not an archive at all, just some text"))
+	TestExpectError(t, err)
+}
+
+func TestIndex(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	contents := map[string]string{
+		"a":     strings.Repeat("a", 1000),
+		"b/c":   strings.Repeat("c", 20000),
+		"b/d/e": "e",
+	}
+	for name, data := range contents {
+		TestExpectSuccess(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644))
+	}
+	TestExpectSuccess(t, os.Link(path.Join(dir, "b/c"), path.Join(dir, "link")))
+
+	archive := func(compression Compression) []byte {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.Compression = compression
+		TestExpectSuccess(t, tw.Archive())
+		return w.Bytes()
+	}
+
+	// a gzip stream with two members, split part way through the archive
+	data := archive(NONE)
+	var multi bytes.Buffer
+	for _, part := range [][]byte{data[:len(data)/2], data[len(data)/2:]} {
+		zw := gzip.NewWriter(&multi)
+		_, err := zw.Write(part)
+		TestExpectSuccess(t, err)
+		TestExpectSuccess(t, zw.Close())
+	}
+
+	for _, data := range [][]byte{data, archive(GZIP), archive(XZ), multi.Bytes()} {
+		index, err := BuildIndex(bytes.NewReader(data))
+		TestExpectSuccess(t, err)
+		for name, expected := range contents {
+			r, err := index.Open(bytes.NewReader(data), name)
+			TestExpectSuccess(t, err)
+			content, err := ioutil.ReadAll(r)
+			TestExpectSuccess(t, err)
+			TestEqual(t, string(content), expected)
+		}
+		r, err := index.Open(bytes.NewReader(data), "./link")
+		TestExpectSuccess(t, err)
+		content, err := ioutil.ReadAll(r)
+		TestExpectSuccess(t, err)
+		TestEqual(t, string(content), contents["b/c"])
+
+		_, err = index.Open(bytes.NewReader(data), "b/d")
+		TestExpectError(t, err)
+		_, err = index.Open(bytes.NewReader(data), "missing")
+		TestExpectError(t, err)
+	}
+
+	index, err := BuildIndex(bytes.NewReader(multi.Bytes()))
+	TestExpectSuccess(t, err)
+	TestEqual(t, index.Compression, GZIP)
+	TestEqual(t, len(index.Restarts), 2)
+	TestEqual(t, index.Restarts[1].Offset, int64(len(data)/2))
+}
+
+func TestDiff(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	archive := func() []byte {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.IncludeOwners = true
+		tw.Compression = GZIP
+		TestExpectSuccess(t, tw.Archive())
+		return w.Bytes()
+	}
+	before := archive()
+
+	// nothing has changed yet
+	changes, err := DiffDir(bytes.NewReader(before), dir)
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(changes), 0)
+
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/f"), []byte("changed"), 0755))
+	TestExpectSuccess(t, os.Chmod(path.Join(dir, "a/b/g"), 0600))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "a/b/i/j/k")))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "new"), nil, 0644))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "a/b/h")))
+	TestExpectSuccess(t, os.Symlink("c", path.Join(dir, "a/b/h")))
+
+	expected := []Change{
+		{Name: "a/b/c/f", Kind: EntryModified, Differences: []string{"size", "content"}},
+		{Name: "a/b/g", Kind: EntryModified, Differences: []string{"mode"}},
+		{Name: "a/b/h", Kind: EntryModified, Differences: []string{"link target"}},
+		{Name: "a/b/i/j/k", Kind: EntryRemoved},
+		{Name: "new", Kind: EntryAdded},
+	}
+	changes, err = DiffDir(bytes.NewReader(before), dir)
+	TestExpectSuccess(t, err)
+	TestEqual(t, changes, expected)
+
+	changes, err = Diff(bytes.NewReader(before), bytes.NewReader(archive()))
+	TestExpectSuccess(t, err)
+	TestEqual(t, changes, expected)
+	TestEqual(t, changes[3].Kind.String(), "removed")
+}
+
+func TestVerify(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/f"), []byte("data"), 0755))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "a/b/c/f"), path.Join(dir, "a/b/link")))
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.IncludeOwners = true
+	TestExpectSuccess(t, tw.Archive())
+	data := w.Bytes()
+
+	report, err := Verify(bytes.NewReader(data), dir)
+	TestExpectSuccess(t, err)
+	TestEqual(t, report.OK(), true)
+	TestEqual(t, report.Checked, 17)
+
+	// the owners weren't recorded by default
+	w = bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, dir).Archive())
+	report, err = Verify(bytes.NewReader(w.Bytes()), dir)
+	TestExpectSuccess(t, err)
+	if os.Getuid() != 500 {
+		TestEqual(t, report.OK(), false)
+	}
+	report, err = VerifyWithOptions(bytes.NewReader(w.Bytes()), dir, VerifyOptions{SkipOwners: true})
+	TestExpectSuccess(t, err)
+	TestEqual(t, report.OK(), true)
+
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/f"), []byte("DATA"), 0755))
+	TestExpectSuccess(t, os.Chmod(path.Join(dir, "a/b/g"), 0600))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "a/b/i/j/k")))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "a/b/h")))
+	TestExpectSuccess(t, os.Symlink("c", path.Join(dir, "a/b/h")))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "a/b/c/d/e")))
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "a/b/c/d/e"), 0755))
+
+	report, err = Verify(bytes.NewReader(data), dir)
+	TestExpectSuccess(t, err)
+	TestEqual(t, report.Mismatches, []Mismatch{
+		{Name: "a/b/c/d/e", Differences: []string{"type"}},
+		{Name: "a/b/c/f", Differences: []string{"content"}},
+		{Name: "a/b/g", Differences: []string{"mode"}},
+		{Name: "a/b/h", Differences: []string{"link target"}},
+		{Name: "a/b/i/j/k", Differences: []string{"missing"}},
+	})
+
+	// without comparing content only the metadata differs
+	report, err = VerifyWithOptions(bytes.NewReader(data), dir, VerifyOptions{SkipContent: true})
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(report.Mismatches), 4)
+}
+
+func TestTarFS(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// an os.DirFS archives the same as the directory
+	dir := makeTestDir(t)
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, dir).Archive())
+	expected := archiveNames(t, w.Bytes())
+	w = bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTarFS(w, os.DirFS(dir)).Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), expected)
+
+	// as does a tree in memory
+	fsys := fstest.MapFS{
+		"etc/config":   {Data: []byte("data"), Mode: 0600, ModTime: time.Unix(1500000000, 0)},
+		"etc/link":     {Data: []byte("config"), Mode: os.ModeSymlink | 0777},
+		"etc/skip.tmp": {Data: []byte("skipped")},
+		"var":          {Mode: os.ModeDir | 0755},
+	}
+	w = bytes.NewBufferString("")
+	tw := NewTarFS(w, fsys)
+	tw.ExcludePath(".*\\.tmp")
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"./", "etc/", "etc/config", "etc/link", "var/",
+	})
+
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), extractionPath).Extract())
+	data, err := ioutil.ReadFile(path.Join(extractionPath, "etc/link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+	fi, err := os.Stat(path.Join(extractionPath, "etc/config"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestTarBufferSize(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/f"), data, 0644))
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, dir).Archive())
+
+	for _, size := range []int{1, 4096, 1 << 20} {
+		sized := bytes.NewBufferString("")
+		tw := NewTar(sized, dir)
+		tw.BufferSize = size
+		TestExpectSuccess(t, tw.Archive())
+		TestEqual(t, sized.Bytes(), w.Bytes())
+
+		target := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), target)
+		u.BufferSize = size
+		TestExpectSuccess(t, u.Extract())
+		extracted, err := ioutil.ReadFile(path.Join(target, "a/b/c/f"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, extracted, data)
+	}
+}
+
+// Archives a directory of many small files, as in a node_modules tree, with
+// the options set by fn.
+func benchmarkTarSmallFiles(b *testing.B, fn func(*Tar)) {
+	StartTest(b)
+	defer FinishTest(b)
+
+	dir := TempDir(b)
+	content := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 10; i++ {
+		sub := path.Join(dir, fmt.Sprintf("dir%d", i))
+		TestExpectSuccess(b, os.Mkdir(sub, 0755))
+		for j := 0; j < 100; j++ {
+			TestExpectSuccess(b, ioutil.WriteFile(path.Join(sub, fmt.Sprintf("file%d", j)), content, 0644))
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tw := NewTar(ioutil.Discard, dir)
+		fn(tw)
+		if err := tw.Archive(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTarSmallFiles(b *testing.B) {
+	benchmarkTarSmallFiles(b, func(tw *Tar) {})
+}
+
+func BenchmarkTarSmallFiles4K(b *testing.B) {
+	benchmarkTarSmallFiles(b, func(tw *Tar) { tw.BufferSize = 4096 })
+}
+
+func BenchmarkTarSmallFiles1M(b *testing.B) {
+	benchmarkTarSmallFiles(b, func(tw *Tar) { tw.BufferSize = 1 << 20 })
+}
+
+func BenchmarkTarSmallFilesReadAhead(b *testing.B) {
+	benchmarkTarSmallFiles(b, func(tw *Tar) { tw.ReadAhead = 16 })
+}
+
+func TestTarReadAhead(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	for i := 0; i < 50; i++ {
+		name := path.Join(dir, fmt.Sprintf("a/b/file%d", i))
+		TestExpectSuccess(t, ioutil.WriteFile(name, []byte(name), 0644))
+	}
+	large := bytes.Repeat([]byte("x"), maxReadAheadSize+1)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/large"), large, 0644))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "a/b/file1"), path.Join(dir, "a/b/link")))
+
+	archive := func(readAhead int) []byte {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.ReadAhead = readAhead
+		tw.ExcludePath("a/b/file1.*")
+		TestExpectSuccess(t, tw.Archive())
+		TestEqual(t, len(tw.prefetched), 0)
+		return w.Bytes()
+	}
+	want := archive(0)
+	for _, n := range []int{1, 4, 100} {
+		TestEqual(t, bytes.Equal(archive(n), want), true)
+	}
+
+	// files that can't be read are still an error
+	TestExpectSuccess(t, os.Chmod(path.Join(dir, "a/b/file3"), 0))
+	if os.Getuid() != 0 {
+		tw := NewTar(bytes.NewBufferString(""), dir)
+		tw.ReadAhead = 4
+		TestExpectError(t, tw.Archive())
+	}
+}
+
+func TestZipConversion(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	mtime := time.Unix(1400000000, 0)
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub"), 0750))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/file"), []byte("content"), 0600))
+	TestExpectSuccess(t, os.Chmod(path.Join(dir, "sub/file"), 0600))
+	TestExpectSuccess(t, os.Symlink("sub/file", path.Join(dir, "link")))
+	for _, name := range []string{"sub/file", "sub"} {
+		TestExpectSuccess(t, os.Chtimes(path.Join(dir, name), mtime, mtime))
+	}
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Compression = GZIP
+	TestExpectSuccess(t, tw.Archive())
+
+	zw := bytes.NewBufferString("")
+	TestExpectSuccess(t, TarToZip(zw, bytes.NewReader(w.Bytes())))
+	zr, err := zip.NewReader(bytes.NewReader(zw.Bytes()), int64(zw.Len()))
+	TestExpectSuccess(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	TestEqual(t, names, []string{"link", "sub/", "sub/file"})
+	TestEqual(t, zr.File[0].Mode()&os.ModeSymlink != 0, true)
+	TestEqual(t, zr.File[1].Mode(), os.ModeDir|0750)
+	TestEqual(t, zr.File[2].Mode(), os.FileMode(0600))
+	TestEqual(t, zr.File[2].Modified.Equal(mtime), true)
+
+	// and back again
+	tw2 := bytes.NewBufferString("")
+	TestExpectSuccess(t, ZipToTar(tw2, bytes.NewReader(zw.Bytes()), int64(zw.Len())))
+	entries, err := List(bytes.NewReader(tw2.Bytes()))
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(entries), 3)
+	TestEqual(t, entries[0].Typeflag, byte(tar.TypeSymlink))
+	TestEqual(t, entries[0].Linkname, "sub/file")
+	TestEqual(t, entries[1].Name, "sub/")
+	TestEqual(t, entries[1].Mode, os.ModeDir|0750)
+	TestEqual(t, entries[2].Name, "sub/file")
+	TestEqual(t, entries[2].Mode, os.FileMode(0600))
+	TestEqual(t, entries[2].Size, int64(7))
+	TestEqual(t, entries[2].ModTime.Equal(mtime), true)
+
+	// hard links have no place in a zip archive
+	w = bytes.NewBufferString("")
+	htw := tar.NewWriter(w)
+	TestExpectSuccess(t, htw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644}))
+	TestExpectSuccess(t, htw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}))
+	TestExpectSuccess(t, htw.Close())
+	TestExpectError(t, TarToZip(ioutil.Discard, bytes.NewReader(w.Bytes())))
+}
+
+func TestTarCpio(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/g"), []byte("content"), 0644))
+	TestExpectSuccess(t, os.Link(path.Join(dir, "a/b/g"), path.Join(dir, "a/hard")))
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.Cpio = true
+	tw.IncludeOwners = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, string(w.Bytes()[:6]), "070701")
+	TestEqual(t, bytes.Contains(w.Bytes(), []byte("TRAILER!!!")), true)
+
+	// the hard link is written as a copy
+	cr := NewCpioReader(bytes.NewReader(w.Bytes()))
+	entries := make(map[string]*tar.Header)
+	for {
+		header, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		entries[header.Name] = header
+		if header.Name == "a/hard" {
+			data, err := ioutil.ReadAll(cr)
+			TestExpectSuccess(t, err)
+			TestEqual(t, string(data), "content")
+		}
+	}
+	TestEqual(t, len(entries), 17)
+	TestEqual(t, entries["./"].Typeflag, byte(tar.TypeDir))
+	TestEqual(t, entries["a/b/c/"].Typeflag, byte(tar.TypeDir))
+	TestEqual(t, entries["a/hard"].Typeflag, byte(tar.TypeReg))
+	TestEqual(t, entries["a/b/h"].Linkname, "g")
+	TestEqual(t, entries["a/b/g"].Uid, os.Getuid())
+
+	// and it is extracted like a tar archive, compressed or not
+	for _, compression := range []Compression{NONE, GZIP} {
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.Cpio = true
+		tw.Compression = compression
+		TestExpectSuccess(t, tw.Archive())
+
+		out := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), out)
+		u.Compression = DETECT
+		TestExpectSuccess(t, u.Extract())
+		data, err := ioutil.ReadFile(path.Join(out, "a/hard"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, string(data), "content")
+		link, err := os.Readlink(path.Join(out, "a/b/c/l"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, link, "../i")
+		fi, err := os.Stat(path.Join(out, "a/b/i/j"))
+		TestExpectSuccess(t, err)
+		TestEqual(t, fi.IsDir(), true)
+	}
+
+	// hard links can't be added directly
+	cw := NewCpioWriter(ioutil.Discard)
+	TestExpectError(t, cw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}))
+}
+
+func TestTarSingleFile(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	name := path.Join(dir, "file.txt")
+	TestExpectSuccess(t, ioutil.WriteFile(name, []byte("content"), 0644))
+	TestExpectSuccess(t, os.Symlink("file.txt", path.Join(dir, "link")))
+
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, name).Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"file.txt"})
+
+	out := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), out).Extract())
+	data, err := ioutil.ReadFile(path.Join(out, "file.txt"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "content")
+
+	// still within the VirtualPath
+	w = bytes.NewBufferString("")
+	tw := NewTar(w, name)
+	tw.VirtualPath = "opt/app"
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"opt/app/file.txt"})
+
+	// a symlink is archived as a symlink
+	w = bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, path.Join(dir, "link")).Archive())
+	entries, err := List(bytes.NewReader(w.Bytes()))
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(entries), 1)
+	TestEqual(t, entries[0].Name, "link")
+	TestEqual(t, entries[0].Typeflag, byte(tar.TypeSymlink))
+	TestEqual(t, entries[0].Linkname, "file.txt")
+
+	// and symlinks to directories are still walked
+	TestExpectSuccess(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/a"), []byte("a"), 0644))
+	TestExpectSuccess(t, os.Symlink("sub", path.Join(dir, "dirlink")))
+	w = bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, path.Join(dir, "dirlink")).Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "a"})
+}
+
+func TestTarThroughputFunc(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "a/b/c/d/e"), make([]byte, 100000), 0644))
+
+	tw := NewTar(bytes.NewBufferString(""), dir)
+	estimate, err := tw.Estimate()
+	TestExpectSuccess(t, err)
+
+	var reports []Throughput
+	tw.Expected = &estimate
+	tw.ProgressInterval = time.Nanosecond
+	tw.ThroughputFunc = func(p Throughput) {
+		reports = append(reports, p)
+	}
+	TestExpectSuccess(t, tw.Archive())
+
+	// reports are made as the archive is written, ending with the finished
+	// archive
+	TestEqual(t, len(reports) > 2, true)
+	last := reports[len(reports)-1]
+	TestEqual(t, last.Finished, true)
+	TestEqual(t, last.Entries, estimate.Entries)
+	TestEqual(t, last.Bytes, int64(100000))
+	TestEqual(t, last.Done, float64(1))
+	TestEqual(t, last.ETA, time.Duration(0))
+	TestNotEqual(t, last.Elapsed, time.Duration(0))
+	TestEqual(t, last.AverageBytesPerSecond > 0, true)
+	TestEqual(t, last.EntriesPerSecond > 0, true)
+
+	// and the fraction done only goes up
+	for i := 1; i < len(reports); i++ {
+		TestEqual(t, reports[i].Done >= reports[i-1].Done, true)
+		TestEqual(t, reports[i].Finished, i == len(reports)-1)
+	}
+}
+
+func TestTarLargeFiles(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// files are made to look large, as writing 8GiB isn't practical
+	large := func(size int64) func(h *tar.Header) (*tar.Header, error) {
+		return func(h *tar.Header) (*tar.Header, error) {
+			if h.Name == "a/b/g" {
+				h.Size = size
+			}
+			return h, nil
+		}
+	}
+
+	// USTAR fails before reading the file, naming it
+	tw := NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Format = tar.FormatUSTAR
+	tw.HeaderTransform = large(maxUstarSize + 1)
+	err := tw.Archive()
+	TestExpectError(t, err)
+	var ee *EntryError
+	TestEqual(t, errors.As(err, &ee), true)
+	TestEqual(t, ee.Path, "a/b/g")
+	TestEqual(t, strings.Contains(err.Error(), "file too large for the USTAR format"), true)
+
+	// and the file is skipped with ContinueOnError
+	w := bytes.NewBufferString("")
+	tw = NewTar(w, makeTestDir(t))
+	tw.Format = tar.FormatUSTAR
+	tw.HeaderTransform = large(maxUstarSize + 1)
+	tw.ContinueOnError = true
+	TestExpectError(t, tw.Archive())
+	for _, name := range archiveNames(t, w.Bytes()) {
+		TestNotEqual(t, name, "a/b/g")
+	}
+
+	// as are files too large for cpio archives
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Cpio = true
+	tw.HeaderTransform = large(maxCpioSize + 1)
+	err = tw.Archive()
+	TestEqual(t, errors.As(err, &ee), true)
+	TestEqual(t, ee.Path, "a/b/g")
+
+	// files up to the limit are written
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Format = tar.FormatUSTAR
+	tw.HeaderTransform = large(0)
+	TestExpectSuccess(t, tw.Archive())
+}
+
+func TestTarPAXRecords(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.PAXRecords = map[string]string{"comment": "nightly", "APCERA.build": "42"}
+	tw.HeaderTransform = func(h *tar.Header) (*tar.Header, error) {
+		if h.Name == "a/b/g" {
+			h.PAXRecords = map[string]string{"comment": "special"}
+		}
+		return h, nil
+	}
+	TestExpectSuccess(t, tw.Archive())
+
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		TestExpectSuccess(t, err)
+		TestEqual(t, header.PAXRecords["APCERA.build"], "42")
+		if header.Name == "a/b/g" {
+			TestEqual(t, header.PAXRecords["comment"], "special")
+		} else {
+			TestEqual(t, header.PAXRecords["comment"], "nightly")
+		}
+	}
+
+	// records written from the header can't be given
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.PAXRecords = map[string]string{"path": "elsewhere"}
+	TestExpectError(t, tw.Archive())
+
+	// and the records need PAX
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Format = tar.FormatUSTAR
+	tw.PAXRecords = map[string]string{"comment": "nightly"}
+	TestExpectError(t, tw.Archive())
+}
+
+func TestTarResolveTarget(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir, err := filepath.EvalSymlinks(TempDir(t))
+	TestExpectSuccess(t, err)
+	real := filepath.Join(dir, "real")
+	TestExpectSuccess(t, os.MkdirAll(filepath.Join(real, "sub"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(filepath.Join(real, "sub", "f"), []byte("data"), 0644))
+	TestExpectSuccess(t, os.Symlink(filepath.Join(real, "sub", "f"), filepath.Join(real, "abs")))
+	link := filepath.Join(dir, "link")
+	TestExpectSuccess(t, os.Symlink(real, link))
+
+	linkname := func(data []byte, name string) string {
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := tr.Next()
+			TestExpectSuccess(t, err)
+			if header.Name == name {
+				return header.Linkname
+			}
+		}
+	}
+
+	// the absolute link isn't seen as within the target through the link
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, link).Archive())
+	TestEqual(t, linkname(w.Bytes(), "abs"), filepath.Join(real, "sub", "f"))
+
+	// unless the target is resolved
+	w = bytes.NewBufferString("")
+	tw := NewTar(w, link)
+	tw.ResolveTarget = true
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "abs", "sub/", "sub/f"})
+	TestEqual(t, linkname(w.Bytes(), "abs"), "sub/f")
+
+	// a link to a single file is archived as the file
+	fileLink := filepath.Join(dir, "file-link")
+	TestExpectSuccess(t, os.Symlink(filepath.Join(real, "sub", "f"), fileLink))
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, fileLink)
+	tw.ResolveTarget = true
+	TestExpectSuccess(t, tw.Archive())
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	header, err := tr.Next()
+	TestExpectSuccess(t, err)
+	TestEqual(t, header.Name, "f")
+	TestEqual(t, header.Typeflag, byte(tar.TypeReg))
+
+	// and a target that can't be resolved is an error
+	tw = NewTar(bytes.NewBufferString(""), filepath.Join(dir, "missing"))
+	tw.ResolveTarget = true
+	TestExpectError(t, tw.Archive())
+}
+
+func TestServeTar(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := dir
+		if r.URL.Path == "/missing" {
+			target = filepath.Join(dir, "missing")
+		}
+		ServeTar(w, r, target, func(t *Tar) {
+			t.Compression = GZIP
+		})
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	TestExpectSuccess(t, err)
+	defer resp.Body.Close()
+	TestEqual(t, resp.StatusCode, http.StatusOK)
+	TestEqual(t, resp.Header.Get("Content-Type"), "application/gzip")
+	TestEqual(t, resp.Header.Get("Content-Disposition"), fmt.Sprintf("attachment; filename=%s.tar.gz", filepath.Base(dir)))
+	TestEqual(t, resp.ContentLength, int64(-1))
+	TestEqual(t, resp.TransferEncoding, []string{"chunked"})
+
+	extractionPath := TempDir(t)
+	u := NewUntar(resp.Body, extractionPath)
+	u.Compression = DETECT
+	TestExpectSuccess(t, u.Extract())
+	_, err = os.Stat(filepath.Join(extractionPath, "a/b/c/d/e"))
+	TestExpectSuccess(t, err)
+
+	// HEAD requests only get the headers
+	resp, err = http.Head(server.URL)
+	TestExpectSuccess(t, err)
+	resp.Body.Close()
+	TestEqual(t, resp.StatusCode, http.StatusOK)
+	TestEqual(t, resp.Header.Get("Content-Type"), "application/gzip")
+
+	// and errors before the archive starts are a 500
+	resp, err = http.Get(server.URL + "/missing")
+	TestExpectSuccess(t, err)
+	resp.Body.Close()
+	TestEqual(t, resp.StatusCode, http.StatusInternalServerError)
+	TestEqual(t, resp.Header.Get("Content-Disposition"), "")
+}
+
+func TestManifestChanges(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := TempDir(t)
+	TestExpectSuccess(t, os.MkdirAll(path.Join(dir, "sub"), 0755))
+	for _, name := range []string{"keep", "change", "sub/gone"} {
+		TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644))
+	}
+
+	// the manifest is read back from the first archive
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.ComputeManifest = true
+	tw.ManifestName = "MANIFEST"
+	TestExpectSuccess(t, tw.Archive())
+	first := w.Bytes()
+	var manifest []ManifestEntry
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		header, err := tr.Next()
+		TestExpectSuccess(t, err)
+		if header.Name == "MANIFEST" {
+			manifest, err = ReadManifest(tr)
+			TestExpectSuccess(t, err)
+			break
+		}
+	}
+	TestEqual(t, len(manifest), 3)
+
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "change"), []byte("changed"), 0644))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "sub/gone")))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/new"), []byte("new"), 0644))
+
+	changes, err := ManifestChanges(manifest, dir)
+	TestExpectSuccess(t, err)
+	TestEqual(t, changes, &Changeset{
+		Added:    []string{"sub/new"},
+		Modified: []string{"change"},
+		Deleted:  []string{"sub/gone"},
+	})
+
+	// the delta holds just the changes, and a whiteout for the deleted file
+	w = bytes.NewBufferString("")
+	tw = NewTar(w, dir)
+	tw.ManifestBase = manifest
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{"./", "change", "sub/", "sub/new", "sub/.wh.gone"})
+
+	// which applies on top of the first archive
+	extractionPath := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(first), extractionPath).Extract())
+	u := NewUntar(bytes.NewReader(w.Bytes()), extractionPath)
+	u.ApplyWhiteouts = true
+	TestExpectSuccess(t, u.Extract())
+	_, err = os.Stat(path.Join(extractionPath, "sub/gone"))
+	TestEqual(t, os.IsNotExist(err), true)
+	data, err := ioutil.ReadFile(path.Join(extractionPath, "change"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "changed")
+
+	// and manifests that aren't in the sha256sum format are refused
+	_, err = ReadManifest(strings.NewReader("not a manifest\n"))
+	TestExpectError(t, err)
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// TargetFS is a filesystem that archives can be extracted into in place of
+// the OS, as given to NewUntarFS. Names are slash separated paths rooted at
+// "/", and the methods behave like the os functions of the same names.
+type TargetFS interface {
+	Lstat(name string) (os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	OpenFile(name string, flag int, perm os.FileMode) (TargetFile, error)
+	MkdirAll(name string, perm os.FileMode) error
+	RemoveAll(name string) error
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Lchown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+
+	// Mknod creates a device or named pipe, with mode holding the file type
+	// bits from the syscall package along with the permissions. Filesystems
+	// that can't create them return an error wrapping ErrMknodUnsupported,
+	// and the entry is skipped with a warning.
+	Mknod(name string, mode uint32, dev int) error
+}
+
+// ErrMknodUnsupported is the error from creating a device or named pipe on a
+// platform or TargetFS that doesn't support them.
+var ErrMknodUnsupported = errors.New("creating devices and named pipes is not supported")
+
+// TargetFile is a file opened for writing within a TargetFS.
+type TargetFile interface {
+	io.Writer
+	io.Seeker
+	io.Closer
+	Truncate(size int64) error
+}
+
+// NewUntarFS returns an Untar to use to extract the contents of r into the
+// filesystem fsys, rather than a directory on disk, with the root of the
+// archive at "/" within fsys. PreserveACLs needs a directory on disk and is
+// ignored. Hardened still checks the targets of links, while the location of
+// entries is kept within fsys by following symlinks relative to
+// AbsoluteRoot.
+func NewUntarFS(r io.Reader, fsys TargetFS) *Untar {
+	u := NewUntar(r, "/")
+	u.targetFS = fsys
+	return u
+}
+
+// Returns the filesystem being extracted into, which is the OS unless set by
+// NewUntarFS.
+func (u *Untar) filesystem() TargetFS {
+	if u.targetFS == nil {
+		return osFS{}
+	}
+	return u.targetFS
+}
+
+// Reports whether extraction is to a directory on disk.
+func (u *Untar) onDisk() bool {
+	_, ok := u.filesystem().(osFS)
+	return ok
+}
+
+// osFS is the TargetFS of the OS, used by NewUntar.
+type osFS struct{}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return osLink(oldname, newname)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (osFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (TargetFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoid returning a nil *os.File in a non-nil interface
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Mknod(name string, mode uint32, dev int) error {
+	osUmask(0000)
+	return osMknod(name, mode, dev)
+}
+
+// Creates hard links, replaced when testing link failures.
+var osLink = os.Link
@@ -0,0 +1,108 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/apcera/util/multierror"
+)
+
+// TeeWriter writes an archive to several destinations at once, such as a
+// local file, an upload and a hash. A destination that fails is left out of
+// any further writes while the others carry on, and its error is kept to be
+// reported by Errors and Err, so that one failing destination doesn't fail
+// the whole archive. Writes only fail once every destination has failed.
+type TeeWriter struct {
+	dests []io.Writer
+	errs  []error
+}
+
+// DestinationError is the error of one of the destinations of a TeeWriter.
+type DestinationError struct {
+	// The position of the destination in those given to NewTeeWriter.
+	Index int
+
+	// The error writing to or closing the destination.
+	Err error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("destination %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error of the destination.
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// NewTeeWriter returns a TeeWriter writing to each of dests.
+func NewTeeWriter(dests ...io.Writer) *TeeWriter {
+	return &TeeWriter{dests: dests, errs: make([]error, len(dests))}
+}
+
+// Write writes b to each of the destinations that hasn't failed. It only
+// returns an error if every destination has failed.
+func (t *TeeWriter) Write(b []byte) (int, error) {
+	for i, w := range t.dests {
+		if t.errs[i] != nil {
+			continue
+		}
+		n, err := w.Write(b)
+		if err == nil && n != len(b) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			t.errs[i] = err
+		}
+	}
+	if len(t.dests) > 0 && t.failed() == len(t.dests) {
+		return 0, fmt.Errorf("every destination failed: %v", t.Err())
+	}
+	return len(b), nil
+}
+
+// Close closes each of the destinations that is an io.Closer, including
+// those that failed, recording any error in closing one that hadn't.
+func (t *TeeWriter) Close() error {
+	for i, w := range t.dests {
+		c, ok := w.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil && t.errs[i] == nil {
+			t.errs[i] = err
+		}
+	}
+	return t.Err()
+}
+
+// Errors returns the error of each destination, in the order they were
+// given, which is nil for those that haven't failed.
+func (t *TeeWriter) Errors() []error {
+	return t.errs
+}
+
+// Err returns nil if none of the destinations have failed, otherwise a
+// *multierror.Error holding a *DestinationError for each that has.
+func (t *TeeWriter) Err() error {
+	var errs *multierror.Error
+	for i, err := range t.errs {
+		if err != nil {
+			errs = multierror.Append(errs, &DestinationError{Index: i, Err: err})
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// Returns the number of destinations that have failed.
+func (t *TeeWriter) failed() int {
+	var n int
+	for _, err := range t.errs {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"io"
+	"time"
+)
+
+// Throughput is the progress of an archive being written, as reported to
+// Tar.ThroughputFunc.
+type Throughput struct {
+	// The number of entries written and bytes of content read so far.
+	Entries int64
+	Bytes   int64
+
+	// How long the archive has taken so far.
+	Elapsed time.Duration
+
+	// The rate content has been read at since the last report, and on
+	// average since the archive was started, in bytes a second.
+	BytesPerSecond        float64
+	AverageBytesPerSecond float64
+
+	// The average number of entries written a second.
+	EntriesPerSecond float64
+
+	// With an Expected estimate, the fraction of the archive written so far,
+	// from 0 to 1, and the time left to write the rest at the average rate,
+	// which is zero until there is a rate to go by.
+	Done float64
+	ETA  time.Duration
+
+	// Set for the last report, once the archive is complete.
+	Finished bool
+}
+
+// throughputMeter tracks the progress of the archive being written, for
+// ThroughputFunc.
+type throughputMeter struct {
+	start     time.Time
+	last      time.Time
+	lastBytes int64
+	bytes     int64
+	interval  time.Duration
+}
+
+// Starts tracking the throughput of the archive about to be written, if
+// there is a ThroughputFunc.
+func (t *Tar) startThroughput() {
+	t.meter = nil
+	if t.ThroughputFunc == nil || t.estimate != nil {
+		return
+	}
+	interval := t.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	now := time.Now()
+	t.meter = &throughputMeter{start: now, last: now, interval: interval}
+}
+
+// Reports the throughput to the ThroughputFunc once the ProgressInterval has
+// passed since the last report, or when the archive is finished.
+func (t *Tar) reportThroughput(finished bool) {
+	m := t.meter
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	since := now.Sub(m.last)
+	if !finished && since < m.interval {
+		return
+	}
+
+	s := t.stats
+	p := Throughput{
+		Entries:  s.Files + s.Dirs + s.Symlinks + s.HardLinks + s.Devices + s.Fifos,
+		Bytes:    m.bytes,
+		Elapsed:  now.Sub(m.start),
+		Finished: finished,
+	}
+	if since > 0 {
+		p.BytesPerSecond = float64(m.bytes-m.lastBytes) / since.Seconds()
+	}
+	if p.Elapsed > 0 {
+		p.AverageBytesPerSecond = float64(p.Bytes) / p.Elapsed.Seconds()
+		p.EntriesPerSecond = float64(p.Entries) / p.Elapsed.Seconds()
+	}
+	if e := t.Expected; e != nil {
+		// go by the content, or by the entries when there is none
+		switch {
+		case finished:
+			p.Done = 1
+		case e.Bytes > 0:
+			p.Done = float64(p.Bytes) / float64(e.Bytes)
+			if p.AverageBytesPerSecond > 0 && p.Bytes < e.Bytes {
+				p.ETA = time.Duration(float64(e.Bytes-p.Bytes) / p.AverageBytesPerSecond * float64(time.Second))
+			}
+		case e.Entries > 0:
+			p.Done = float64(p.Entries) / float64(e.Entries)
+			if p.EntriesPerSecond > 0 && p.Entries < e.Entries {
+				p.ETA = time.Duration(float64(e.Entries-p.Entries) / p.EntriesPerSecond * float64(time.Second))
+			}
+		}
+		if p.Done > 1 {
+			p.Done = 1
+		}
+	}
+
+	m.last, m.lastBytes = now, m.bytes
+	t.ThroughputFunc(p)
+}
+
+// throughputReader counts the content read through it for the
+// ThroughputFunc.
+type throughputReader struct {
+	r io.Reader
+	t *Tar
+}
+
+func (r *throughputReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.t.meter.bytes += int64(n)
+		r.t.reportThroughput(false)
+	}
+	return n, err
+}
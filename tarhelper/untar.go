@@ -4,17 +4,27 @@ package tarhelper
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/ecdh"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/apcera/util/pathmatch"
 )
 
-// The type of compression that this archive will be us
+// The type of compression that this archive will be us. Other types can be
+// used by registering them with AddCompressor and AddDecompressor, under the
+// name used for the Compression.
 type Compression string
 
 const (
@@ -22,6 +32,27 @@ const (
 	BZIP2  = Compression("bzip2")
 	GZIP   = Compression("gzip")
 	DETECT = Compression("detect")
+	XZ     = Compression("xz")
+	ZSTD   = Compression("zstd")
+)
+
+// OverwritePolicy decides what happens when an entry being extracted
+// already exists.
+type OverwritePolicy int
+
+const (
+	// Overwrite replaces the existing file with the entry.
+	Overwrite OverwritePolicy = iota
+
+	// OverwriteError stops extraction with an error.
+	OverwriteError
+
+	// OverwriteSkip keeps the existing file and skips the entry.
+	OverwriteSkip
+
+	// OverwriteIfNewer replaces the existing file only if the entry's
+	// modification time is later than the file's, and otherwise skips it.
+	OverwriteIfNewer
 )
 
 type resolvedLink struct {
@@ -29,6 +60,29 @@ type resolvedLink struct {
 	dst string
 }
 
+// dirMetadata holds the permissions and times to give an extracted
+// directory once everything within it has been extracted.
+type dirMetadata struct {
+	name string
+
+	// The permissions to give the directory, if chmod is set.
+	mode  os.FileMode
+	chmod bool
+
+	// The times to give the directory, if chtimes is set.
+	atime   time.Time
+	mtime   time.Time
+	chtimes bool
+}
+
+// entryFlags holds the file flags to give an extracted entry, along with
+// the entry's name in the archive.
+type entryFlags struct {
+	name  string
+	entry string
+	flags uint32
+}
+
 // Untar manages state of a TAR archive to be extracted.
 type Untar struct {
 
@@ -39,6 +93,9 @@ type Untar struct {
 	// The source reader.
 	source io.Reader
 
+	// The filesystem the files are extracted into, or nil for the OS.
+	targetFS TargetFS
+
 	// A list of currently resolved links. This is used to ensure when creating
 	// a file that follows through a symlink, we create the file relative to the
 	// location of the AbsoluteRoot.
@@ -53,27 +110,213 @@ type Untar struct {
 	// The Compression being used in this tar.
 	Compression Compression
 
+	// DecryptionKey, if set, is the 32 byte key that the archive was
+	// encrypted with by Tar.EncryptionKey, which it is decrypted with before
+	// being decompressed.
+	DecryptionKey []byte
+
+	// DecryptionIdentity, if set, is the X25519 private key of one of the
+	// Tar.Recipients that the archive was encrypted to, which it is
+	// decrypted with before being decompressed.
+	DecryptionIdentity *ecdh.PrivateKey
+
 	// The archive/tar reader that we will use to extract each
-	// element from the tar file. This will be set when Extract()
-	// is called.
-	archive *tar.Reader
+	// element from the tar file, or a CpioReader for cpio archives. This
+	// will be set when Extract() is called.
+	archive archiveReader
+
+	// The context for the extraction in progress, checked between entries.
+	ctx context.Context
+
+	// Cached user and group lookups, for ResolveNames.
+	names *nameCache
+
+	// The compiled IncludedPaths.
+	includes []*pathmatch.Glob
+
+	// The pool writing files for Parallelism, while extracting.
+	pool *extractPool
+
+	// Guards the state used by the pool while finishing files.
+	mu sync.Mutex
+
+	// Directories extracted so far along with the permissions and times to
+	// give them once everything within them has been extracted, for
+	// PreservePermissions and PreserveTimestamps.
+	dirs []dirMetadata
+
+	// Entries extracted so far along with the file flags to give them once
+	// everything has been extracted, for PreserveFileFlags.
+	fileFlags []entryFlags
+
+	// Entries extracted so far to give security contexts once everything
+	// has been extracted, for SELinux.
+	selinuxLabels []selinuxLabel
+
+	// The macOS metadata to give files once everything has been extracted,
+	// for AppleDoubleRestore.
+	macMetadata []pendingMetadata
+
+	// The names of the entries extracted so far, and their parents, which
+	// opaque whiteouts leave in place, for ApplyWhiteouts.
+	extracted map[string]bool
 
 	// Set to true if extraction should attempt to preserve
 	// permissions as recorded in the tar file. If this is false then
 	// files will be created with a default of 755 for directories and 644
-	// for files.
+	// for files. Directories that their owner can't write to are created
+	// writable and given their permissions once extraction is complete, so
+	// that their contents can be extracted.
 	PreservePermissions bool
 
+	// PreserveSetuid restores the setuid and setgid bits recorded for files.
+	// When false they are dropped. NewUntar sets this to true.
+	PreserveSetuid bool
+
+	// PreserveTimestamps can be set to restore the modification and access
+	// times recorded in the archive, with as much precision as was recorded.
+	// Entries without an access time get their modification time for both.
+	// The times of directories are applied once extraction is complete, so
+	// that extracting their contents doesn't change them. Symlinks keep the
+	// time they were created.
+	PreserveTimestamps bool
+
 	// Set to true if extraction should attempt to restore owners of files
 	// and directories from the archive.  Any Uid/Gid over 500 will be set
 	// to the MappedUserID/MappedGroupID setting.  If this is set to false
 	// it will default to all files going to the MappedUserID/MappedGroupID.
 	PreserveOwners bool
 
+	// PreserveACLs can be set to reapply POSIX ACLs recorded in the archive
+	// to the files and directories they were recorded for.
+	PreserveACLs bool
+
+	// SELinux decides what security contexts extracted entries are given,
+	// whether those recorded in the archive or those the loaded policy gives
+	// their paths. They are given once everything has been extracted, and
+	// are best effort as setting them needs privileges and SELinux to be
+	// enabled. Failures are reported to the WarningFunc. The default is to
+	// leave entries with the contexts they are given where they are
+	// extracted.
+	SELinux SELinuxPolicy
+
+	// PreserveFileFlags can be set to reapply the immutable, append only and
+	// no dump flags recorded in the archive, on Linux and macOS, along with
+	// the Finder's hidden flag on macOS. They are applied once
+	// everything else has been extracted, since they would otherwise get in
+	// the way of it, and are best effort as setting the immutable and append
+	// only flags needs privileges. Failures are reported to the WarningFunc.
+	PreserveFileFlags bool
+
+	// AppleDouble decides what is done with the AppleDouble entries holding
+	// macOS metadata, as written by bsdtar and Tar.IncludeAppleDouble. The
+	// default is to extract them as files.
+	AppleDouble AppleDoublePolicy
+
+	// Sparse can be set to leave holes in extracted files in place of runs of
+	// zeros, such as the holes recorded for sparse entries, so that disk
+	// images don't use more space than they need.
+	Sparse bool
+
+	// BufferSize is the size of the buffers used to copy the content of
+	// files out of the archive, which are pooled and reused. The default is
+	// 32KB.
+	BufferSize int
+
+	// Parallelism, if over one, is the number of goroutines writing the
+	// regular files of up to 1MB being extracted, so that extracting many
+	// small files isn't held up by the latency of creating each one. The
+	// archive is still read in order, and directories, links and anything
+	// else are created in order by the goroutine reading it, once any files
+	// they might depend on have been written. Any TargetFS has to be safe
+	// for concurrent use.
+	Parallelism int
+
+	// IncludedPaths can be set to only extract the entries matching one of
+	// these shell style globs, along with everything within matching
+	// directories. Patterns are relative to the root of the archive and "**"
+	// matches any number of directories. Parent directories of the included
+	// entries are created as needed. The contents of other entries are
+	// skipped over, which avoids reading them when the source is an
+	// uncompressed io.ReadSeeker.
+	IncludedPaths []string
+
+	// EntryFilter, if set, is called with the header of each entry as it is
+	// read, after the IncludedPaths, and reports whether to extract it. The
+	// header may be changed in place to rename the entry or change its mode,
+	// owner or times, and an error stops the extraction, so entries such as
+	// setuid binaries can be skipped, rewritten or rejected. Renamed entries
+	// are checked like any other, and hard links to them have to be renamed
+	// to match.
+	EntryFilter func(header *tar.Header) (extract bool, err error)
+
+	// MaxEntries, MaxFileSize and MaxTotalSize limit the number of entries
+	// extracted, the size of any one file and the combined size of all of
+	// the files, to protect against archives made to exhaust disk space or
+	// inodes. Extraction stops with an error as soon as an entry would exceed
+	// a limit. Zero means no limit.
+	MaxEntries   int64
+	MaxFileSize  int64
+	MaxTotalSize int64
+
+	// OverwritePolicy decides what is done with entries that already exist
+	// in the target directory. Directories that already exist are always
+	// merged with rather than replaced. The default is to overwrite.
+	OverwritePolicy OverwritePolicy
+
+	// ConflictFunc, if set, is called for each entry that already exists with
+	// the entry's header and the existing file, and returns the policy to
+	// apply to it in place of the OverwritePolicy, or an error to stop
+	// extraction.
+	ConflictFunc func(header *tar.Header, existing os.FileInfo) (OverwritePolicy, error)
+
+	// Hardened enables extra checks that keep extraction within the target
+	// directory. Symlinks with absolute targets or with relative targets that
+	// lead outside of the archive are refused, as are entries whose location
+	// resolves outside of the target after following any symlinks already on
+	// disk, so a link can't be used to write elsewhere. On Linux, extracting
+	// into a RootFS also closes the races with links being changed on disk
+	// while extracting.
+	Hardened bool
+
+	// Atomic can be set to extract into a new directory beside the target,
+	// which then takes the place of the target once everything has been
+	// extracted, so that a failed extraction leaves the target as it was and
+	// the new directory is removed. The target is replaced as a whole rather
+	// than merged with. An existing target is moved aside and the new
+	// directory renamed into its place, leaving a moment in which neither is
+	// there, and the old one is then removed. It can't be used with a
+	// TargetFS.
+	Atomic bool
+
+	// CopyFailedLinks can be set to copy the file a hard link refers to in
+	// place of the link when the link can't be created, such as when the link
+	// would cross filesystems. The copy is given the link's owner.
+	CopyFailedLinks bool
+
 	// SkipSpecialDevices can be used to skip extracting special devices defiend
 	// within the tarball. This includes things like character or block devices.
 	SkipSpecialDevices bool
 
+	// AllowDevices must be set for character and block devices in the archive
+	// to be created, which is only possible when running as root. Devices
+	// are otherwise skipped, as are devices that can't be created for lack of
+	// privileges, and reported to the WarningFunc.
+	AllowDevices bool
+
+	// ApplyWhiteouts can be set to extract an archive as a layer, such as
+	// one written with Tar.LayerBase or an OCI image layer, over what is
+	// already in the target. Whiteout entries, with names starting with
+	// WhiteoutPrefix, delete the file or directory they name rather than
+	// being extracted, and an OpaqueWhiteout deletes everything that was
+	// already in its directory other than what the archive extracts into it.
+	// Stacked layers can then be flattened by extracting each in turn.
+	ApplyWhiteouts bool
+
+	// WarningFunc, if set, is called with the name of each entry that is
+	// skipped rather than extracted, along with the reason why.
+	WarningFunc func(name string, err error)
+
 	// The default UID to set files with an owner over 500 to. If PreserveOwners
 	// is false, this will be the UID assigned for all files in the archive.
 	// This defaults to the UID of the current running user.
@@ -84,6 +327,18 @@ type Untar struct {
 	// This defaults to the GID of the current running user.
 	MappedGroupID int
 
+	// ForceOwner can be set to give every extracted entry the MappedUserID
+	// and MappedGroupID, whatever owner is recorded in the archive, taking
+	// precedence over PreserveOwners and the mapping functions.
+	ForceOwner bool
+
+	// StrictOwners can be set to stop extraction with an error when the owner
+	// of an entry can't be set. Otherwise these failures are ignored. Either
+	// way, when extracting to disk without running as root, owners other
+	// than the current user aren't set at all, since only root can give
+	// files away, so the same settings work with and without privileges.
+	StrictOwners bool
+
 	// IncludedPermissionMask is combined with the uploaded file mask as a way to
 	// ensure a base level of permissions for all objects.
 	IncludedPermissionMask os.FileMode
@@ -103,6 +358,19 @@ type Untar struct {
 	// file. It can also return an error if it is unable to choose a GID or the
 	// GID is not allowed.
 	GroupMappingFunc func(int) (int, error)
+
+	// ResolveNames can be set to look up owners by the user and group names
+	// recorded in the archive when the recorded UID or GID doesn't exist on
+	// this host. The resolved ids are then used in place of the recorded ones
+	// when owners are preserved or mapped.
+	ResolveNames bool
+
+	// IDMappingFunc, if set, is called for every entry with the UID and GID
+	// recorded in the archive and returns the UID and GID to give the
+	// extracted file, or an error if the entry can't be mapped. It is used
+	// regardless of PreserveOwners, replacing the OwnerMappingFunc and
+	// GroupMappingFunc and the MappedUserID and MappedGroupID defaults.
+	IDMappingFunc func(uid, gid int) (int, int, error)
 }
 
 // NewUntar returns an Untar to use to extract the contents of r into targetDir.
@@ -112,6 +380,7 @@ func NewUntar(r io.Reader, targetDir string) *Untar {
 		source:              r,
 		target:              targetDir,
 		PreservePermissions: true,
+		PreserveSetuid:      true,
 		PreserveOwners:      false,
 		AbsoluteRoot:        "/",
 		resolvedLinks:       make([]resolvedLink, 0),
@@ -143,30 +412,79 @@ func NewUntar(r io.Reader, targetDir string) *Untar {
 
 // Extract unpacks the tar reader that was passed into New(). This is
 // broken out from new to give the caller time to set various
-// settings in the Untar object.
+// settings in the Untar object. Archives in the newc cpio format, such as
+// those written with Tar.Cpio, are detected and extracted too.
 func (u *Untar) Extract() error {
+	return u.ExtractContext(context.Background())
+}
+
+// ExtractContext is like Extract, but stops with the context's error if it is
+// cancelled before extraction is complete. Entries extracted up to that point
+// are left in place, unless extracting Atomic.
+func (u *Untar) ExtractContext(ctx context.Context) error {
+	if u.Atomic {
+		return u.extractAtomic(ctx)
+	}
+	return u.extract(ctx)
+}
+
+// Extracts the archive into the target directory.
+func (u *Untar) extract(ctx context.Context) error {
+	u.ctx = ctx
+	defer func() {
+		u.ctx = nil
+		u.includes = nil
+		u.dirs = nil
+		u.fileFlags = nil
+		u.selinuxLabels = nil
+		u.macMetadata = nil
+		u.extracted = nil
+		if u.pool != nil {
+			u.pool.close()
+			u.pool = nil
+		}
+	}()
+
+	var err error
+	if u.includes, err = compileIncludes(u.IncludedPaths); err != nil {
+		return err
+	}
+
 	// check for detect mode before the main setup, we'll change compression
-	// to the intended type and setup a new reader to re-read the header
-	switch u.Compression {
-	case NONE:
-		u.archive = tar.NewReader(u.source)
+	// to the intended type and use the buffered reader that re-reads the
+	// peeked header
+	compression, source := u.Compression, u.source
+	if u.DecryptionKey != nil && u.DecryptionIdentity != nil {
+		return fmt.Errorf("an archive can't be decrypted with both a key and an identity")
+	}
+	if u.DecryptionKey != nil {
+		if source, err = NewDecryptReader(source, u.DecryptionKey); err != nil {
+			return err
+		}
+	} else if u.DecryptionIdentity != nil {
+		if source, err = NewIdentityDecryptReader(source, u.DecryptionIdentity); err != nil {
+			return err
+		}
+	}
+	if compression == DETECT {
+		compression, source = DetectCompression(source)
+	}
 
-	case DETECT:
-		arch, err := DetectArchiveCompression(u.source)
-		if err != nil {
+	switch compression {
+	case NONE:
+		if u.archive, err = newArchiveReader(source); err != nil {
 			return err
 		}
-		u.archive = arch
 
 	default:
 		// Look up the compression handler
-		comp, exists := decompressorTypes[string(u.Compression)]
+		comp, exists := lookupDecompressor(compression)
 		if !exists {
-			return fmt.Errorf("unrecognized decompression type %q", u.Compression)
+			return fmt.Errorf("unrecognized decompression type %q", compression)
 		}
 
 		// Create the reader
-		arch, err := comp.NewReader(u.source)
+		arch, err := comp.NewReader(source)
 		if err != nil {
 			return err
 		}
@@ -175,10 +493,21 @@ func (u *Untar) Extract() error {
 				cl.Close()
 			}
 		}()
-		u.archive = tar.NewReader(arch)
+		if u.archive, err = newArchiveReader(arch); err != nil {
+			return err
+		}
+	}
+
+	if u.Parallelism > 1 {
+		u.pool = newExtractPool(u.Parallelism)
 	}
 
+	var entries, totalSize int64
 	for {
+		if err := contextErr(u.ctx); err != nil {
+			return err
+		}
+
 		header, err := u.archive.Next()
 		if err == io.EOF {
 			// EOF, ok, break to return
@@ -189,11 +518,85 @@ func (u *Untar) Extract() error {
 			return err
 		}
 
+		// skip anything that isn't included, leaving its content unread
+		if !matchIncludes(u.includes, header.Name) {
+			continue
+		}
+		if u.EntryFilter != nil {
+			name := header.Name
+			extract, err := u.EntryFilter(header)
+			if err != nil {
+				return fmt.Errorf("entry filter failed for %q: %v", name, err)
+			}
+			if !extract {
+				continue
+			}
+		}
+
+		// enforce the limits before extracting anything more
+		entries++
+		totalSize += header.Size
+		switch {
+		case u.MaxEntries > 0 && entries > u.MaxEntries:
+			return fmt.Errorf("archive has more than the limit of %d entries", u.MaxEntries)
+		case u.MaxFileSize > 0 && header.Size > u.MaxFileSize:
+			return fmt.Errorf("%s is %d bytes, over the limit of %d bytes per file",
+				header.Name, header.Size, u.MaxFileSize)
+		case u.MaxTotalSize > 0 && totalSize > u.MaxTotalSize:
+			return fmt.Errorf("archive contents exceed the limit of %d bytes at %s",
+				u.MaxTotalSize, header.Name)
+		}
+
 		err = u.processEntry(header)
 		if err != nil {
 			// See note on logging above.
 			return err
 		}
+		if u.pool != nil {
+			if err := u.pool.failed(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// wait for the files still being written
+	if u.pool != nil {
+		if err := u.pool.close(); err != nil {
+			return err
+		}
+	}
+
+	// the macOS metadata, which doesn't change the modification times
+	for _, m := range u.macMetadata {
+		if err := writeMacMetadata(m.name, m.metadata); err != nil {
+			u.warn(m.entry, fmt.Errorf("failed to restore macOS metadata: %v", err))
+		}
+	}
+
+	// the SELinux contexts, which need to be set before the file flags
+	u.applySELinuxLabels()
+
+	// apply the directory permissions and times last, deepest first, now
+	// that nothing more will be written within them
+	for i := len(u.dirs) - 1; i >= 0; i-- {
+		d := u.dirs[i]
+		if d.chmod {
+			if err := u.filesystem().Chmod(d.name, d.mode); err != nil {
+				return err
+			}
+		}
+		if d.chtimes {
+			if err := u.filesystem().Chtimes(d.name, d.atime, d.mtime); err != nil {
+				return err
+			}
+		}
+	}
+
+	// and then the file flags, which may stop anything more being changed
+	for _, f := range u.fileFlags {
+		if err := writeFileFlags(f.name, f.flags); err != nil {
+			u.warn(f.entry, fmt.Errorf("failed to set file flags: %v", err))
+		}
 	}
 
 	return nil
@@ -231,6 +634,128 @@ func checkLinkName(dest, src, targetBase string) error {
 	return nil
 }
 
+// Checks that the target of the link in the named entry stays within the
+// archive. Symlink targets are relative to the directory holding the link
+// while hard link targets are relative to the root of the archive.
+func checkLinkTarget(name, linkname string, symlink bool) error {
+	if path.IsAbs(linkname) {
+		return fmt.Errorf("Link %s to absolute path %s not allowed.", name, linkname)
+	}
+	target := linkname
+	if symlink {
+		target = path.Join(path.Dir(name), linkname)
+	}
+	target = path.Clean(target)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return fmt.Errorf("Link %s to %s leads outside of the archive.", name, linkname)
+	}
+	return nil
+}
+
+// Checks that the given path is within the target directory. Symlinks in the
+// path must already be resolved.
+func (u *Untar) checkWithinTarget(name string) error {
+	root, err := filepath.Abs(u.target)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Path %s resolves outside of the target directory.", name)
+	}
+	return nil
+}
+
+// Checks that the entry with the given header, to be extracted to name, is
+// written within the target directory, following the symlinks already on
+// disk as resolveDestination will, but without creating anything. The target
+// of a symlink is checked from where its directory really is, as the link may
+// be written through other links.
+func (u *Untar) checkDestination(header *tar.Header, name string) error {
+	// the root entry of the archive is the target itself, and so is within
+	// its parent rather than the target
+	if path.Clean(header.Name) == "." {
+		return nil
+	}
+	dir, err := u.lookupDestination(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	resolved, err := evalExistingSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if err := u.checkWithinTarget(resolved); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeSymlink {
+		return nil
+	}
+	// joined without cleaning, so that ".." is taken after following any
+	// links before it, as it will be
+	target, err := evalExistingSymlinks(resolved + string(filepath.Separator) + filepath.FromSlash(header.Linkname))
+	if err != nil {
+		return err
+	}
+	if err := u.checkWithinTarget(target); err != nil {
+		return fmt.Errorf("Link %s to %s leads outside of the target directory.", header.Name, header.Linkname)
+	}
+	return nil
+}
+
+// Resolves the named directory as resolveDestination does, following any
+// symlinks already on disk, but without creating the directories that don't
+// exist yet, which are taken to be plain directories.
+func (u *Untar) lookupDestination(name string) (string, error) {
+	dir := "."
+	if path.IsAbs(name) {
+		dir = string(os.PathSeparator)
+	}
+	for _, part := range strings.Split(name, string(os.PathSeparator)) {
+		if part == "" {
+			continue
+		}
+		next, err := u.convertToDestination(path.Join(dir, part), false)
+		if err != nil {
+			return "", err
+		}
+		dir = next
+	}
+	return dir, nil
+}
+
+// Returns name with the symlinks in it evaluated, as far as it exists, with
+// the rest of it joined on.
+func evalExistingSymlinks(name string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(name)
+	if err == nil || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	i := strings.LastIndex(name, string(filepath.Separator))
+	if i < 0 {
+		return filepath.Abs(name)
+	}
+	dir, base := name[:i], name[i+1:]
+	if dir == "" {
+		dir = string(filepath.Separator)
+	}
+	resolved, err = evalExistingSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, base), nil
+}
+
 // Processes a single header/body combination from the tar
 // archive being processed in Extract() above.
 func (u *Untar) processEntry(header *tar.Header) error {
@@ -243,6 +768,23 @@ func (u *Untar) processEntry(header *tar.Header) error {
 
 	name := path.Join(u.target, header.Name)
 
+	// when hardened, check where the entry ends up before any of the
+	// directories leading to it are created
+	if u.Hardened {
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			symlink := header.Typeflag == tar.TypeSymlink
+			if err := checkLinkTarget(header.Name, header.Linkname, symlink); err != nil {
+				return err
+			}
+		}
+		if u.onDisk() {
+			if err := u.checkDestination(header, name); err != nil {
+				return err
+			}
+		}
+	}
+
 	// resolve the destination and then reset the name based on the resolution
 	destDir, err := u.resolveDestination(path.Dir(name))
 	name = path.Join(destDir, path.Base(name))
@@ -250,23 +792,49 @@ func (u *Untar) processEntry(header *tar.Header) error {
 		return err
 	}
 
+	// wait for any files being written that this entry depends on
+	if err := u.waitForFiles(header, name); err != nil {
+		return err
+	}
+
+	// restore or skip macOS metadata as asked
+	if handled, err := u.handleAppleDouble(header, name); handled || err != nil {
+		return err
+	}
+
+	// apply whiteouts in place of extracting them
+	if u.ApplyWhiteouts {
+		if whiteout, err := u.applyWhiteout(header.Name, destDir); whiteout || err != nil {
+			return err
+		}
+	}
+
+	// decide what to do about anything already in the way
+	if existing, err := u.filesystem().Lstat(name); err == nil {
+		overwrite, err := u.resolveConflict(header, existing)
+		if err != nil || !overwrite {
+			return err
+		}
+	}
+
 	// look at the type to see how we want to remove existing entries
 	switch {
 	case header.Typeflag == tar.TypeDir:
 		// if we are extracting a directory, we want to see if the directory
 		// already exists... if it exists but isn't a directory, we need
 		// to remove it
-		fi, _ := os.Stat(name)
+		fi, _ := u.filesystem().Stat(name)
 		if fi != nil {
 			if !fi.IsDir() {
-				os.RemoveAll(name)
+				u.filesystem().RemoveAll(name)
 			}
 		}
 	default:
-		os.RemoveAll(name)
+		u.filesystem().RemoveAll(name)
 	}
 
 	// handle individual types
+	linkCopied := false
 	switch {
 	case header.Typeflag == tar.TypeDir:
 		// Handle directories
@@ -276,11 +844,18 @@ func (u *Untar) processEntry(header *tar.Header) error {
 			mode = os.FileMode(header.Mode) | u.IncludedPermissionMask
 		}
 
-		// create the directory
-		err := os.MkdirAll(name, mode)
+		// create the directory writable, so that its contents can be
+		// extracted, leaving more restrictive permissions for later
+		created := mode | 0700
+		_, statErr := u.filesystem().Lstat(name)
+		err := u.filesystem().MkdirAll(name, created)
 		if err != nil {
 			return err
 		}
+		if created != mode && os.IsNotExist(statErr) {
+			d := u.dirMetadata(name)
+			d.mode, d.chmod = mode, true
+		}
 
 	case header.Typeflag == tar.TypeSymlink:
 		// Handle symlinks
@@ -295,7 +870,7 @@ func (u *Untar) processEntry(header *tar.Header) error {
 		}
 
 		// make the link
-		if err := os.Symlink(header.Linkname, name); err != nil {
+		if err := u.filesystem().Symlink(header.Linkname, name); err != nil {
 			return err
 		}
 
@@ -307,45 +882,38 @@ func (u *Untar) processEntry(header *tar.Header) error {
 
 		// find the full path, need to ensure it exists
 		link := path.Clean(path.Join(u.target, header.Linkname))
+		if u.Hardened && u.onDisk() {
+			resolved, err := filepath.EvalSymlinks(link)
+			if err != nil {
+				return err
+			}
+			if err := u.checkWithinTarget(resolved); err != nil {
+				return err
+			}
+		}
 
 		// do the link... no permissions or owners, those carry over
-		if err := os.Link(link, name); err != nil {
-			return err
+		if err := u.filesystem().Link(link, name); err != nil {
+			if !u.CopyFailedLinks {
+				return err
+			}
+			if err := copyFile(u.filesystem(), link, name); err != nil {
+				return err
+			}
+			linkCopied = true
 		}
 
 	case header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA:
-		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
-		// determine the mode to use
-		mode := os.FileMode(0644)
-		if u.PreservePermissions {
-			mode = os.FileMode(header.Mode) | u.IncludedPermissionMask
-		}
-
-		// open the file
-		f, err := os.OpenFile(name, flags, mode)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		// SETUID/SETGID needs to be defered...
-		// The standard chown call is after handling the files, since we want to
-		// just have it one place, and after the file exists.  However, chown
-		// will clear the setuid/setgid bit on a file.
-		if header.Mode&c_ISUID != 0 {
-			defer lazyChmod(name, os.ModeSetuid)
+		// small files are written by the pool, if there is one, while the
+		// archive is read on
+		if u.pool != nil && header.Size <= parallelFileSize {
+			return u.submitFile(header, name)
 		}
-		if header.Mode&c_ISGID != 0 {
-			defer lazyChmod(name, os.ModeSetgid)
-		}
-
-		// copy the contents
-		n, err := io.Copy(f, u.archive)
-		if err != nil {
-			return err
-		} else if n != header.Size {
-			return fmt.Errorf("Short write while copying file %s", name)
+		var src io.Reader = u.archive
+		if u.ctx != nil {
+			src = &contextReader{ctx: u.ctx, r: src}
 		}
+		return u.extractFile(header, name, src)
 
 	case header.Typeflag == tar.TypeBlock || header.Typeflag == tar.TypeChar || header.Typeflag == tar.TypeFifo:
 		// check to see if the flag to skip character/block devices is set, and
@@ -354,6 +922,13 @@ func (u *Untar) processEntry(header *tar.Header) error {
 			return nil
 		}
 
+		// devices are only created when allowed
+		device := header.Typeflag != tar.TypeFifo
+		if device && !u.AllowDevices {
+			u.warn(header.Name, fmt.Errorf("creating devices is not allowed"))
+			return nil
+		}
+
 		// determine how to OR the mode
 		devmode := uint32(0)
 		switch header.Typeflag {
@@ -373,8 +948,13 @@ func (u *Untar) processEntry(header *tar.Header) error {
 
 		// syscall to mknod
 		dev := makedev(header.Devmajor, header.Devminor)
-		osUmask(0000)
-		if err := osMknod(name, devmode|uint32(mode), dev); err != nil {
+		if err := u.filesystem().Mknod(name, devmode|uint32(mode), dev); err != nil {
+			// without privileges the device is skipped, as is anything that
+			// can't be created on this platform
+			if (device && os.IsPermission(err)) || errors.Is(err, ErrMknodUnsupported) {
+				u.warn(header.Name, fmt.Errorf("failed to create device: %w", err))
+				return nil
+			}
 			return err
 		}
 
@@ -382,32 +962,212 @@ func (u *Untar) processEntry(header *tar.Header) error {
 		return fmt.Errorf("Unrecognized type: %d", header.Typeflag)
 	}
 
-	// process the uid/gid ownership
-	uid := u.MappedUserID
-	gid := u.MappedGroupID
-	if u.PreserveOwners {
-		if uid, err = u.OwnerMappingFunc(header.Uid); err != nil {
-			return fmt.Errorf("failed to map UID for file: %v", err)
-		}
-		if gid, err = u.GroupMappingFunc(header.Gid); err != nil {
-			return fmt.Errorf("failed to map GID for file: %v", err)
+	return u.finishEntry(header, name, linkCopied)
+}
+
+// Writes the regular file with the given header to name, with its content
+// read from src, and then finishes it.
+func (u *Untar) extractFile(header *tar.Header, name string, src io.Reader) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	// determine the mode to use
+	mode := os.FileMode(0644)
+	if u.PreservePermissions {
+		mode = os.FileMode(header.Mode) | u.IncludedPermissionMask
+	}
+
+	// open the file
+	f, err := u.filesystem().OpenFile(name, flags, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// SETUID/SETGID needs to be defered...
+	// The standard chown call is after handling the files, since we want to
+	// just have it one place, and after the file exists.  However, chown
+	// will clear the setuid/setgid bit on a file.
+	if header.Mode&c_ISUID != 0 && u.PreserveSetuid {
+		defer lazyChmod(u.filesystem(), name, os.ModeSetuid)
+	}
+	if header.Mode&c_ISGID != 0 && u.PreserveSetuid {
+		defer lazyChmod(u.filesystem(), name, os.ModeSetgid)
+	}
+
+	// copy the contents
+	var dst io.Writer = f
+	var sparse *sparseWriter
+	if u.Sparse {
+		sparse = &sparseWriter{f: f}
+		dst = sparse
+	}
+	n, err := copyBuffer(dst, src, u.BufferSize)
+	if err != nil {
+		return err
+	} else if n != header.Size {
+		return fmt.Errorf("Short write while copying file %s", name)
+	}
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			return err
 		}
 	}
 
+	return u.finishEntry(header, name, false)
+}
+
+// Applies the owner, ACLs, file flags and times of the extracted entry with
+// the given header, once it has been created at name.
+func (u *Untar) finishEntry(header *tar.Header, name string, linkCopied bool) error {
+	// process the uid/gid ownership
+	uid, gid, err := u.entryOwner(header)
+	if err != nil {
+		return err
+	}
+
 	// apply it
-	switch header.Typeflag {
-	case tar.TypeSymlink:
-		os.Lchown(name, uid, gid)
-	case tar.TypeLink:
+	switch {
+	case header.Typeflag == tar.TypeSymlink:
+		if err := u.chown(name, uid, gid, true); err != nil {
+			return err
+		}
+	case header.Typeflag == tar.TypeLink && !linkCopied:
 		// don't chown on hard links or symlinks. doing this also removes setuid
 		// from mode and the hard link will already pick up the same owner
 	default:
-		os.Chown(name, uid, gid)
+		if err := u.chown(name, uid, gid, false); err != nil {
+			return err
+		}
+	}
+
+	// reapply any ACLs, after ownership since they may refer to the owner
+	if u.PreserveACLs && u.onDisk() {
+		if acls := headerACLs(header); acls != nil {
+			if err := writeACLs(name, acls); err != nil {
+				return fmt.Errorf("failed to set ACLs on %s: %v", name, err)
+			}
+		}
+	}
+
+	// security contexts are set once everything has been extracted, and a
+	// hard link shares the context of its file
+	if u.SELinux != SELinuxIgnore && u.onDisk() && (header.Typeflag != tar.TypeLink || linkCopied) {
+		u.recordSELinuxLabel(header, name)
+	}
+
+	// file flags are set last of all
+	if u.PreserveFileFlags && u.onDisk() {
+		if flags, ok := headerFileFlags(header); ok {
+			u.mu.Lock()
+			u.fileFlags = append(u.fileFlags, entryFlags{name: name, entry: header.Name, flags: flags})
+			u.mu.Unlock()
+		}
+	}
+
+	// restore the times, once nothing else will modify the entry
+	if u.PreserveTimestamps {
+		atime := header.AccessTime
+		if atime.IsZero() {
+			atime = header.ModTime
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			// symlinks can't portably be given times and hard links share
+			// them with the file they link to, or were copied from it
+		case tar.TypeDir:
+			d := u.dirMetadata(name)
+			d.atime, d.mtime, d.chtimes = atime, header.ModTime, true
+		default:
+			if err := u.filesystem().Chtimes(name, atime, header.ModTime); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// Returns the owner to give the extracted entry with the given header.
+func (u *Untar) entryOwner(header *tar.Header) (uid, gid int, err error) {
+	// the name cache and mapping functions are only used by one file at a
+	// time when the pool is writing files
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	uid = u.MappedUserID
+	gid = u.MappedGroupID
+	headerUid, headerGid := header.Uid, header.Gid
+	if u.ResolveNames {
+		if u.names == nil {
+			u.names = newNameCache()
+		}
+		headerUid, headerGid = u.names.resolve(headerUid, headerGid, header.Uname, header.Gname)
+	}
+	if u.IDMappingFunc != nil {
+		if uid, gid, err = u.IDMappingFunc(headerUid, headerGid); err != nil {
+			return 0, 0, fmt.Errorf("failed to map owner for file: %v", err)
+		}
+	} else if u.PreserveOwners {
+		if uid, err = u.OwnerMappingFunc(headerUid); err != nil {
+			return 0, 0, fmt.Errorf("failed to map UID for file: %v", err)
+		}
+		if gid, err = u.GroupMappingFunc(headerGid); err != nil {
+			return 0, 0, fmt.Errorf("failed to map GID for file: %v", err)
+		}
+	}
+
+	if u.ForceOwner {
+		uid, gid = u.MappedUserID, u.MappedGroupID
+	}
+	return uid, gid, nil
+}
+
+// Returns the metadata to give the named directory once extraction is
+// complete, adding it if the directory doesn't have any yet.
+func (u *Untar) dirMetadata(name string) *dirMetadata {
+	if n := len(u.dirs); n > 0 && u.dirs[n-1].name == name {
+		return &u.dirs[n-1]
+	}
+	u.dirs = append(u.dirs, dirMetadata{name: name})
+	return &u.dirs[len(u.dirs)-1]
+}
+
+// Decides whether an entry should replace the existing file in its place,
+// according to the ConflictFunc or the OverwritePolicy. Directories are
+// always merged.
+func (u *Untar) resolveConflict(header *tar.Header, existing os.FileInfo) (bool, error) {
+	if header.Typeflag == tar.TypeDir && existing.IsDir() {
+		return true, nil
+	}
+
+	policy := u.OverwritePolicy
+	if u.ConflictFunc != nil {
+		var err error
+		if policy, err = u.ConflictFunc(header, existing); err != nil {
+			return false, err
+		}
+	}
+
+	switch policy {
+	case Overwrite:
+		return true, nil
+	case OverwriteError:
+		return false, fmt.Errorf("%s already exists", header.Name)
+	case OverwriteSkip:
+		return false, nil
+	case OverwriteIfNewer:
+		return header.ModTime.After(existing.ModTime()), nil
+	default:
+		return false, fmt.Errorf("unknown overwrite policy %d", policy)
+	}
+}
+
+// Reports an entry that was skipped to the WarningFunc.
+func (u *Untar) warn(name string, err error) {
+	if u.WarningFunc != nil {
+		u.WarningFunc(name, err)
+	}
+}
+
 func (u *Untar) resolveDestination(name string) (string, error) {
 	pathParts := strings.Split(name, string(os.PathSeparator))
 
@@ -434,7 +1194,7 @@ func (u *Untar) resolveDestination(name string) (string, error) {
 	// normally it begins with the previous dest, but if it is empty we need to
 	// start with resolving the first path piece
 	if len(u.resolvedLinks) == 0 {
-		dst, err := u.convertToDestination(path.Join(prefix, pathParts[i]))
+		dst, err := u.convertToDestination(path.Join(prefix, pathParts[i]), true)
 		if err != nil {
 			return "", err
 		}
@@ -451,7 +1211,7 @@ func (u *Untar) resolveDestination(name string) (string, error) {
 			prefix,
 			u.resolvedLinks[len(u.resolvedLinks)-1].dst,
 			pathParts[j])
-		dst, err := u.convertToDestination(testPath)
+		dst, err := u.convertToDestination(testPath, true)
 		if err != nil {
 			return "", err
 		}
@@ -465,12 +1225,15 @@ func (u *Untar) resolveDestination(name string) (string, error) {
 	return u.resolvedLinks[len(u.resolvedLinks)-1].dst, nil
 }
 
-func (u *Untar) convertToDestination(dir string) (string, error) {
+// Returns where the named directory leads when it is a symlink, or the
+// directory itself otherwise, creating it if it doesn't exist and create is
+// set.
+func (u *Untar) convertToDestination(dir string, create bool) (string, error) {
 	// Lstat the current element to see if it is a symlink
 	if dir == "" {
 		dir = "."
 	}
-	lstat, err := os.Lstat(dir)
+	lstat, err := u.filesystem().Lstat(dir)
 	if err != nil {
 		// If the error is that the path doesn't exist, we will go ahead and create
 		// it. Normally, tar files have a directory entry before it mentions files
@@ -481,13 +1244,17 @@ func (u *Untar) convertToDestination(dir string) (string, error) {
 		//
 		// NOTE: by the time this is executed, the location of the directory has
 		// already been validated as safe.
+		if os.IsNotExist(err) && !create {
+			return path.Clean(dir), nil
+		}
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+			if err := u.filesystem().MkdirAll(dir, os.FileMode(0755)); err != nil {
+				return "", err
+			}
+			if err := u.chown(dir, u.MappedUserID, u.MappedGroupID, false); err != nil {
 				return "", err
 			}
-			// we don't error check on chown incase the process is unprivledged
-			os.Chown(dir, u.MappedUserID, u.MappedGroupID)
-			lstat, err = os.Lstat(dir)
+			lstat, err = u.filesystem().Lstat(dir)
 		}
 	}
 	if err != nil {
@@ -497,7 +1264,7 @@ func (u *Untar) convertToDestination(dir string) (string, error) {
 	// check symlink mode
 	if lstat.Mode()&os.ModeSymlink == os.ModeSymlink {
 		// it is a symlink, now we want to read it and store the dest
-		link, err := os.Readlink(dir)
+		link, err := u.filesystem().Readlink(dir)
 		if err != nil {
 			return "", err
 		}
@@ -520,8 +1287,34 @@ func (u *Untar) convertToDestination(dir string) (string, error) {
 	return dir, nil
 }
 
-func lazyChmod(name string, m os.FileMode) {
-	if fi, err := os.Stat(name); err == nil {
-		os.Chmod(name, fi.Mode()|m)
+// Copies the contents and permissions of the file src to the new file dst,
+// both within fsys.
+func copyFile(fsys TargetFS, src, dst string) error {
+	fi, err := fsys.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Can't copy %s in place of a link, it isn't a regular file.", src)
+	}
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffer(out, in, 0); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func lazyChmod(fsys TargetFS, name string, m os.FileMode) {
+	if fi, err := fsys.Stat(name); err == nil {
+		fsys.Chmod(name, fi.Mode()|m)
 	}
 }
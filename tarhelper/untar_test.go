@@ -4,13 +4,22 @@ package tarhelper
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -437,7 +446,7 @@ func TestUntarFailures(t *testing.T) {
 
 	// Bad compression type.
 	u := NewUntar(strings.NewReader("bad"), "/tmp")
-	u.Compression = Compression(-1)
+	u.Compression = Compression(rune(-1))
 	TestExpectError(t, u.Extract())
 
 	// FIXME(brady): add more cases here!
@@ -452,3 +461,1191 @@ func TestCannotDetectCompression(t *testing.T) {
 
 	TestExpectError(t, u.Extract())
 }
+
+func TestDetectCompression(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	dir := makeTestDir(t)
+	for _, c := range []Compression{NONE, GZIP, BZIP2, XZ, ZSTD} {
+		if c == BZIP2 {
+			if _, err := exec.LookPath("bzip2"); err != nil {
+				continue
+			}
+		}
+
+		w := bytes.NewBufferString("")
+		tw := NewTar(w, dir)
+		tw.Compression = c
+		TestExpectSuccess(t, tw.Archive())
+
+		// the detected type matches and the returned reader still has the
+		// full stream
+		detected, r := DetectCompression(bytes.NewReader(w.Bytes()))
+		TestEqual(t, detected, c)
+		data, err := ioutil.ReadAll(r)
+		TestExpectSuccess(t, err)
+		TestEqual(t, data, w.Bytes())
+
+		// the tar reader can be read through to the end
+		arch, err := DetectArchiveCompression(bytes.NewReader(w.Bytes()))
+		TestExpectSuccess(t, err)
+		entries := 0
+		for {
+			_, err := arch.Next()
+			if err == io.EOF {
+				break
+			}
+			TestExpectSuccess(t, err)
+			entries++
+		}
+		TestNotEqual(t, entries, 0)
+	}
+
+	// a plain archive whose first entry starts with "BZ" is not bzip2
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "BZhello", Mode: 0644, Typeflag: tar.TypeReg}))
+	TestExpectSuccess(t, tw.Close())
+	detected, _ := DetectCompression(bytes.NewReader(w.Bytes()))
+	TestEqual(t, detected, NONE)
+}
+
+// xorCodec is a toy compression type for testing registered codecs, which
+// writes a magic number followed by every byte xored with 0x5a.
+type xorCodec struct{}
+
+type xorWriter struct{ w io.Writer }
+
+func (x xorWriter) Write(b []byte) (int, error) {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ 0x5a
+	}
+	return x.w.Write(out)
+}
+
+func (x xorWriter) Close() error { return nil }
+
+type xorReader struct{ r io.Reader }
+
+func (x xorReader) Read(b []byte) (int, error) {
+	n, err := x.r.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] ^= 0x5a
+	}
+	return n, err
+}
+
+func (xorCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if _, err := io.WriteString(w, "XOR1"); err != nil {
+		return nil, err
+	}
+	return xorWriter{w}, nil
+}
+
+func (xorCodec) Detect(br *bufio.Reader) bool {
+	data, err := br.Peek(4)
+	return err == nil && string(data) == "XOR1"
+}
+
+func (xorCodec) NewReader(r io.Reader) (io.Reader, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	return xorReader{r}, nil
+}
+
+func TestRegisteredCompression(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	xor := Compression("xor")
+	AddCompressor(string(xor), xorCodec{})
+	AddDecompressor(string(xor), xorCodec{})
+
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Compression = xor
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, string(w.Bytes()[:4]), "XOR1")
+
+	detected, _ := DetectCompression(bytes.NewReader(w.Bytes()))
+	TestEqual(t, detected, xor)
+
+	dir := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), dir)
+	u.Compression = DETECT
+	TestExpectSuccess(t, u.Extract())
+	data, err := ioutil.ReadFile(path.Join(dir, "a/b/c/d/e"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(data), 0)
+	_, err = os.Lstat(path.Join(dir, "a/b/i/j/k"))
+	TestExpectSuccess(t, err)
+}
+
+func TestCommandCompression(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("gzip is not installed")
+	}
+	cmdgzip := Compression("cmdgzip")
+	AddCompressor(string(cmdgzip), &CommandCompressor{Name: "gzip", Args: []string{"-c"}})
+	AddDecompressor(string(cmdgzip), &CommandDecompressor{Name: "gzip", Args: []string{"-dc"}})
+
+	// the output is a regular gzip stream
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Compression = cmdgzip
+	TestExpectSuccess(t, tw.Archive())
+	detected, _ := DetectCompression(bytes.NewReader(w.Bytes()))
+	TestEqual(t, detected, GZIP)
+
+	// which the command can read back, without a magic number to detect it
+	dir := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), dir)
+	u.Compression = cmdgzip
+	TestExpectSuccess(t, u.Extract())
+	_, err := os.Lstat(path.Join(dir, "a/b/i/j/k"))
+	TestExpectSuccess(t, err)
+
+	// commands that fail fail the archive, with what they wrote to stderr
+	AddCompressor(string(cmdgzip), &CommandCompressor{Name: "sh", Args: []string{"-c", "echo broken >&2; exit 3"}})
+	tw = NewTar(bytes.NewBufferString(""), makeTestDir(t))
+	tw.Compression = cmdgzip
+	err = tw.Archive()
+	TestExpectError(t, err)
+	TestEqual(t, strings.Contains(err.Error(), "broken"), true)
+
+	// as do corrupt streams
+	data := append([]byte(nil), w.Bytes()[:len(w.Bytes())/2]...)
+	u = NewUntar(bytes.NewReader(data), TempDir(t))
+	u.Compression = cmdgzip
+	TestExpectError(t, u.Extract())
+}
+
+func TestUntarExtractContext(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, makeTestDir(t)).Archive())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u := NewUntar(bytes.NewReader(w.Bytes()), TempDir(t))
+	TestEqual(t, u.ExtractContext(ctx), context.Canceled)
+
+	u = NewUntar(bytes.NewReader(w.Bytes()), TempDir(t))
+	TestExpectSuccess(t, u.ExtractContext(context.Background()))
+}
+
+func TestUntarHardened(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	makeArchive := func(headers ...*tar.Header) []byte {
+		w := bytes.NewBufferString("")
+		tw := tar.NewWriter(w)
+		for _, h := range headers {
+			if h.Typeflag == tar.TypeReg {
+				h.Size = 4
+			}
+			if h.Mode == 0 {
+				h.Mode = 0644
+			}
+			TestExpectSuccess(t, tw.WriteHeader(h))
+			if h.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte("data"))
+				TestExpectSuccess(t, err)
+			}
+		}
+		TestExpectSuccess(t, tw.Close())
+		return w.Bytes()
+	}
+	extract := func(target string, hardened bool, data []byte) error {
+		u := NewUntar(bytes.NewReader(data), target)
+		u.Hardened = hardened
+		return u.Extract()
+	}
+
+	// links within the archive are fine
+	good := makeArchive(
+		&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "a/file", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "a/b/up", Typeflag: tar.TypeSymlink, Linkname: "../file"},
+		&tar.Header{Name: "a/b/hard", Typeflag: tar.TypeLink, Linkname: "a/file"},
+		&tar.Header{Name: "a/b/via/", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		&tar.Header{Name: "a/b/via/other", Typeflag: tar.TypeReg},
+	)
+	target := TempDir(t)
+	TestExpectSuccess(t, extract(target, true, good))
+	_, err := os.Stat(path.Join(target, "a/other"))
+	TestExpectSuccess(t, err)
+
+	// links leading out of the archive are refused
+	for _, h := range []*tar.Header{
+		{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "a/rel", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+	} {
+		TestExpectError(t, extract(TempDir(t), true, makeArchive(h)))
+	}
+
+	// as are entries that would be written through an existing link
+	outside := TempDir(t)
+	target = TempDir(t)
+	TestExpectSuccess(t, os.Symlink(outside, path.Join(target, "escape")))
+	data := makeArchive(&tar.Header{Name: "escape/file", Typeflag: tar.TypeReg})
+	TestExpectError(t, extract(target, true, data))
+	_, err = os.Stat(path.Join(outside, "file"))
+	TestEqual(t, os.IsNotExist(err), true)
+
+	// or would be, with links whose targets only lead out once the links
+	// they were written through are followed, with nothing created outside
+	parent := TempDir(t)
+	target = path.Join(parent, "target")
+	TestExpectSuccess(t, os.Mkdir(target, 0755))
+	data = makeArchive(
+		&tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."},
+		&tar.Header{Name: "d/l", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		&tar.Header{Name: "l/made/by/archive/f", Typeflag: tar.TypeReg},
+	)
+	TestExpectError(t, extract(target, true, data))
+	_, err = os.Lstat(path.Join(target, "l"))
+	TestEqual(t, os.IsNotExist(err), true)
+	_, err = os.Stat(path.Join(parent, "made"))
+	TestEqual(t, os.IsNotExist(err), true)
+
+	// the root entry of the archive is the target itself
+	target = TempDir(t)
+	TestExpectSuccess(t, extract(target, true, makeArchive(
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./file", Typeflag: tar.TypeReg},
+	)))
+	_, err = os.Stat(path.Join(target, "file"))
+	TestExpectSuccess(t, err)
+
+	// without hardening the absolute link is allowed
+	TestExpectSuccess(t, extract(TempDir(t), false, makeArchive(
+		&tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/etc"})))
+}
+
+func TestUntarIDMappingFunc(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	buffer := bytes.NewBufferString("")
+	archive := tar.NewWriter(buffer)
+	TestExpectSuccess(t, archive.WriteHeader(&tar.Header{
+		Name:     "foo",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      1234,
+		Gid:      5678,
+	}))
+	TestExpectSuccess(t, archive.Close())
+
+	usr, err := user.Current()
+	TestExpectSuccess(t, err)
+	myUid, err := strconv.Atoi(usr.Uid)
+	TestExpectSuccess(t, err)
+	myGid, err := strconv.Atoi(usr.Gid)
+	TestExpectSuccess(t, err)
+
+	// used without PreserveOwners, in place of the mapped ids
+	tempDir := TempDir(t)
+	u := NewUntar(bytes.NewReader(buffer.Bytes()), tempDir)
+	u.MappedUserID = -1
+	u.MappedGroupID = -1
+	called := false
+	u.IDMappingFunc = func(uid, gid int) (int, int, error) {
+		called = true
+		TestEqual(t, uid, 1234)
+		TestEqual(t, gid, 5678)
+		return myUid, myGid, nil
+	}
+	TestExpectSuccess(t, u.Extract())
+	TestEqual(t, called, true)
+
+	stat, err := os.Stat(path.Join(tempDir, "foo"))
+	TestExpectSuccess(t, err)
+	sys := stat.Sys().(*syscall.Stat_t)
+	TestEqual(t, sys.Uid, uint32(myUid))
+	TestEqual(t, sys.Gid, uint32(myGid))
+
+	// errors stop the extraction
+	u = NewUntar(bytes.NewReader(buffer.Bytes()), TempDir(t))
+	u.IDMappingFunc = func(uid, gid int) (int, int, error) {
+		return 0, 0, fmt.Errorf("not allowed")
+	}
+	TestExpectError(t, u.Extract())
+}
+
+func TestUntarResolveNames(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	usr, err := user.Current()
+	TestExpectSuccess(t, err)
+	group, err := user.LookupGroupId(usr.Gid)
+	TestExpectSuccess(t, err)
+	myUid, err := strconv.Atoi(usr.Uid)
+	TestExpectSuccess(t, err)
+	myGid, err := strconv.Atoi(usr.Gid)
+	TestExpectSuccess(t, err)
+
+	// an owner whose ids don't exist here, but whose names do
+	buffer := bytes.NewBufferString("")
+	archive := tar.NewWriter(buffer)
+	TestExpectSuccess(t, archive.WriteHeader(&tar.Header{
+		Name:     "foo",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      987654,
+		Gid:      987654,
+		Uname:    usr.Username,
+		Gname:    group.Name,
+	}))
+	TestExpectSuccess(t, archive.Close())
+
+	for _, resolve := range []bool{true, false} {
+		var gotUid, gotGid int
+		u := NewUntar(bytes.NewReader(buffer.Bytes()), TempDir(t))
+		u.ResolveNames = resolve
+		u.IDMappingFunc = func(uid, gid int) (int, int, error) {
+			gotUid, gotGid = uid, gid
+			return myUid, myGid, nil
+		}
+		TestExpectSuccess(t, u.Extract())
+		if resolve {
+			TestEqual(t, gotUid, myUid)
+			TestEqual(t, gotGid, myGid)
+		} else {
+			TestEqual(t, gotUid, 987654)
+			TestEqual(t, gotGid, 987654)
+		}
+	}
+}
+
+func TestUntarHardLinks(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "file", Typeflag: tar.TypeReg, Mode: 0600, Size: 4}))
+	_, err := tw.Write([]byte("data"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "link", Typeflag: tar.TypeLink, Linkname: "file"}))
+	TestExpectSuccess(t, tw.Close())
+
+	// the link shares the file
+	target := TempDir(t)
+	TestExpectSuccess(t, NewUntar(bytes.NewReader(w.Bytes()), target).Extract())
+	fi1, err := os.Stat(path.Join(target, "file"))
+	TestExpectSuccess(t, err)
+	fi2, err := os.Stat(path.Join(target, "link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, os.SameFile(fi1, fi2), true)
+
+	// links that can't be made are an error, unless they can be copied
+	defer func() { osLink = os.Link }()
+	osLink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	TestExpectError(t, NewUntar(bytes.NewReader(w.Bytes()), TempDir(t)).Extract())
+
+	target = TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), target)
+	u.CopyFailedLinks = true
+	TestExpectSuccess(t, u.Extract())
+	fi1, err = os.Stat(path.Join(target, "file"))
+	TestExpectSuccess(t, err)
+	fi2, err = os.Stat(path.Join(target, "link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, os.SameFile(fi1, fi2), false)
+	TestEqual(t, fi2.Mode().Perm(), os.FileMode(0600))
+	data, err := ioutil.ReadFile(path.Join(target, "link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+}
+
+func TestUntarDevices(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}))
+	TestExpectSuccess(t, tw.Close())
+
+	extract := func(allow bool) (string, []string) {
+		var warned []string
+		target := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), target)
+		u.AllowDevices = allow
+		u.WarningFunc = func(name string, err error) {
+			TestNotEqual(t, err, nil)
+			warned = append(warned, name)
+		}
+		TestExpectSuccess(t, u.Extract())
+		return target, warned
+	}
+
+	// devices are skipped unless allowed
+	target, warned := extract(false)
+	TestEqual(t, warned, []string{"null"})
+	_, err := os.Lstat(path.Join(target, "null"))
+	TestEqual(t, os.IsNotExist(err), true)
+
+	// when allowed they're created, or skipped without the privileges
+	target, warned = extract(true)
+	fi, err := os.Lstat(path.Join(target, "null"))
+	if warned != nil {
+		TestEqual(t, warned, []string{"null"})
+		TestEqual(t, os.IsNotExist(err), true)
+	} else {
+		TestExpectSuccess(t, err)
+		TestEqual(t, fi.Mode()&os.ModeCharDevice != 0, true)
+	}
+
+	// where they can't be created at all, as on Windows, named pipes and
+	// devices are skipped with a warning and the rest is extracted
+	w = bytes.NewBufferString("")
+	tw = tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}))
+	TestExpectSuccess(t, tw.Close())
+	fsys := noMknodFS{NewMemFS()}
+	u := NewUntarFS(bytes.NewReader(w.Bytes()), fsys)
+	u.AllowDevices = true
+	warned = nil
+	u.WarningFunc = func(name string, err error) {
+		TestEqual(t, errors.Is(err, ErrMknodUnsupported), true)
+		warned = append(warned, name)
+	}
+	TestExpectSuccess(t, u.Extract())
+	TestEqual(t, warned, []string{"fifo", "null"})
+	_, err = fsys.Lstat("/fifo")
+	TestEqual(t, os.IsNotExist(err), true)
+	_, err = fsys.Lstat("/file")
+	TestExpectSuccess(t, err)
+}
+
+// noMknodFS is a MemFS that can't create devices or named pipes.
+type noMknodFS struct {
+	*MemFS
+}
+
+func (noMknodFS) Mknod(name string, mode uint32, dev int) error {
+	return fmt.Errorf("mknod(%q): %w", name, ErrMknodUnsupported)
+}
+
+func TestUntarLimits(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	for _, name := range []string{"a", "b", "c"} {
+		TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+		_, err := tw.Write([]byte("data"))
+		TestExpectSuccess(t, err)
+	}
+	TestExpectSuccess(t, tw.Close())
+
+	extract := func(entries, fileSize, totalSize int64) (string, error) {
+		target := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), target)
+		u.MaxEntries = entries
+		u.MaxFileSize = fileSize
+		u.MaxTotalSize = totalSize
+		return target, u.Extract()
+	}
+
+	// limits that aren't reached don't matter
+	_, err := extract(3, 4, 12)
+	TestExpectSuccess(t, err)
+
+	_, err = extract(0, 3, 0)
+	TestExpectError(t, err)
+
+	// extraction stops at the entry over the limit
+	for _, limits := range [][]int64{{2, 0, 0}, {0, 0, 11}} {
+		target, err := extract(limits[0], limits[1], limits[2])
+		TestExpectError(t, err)
+		_, err = os.Stat(path.Join(target, "b"))
+		TestExpectSuccess(t, err)
+		_, err = os.Stat(path.Join(target, "c"))
+		TestEqual(t, os.IsNotExist(err), true)
+	}
+}
+
+func TestUntarOverwritePolicy(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3,
+		ModTime: time.Unix(1500000000, 0)}))
+	_, err := tw.Write([]byte("new"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, tw.Close())
+
+	extract := func(mtime time.Time, setup func(u *Untar)) (string, error) {
+		target := TempDir(t)
+		name := path.Join(target, "dir/file")
+		TestExpectSuccess(t, os.Mkdir(path.Join(target, "dir"), 0755))
+		TestExpectSuccess(t, ioutil.WriteFile(name, []byte("old"), 0644))
+		TestExpectSuccess(t, os.Chtimes(name, mtime, mtime))
+		u := NewUntar(bytes.NewReader(w.Bytes()), target)
+		setup(u)
+		if err := u.Extract(); err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(name)
+		TestExpectSuccess(t, err)
+		return string(data), nil
+	}
+	older, newer := time.Unix(1400000000, 0), time.Unix(1600000000, 0)
+
+	for _, test := range []struct {
+		policy   OverwritePolicy
+		mtime    time.Time
+		expected string
+	}{
+		{Overwrite, newer, "new"},
+		{OverwriteSkip, older, "old"},
+		{OverwriteIfNewer, older, "new"},
+		{OverwriteIfNewer, newer, "old"},
+	} {
+		data, err := extract(test.mtime, func(u *Untar) { u.OverwritePolicy = test.policy })
+		TestExpectSuccess(t, err)
+		TestEqual(t, data, test.expected)
+	}
+
+	_, err = extract(older, func(u *Untar) { u.OverwritePolicy = OverwriteError })
+	TestExpectError(t, err)
+
+	// the callback decides for each conflict
+	var conflicts []string
+	data, err := extract(older, func(u *Untar) {
+		u.OverwritePolicy = OverwriteError
+		u.ConflictFunc = func(header *tar.Header, existing os.FileInfo) (OverwritePolicy, error) {
+			conflicts = append(conflicts, header.Name)
+			TestEqual(t, existing.Size(), int64(3))
+			return OverwriteSkip, nil
+		}
+	})
+	TestExpectSuccess(t, err)
+	TestEqual(t, data, "old")
+	TestEqual(t, conflicts, []string{"dir/file"})
+
+	_, err = extract(older, func(u *Untar) {
+		u.ConflictFunc = func(header *tar.Header, existing os.FileInfo) (OverwritePolicy, error) {
+			return Overwrite, fmt.Errorf("refused")
+		}
+	})
+	TestExpectError(t, err)
+}
+
+func TestUntarIncludedPaths(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	for _, name := range []string{"etc/", "etc/config/", "usr/"} {
+		TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}))
+	}
+	for _, name := range []string{"etc/config/a", "etc/config/b", "etc/other", "usr/config"} {
+		TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+		_, err := tw.Write([]byte("data"))
+		TestExpectSuccess(t, err)
+	}
+	TestExpectSuccess(t, tw.Close())
+
+	target := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), target)
+	u.IncludedPaths = []string{"etc/config/*"}
+	TestExpectSuccess(t, u.Extract())
+	for _, name := range []string{"etc/config/a", "etc/config/b"} {
+		_, err := os.Stat(path.Join(target, name))
+		TestExpectSuccess(t, err)
+	}
+	for _, name := range []string{"etc/other", "usr"} {
+		_, err := os.Stat(path.Join(target, name))
+		TestEqual(t, os.IsNotExist(err), true)
+	}
+
+	// directories include everything within them
+	target = TempDir(t)
+	u = NewUntar(bytes.NewReader(w.Bytes()), target)
+	u.Compression = DETECT
+	u.IncludedPaths = []string{"usr/"}
+	TestExpectSuccess(t, u.Extract())
+	_, err := os.Stat(path.Join(target, "usr/config"))
+	TestExpectSuccess(t, err)
+	_, err = os.Stat(path.Join(target, "etc"))
+	TestEqual(t, os.IsNotExist(err), true)
+
+	u = NewUntar(bytes.NewReader(w.Bytes()), TempDir(t))
+	u.IncludedPaths = []string{`etc\`}
+	TestExpectError(t, u.Extract())
+}
+
+func TestUntarFS(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0640, Size: 4}))
+	_, err := tw.Write([]byte("data"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/file"}))
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/dir"}))
+	// written through the absolute symlink, relative to the root of the fs
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "abs/through", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}))
+	_, err = tw.Write([]byte("ok"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0600}))
+	TestExpectSuccess(t, tw.Close())
+
+	fsys := NewMemFS()
+	u := NewUntarFS(bytes.NewReader(w.Bytes()), fsys)
+	u.Sparse = true
+	TestExpectSuccess(t, u.Extract())
+
+	data, err := fsys.ReadFile("dir/file")
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+	data, err = fsys.ReadFile("dir/through")
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "ok")
+	fi, err := fsys.Stat("dir")
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode(), os.ModeDir|0750)
+	fi, err = fsys.Lstat("fifo")
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode(), os.ModeNamedPipe|0600)
+	link, err := fsys.Readlink("abs")
+	TestExpectSuccess(t, err)
+	TestEqual(t, link, "/dir")
+
+	var names []string
+	infos, err := fsys.ReadDir("dir")
+	TestExpectSuccess(t, err)
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	TestEqual(t, names, []string{"file", "link", "through"})
+
+	// hard links share their content
+	f, err := fsys.OpenFile("dir/link", os.O_WRONLY|os.O_TRUNC, 0)
+	TestExpectSuccess(t, err)
+	_, err = f.Write([]byte("new"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, f.Close())
+	data, err = fsys.ReadFile("dir/file")
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "new")
+
+	// nothing was written to disk
+	_, err = os.Stat("/dir/through")
+	TestEqual(t, os.IsNotExist(err), true)
+}
+
+func TestUntarApplyWhiteouts(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	base, dir := TempDir(t), TempDir(t)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, root := range []string{base, dir} {
+		for _, name := range []string{"sub", "gone"} {
+			TestExpectSuccess(t, os.Mkdir(path.Join(root, name), 0755))
+		}
+		// the files are only the same in both with the same times
+		for _, name := range []string{"a", "b", "sub/c", "sub/d", "gone/e"} {
+			TestExpectSuccess(t, ioutil.WriteFile(path.Join(root, name), []byte(name), 0644))
+			TestExpectSuccess(t, os.Chtimes(path.Join(root, name), modTime, modTime))
+		}
+	}
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "b")))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "sub/c")))
+	TestExpectSuccess(t, os.Remove(path.Join(dir, "sub/d")))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(dir, "sub/new"), []byte("new"), 0644))
+	TestExpectSuccess(t, os.RemoveAll(path.Join(dir, "gone")))
+
+	// extract the base, then the layer of the changes over it
+	out := TempDir(t)
+	w := bytes.NewBufferString("")
+	TestExpectSuccess(t, NewTar(w, base).Archive())
+	TestExpectSuccess(t, NewUntar(w, out).Extract())
+
+	w = bytes.NewBufferString("")
+	tw := NewTar(w, dir)
+	tw.LayerBase = base
+	TestExpectSuccess(t, tw.Archive())
+	TestEqual(t, archiveNames(t, w.Bytes()), []string{
+		"./", "sub/", "sub/new", ".wh.b", ".wh.gone", "sub/.wh..wh..opq",
+	})
+	u := NewUntar(w, out)
+	u.ApplyWhiteouts = true
+	TestExpectSuccess(t, u.Extract())
+
+	var names []string
+	for _, root := range []string{out, path.Join(out, "sub")} {
+		infos, err := ioutil.ReadDir(root)
+		TestExpectSuccess(t, err)
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+	}
+	TestEqual(t, names, []string{"a", "sub", "new"})
+
+	// the same works on a TargetFS
+	w = bytes.NewBufferString("")
+	tw2 := tar.NewWriter(w)
+	TestExpectSuccess(t, tw2.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, name := range []string{"dir/keep", "dir/drop", "other"} {
+		TestExpectSuccess(t, tw2.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}))
+	}
+	TestExpectSuccess(t, tw2.Close())
+	fsys := NewMemFS()
+	TestExpectSuccess(t, NewUntarFS(w, fsys).Extract())
+
+	w = bytes.NewBufferString("")
+	tw2 = tar.NewWriter(w)
+	for _, name := range []string{"dir/new", "dir/.wh..wh..opq", ".wh.other"} {
+		TestExpectSuccess(t, tw2.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}))
+	}
+	TestExpectSuccess(t, tw2.Close())
+	u = NewUntarFS(w, fsys)
+	u.ApplyWhiteouts = true
+	TestExpectSuccess(t, u.Extract())
+
+	names = nil
+	for _, root := range []string{"/", "dir"} {
+		infos, err := fsys.ReadDir(root)
+		TestExpectSuccess(t, err)
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+	}
+	TestEqual(t, names, []string{"dir", "new"})
+}
+
+func TestUntarAppleDouble(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	finderInfo := []byte("TEXTttxt" + strings.Repeat("\x00", 24))
+	m := macMetadata{finderInfo: finderInfo, resourceFork: []byte("resources")}
+	data := m.appleDouble()
+	parsed, err := parseAppleDouble(data)
+	TestExpectSuccess(t, err)
+	TestEqual(t, parsed.finderInfo, finderInfo)
+	TestEqual(t, parsed.resourceFork, []byte("resources"))
+	_, err = parseAppleDouble([]byte("not an AppleDouble file at all"))
+	TestExpectError(t, err)
+	TestEqual(t, appleDoubleName("dir/file"), "dir/._file")
+	TestEqual(t, appleDoubleName("dir/"), "._dir")
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{
+		Name: "._file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}))
+	_, err = tw.Write(data)
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}))
+	TestExpectSuccess(t, tw.Close())
+
+	for _, policy := range []AppleDoublePolicy{AppleDoubleExtract, AppleDoubleRestore, AppleDoubleSkip} {
+		dir := TempDir(t)
+		u := NewUntar(bytes.NewReader(w.Bytes()), dir)
+		u.AppleDouble = policy
+		TestExpectSuccess(t, u.Extract())
+
+		_, err := os.Stat(path.Join(dir, "file"))
+		TestExpectSuccess(t, err)
+		_, err = os.Stat(path.Join(dir, "._file"))
+		switch {
+		case policy == AppleDoubleSkip, policy == AppleDoubleRestore && macMetadataSupported:
+			TestEqual(t, os.IsNotExist(err), true)
+		default:
+			TestExpectSuccess(t, err)
+		}
+	}
+}
+
+// chownFailingFS is a MemFS that can't set owners.
+type chownFailingFS struct {
+	*MemFS
+}
+
+func (chownFailingFS) Chown(name string, uid, gid int) error {
+	return fmt.Errorf("not permitted")
+}
+
+func TestUntarForceOwner(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	if os.Getuid() != 0 {
+		t.Skip("giving files away needs root")
+	}
+
+	buffer := bytes.NewBufferString("")
+	archive := tar.NewWriter(buffer)
+	TestExpectSuccess(t, archive.WriteHeader(&tar.Header{
+		Name:     "foo",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      1234,
+		Gid:      5678,
+	}))
+	TestExpectSuccess(t, archive.Close())
+
+	// the forced owner wins over everything else
+	tempDir := TempDir(t)
+	u := NewUntar(bytes.NewReader(buffer.Bytes()), tempDir)
+	u.PreserveOwners = true
+	u.IDMappingFunc = func(uid, gid int) (int, int, error) {
+		return 1111, 2222, nil
+	}
+	u.ForceOwner = true
+	u.MappedUserID = 4321
+	u.MappedGroupID = 8765
+	TestExpectSuccess(t, u.Extract())
+
+	stat, err := os.Stat(path.Join(tempDir, "foo"))
+	TestExpectSuccess(t, err)
+	sys := stat.Sys().(*syscall.Stat_t)
+	TestEqual(t, sys.Uid, uint32(4321))
+	TestEqual(t, sys.Gid, uint32(8765))
+
+	// failures to set owners are ignored unless strict
+	for _, strict := range []bool{false, true} {
+		u = NewUntarFS(bytes.NewReader(buffer.Bytes()), chownFailingFS{NewMemFS()})
+		u.StrictOwners = strict
+		if strict {
+			TestExpectError(t, u.Extract())
+		} else {
+			TestExpectSuccess(t, u.Extract())
+		}
+	}
+}
+
+func TestUntarReadOnlyDirectories(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	mtime := time.Unix(1400000000, 0)
+	buffer := bytes.NewBufferString("")
+	archive := tar.NewWriter(buffer)
+	TestExpectSuccess(t, archive.WriteHeader(&tar.Header{
+		Name: "dir/", Typeflag: tar.TypeDir, Mode: 0500, ModTime: mtime}))
+	TestExpectSuccess(t, archive.WriteHeader(&tar.Header{
+		Name: "dir/sub/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime}))
+	TestExpectSuccess(t, archive.WriteHeader(&tar.Header{
+		Name: "dir/sub/file", Typeflag: tar.TypeReg, Mode: 0444, Size: 4, ModTime: mtime}))
+	_, err := archive.Write([]byte("data"))
+	TestExpectSuccess(t, err)
+	TestExpectSuccess(t, archive.Close())
+
+	// the directories are writable until their contents are extracted
+	fsys := NewMemFS()
+	u := NewUntarFS(bytes.NewReader(buffer.Bytes()), fsys)
+	u.PreserveTimestamps = true
+	TestExpectSuccess(t, u.Extract())
+	TestEqual(t, len(u.dirs), 0)
+
+	for _, name := range []string{"dir", "dir/sub"} {
+		fi, err := fsys.Stat(name)
+		TestExpectSuccess(t, err)
+		TestEqual(t, fi.ModTime().Equal(mtime), true)
+	}
+	fi, err := fsys.Stat("dir")
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode(), os.ModeDir|0500)
+	fi, err = fsys.Stat("dir/sub")
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode(), os.ModeDir|0555)
+	data, err := fsys.ReadFile("dir/sub/file")
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "data")
+
+	// and the same on disk
+	dir := TempDir(t)
+	u = NewUntar(bytes.NewReader(buffer.Bytes()), dir)
+	u.PreserveTimestamps = true
+	TestExpectSuccess(t, u.Extract())
+	fi, err = os.Stat(path.Join(dir, "dir"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, fi.Mode(), os.ModeDir|0500)
+	TestEqual(t, fi.ModTime().Equal(mtime), true)
+	AddTestFinalizer(func() {
+		os.Chmod(path.Join(dir, "dir/sub"), 0755)
+		os.Chmod(path.Join(dir, "dir"), 0755)
+	})
+}
+
+func TestUntarParallelism(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	mtime := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	write := func(h *tar.Header, data string) {
+		h.ModTime = mtime
+		h.Size = int64(len(data))
+		TestExpectSuccess(t, tw.WriteHeader(h))
+		_, err := io.WriteString(tw, data)
+		TestExpectSuccess(t, err)
+	}
+	write(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("dir/file%d", i)
+		write(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0640}, name)
+	}
+	big := strings.Repeat("b", parallelFileSize+1)
+	write(&tar.Header{Name: "dir/big", Typeflag: tar.TypeReg, Mode: 0644}, big)
+	// links to files that are being written in parallel, and a file
+	// replacing one of them
+	write(&tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/file49"}, "")
+	write(&tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "file48"}, "")
+	write(&tar.Header{Name: "dir/file0", Typeflag: tar.TypeReg, Mode: 0600}, "replaced")
+	TestExpectSuccess(t, tw.Close())
+
+	dir := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), dir)
+	u.Parallelism = 4
+	u.PreservePermissions = true
+	u.PreserveTimestamps = true
+	TestExpectSuccess(t, u.Extract())
+
+	for i := 1; i < 50; i++ {
+		name := fmt.Sprintf("dir/file%d", i)
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		TestExpectSuccess(t, err)
+		TestEqual(t, string(data), name)
+		fi, err := os.Stat(path.Join(dir, name))
+		TestExpectSuccess(t, err)
+		TestEqual(t, fi.Mode(), os.FileMode(0640))
+		TestEqual(t, fi.ModTime().Equal(mtime), true)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "dir/big"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(data), len(big))
+	data, err = ioutil.ReadFile(path.Join(dir, "dir/file0"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "replaced")
+	data, err = ioutil.ReadFile(path.Join(dir, "dir/link"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "dir/file49")
+	data, err = ioutil.ReadFile(path.Join(dir, "dir/symlink"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, string(data), "dir/file48")
+
+	// a file that can't be written fails the extraction
+	u = NewUntar(bytes.NewReader(w.Bytes()), dir)
+	u.Parallelism = 4
+	u.OverwritePolicy = OverwriteError
+	TestExpectError(t, u.Extract())
+}
+
+func TestUntarEntryFilter(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	w := bytes.NewBufferString("")
+	tw := tar.NewWriter(w)
+	for _, h := range []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "setuid", Typeflag: tar.TypeReg, Mode: 04755},
+		{Name: "rename", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		TestExpectSuccess(t, tw.WriteHeader(h))
+	}
+	TestExpectSuccess(t, tw.Close())
+
+	// entries can be skipped and renamed
+	dir := TempDir(t)
+	u := NewUntar(bytes.NewReader(w.Bytes()), dir)
+	u.EntryFilter = func(h *tar.Header) (bool, error) {
+		if h.Name == "rename" {
+			h.Name = "renamed"
+		}
+		return h.Mode&c_ISUID == 0, nil
+	}
+	TestExpectSuccess(t, u.Extract())
+	names, err := ioutil.ReadDir(dir)
+	TestExpectSuccess(t, err)
+	TestEqual(t, len(names), 2)
+	TestEqual(t, names[0].Name(), "file")
+	TestEqual(t, names[1].Name(), "renamed")
+
+	// or rejected
+	u = NewUntar(bytes.NewReader(w.Bytes()), TempDir(t))
+	u.EntryFilter = func(h *tar.Header) (bool, error) {
+		if h.Mode&c_ISUID != 0 {
+			return false, fmt.Errorf("setuid binaries aren't allowed")
+		}
+		return true, nil
+	}
+	err = u.Extract()
+	TestExpectError(t, err)
+	TestEqual(t, strings.Contains(err.Error(), "setuid"), true)
+
+	// and renamed entries are still checked
+	u = NewUntar(bytes.NewReader(w.Bytes()), TempDir(t))
+	u.EntryFilter = func(h *tar.Header) (bool, error) {
+		h.Name = "../" + h.Name
+		return true, nil
+	}
+	TestExpectError(t, u.Extract())
+}
+
+func TestExtractURL(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	src := TempDir(t)
+	TestExpectSuccess(t, os.MkdirAll(path.Join(src, "a/b"), 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(src, "a/b/file"), bytes.Repeat([]byte("data"), 1024), 0644))
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, src)
+	tw.Compression = GZIP
+	TestExpectSuccess(t, tw.Archive())
+	data := w.Bytes()
+
+	// the first request for each path is cut off half way through, and the
+	// ranges asked for after are recorded
+	var mu sync.Mutex
+	ranges := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests := ranges[r.URL.Path]
+		ranges[r.URL.Path] = append(requests, r.Header.Get("Range"))
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case len(requests) == 0:
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case r.URL.Path == "/norange":
+			w.Write(data)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	defer server.Close()
+	opts := &URLOptions{Retries: 2, RetryDelay: time.Millisecond}
+
+	// resumed with a range request
+	dir := TempDir(t)
+	TestExpectSuccess(t, ExtractURL(context.Background(), server.URL+"/archive.tar.gz", dir, opts))
+	_, err := os.Stat(path.Join(dir, "a/b/file"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, ranges["/archive.tar.gz"], []string{"", fmt.Sprintf("bytes=%d-", len(data)/2)})
+
+	// or by reading past what was already read, for servers without ranges
+	dir = TempDir(t)
+	TestExpectSuccess(t, ExtractURL(context.Background(), server.URL+"/norange", dir, opts))
+	_, err = os.Stat(path.Join(dir, "a/b/file"))
+	TestExpectSuccess(t, err)
+
+	// without retries the download fails
+	TestExpectError(t, ExtractURL(context.Background(), server.URL+"/once", TempDir(t), nil))
+
+	// as do missing archives, without being retried
+	TestExpectError(t, ExtractURL(context.Background(), server.URL+"/missing", TempDir(t), opts))
+	TestEqual(t, len(ranges["/missing"]), 1)
+}
+
+func TestUntarAtomic(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	// compressed, so that cutting it short is an error
+	w := bytes.NewBufferString("")
+	tw := NewTar(w, makeTestDir(t))
+	tw.Compression = GZIP
+	TestExpectSuccess(t, tw.Archive())
+	data := w.Bytes()
+
+	parent := TempDir(t)
+	target := path.Join(parent, "target")
+	TestExpectSuccess(t, os.Mkdir(target, 0755))
+	TestExpectSuccess(t, ioutil.WriteFile(path.Join(target, "old"), []byte("old"), 0644))
+	siblings := func() []string {
+		infos, err := ioutil.ReadDir(parent)
+		TestExpectSuccess(t, err)
+		names := make([]string, len(infos))
+		for i, fi := range infos {
+			names[i] = fi.Name()
+		}
+		return names
+	}
+
+	// a failed extraction leaves the target as it was
+	u := NewUntar(bytes.NewReader(data[:len(data)/2]), target)
+	u.Compression = GZIP
+	u.Atomic = true
+	TestExpectError(t, u.Extract())
+	_, err := os.Stat(path.Join(target, "old"))
+	TestExpectSuccess(t, err)
+	_, err = os.Stat(path.Join(target, "a"))
+	TestEqual(t, os.IsNotExist(err), true)
+	TestEqual(t, siblings(), []string{"target"})
+
+	// while a complete one replaces it
+	u = NewUntar(bytes.NewReader(data), target)
+	u.Compression = GZIP
+	u.Atomic = true
+	TestExpectSuccess(t, u.Extract())
+	_, err = os.Stat(path.Join(target, "a/b/c/d/e"))
+	TestExpectSuccess(t, err)
+	_, err = os.Stat(path.Join(target, "old"))
+	TestEqual(t, os.IsNotExist(err), true)
+	TestEqual(t, siblings(), []string{"target"})
+
+	// or creates it if it wasn't there
+	created := path.Join(parent, "created")
+	u = NewUntar(bytes.NewReader(data), created)
+	u.Compression = GZIP
+	u.Atomic = true
+	TestExpectSuccess(t, u.Extract())
+	_, err = os.Stat(path.Join(created, "a/b/c/d/e"))
+	TestExpectSuccess(t, err)
+	TestEqual(t, siblings(), []string{"created", "target"})
+}
@@ -5,7 +5,9 @@ package tarhelper
 import (
 	"archive/tar"
 	"bufio"
+	"context"
 	"io"
+	"os"
 )
 
 // defaultMappingFunc is the default mapping function when taring or untaring
@@ -14,38 +16,98 @@ func defaultMappingFunc(id int) (int, error) {
 	return id, nil
 }
 
+// Returns the tar header mode for the permissions in a FileMode, including
+// the setuid, setgid and sticky bits.
+func tarMode(fm os.FileMode) int64 {
+	mode := int64(fm.Perm())
+	if fm&os.ModeSetuid != 0 {
+		mode |= c_ISUID
+	}
+	if fm&os.ModeSetgid != 0 {
+		mode |= c_ISGID
+	}
+	if fm&os.ModeSticky != 0 {
+		mode |= c_ISVTX
+	}
+	return mode
+}
+
+// DetectCompression peeks at the start of the source reader to determine
+// which of the registered compression types it uses. It returns the detected
+// Compression, or NONE if no decompressor recognized the stream, along with a
+// reader that must be used in place of the source since the peeked bytes have
+// already been consumed from it.
+func DetectCompression(r io.Reader) (Compression, io.Reader) {
+	br := bufio.NewReader(r)
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	for _, name := range decompressorOrder {
+		if decompressorTypes[name].Detect(br) {
+			return Compression(name), br
+		}
+	}
+	return NONE, br
+}
+
 // DetectArchiveCompression takes a source reader and will determine the
 // compression type to use, if any. It will return a *tar.Reader that can be
-// used to read the archive.
+// used to read the archive. Any resources held by the decompressor are
+// released once the end of the compressed stream is reached.
 func DetectArchiveCompression(r io.Reader) (*tar.Reader, error) {
-	var comp Decompressor
+	comp, br := DetectCompression(r)
+	if comp == NONE {
+		return tar.NewReader(br), nil
+	}
 
-	// setup a buffered reader
-	br := bufio.NewReader(r)
+	dc, _ := lookupDecompressor(comp)
+	arch, err := dc.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	if cl, ok := arch.(io.ReadCloser); ok {
+		arch = &closeOnEOFReader{ReadCloser: cl}
+	}
+	return tar.NewReader(arch), nil
+}
 
-	// loop over the registered decompressors to find the right one
-	for _, c := range decompressorTypes {
-		if c.Detect(br) {
-			comp = c
-			break
-		}
+// closeOnEOFReader closes the underlying reader as soon as a read returns an
+// error, for use when nothing else is in a position to close it.
+type closeOnEOFReader struct {
+	io.ReadCloser
+	closed bool
+}
+
+func (r *closeOnEOFReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		r.closed = true
+		r.ReadCloser.Close()
 	}
+	return n, err
+}
 
-	// Create the reader if a compression handler was found, else fall back on
-	// using no compression.
-	if comp != nil {
-		// Create the reader
-		arch, err := comp.NewReader(br)
-		if err != nil {
-			return nil, err
-		}
-		defer func() {
-			if cl, ok := arch.(io.ReadCloser); ok {
-				cl.Close()
-			}
-		}()
-		return tar.NewReader(arch), nil
+// Returns the error for a context that is done, or nil if it isn't or no
+// context was given.
+func contextErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
 	}
+	return ctx.Err()
+}
 
-	return tar.NewReader(br), nil
+// contextReader fails reads once its context is done, so that long copies can
+// be abandoned part way through.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
 }
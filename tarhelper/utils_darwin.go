@@ -4,6 +4,10 @@
 
 package tarhelper
 
+import (
+	"syscall"
+)
+
 func makedev(major, minor int64) int {
 	return int(major)<<24 | int(minor)
 }
@@ -15,3 +19,7 @@ func majordev(dev int64) int64 {
 func minordev(dev int64) int64 {
 	return int64(dev & 0xffffff)
 }
+
+func osMknod(name string, mode uint32, dev int) error {
+	return syscall.Mknod(name, mode, dev)
+}
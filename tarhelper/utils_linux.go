@@ -4,14 +4,26 @@
 
 package tarhelper
 
+import (
+	"syscall"
+)
+
+// Device numbers are encoded as glibc does, with the low 8 bits of the minor
+// number, then 12 bits of the major number, then the rest of the minor and
+// then the rest of the major.
+
 func makedev(major, minor int64) int {
-	return int(major)<<8 | int(minor)
+	return int(minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32)
 }
 
 func majordev(dev int64) int64 {
-	return int64((dev >> 8) & 0xff)
+	return (dev>>8)&0xfff | (dev>>32)&^0xfff
 }
 
 func minordev(dev int64) int64 {
-	return int64(dev & 0xff)
+	return dev&0xff | (dev>>12)&0xffffff00
+}
+
+func osMknod(name string, mode uint32, dev int) error {
+	return syscall.Mknod(name, mode, dev)
 }
@@ -0,0 +1,24 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"testing"
+
+	. "github.com/apcera/util/testtool"
+)
+
+func TestDeviceNumbers(t *testing.T) {
+	StartTest(t)
+	defer FinishTest(t)
+
+	for _, d := range [][2]int64{{1, 3}, {8, 17}, {259, 65536}, {4095, 255}, {5000, 1 << 20}} {
+		dev := int64(makedev(d[0], d[1]))
+		TestEqual(t, majordev(dev), d[0])
+		TestEqual(t, minordev(dev), d[1])
+	}
+
+	// the encoding matches the kernel's for the common small numbers
+	TestEqual(t, makedev(1, 3), 0x103)
+	TestEqual(t, makedev(259, 65536), 0x10010300)
+}
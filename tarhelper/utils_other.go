@@ -0,0 +1,28 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// +build !linux,!darwin,!windows
+
+package tarhelper
+
+import (
+	"fmt"
+)
+
+// Device numbers aren't decoded on other platforms, so devices are archived
+// as 0, 0 and are skipped on extraction.
+
+func makedev(major, minor int64) int {
+	return 0
+}
+
+func majordev(dev int64) int64 {
+	return 0
+}
+
+func minordev(dev int64) int64 {
+	return 0
+}
+
+func osMknod(name string, mode uint32, dev int) error {
+	return fmt.Errorf("mknod(%q): %w on this platform", name, ErrMknodUnsupported)
+}
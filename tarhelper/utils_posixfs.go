@@ -13,10 +13,6 @@ func osUmask(mask int) {
 	syscall.Umask(mask)
 }
 
-func osMknod(name string, mode uint32, dev int) error {
-	return syscall.Mknod(name, mode, dev)
-}
-
 func osDeviceNumbersForFileInfo(fi os.FileInfo) (int64, int64) {
 	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
 		return majordev(int64(sys.Rdev)), minordev(int64(sys.Rdev))
@@ -24,20 +20,42 @@ func osDeviceNumbersForFileInfo(fi os.FileInfo) (int64, int64) {
 	return 0, 0
 }
 
+// The functions below fall back to the same values as on Windows for a
+// FileInfo that didn't come from the OS, and so has no Stat_t.
+
 func uidForFileInfo(fi os.FileInfo) int {
-	return int(fi.Sys().(*syscall.Stat_t).Uid)
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(sys.Uid)
+	}
+	return 0
 }
 
 func gidForFileInfo(fi os.FileInfo) int {
-	return int(fi.Sys().(*syscall.Stat_t).Gid)
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(sys.Gid)
+	}
+	return 0
 }
 
 func linkCountForFileInfo(fi os.FileInfo) uint {
-	return uint(fi.Sys().(*syscall.Stat_t).Nlink)
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint(sys.Nlink)
+	}
+	return 1
 }
 
 func inodeForFileInfo(fi os.FileInfo) uint64 {
-	return fi.Sys().(*syscall.Stat_t).Ino
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 1
+}
+
+func fileIDForFileInfo(fi os.FileInfo) (fileID, bool) {
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fileID{dev: uint64(sys.Dev), ino: uint64(sys.Ino)}, true
+	}
+	return fileID{}, false
 }
 
 // chmodTarEntry is used to adjust the file permissions used in tar header based
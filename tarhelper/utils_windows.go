@@ -9,16 +9,19 @@ import (
 	"os"
 )
 
+// Device numbers aren't decoded on Windows, so devices are archived as 0, 0
+// and are skipped on extraction, as mknod isn't supported.
+
 func makedev(major, minor int64) int {
-	panic(fmt.Sprintf("no Windows support for making Unix devices [makedev(%d, %d)]", major, minor))
+	return 0
 }
 
 func majordev(dev int64) int64 {
-	panic(fmt.Sprintf("no Windows support for making Unix devices [majordev(%d)]", dev))
+	return 0
 }
 
 func minordev(dev int64) int64 {
-	panic(fmt.Sprintf("no Windows support for making Unix devices [minordev(%d)]", dev))
+	return 0
 }
 
 func osUmask(mask int) {
@@ -26,7 +29,7 @@ func osUmask(mask int) {
 }
 
 func osMknod(name string, mode uint32, dev int) error {
-	return fmt.Errorf("no Windows support to mknod(%q) (mode %d dev %d)", name, mode, dev)
+	return fmt.Errorf("mknod(%q): %w on Windows", name, ErrMknodUnsupported)
 }
 
 func osDeviceNumbersForFileInfo(_ os.FileInfo) (int64, int64) {
@@ -41,7 +44,7 @@ func gidForFileInfo(_ os.FileInfo) int {
 	return 0
 }
 
-func linkCountForFileInfo(_ os.FileInfo) uint16 {
+func linkCountForFileInfo(_ os.FileInfo) uint {
 	return 1
 }
 
@@ -51,6 +54,10 @@ func inodeForFileInfo(_ os.FileInfo) uint64 {
 	return 1
 }
 
+func fileIDForFileInfo(_ os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
 // chmodTarEntry is used to adjust the file permissions used in tar header based
 // on the platform the archival is done.
 func chmodTarEntry(perm os.FileMode) os.FileMode {
@@ -0,0 +1,179 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Report is the result of verifying an archive against a directory.
+type Report struct {
+	// The number of entries checked.
+	Checked int
+
+	// The entries that didn't match what is on disk.
+	Mismatches []Mismatch
+}
+
+// OK reports whether every entry matched.
+func (r Report) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// Mismatch is an entry in an archive that doesn't match what is on disk.
+type Mismatch struct {
+	// The name of the entry, cleaned so that "./a/" is "a".
+	Name string
+
+	// The attributes that differ, of "missing", "type", "size", "mode",
+	// "owner", "link target" and "content". A missing file isn't compared
+	// any further.
+	Differences []string
+}
+
+// VerifyOptions controls what Verify compares.
+type VerifyOptions struct {
+	// SkipContent leaves out comparing the content of regular files, so
+	// that only metadata is compared and no files are read.
+	SkipContent bool
+
+	// SkipOwners leaves out comparing owners, for archives that didn't
+	// record them.
+	SkipOwners bool
+}
+
+// Verify checks that every entry in the archive read from r, which may be
+// compressed with any of the supported compression types, exists within dir
+// with a matching type, size, mode, owner, link target and content, like
+// "tar --compare". Files in dir that aren't in the archive are ignored.
+// Differences are reported in the Report, while the error is for problems
+// reading the archive.
+func Verify(r io.Reader, dir string) (Report, error) {
+	return VerifyWithOptions(r, dir, VerifyOptions{})
+}
+
+// VerifyWithOptions is like Verify, with control over what is compared.
+func VerifyWithOptions(r io.Reader, dir string, opts VerifyOptions) (Report, error) {
+	var report Report
+	archive, err := DetectArchiveCompression(r)
+	if err != nil {
+		return report, err
+	}
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+
+		report.Checked++
+		diffs, err := verifyEntry(header, archive, dir, opts)
+		if err != nil {
+			return report, err
+		}
+		if diffs != nil {
+			report.Mismatches = append(report.Mismatches, Mismatch{
+				Name:        path.Clean(header.Name),
+				Differences: diffs,
+			})
+		}
+	}
+}
+
+// Compares a single entry, whose content is read from r, with the file of
+// the same name within dir.
+func verifyEntry(header *tar.Header, r io.Reader, dir string, opts VerifyOptions) ([]string, error) {
+	name := filepath.Join(dir, filepath.FromSlash(path.Clean(header.Name)))
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return []string{"missing"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// hard links are compared by being the same file as their target
+	if header.Typeflag == tar.TypeLink {
+		target, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(path.Clean(header.Linkname))))
+		if err != nil || !os.SameFile(fi, target) {
+			return []string{"link target"}, nil
+		}
+		return nil, nil
+	}
+
+	var diffs []string
+	mode := fi.Mode()
+	var sameType bool
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		sameType = mode.IsRegular()
+	case tar.TypeDir:
+		sameType = mode.IsDir()
+	case tar.TypeSymlink:
+		sameType = mode&os.ModeSymlink != 0
+	case tar.TypeChar:
+		sameType = mode&os.ModeCharDevice != 0
+	case tar.TypeBlock:
+		sameType = mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+	case tar.TypeFifo:
+		sameType = mode&os.ModeNamedPipe != 0
+	}
+	if !sameType {
+		return []string{"type"}, nil
+	}
+
+	if mode.IsRegular() && header.Size != fi.Size() {
+		diffs = append(diffs, "size")
+	}
+	if mode&os.ModeSymlink == 0 && header.Mode&07777 != tarMode(mode) {
+		diffs = append(diffs, "mode")
+	}
+	if !opts.SkipOwners && (header.Uid != uidForFileInfo(fi) || header.Gid != gidForFileInfo(fi)) {
+		diffs = append(diffs, "owner")
+	}
+	if mode&os.ModeSymlink != 0 {
+		link, err := os.Readlink(name)
+		if err != nil {
+			return nil, err
+		}
+		if link != header.Linkname {
+			diffs = append(diffs, "link target")
+		}
+	}
+	if mode.IsRegular() && !opts.SkipContent && header.Size == fi.Size() {
+		same, err := sameContent(name, r)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			diffs = append(diffs, "content")
+		}
+	}
+	return diffs, nil
+}
+
+// Compares the SHA-256 digests of the named file and the content read from r.
+func sameContent(name string, r io.Reader) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fileDigest, entryDigest := sha256.New(), sha256.New()
+	if _, err := io.Copy(fileDigest, f); err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(entryDigest, r); err != nil {
+		return false, err
+	}
+	return bytes.Equal(fileDigest.Sum(nil), entryDigest.Sum(nil)), nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"fmt"
+	"io"
+)
+
+// VolumeWriter splits what is written to it across volumes of a fixed size,
+// such as for media or object stores with a limit on the size of each
+// object. It can be used as the destination of a Tar, after any compression,
+// and a VolumeReader puts the volumes back together.
+type VolumeWriter struct {
+	size    int64
+	next    func(n int) (io.Writer, error)
+	volume  io.Writer
+	n       int
+	written int64
+}
+
+// NewVolumeWriter returns a VolumeWriter that writes volumes of size bytes,
+// other than the last which may be smaller. nextWriter is called for the
+// writer of each volume as it is needed, with the number of the volume
+// starting from 1. Volumes that are io.Closers are closed when they are
+// full.
+func NewVolumeWriter(size int64, nextWriter func(n int) (io.Writer, error)) *VolumeWriter {
+	return &VolumeWriter{size: size, next: nextWriter}
+}
+
+// Write writes b to the current volume, moving on to the next volume when it
+// is full.
+func (v *VolumeWriter) Write(b []byte) (int, error) {
+	if v.size <= 0 {
+		return 0, fmt.Errorf("invalid volume size %d", v.size)
+	}
+	var written int
+	for len(b) > 0 {
+		if v.volume == nil || v.written == v.size {
+			if err := v.nextVolume(); err != nil {
+				return written, err
+			}
+		}
+		chunk := b
+		if left := v.size - v.written; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		n, err := v.volume.Write(chunk)
+		written += n
+		v.written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("failed to write volume %d: %v", v.n, err)
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Volumes returns the number of volumes that have been started.
+func (v *VolumeWriter) Volumes() int {
+	return v.n
+}
+
+// Close closes the last volume, if it is an io.Closer.
+func (v *VolumeWriter) Close() error {
+	return v.closeVolume()
+}
+
+// Closes the current volume and starts the next one.
+func (v *VolumeWriter) nextVolume() error {
+	if err := v.closeVolume(); err != nil {
+		return err
+	}
+	w, err := v.next(v.n + 1)
+	if err != nil {
+		return fmt.Errorf("failed to start volume %d: %v", v.n+1, err)
+	}
+	v.n++
+	v.volume = w
+	v.written = 0
+	return nil
+}
+
+// Closes the current volume if it is an io.Closer.
+func (v *VolumeWriter) closeVolume() error {
+	volume := v.volume
+	v.volume = nil
+	if c, ok := volume.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("failed to close volume %d: %v", v.n, err)
+		}
+	}
+	return nil
+}
+
+// VolumeReader reads the volumes written by a VolumeWriter one after the
+// other, as the single stream that was split across them.
+type VolumeReader struct {
+	next   func(n int) (io.Reader, error)
+	volume io.Reader
+	n      int
+	done   bool
+}
+
+// NewVolumeReader returns a VolumeReader that reads the volumes returned by
+// nextReader, which is called with the number of each volume in turn,
+// starting from 1, and returns io.EOF once there are no more. Volumes that
+// are io.Closers are closed once they have been read.
+func NewVolumeReader(nextReader func(n int) (io.Reader, error)) *VolumeReader {
+	return &VolumeReader{next: nextReader}
+}
+
+// Read reads from the current volume, moving on to the next volume at the end
+// of each one.
+func (v *VolumeReader) Read(b []byte) (int, error) {
+	for !v.done {
+		if v.volume == nil {
+			r, err := v.next(v.n + 1)
+			if err == io.EOF {
+				v.done = true
+				break
+			} else if err != nil {
+				return 0, fmt.Errorf("failed to open volume %d: %v", v.n+1, err)
+			}
+			v.n++
+			v.volume = r
+		}
+
+		n, err := v.volume.Read(b)
+		if err == io.EOF {
+			if err := v.closeVolume(); err != nil {
+				return n, err
+			}
+			err = nil
+		} else if err != nil {
+			err = fmt.Errorf("failed to read volume %d: %v", v.n, err)
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Close closes the current volume, if it is an io.Closer.
+func (v *VolumeReader) Close() error {
+	v.done = true
+	return v.closeVolume()
+}
+
+// Closes the current volume if it is an io.Closer.
+func (v *VolumeReader) closeVolume() error {
+	volume := v.volume
+	v.volume = nil
+	if c, ok := volume.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("failed to close volume %d: %v", v.n, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package tarhelper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// TarToZip converts the archive read from r, which may be compressed with any
+// of the supported compression types, to a zip archive written to w, without
+// extracting anything. Paths, permissions and modification times are kept,
+// and symlinks are stored the way Info-ZIP does, with their target as their
+// content. Zip archives can't hold hard links, devices or named pipes, so
+// archives with them can't be converted.
+func TarToZip(w io.Writer, r io.Reader) error {
+	archive, err := DetectArchiveCompression(r)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeZipEntry(zw, header, archive); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Writes the tar entry with the given header and content to zw.
+func writeZipEntry(zw *zip.Writer, header *tar.Header, content io.Reader) error {
+	name := strings.TrimPrefix(header.Name, "./")
+	if name == "" || name == "." {
+		// the root of the archive has no entry of its own in a zip
+		return nil
+	}
+
+	fi := header.FileInfo()
+	fh, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	fh.Name = name
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+		fh.Method = zip.Store
+		_, err = zw.CreateHeader(fh)
+		return err
+
+	case tar.TypeSymlink:
+		fh.Method = zip.Store
+		f, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, header.Linkname)
+		return err
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, content)
+		return err
+
+	case tar.TypeLink:
+		return fmt.Errorf("%s: zip archives can't hold hard links", header.Name)
+
+	default:
+		return fmt.Errorf("%s: zip archives can't hold entries of type %q", header.Name, header.Typeflag)
+	}
+}
+
+// ZipToTar converts the zip archive of the given size read from r to an
+// uncompressed tar archive written to w, without extracting anything. Paths,
+// permissions and modification times are kept, and entries that Info-ZIP
+// recorded as symlinks are written as symlinks. Entries from zip archives
+// made on Windows, which don't record permissions, are given the defaults
+// that the archive/zip package gives them.
+func ZipToTar(w io.Writer, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, f := range zr.File {
+		if err := writeTarEntry(tw, f); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// Writes the zip entry f to tw.
+func writeTarEntry(tw *tar.Writer, f *zip.File) error {
+	fi := f.FileInfo()
+	mode := fi.Mode()
+
+	var link string
+	if mode&os.ModeSymlink != 0 {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		target, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		link = string(target)
+	} else if !mode.IsDir() && !mode.IsRegular() {
+		return fmt.Errorf("unsupported file mode %v", mode)
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	header.Name = f.Name
+	if mode.IsDir() && !strings.HasSuffix(header.Name, "/") {
+		header.Name += "/"
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !mode.IsRegular() {
+		return nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(tw, rc)
+	return err
+}
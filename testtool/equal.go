@@ -7,6 +7,9 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/apcera/util/strutil"
 )
 
 // -----------------------------------------------------------------------
@@ -14,12 +17,12 @@ import (
 // -----------------------------------------------------------------------
 
 // This describes the given object and if the output is too long then it
-// suppresses it unless --debug was used.
+// truncates it unless --debug was used.
 func describe(prefix string, i interface{}) string {
 	out := fmt.Sprintf("%s%#v", prefix, i)
-	if len(out) > 160 && !TestDebug {
+	if utf8.RuneCountInString(out) > 160 && !TestDebug {
 		out = fmt.Sprintf(
-			"%s: Value suppressed. Use --debug to see it.", prefix)
+			"%s Use --debug to see all of it.", strutil.Truncate(out, 160))
 	}
 	return out
 }
@@ -3,6 +3,7 @@
 package testtool
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -114,3 +115,16 @@ func TestTestNotEquals(t *testing.T) {
 	m.RunTest(t, false, func() { TestNotEqual(m, strSlice1, strSlice2) })
 	m.RunTest(t, false, func() { TestNotEqual(m, strMap1, strMap2) })
 }
+
+func TestDescribe(t *testing.T) {
+	if have := describe("have: ", "short"); have != `have: "short"` {
+		t.Fatalf("short values should be described in full, got %q", have)
+	}
+
+	// Long values are cut at a rune boundary rather than hidden.
+	long := describe("have: ", strings.Repeat("ü", 200))
+	want := `have: "` + strings.Repeat("ü", 152) + "… Use --debug to see all of it."
+	if long != want {
+		t.Fatalf("long values should be truncated, got %q", long)
+	}
+}
@@ -33,7 +33,7 @@ type Logger interface {
 
 // If an error implements the Backtrace() function then that backtrace will be
 // displayed using the TestExpectSuccess() functions. For an example see
-// BackError in the apcera/cfg package.
+// the Error type in the errtrace package.
 type Backtracer interface {
 	Backtrace() []string
 }
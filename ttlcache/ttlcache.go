@@ -0,0 +1,335 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package ttlcache provides a concurrency safe map where each entry expires
+// after a time to live. Expired entries are removed lazily when they are
+// accessed, and optionally by a background janitor goroutine. The cache can
+// also be capped to a maximum number of entries.
+package ttlcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// EvictReason describes why an entry was removed from the cache.
+type EvictReason int
+
+const (
+	// The entry's time to live elapsed.
+	Expired EvictReason = iota
+
+	// The entry was removed to keep the cache under its maximum size.
+	Capacity
+
+	// The entry was removed with Delete() or Purge().
+	Deleted
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Capacity:
+		return "capacity"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// EvictionFunc is called whenever an entry is removed from the cache for any
+// reason other than being replaced by Set(). It is called without any locks
+// held so it is safe for it to use the cache.
+type EvictionFunc func(key string, value interface{}, reason EvictReason)
+
+// A single cached value.
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+
+	// Position of the entry in the insertion order list, used to find the
+	// oldest entry when the cache is full.
+	elem *list.Element
+}
+
+// Returns true if the entry has expired at the given time. A zero expiration
+// never expires.
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// An eviction waiting for its callback to be run.
+type eviction struct {
+	entry  *entry
+	reason EvictReason
+}
+
+// Cache is a map of string keys to values that expire. The zero value is not
+// usable, use New() instead.
+type Cache struct {
+	lock    sync.Mutex
+	items   map[string]*entry
+	order   *list.List
+	ttl     time.Duration
+	maxSize int
+	onEvict EvictionFunc
+
+	// Stops the janitor goroutine if one is running.
+	stop chan struct{}
+
+	// Used in place of time.Now() so tests can control time.
+	now func() time.Time
+}
+
+// New returns a Cache where entries added with Set() expire after ttl. A ttl
+// of zero or less means entries never expire unless SetWithTTL() is used.
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		items: make(map[string]*entry),
+		order: list.New(),
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+// SetMaxSize caps the number of entries in the cache. When a new key would
+// exceed the cap, expired entries are removed first and then the oldest
+// entries are evicted. A size of zero or less removes the cap.
+func (c *Cache) SetMaxSize(size int) {
+	c.lock.Lock()
+	c.maxSize = size
+	evicted := c.enforceSize(0)
+	c.lock.Unlock()
+	c.notify(evicted)
+}
+
+// SetEvictionFunc sets the function called when an entry is removed.
+func (c *Cache) SetEvictionFunc(f EvictionFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onEvict = f
+}
+
+// StartJanitor starts a goroutine that removes expired entries every interval.
+// Calling it again replaces the running janitor. It is stopped by Close().
+func (c *Cache) StartJanitor(interval time.Duration) {
+	c.lock.Lock()
+	if c.stop != nil {
+		close(c.stop)
+	}
+	stop := make(chan struct{})
+	c.stop = stop
+	c.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.DeleteExpired()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the janitor goroutine if one is running. The cache can still be
+// used afterwards, but expired entries are only removed lazily.
+func (c *Cache) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// Set stores value under key using the cache's default time to live.
+func (c *Cache) Set(key string, value interface{}) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL stores value under key, expiring it after ttl. A ttl of zero or
+// less means the entry never expires.
+func (c *Cache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+
+	c.lock.Lock()
+	var evicted []eviction
+	if e, ok := c.items[key]; ok {
+		// Replacing an entry refreshes its position in the eviction order.
+		e.value = value
+		e.expires = expires
+		c.order.MoveToBack(e.elem)
+	} else {
+		evicted = c.enforceSize(1)
+		e := &entry{key: key, value: value, expires: expires}
+		e.elem = c.order.PushBack(e)
+		c.items[key] = e
+	}
+	c.lock.Unlock()
+	c.notify(evicted)
+}
+
+// Get returns the value stored under key. The second return value is false if
+// the key does not exist or has expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	e, ok := c.items[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil, false
+	}
+	if e.expired(c.now()) {
+		c.remove(e)
+		c.lock.Unlock()
+		c.notify([]eviction{{entry: e, reason: Expired}})
+		return nil, false
+	}
+	// The value can be replaced in place by SetWithTTL once unlocked.
+	value := e.value
+	c.lock.Unlock()
+	return value, true
+}
+
+// TTL returns the time remaining before key expires. The second return value
+// is false if the key does not exist. A key that never expires returns zero.
+func (c *Cache) TTL(key string) (time.Duration, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return 0, false
+	}
+	if e.expires.IsZero() {
+		return 0, true
+	}
+	now := c.now()
+	if e.expired(now) {
+		return 0, false
+	}
+	return e.expires.Sub(now), true
+}
+
+// Delete removes key from the cache, returning true if it was present.
+func (c *Cache) Delete(key string) bool {
+	c.lock.Lock()
+	e, ok := c.items[key]
+	if ok {
+		c.remove(e)
+	}
+	c.lock.Unlock()
+	if ok {
+		c.notify([]eviction{{entry: e, reason: Deleted}})
+	}
+	return ok
+}
+
+// DeleteExpired removes every expired entry and returns how many were
+// removed.
+func (c *Cache) DeleteExpired() int {
+	c.lock.Lock()
+	now := c.now()
+	var evicted []eviction
+	for _, e := range c.items {
+		if e.expired(now) {
+			c.remove(e)
+			evicted = append(evicted, eviction{entry: e, reason: Expired})
+		}
+	}
+	c.lock.Unlock()
+	c.notify(evicted)
+	return len(evicted)
+}
+
+// Purge removes every entry from the cache.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	evicted := make([]eviction, 0, len(c.items))
+	for _, e := range c.items {
+		evicted = append(evicted, eviction{entry: e, reason: Deleted})
+	}
+	c.items = make(map[string]*entry)
+	c.order.Init()
+	c.lock.Unlock()
+	c.notify(evicted)
+}
+
+// Len returns the number of entries in the cache. This may include entries
+// that have expired but not yet been removed.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Keys returns the keys of every entry that has not expired, oldest first.
+func (c *Cache) Keys() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	keys := make([]string, 0, len(c.items))
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry)
+		if !e.expired(now) {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// Removes an entry. Must be called with the lock held.
+func (c *Cache) remove(e *entry) {
+	delete(c.items, e.key)
+	c.order.Remove(e.elem)
+}
+
+// Makes room for adding more entries without exceeding maxSize. Expired
+// entries are removed first, then the oldest. Must be called with the lock
+// held.
+func (c *Cache) enforceSize(adding int) []eviction {
+	if c.maxSize <= 0 || len(c.items)+adding <= c.maxSize {
+		return nil
+	}
+
+	var evicted []eviction
+	now := c.now()
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if e := elem.Value.(*entry); e.expired(now) {
+			c.remove(e)
+			evicted = append(evicted, eviction{entry: e, reason: Expired})
+		}
+		elem = next
+	}
+	for len(c.items)+adding > c.maxSize && c.order.Len() > 0 {
+		e := c.order.Front().Value.(*entry)
+		c.remove(e)
+		evicted = append(evicted, eviction{entry: e, reason: Capacity})
+	}
+	return evicted
+}
+
+// Runs the eviction callback for each eviction. Must be called without the
+// lock held.
+func (c *Cache) notify(evicted []eviction) {
+	if len(evicted) == 0 {
+		return
+	}
+	c.lock.Lock()
+	f := c.onEvict
+	c.lock.Unlock()
+	if f == nil {
+		return
+	}
+	for _, ev := range evicted {
+		f(ev.entry.key, ev.entry.value, ev.reason)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ttlcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+// Returns a cache whose clock is controlled by the returned function.
+func newTestCache(ttl time.Duration) (*Cache, func(time.Duration)) {
+	c := New(ttl)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestSetGet(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c, advance := newTestCache(time.Minute)
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, 0)
+
+	v, ok := c.Get("a")
+	tt.TestTrue(t, ok)
+	tt.TestEqual(t, v, 1)
+
+	ttl, ok := c.TTL("a")
+	tt.TestTrue(t, ok)
+	tt.TestEqual(t, ttl, time.Minute)
+
+	advance(time.Minute)
+	_, ok = c.Get("a")
+	tt.TestFalse(t, ok)
+	tt.TestEqual(t, c.Len(), 1)
+
+	// Entries without a TTL never expire.
+	advance(time.Hour)
+	v, ok = c.Get("b")
+	tt.TestTrue(t, ok)
+	tt.TestEqual(t, v, 2)
+}
+
+func TestDeleteAndPurge(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c, _ := newTestCache(time.Minute)
+	reasons := map[string]EvictReason{}
+	c.SetEvictionFunc(func(k string, v interface{}, r EvictReason) {
+		reasons[k] = r
+	})
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	tt.TestTrue(t, c.Delete("a"))
+	tt.TestFalse(t, c.Delete("a"))
+	c.Purge()
+	tt.TestEqual(t, c.Len(), 0)
+	tt.TestEqual(t, reasons, map[string]EvictReason{"a": Deleted, "b": Deleted})
+}
+
+func TestDeleteExpired(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c, advance := newTestCache(time.Minute)
+	expired := []string{}
+	c.SetEvictionFunc(func(k string, v interface{}, r EvictReason) {
+		tt.TestEqual(t, r, Expired)
+		expired = append(expired, k)
+	})
+
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, time.Hour)
+	advance(2 * time.Minute)
+	tt.TestEqual(t, c.Keys(), []string{"b"})
+	tt.TestEqual(t, c.DeleteExpired(), 1)
+	tt.TestEqual(t, expired, []string{"a"})
+	tt.TestEqual(t, c.Len(), 1)
+}
+
+func TestMaxSize(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c, advance := newTestCache(time.Minute)
+	evicted := map[string]EvictReason{}
+	c.SetEvictionFunc(func(k string, v interface{}, r EvictReason) {
+		evicted[k] = r
+	})
+	c.SetMaxSize(2)
+
+	c.SetWithTTL("a", 1, time.Second)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	tt.TestEqual(t, c.Keys(), []string{"b", "c"})
+	tt.TestEqual(t, evicted["a"], Capacity)
+
+	// Updating an entry refreshes its position so "c" becomes the oldest.
+	c.Set("b", 4)
+	c.SetWithTTL("d", 5, time.Second)
+	tt.TestEqual(t, c.Keys(), []string{"b", "d"})
+	tt.TestEqual(t, evicted["c"], Capacity)
+
+	// Expired entries are removed before the oldest live entry.
+	advance(2 * time.Second)
+	c.Set("e", 6)
+	tt.TestEqual(t, c.Keys(), []string{"b", "e"})
+	tt.TestEqual(t, evicted["d"], Expired)
+}
+
+func TestJanitor(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c := New(time.Millisecond)
+	defer c.Close()
+
+	var lock sync.Mutex
+	removed := 0
+	c.SetEvictionFunc(func(k string, v interface{}, r EvictReason) {
+		lock.Lock()
+		removed++
+		lock.Unlock()
+	})
+	c.Set("a", 1)
+	c.StartJanitor(5 * time.Millisecond)
+
+	tt.Timeout(t, 5*time.Second, 5*time.Millisecond, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return removed == 1
+	})
+	tt.TestEqual(t, c.Len(), 0)
+}
+
+func TestConcurrentSetGet(t *testing.T) {
+	tt.StartTest(t)
+	defer tt.FinishTest(t)
+
+	c := New(time.Minute)
+	c.Set("a", 0)
+
+	// Run with -race to check values are replaced under the lock.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			c.Set("a", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_, ok := c.Get("a")
+			tt.TestTrue(t, ok)
+		}
+	}()
+	wg.Wait()
+
+	v, ok := c.Get("a")
+	tt.TestTrue(t, ok)
+	tt.TestEqual(t, v, 999)
+}